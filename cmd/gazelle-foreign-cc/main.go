@@ -31,13 +31,17 @@ func main() {
 	}
 
 	// Test the CMake File API
-	buildDir := filepath.Join(*sourceDir, ".cmake-build")
+	buildDir, err := os.MkdirTemp("", "gazelle-foreign-cc-build")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(buildDir)
 	api := language.NewCMakeFileAPI(*sourceDir, buildDir, "cmake", make(map[string]string))
 
 	targets, err := api.GenerateFromAPI("")
 	if err != nil {
 		log.Printf("CMake File API failed: %v", err)
-		log.Println("The system would fall back to regex parsing in the actual Gazelle plugin.")
+		log.Println("The system would fall back to parsing CMakeLists.txt directly in the actual Gazelle plugin.")
 		return
 	}
 
@@ -49,6 +53,8 @@ func main() {
 		log.Printf("    Headers: %v", target.Headers)
 		log.Printf("    Include dirs: %v", target.IncludeDirectories)
 		log.Printf("    Linked libs: %v", target.LinkedLibraries)
+		log.Printf("    Defines: %v", target.CompileDefinitions)
+		log.Printf("    Compile options: %v", target.CompileOptions)
 	}
 
 	log.Println("CMake File API test completed successfully!")
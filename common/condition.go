@@ -0,0 +1,372 @@
+package common
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// conditionArg is an argument of if(), elseif() or while(). Unquoted arguments
+// that name a variable are replaced by its value where CMake does so; quoted
+// arguments and the results of evaluated subexpressions are taken literally.
+type conditionArg struct {
+	value     string
+	quoted    bool
+	evaluated bool // value holds the result of a subexpression
+	result    bool
+}
+
+func boolConditionArg(result bool) conditionArg {
+	return conditionArg{evaluated: true, result: result}
+}
+
+// isKeyword reports whether arg is the unquoted keyword
+func (arg conditionArg) isKeyword(keyword string) bool {
+	return !arg.quoted && !arg.evaluated && arg.value == keyword
+}
+
+var unaryConditionOperators = map[string]bool{
+	"EXISTS":       true,
+	"COMMAND":      true,
+	"DEFINED":      true,
+	"TARGET":       true,
+	"TEST":         true,
+	"POLICY":       true,
+	"IS_DIRECTORY": true,
+	"IS_SYMLINK":   true,
+	"IS_ABSOLUTE":  true,
+	"IS_READABLE":  true,
+}
+
+var binaryConditionOperators = map[string]bool{
+	"EQUAL":                 true,
+	"LESS":                  true,
+	"LESS_EQUAL":            true,
+	"GREATER":               true,
+	"GREATER_EQUAL":         true,
+	"STREQUAL":              true,
+	"STRLESS":               true,
+	"STRLESS_EQUAL":         true,
+	"STRGREATER":            true,
+	"STRGREATER_EQUAL":      true,
+	"VERSION_EQUAL":         true,
+	"VERSION_LESS":          true,
+	"VERSION_LESS_EQUAL":    true,
+	"VERSION_GREATER":       true,
+	"VERSION_GREATER_EQUAL": true,
+	"MATCHES":               true,
+	"IN_LIST":               true,
+	"PATH_EQUAL":            true,
+	"IS_NEWER_THAN":         true,
+}
+
+var policyRegex = regexp.MustCompile(`^CMP[0-9]{4}$`)
+
+// conditionArguments expands the arguments of a condition command, keeping
+// track of which were quoted
+func (in *cmakeInterpreter) conditionArguments(cmd CMakeCommand) []conditionArg {
+	var args []conditionArg
+	for _, arg := range cmd.Arguments {
+		if arg.Kind != UnquotedArgument {
+			args = append(args, conditionArg{value: arg.Expand(in.lookup), quoted: true})
+			continue
+		}
+		for _, element := range SplitCMakeList(arg.Expand(in.lookup)) {
+			args = append(args, conditionArg{value: element})
+		}
+	}
+	return args
+}
+
+// isFalseConstant reports whether value is one of CMake's false constants
+func isFalseConstant(value string) bool {
+	switch strings.ToUpper(value) {
+	case "", "0", "OFF", "NO", "FALSE", "N", "IGNORE", "NOTFOUND":
+		return true
+	}
+	return strings.HasSuffix(value, "-NOTFOUND")
+}
+
+// truthy evaluates a lone argument: a constant, or else the name of a variable
+// that is true when defined to anything but a false constant
+func (in *cmakeInterpreter) truthy(arg conditionArg) bool {
+	if arg.evaluated {
+		return arg.result
+	}
+	if isTruthy(arg.value) {
+		return true
+	}
+	if isFalseConstant(arg.value) || arg.quoted {
+		return false
+	}
+	if _, err := strconv.ParseFloat(arg.value, 64); err == nil {
+		return false // Zero, since isTruthy accepts every other number
+	}
+	value, ok := in.variable(arg.value)
+	return ok && !isFalseConstant(value)
+}
+
+// operand returns the value of an operand of a binary test: the value of the
+// variable an unquoted argument names, or else the argument itself
+func (in *cmakeInterpreter) operand(arg conditionArg) string {
+	if arg.evaluated {
+		if arg.result {
+			return "1"
+		}
+		return "0"
+	}
+	if !arg.quoted {
+		if value, ok := in.variable(arg.value); ok {
+			return value
+		}
+	}
+	return arg.value
+}
+
+// evaluateCondition evaluates the arguments of if(), elseif() or while()
+// with CMake's precedence: parentheses, unary tests, binary tests, NOT, AND
+// and OR
+func (in *cmakeInterpreter) evaluateCondition(args []conditionArg) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	var tokens []conditionArg
+	for i := 0; i < len(args); i++ {
+		if !args[i].isKeyword("(") {
+			tokens = append(tokens, args[i])
+			continue
+		}
+		depth, j := 1, i+1
+		for ; j < len(args); j++ {
+			if args[j].isKeyword("(") {
+				depth++
+			} else if args[j].isKeyword(")") {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+		tokens = append(tokens, boolConditionArg(in.evaluateCondition(args[i+1:min(j, len(args))])))
+		i = j
+	}
+
+	for i := 0; i+1 < len(tokens); i++ {
+		if op := tokens[i]; !op.quoted && !op.evaluated && unaryConditionOperators[op.value] {
+			result := in.unaryTest(op.value, tokens[i+1])
+			tokens = append(append(tokens[:i:i], boolConditionArg(result)), tokens[i+2:]...)
+		}
+	}
+
+	for i := 0; i+2 < len(tokens); {
+		if op := tokens[i+1]; !op.quoted && !op.evaluated && binaryConditionOperators[op.value] {
+			result := in.binaryTest(op.value, tokens[i], tokens[i+2])
+			tokens = append(append(tokens[:i:i], boolConditionArg(result)), tokens[i+3:]...)
+			continue
+		}
+		i++
+	}
+
+	for i := len(tokens) - 2; i >= 0; i-- {
+		if tokens[i].isKeyword("NOT") {
+			result := !in.truthy(tokens[i+1])
+			tokens = append(append(tokens[:i:i], boolConditionArg(result)), tokens[i+2:]...)
+		}
+	}
+
+	for _, logical := range []string{"AND", "OR"} {
+		for i := 0; i+2 < len(tokens); {
+			if !tokens[i+1].isKeyword(logical) {
+				i++
+				continue
+			}
+			left, right := in.truthy(tokens[i]), in.truthy(tokens[i+2])
+			result := left && right
+			if logical == "OR" {
+				result = left || right
+			}
+			tokens = append(append(tokens[:i:i], boolConditionArg(result)), tokens[i+3:]...)
+		}
+	}
+
+	if len(tokens) != 1 {
+		log.Printf("Could not evaluate condition with %d terms left, treating it as false.", len(tokens))
+		return false
+	}
+	return in.truthy(tokens[0])
+}
+
+// conditionPath makes a path tested by EXISTS and friends absolute
+func (in *cmakeInterpreter) conditionPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"], p)
+}
+
+func (in *cmakeInterpreter) unaryTest(op string, arg conditionArg) bool {
+	value := arg.value
+	switch op {
+	case "DEFINED":
+		switch {
+		case strings.HasPrefix(value, "ENV{") && strings.HasSuffix(value, "}"):
+			name := strings.TrimSuffix(strings.TrimPrefix(value, "ENV{"), "}")
+			if v, ok := in.env[name]; ok {
+				return v != ""
+			}
+			_, ok := os.LookupEnv(name)
+			return ok
+		case strings.HasPrefix(value, "CACHE{") && strings.HasSuffix(value, "}"):
+			_, ok := in.cache[strings.TrimSuffix(strings.TrimPrefix(value, "CACHE{"), "}")]
+			return ok
+		}
+		_, ok := in.variable(value)
+		return ok
+	case "COMMAND":
+		return in.isCommand(value)
+	case "TARGET":
+		return in.hasTarget != nil && in.hasTarget(value)
+	case "POLICY":
+		return policyRegex.MatchString(value)
+	case "EXISTS", "IS_READABLE":
+		if value == "" {
+			return false
+		}
+		_, err := os.Stat(in.conditionPath(value))
+		return err == nil
+	case "IS_DIRECTORY":
+		if value == "" {
+			return false
+		}
+		info, err := os.Stat(in.conditionPath(value))
+		return err == nil && info.IsDir()
+	case "IS_SYMLINK":
+		if value == "" {
+			return false
+		}
+		info, err := os.Lstat(in.conditionPath(value))
+		return err == nil && info.Mode()&os.ModeSymlink != 0
+	case "IS_ABSOLUTE":
+		return filepath.IsAbs(value)
+	}
+	return false // TEST: tests are only known after the whole file was read
+}
+
+func (in *cmakeInterpreter) binaryTest(op string, left, right conditionArg) bool {
+	switch op {
+	case "MATCHES":
+		re, err := regexp.Compile(right.value)
+		if err != nil {
+			log.Printf("Invalid regular expression in if(... MATCHES %s): %v", right.value, err)
+			return false
+		}
+		match := re.FindStringSubmatch(in.operand(left))
+		for i := 0; i < 10; i++ {
+			delete(in.scope.vars, "CMAKE_MATCH_"+strconv.Itoa(i))
+		}
+		if match == nil {
+			return false
+		}
+		for i, group := range match {
+			if i < 10 {
+				in.scope.vars["CMAKE_MATCH_"+strconv.Itoa(i)] = group
+			}
+		}
+		in.scope.vars["CMAKE_MATCH_COUNT"] = strconv.Itoa(len(match) - 1)
+		return true
+	case "IN_LIST":
+		list, _ := in.variable(right.value)
+		for _, element := range cmakeListElements(list) {
+			if element == in.operand(left) {
+				return true
+			}
+		}
+		return false
+	case "IS_NEWER_THAN":
+		leftInfo, leftErr := os.Stat(in.conditionPath(in.operand(left)))
+		rightInfo, rightErr := os.Stat(in.conditionPath(in.operand(right)))
+		return leftErr != nil || rightErr != nil || !leftInfo.ModTime().Before(rightInfo.ModTime())
+	}
+
+	a, b := in.operand(left), in.operand(right)
+	switch op {
+	case "STREQUAL":
+		return a == b
+	case "STRLESS":
+		return a < b
+	case "STRLESS_EQUAL":
+		return a <= b
+	case "STRGREATER":
+		return a > b
+	case "STRGREATER_EQUAL":
+		return a >= b
+	case "PATH_EQUAL":
+		return filepath.Clean(a) == filepath.Clean(b)
+	case "EQUAL", "LESS", "LESS_EQUAL", "GREATER", "GREATER_EQUAL":
+		x, errX := strconv.ParseFloat(a, 64)
+		y, errY := strconv.ParseFloat(b, 64)
+		if errX != nil || errY != nil {
+			return false
+		}
+		return compareResult(op, compareFloats(x, y))
+	}
+	// VERSION_*
+	return compareResult(strings.TrimPrefix(op, "VERSION_"), compareVersions(a, b))
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// compareResult applies a comparison operator to the result of a comparison
+func compareResult(op string, cmp int) bool {
+	switch op {
+	case "EQUAL":
+		return cmp == 0
+	case "LESS":
+		return cmp < 0
+	case "LESS_EQUAL":
+		return cmp <= 0
+	case "GREATER":
+		return cmp > 0
+	case "GREATER_EQUAL":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareVersions compares dotted version numbers component by component,
+// treating missing components as zero
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(leadingDigits(as[i]))
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(leadingDigits(bs[i]))
+		}
+		if x != y {
+			return compareFloats(float64(x), float64(y))
+		}
+	}
+	return 0
+}
+
+func leadingDigits(s string) string {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	return s[:end]
+}
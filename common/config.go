@@ -1,10 +1,18 @@
 package common
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
 
@@ -14,6 +22,47 @@ type CMakeConfig struct {
 	CMakeExecutable string
 	// CMake variables to be passed as -D flags
 	CMakeDefines map[string]string
+	// ResolveMappings maps CMake target names that are not part of the project,
+	// such as imported targets like "ZLIB::ZLIB", to the Bazel labels to depend on
+	ResolveMappings map[string]string
+	// LinkoptsMappings overrides the linkopts used for a system library, which
+	// default to -l<name>
+	LinkoptsMappings map[string][]string
+	// PreserveGlobs lists the files CMake finds with file(GLOB) through a
+	// glob() in srcs and hdrs instead of one by one
+	PreserveGlobs bool
+	// Layout is how the rules of a CMake project are spread over packages,
+	// LayoutFlat or LayoutMirror
+	Layout string
+	// SourcePackage is the package with the cmake_source directive covering
+	// this one and Source its value, so that the packages mirroring the
+	// directories of an external project know where it comes from
+	SourcePackage string
+	Source        string
+	// SourceDefines are the cmake_define directives of the closest package with
+	// any or with a cmake_source directive, which the packages mirroring the
+	// directories of a project configure it with
+	SourceDefines map[string]string
+	// CacheDir is where configure results are cached across runs, set with
+	// the -cmake_cache_dir flag. Empty disables the cache.
+	CacheDir string
+	// BuildDir is the directory holding the directories CMake projects are
+	// configured in, one per project and defines, out of the source tree. It
+	// is set with the -cmake_build_dir flag.
+	BuildDir string
+	// Jobs is the number of CMake projects configured at once, set with the
+	// -cmake_jobs flag
+	Jobs int
+	// BuildType is the CMAKE_BUILD_TYPE projects are configured with, and the
+	// configuration read from multi-config generators for fastbuild. Empty
+	// leaves it to the project.
+	BuildType string
+	// Generator is the CMake generator projects are configured with, empty
+	// for the default one
+	Generator string
+	// SnapshotMode is how snapshots of the File API reply checked in next to
+	// the BUILD files are used, set with the -cmake_snapshot flag
+	SnapshotMode string
 	// Add other CMake-specific configuration fields here.
 }
 
@@ -22,31 +71,196 @@ const (
 	CMakeExecutableDirective = "cmake_executable"
 	CMakeSourceDirective     = "cmake_source"
 	CMakeDefineDirective     = "cmake_define"
+	// cmake_resolve <cmake-target> <bazel-label> maps a CMake target to a Bazel label
+	CMakeResolveDirective = "cmake_resolve"
+	// cmake_resolve_file <path> loads cmake_resolve mappings from a file
+	CMakeResolveFileDirective = "cmake_resolve_file"
+	// cmake_linkopts <library> [<linkopt>...] sets the linkopts used for a system library
+	CMakeLinkoptsDirective = "cmake_linkopts"
+	// cmake_preserve_globs [true|false] emits glob() for files found with file(GLOB)
+	CMakePreserveGlobsDirective = "cmake_preserve_globs"
+	// cmake_layout flat|mirror places the rules of a project in one package or
+	// in the package of each CMake source directory
+	CMakeLayoutDirective = "cmake_layout"
+	// cmake_build_type <type> sets the CMAKE_BUILD_TYPE projects configure with
+	CMakeBuildTypeDirective = "cmake_build_type"
+	// cmake_generator <generator> sets the generator projects configure with,
+	// e.g. "Ninja Multi-Config"
+	CMakeGeneratorDirective = "cmake_generator"
 	// Define other directive names here
 )
 
+// Values of the cmake_layout directive
+const (
+	// LayoutFlat generates every target of a project in its package
+	LayoutFlat = "flat"
+	// LayoutMirror generates each target in the package matching the CMake
+	// source directory that declares it
+	LayoutMirror = "mirror"
+)
+
+// Values of the -cmake_snapshot flag
+const (
+	// SnapshotAuto replays the snapshot of a project when there is one and
+	// runs cmake otherwise
+	SnapshotAuto = "auto"
+	// SnapshotRecord runs cmake and records its reply in a snapshot
+	SnapshotRecord = "record"
+	// SnapshotReplay only replays snapshots and never runs cmake
+	SnapshotReplay = "replay"
+	// SnapshotOff ignores snapshots
+	SnapshotOff = "off"
+)
+
 // NewCMakeConfig creates a new CMakeConfig with default values.
 func NewCMakeConfig() *CMakeConfig {
 	return &CMakeConfig{
-		CMakeExecutable: "cmake", // Default value
-		CMakeDefines:    make(map[string]string),
+		CMakeExecutable:  "cmake", // Default value
+		Layout:           LayoutFlat,
+		CacheDir:         defaultCacheDir(),
+		BuildDir:         defaultBuildDir(),
+		Jobs:             runtime.NumCPU(),
+		SnapshotMode:     SnapshotAuto,
+		CMakeDefines:     make(map[string]string),
+		ResolveMappings:  make(map[string]string),
+		LinkoptsMappings: make(map[string][]string),
+	}
+}
+
+// defaultCacheDir returns the directory configure results are cached in by
+// default, in the cache directory of the user
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gazelle-foreign-cc", "configure")
+}
+
+// defaultBuildDir returns the directory CMake projects are configured in by
+// default, in the cache directory of the user or else the temporary one
+func defaultBuildDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "gazelle-foreign-cc", "build")
+	}
+	return filepath.Join(os.TempDir(), "gazelle-foreign-cc-build")
+}
+
+// Clone returns a copy of the configuration, so that directives of a package
+// are inherited by its subpackages without affecting its siblings.
+func (cfg *CMakeConfig) Clone() *CMakeConfig {
+	clone := &CMakeConfig{
+		CMakeExecutable:  cfg.CMakeExecutable,
+		PreserveGlobs:    cfg.PreserveGlobs,
+		Layout:           cfg.Layout,
+		BuildType:        cfg.BuildType,
+		Generator:        cfg.Generator,
+		SourcePackage:    cfg.SourcePackage,
+		Source:           cfg.Source,
+		SourceDefines:    cfg.SourceDefines,
+		CacheDir:         cfg.CacheDir,
+		BuildDir:         cfg.BuildDir,
+		Jobs:             cfg.Jobs,
+		SnapshotMode:     cfg.SnapshotMode,
+		CMakeDefines:     make(map[string]string),
+		ResolveMappings:  make(map[string]string),
+		LinkoptsMappings: make(map[string][]string),
+	}
+	for k, v := range cfg.CMakeDefines {
+		clone.CMakeDefines[k] = v
+	}
+	for k, v := range cfg.ResolveMappings {
+		clone.ResolveMappings[k] = v
+	}
+	for k, v := range cfg.LinkoptsMappings {
+		clone.LinkoptsMappings[k] = v
+	}
+	return clone
+}
+
+// ResolveLabel returns the label configured with cmake_resolve for a CMake
+// target, relative to the package pkg.
+func (cfg *CMakeConfig) ResolveLabel(cmakeTarget, pkg string) (string, bool) {
+	mapped, ok := cfg.ResolveMappings[cmakeTarget]
+	if !ok {
+		return "", false
 	}
+	l, err := label.Parse(mapped)
+	if err != nil {
+		return mapped, true
+	}
+	return l.Rel("", pkg).String(), true
+}
+
+// LoadResolveFile reads cmake_resolve mappings from a file. Each non-empty line
+// holds a CMake target name and a Bazel label separated by whitespace; lines
+// starting with '#' are comments.
+func LoadResolveFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mappings := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmakeTarget, bazelLabel, err := parseResolveMapping(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		mappings[cmakeTarget] = bazelLabel
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// parseResolveMapping parses a "<cmake-target> <bazel-label>" mapping
+func parseResolveMapping(value string) (string, string, error) {
+	parts := strings.Fields(value)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid mapping %q, expected '<cmake-target> <bazel-label>'", value)
+	}
+	if _, err := label.Parse(parts[1]); err != nil {
+		return "", "", fmt.Errorf("invalid label %q: %w", parts[1], err)
+	}
+	return parts[0], parts[1], nil
 }
 
 // RegisterFlags registers command-line flags for CMake configuration.
 // It satisfies the config.Configurer interface.
 func (cfg *CMakeConfig) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
-	// Example of registering a flag.
-	// fs.StringVar(&cfg.SomeSetting, "cmake_some_setting", "default_value", "Description of some setting")
+	fs.StringVar(&cfg.CacheDir, "cmake_cache_dir", cfg.CacheDir, "directory caching CMake configure results across runs, reused while the CMake files, defines, cmake version and compilers are unchanged; empty to always run cmake")
+	fs.StringVar(&cfg.BuildDir, "cmake_build_dir", cfg.BuildDir, "directory CMake projects are configured in, out of the source tree, in a subdirectory per project and defines")
+	fs.IntVar(&cfg.Jobs, "cmake_jobs", cfg.Jobs, "number of CMake projects configured in parallel")
+	fs.StringVar(&cfg.SnapshotMode, "cmake_snapshot", cfg.SnapshotMode, "use of the CMake snapshots next to the BUILD files: auto replays them when present, record runs cmake and writes them, replay never runs cmake, off ignores them")
 }
 
 // CheckFlags validates the configuration settings.
 // It satisfies the config.Configurer interface.
 func (cfg *CMakeConfig) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
-	// Example of validating a flag.
-	// if cfg.SomeSetting == "" {
-	// 	return fmt.Errorf("-cmake_some_setting must be set")
-	// }
+	if cfg.BuildDir == "" {
+		return fmt.Errorf("-cmake_build_dir must not be empty")
+	}
+	if !filepath.IsAbs(cfg.BuildDir) {
+		cfg.BuildDir = filepath.Join(c.WorkDir, cfg.BuildDir)
+	}
+	if cfg.Jobs < 1 {
+		return fmt.Errorf("-cmake_jobs must be at least 1, got %d", cfg.Jobs)
+	}
+	switch cfg.SnapshotMode {
+	case SnapshotAuto, SnapshotRecord, SnapshotReplay, SnapshotOff:
+	default:
+		return fmt.Errorf("-cmake_snapshot must be auto, record, replay or off, got %q", cfg.SnapshotMode)
+	}
 	return nil
 }
 
@@ -57,6 +271,13 @@ func (cfg *CMakeConfig) KnownDirectives() []string {
 		CMakeExecutableDirective,
 		CMakeSourceDirective,
 		CMakeDefineDirective,
+		CMakeResolveDirective,
+		CMakeResolveFileDirective,
+		CMakeLinkoptsDirective,
+		CMakePreserveGlobsDirective,
+		CMakeLayoutDirective,
+		CMakeBuildTypeDirective,
+		CMakeGeneratorDirective,
 		// Add other known directives here
 	}
 }
@@ -69,6 +290,8 @@ func (cfg *CMakeConfig) Configure(c *config.Config, rel string, f *rule.File) {
 		return
 	}
 
+	var source string
+	sourceDefines := make(map[string]string)
 	for _, directive := range f.Directives {
 		switch directive.Key {
 		case CMakeExecutableDirective:
@@ -77,15 +300,83 @@ func (cfg *CMakeConfig) Configure(c *config.Config, rel string, f *rule.File) {
 		case CMakeSourceDirective:
 			// The cmake_source directive is handled per-package in GenerateRules, not globally
 			log.Printf("Configure: Found cmake_source directive %s in %s (will be processed per-package)", directive.Value, rel)
+			source = directive.Value
 		case CMakeDefineDirective:
 			// cmake_define directives are now processed per-package in GenerateRules
 			// to ensure proper scoping instead of global application
 			log.Printf("Configure: Found cmake_define directive %s in %s (will be processed per-package)", directive.Value, rel)
+			if parts := strings.Fields(directive.Value); len(parts) == 2 {
+				sourceDefines[parts[0]] = parts[1]
+			}
+		case CMakeResolveDirective:
+			cmakeTarget, bazelLabel, err := parseResolveMapping(directive.Value)
+			if err != nil {
+				log.Printf("Configure: Ignoring cmake_resolve directive in %s: %v", rel, err)
+				continue
+			}
+			cfg.ResolveMappings[cmakeTarget] = bazelLabel
+			log.Printf("Configure: Resolving CMake target %s to %s in %s", cmakeTarget, bazelLabel, rel)
+		case CMakeResolveFileDirective:
+			path := directive.Value
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(c.RepoRoot, rel, path)
+			}
+			mappings, err := LoadResolveFile(path)
+			if err != nil {
+				log.Printf("Configure: Failed to load cmake_resolve_file %s in %s: %v", directive.Value, rel, err)
+				continue
+			}
+			for cmakeTarget, bazelLabel := range mappings {
+				cfg.ResolveMappings[cmakeTarget] = bazelLabel
+			}
+			log.Printf("Configure: Loaded %d CMake target mappings from %s in %s", len(mappings), directive.Value, rel)
+		case CMakeLinkoptsDirective:
+			// A library without linkopts is dropped from the link line
+			parts := strings.Fields(directive.Value)
+			if len(parts) == 0 {
+				log.Printf("Configure: Ignoring empty cmake_linkopts directive in %s. Expected format: '<library> [<linkopt>...]'", rel)
+				continue
+			}
+			cfg.LinkoptsMappings[parts[0]] = parts[1:]
+			log.Printf("Configure: Linking system library %s with linkopts %v in %s", parts[0], parts[1:], rel)
+		case CMakePreserveGlobsDirective:
+			// A bare directive turns the option on
+			value := strings.TrimSpace(directive.Value)
+			if value == "" {
+				value = "true"
+			}
+			preserve, err := strconv.ParseBool(value)
+			if err != nil {
+				log.Printf("Configure: Ignoring cmake_preserve_globs directive in %s: expected true or false, got %q", rel, directive.Value)
+				continue
+			}
+			cfg.PreserveGlobs = preserve
+		case CMakeLayoutDirective:
+			switch layout := strings.TrimSpace(directive.Value); layout {
+			case LayoutFlat, LayoutMirror:
+				cfg.Layout = layout
+			default:
+				log.Printf("Configure: Ignoring cmake_layout directive in %s: expected %s or %s, got %q", rel, LayoutFlat, LayoutMirror, directive.Value)
+			}
+		case CMakeBuildTypeDirective:
+			cfg.BuildType = strings.TrimSpace(directive.Value)
+			log.Printf("Configure: Set CMAKE_BUILD_TYPE to %q from directive in %s", cfg.BuildType, rel)
+		case CMakeGeneratorDirective:
+			cfg.Generator = strings.TrimSpace(directive.Value)
+			log.Printf("Configure: Set CMake generator to %q from directive in %s", cfg.Generator, rel)
 		// Add cases for other directives here
 		default:
 			// Gazelle will warn about unknown directives if not in KnownDirectives()
 		}
 	}
+
+	if source != "" {
+		cfg.SourcePackage = rel
+		cfg.Source = source
+	}
+	if source != "" || len(sourceDefines) > 0 {
+		cfg.SourceDefines = sourceDefines
+	}
 }
 
 // GetCMakeConfig retrieves the CMakeConfig from the global config.Config.
@@ -98,4 +389,4 @@ func GetCMakeConfig(c *config.Config) *CMakeConfig {
 	newCfg := NewCMakeConfig()
 	c.Exts["cmake"] = newCfg
 	return newCfg
-}
\ No newline at end of file
+}
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// checkResultArgs gives the positions of the arguments naming the variables
+// the commands of the CMake check modules, try_compile() and try_run() set.
+// Their values depend on the toolchain cmake configures with.
+var checkResultArgs = map[string][]int{
+	"check_include_file":         {1},
+	"check_include_file_cxx":     {1},
+	"check_include_files":        {1},
+	"check_function_exists":      {1},
+	"check_variable_exists":      {1},
+	"check_symbol_exists":        {2},
+	"check_cxx_symbol_exists":    {2},
+	"check_library_exists":       {3},
+	"check_type_size":            {1},
+	"check_struct_has_member":    {3},
+	"check_prototype_definition": {4},
+	"check_c_source_compiles":    {1},
+	"check_cxx_source_compiles":  {1},
+	"check_c_source_runs":        {1},
+	"check_cxx_source_runs":      {1},
+	"check_source_compiles":      {2},
+	"check_source_runs":          {2},
+	"check_c_compiler_flag":      {1},
+	"check_cxx_compiler_flag":    {1},
+	"check_compiler_flag":        {2},
+	"check_linker_flag":          {2},
+	"test_big_endian":            {0},
+	"try_compile":                {0},
+	"try_run":                    {0, 1},
+}
+
+// CheckResultVariables returns the variables a command sets to the result of
+// a check, or nil if it is not a check. check_type_size() also sets
+// HAVE_<variable>.
+func CheckResultVariables(name string, args []string) []string {
+	name = strings.ToLower(name)
+	var variables []string
+	for _, i := range checkResultArgs[name] {
+		if i < len(args) {
+			variables = append(variables, args[i])
+		}
+	}
+	if name == "check_type_size" && len(args) > 1 {
+		variables = append(variables, "HAVE_"+args[1])
+	}
+	return variables
+}
+
+// ParseConfigureOptions applies the options of configure_file() or
+// file(CONFIGURE) to a configure file
+func ParseConfigureOptions(configFile *CMakeConfigureFile, options []string) {
+	for i := 0; i < len(options); i++ {
+		switch options[i] {
+		case "COPYONLY":
+			configFile.CopyOnly = true
+		case "@ONLY":
+			configFile.AtOnly = true
+		case "ESCAPE_QUOTES":
+			configFile.EscapeQuotes = true
+		case "NEWLINE_STYLE":
+			if i+1 < len(options) {
+				i++
+				switch strings.ToUpper(options[i]) {
+				case "UNIX", "LF":
+					configFile.NewlineStyle = "UNIX"
+				case "DOS", "WIN32", "CRLF":
+					configFile.NewlineStyle = "DOS"
+				}
+			}
+		}
+	}
+}
+
+// ParseFileConfigure parses the arguments of file(CONFIGURE OUTPUT <output>
+// CONTENT <content> [ESCAPE_QUOTES] [@ONLY] [NEWLINE_STYLE <style>]) following
+// CONFIGURE. The output is returned as written.
+func ParseFileConfigure(args []string) (*CMakeConfigureFile, bool) {
+	configFile := &CMakeConfigureFile{Variables: make(map[string]string)}
+	hasContent := false
+	var options []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "OUTPUT":
+			if i+1 < len(args) {
+				i++
+				configFile.OutputFile = args[i]
+			}
+		case "CONTENT":
+			if i+1 < len(args) {
+				i++
+				configFile.Content = args[i]
+				hasContent = true
+			}
+		default:
+			options = append(options, args[i])
+		}
+	}
+	ParseConfigureOptions(configFile, options)
+	return configFile, configFile.OutputFile != "" && hasContent
+}
+
+var (
+	templateAtRegex     = regexp.MustCompile(`@([A-Za-z0-9_.+-]+)@`)
+	templateRefRegex    = regexp.MustCompile(`\$\{([A-Za-z0-9_.+-]+)\}`)
+	templateDefineRegex = regexp.MustCompile(`#[ \t]*cmakedefine(?:01)?[ \t]+([A-Za-z0-9_]+)`)
+)
+
+// TemplateVariables returns the variables a configure_file() template uses,
+// through @VAR@, ${VAR} unless atOnly is set, #cmakedefine and #cmakedefine01
+func TemplateVariables(template string, atOnly bool) []string {
+	regexes := []*regexp.Regexp{templateAtRegex, templateDefineRegex}
+	if !atOnly {
+		regexes = append(regexes, templateRefRegex)
+	}
+	var variables []string
+	for _, re := range regexes {
+		for _, match := range re.FindAllStringSubmatch(template, -1) {
+			variables = appendIfMissing(variables, match[1])
+		}
+	}
+	sort.Strings(variables)
+	return variables
+}
+
+// ConfigureTemplateRule returns a cmake_configure_template rule generating the
+// output of a configure file from its template without running cmake, with
+// the values the template uses among values. The caller sets its src, or
+// content for file(CONFIGURE), and out. When the template uses the result of
+// a check, which only cmake can compute for the toolchain, or a path inside
+// one of dirs, the source and build directories as they are on this machine,
+// it returns nil and what it uses instead.
+func ConfigureTemplateRule(configFile *CMakeConfigureFile, template string, values map[string]string, checkResults map[string]bool, dirs []string) (*rule.Rule, string) {
+	r := rule.NewRule("cmake_configure_template", configFile.Name)
+	if configFile.CopyOnly {
+		r.SetAttr("copy_only", true)
+		return r, ""
+	}
+
+	defines := make(map[string]string)
+	for _, variable := range TemplateVariables(template, configFile.AtOnly) {
+		if checkResults[variable] {
+			return nil, "the check result " + variable
+		}
+		value, ok := values[variable]
+		if !ok {
+			continue
+		}
+		if containsPathIn(value, dirs) {
+			return nil, "the local path " + variable
+		}
+		defines[variable] = value
+	}
+	if len(defines) > 0 {
+		r.SetAttr("defines", defines)
+	}
+	if configFile.AtOnly {
+		r.SetAttr("at_only", true)
+	}
+	if configFile.EscapeQuotes {
+		r.SetAttr("escape_quotes", true)
+	}
+	if configFile.NewlineStyle != "" {
+		r.SetAttr("newline_style", configFile.NewlineStyle)
+	}
+	return r, ""
+}
+
+// containsPathIn checks if a value contains the path of one of dirs or of a
+// file inside it
+func containsPathIn(value string, dirs []string) bool {
+	for _, dir := range dirs {
+		if dir != "" && strings.Contains(filepath.ToSlash(value)+"/", filepath.ToSlash(dir)+"/") {
+			return true
+		}
+	}
+	return false
+}
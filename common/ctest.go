@@ -0,0 +1,136 @@
+package common
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+var invalidRuleNameChars = regexp.MustCompile(`[^A-Za-z0-9_.+=,@~-]`)
+
+// TestTimeout maps a CTest TIMEOUT in seconds onto Bazel's timeout categories
+func TestTimeout(seconds float64) string {
+	switch {
+	case seconds <= 0:
+		return ""
+	case seconds <= 60:
+		return "short"
+	case seconds <= 300:
+		return "moderate"
+	case seconds <= 900:
+		return "long"
+	default:
+		return "eternal"
+	}
+}
+
+// SetTestAttrs copies the command arguments and CTest properties of a test onto a cc_test rule
+func SetTestAttrs(r *rule.Rule, test CMakeTest) {
+	if len(test.Args) > 0 {
+		r.SetAttr("args", test.Args)
+	}
+	if len(test.Env) > 0 {
+		r.SetAttr("env", test.Env)
+	}
+
+	tags := append([]string{}, test.Labels...)
+	// Bazel cannot invert a test's result, and a disabled test should not run
+	// as part of a wildcard; both are kept buildable but tagged manual.
+	if test.Disabled {
+		tags = appendIfMissing(tags, "manual")
+	}
+	if test.WillFail {
+		tags = appendIfMissing(tags, "manual")
+		log.Printf("Test %s is expected to fail (WILL_FAIL), tagging it manual", test.Name)
+	}
+	if len(tags) > 0 {
+		r.SetAttr("tags", tags)
+	}
+
+	if timeout := TestTimeout(test.Timeout); timeout != "" {
+		r.SetAttr("timeout", timeout)
+	}
+}
+
+// TestRules turns the rule generated for an executable into cc_test rules for the
+// tests registered on it. A single test converts the rule in place. When several
+// tests run the same executable, its sources become an always-linked library
+// and each test gets its own cc_test depending on it.
+func TestRules(r *rule.Rule, tests []CMakeTest) []*rule.Rule {
+	if len(tests) == 0 {
+		return []*rule.Rule{r}
+	}
+
+	if len(tests) == 1 {
+		r.SetKind("cc_test")
+		SetTestAttrs(r, tests[0])
+		return []*rule.Rule{r}
+	}
+
+	libName := r.Name() + "_lib"
+	r.SetKind("cc_library")
+	r.SetName(libName)
+	r.SetAttr("alwayslink", true)
+
+	// Shared libraries are linked dynamically into the final binaries only
+	dynamicDeps := r.AttrStrings("dynamic_deps")
+	r.DelAttr("dynamic_deps")
+
+	rules := []*rule.Rule{r}
+	for _, test := range tests {
+		testName := invalidRuleNameChars.ReplaceAllString(test.Name, "_")
+		t := rule.NewRule("cc_test", testName)
+		t.SetAttr("deps", []string{":" + libName})
+		if len(dynamicDeps) > 0 {
+			t.SetAttr("dynamic_deps", dynamicDeps)
+		}
+		SetTestAttrs(t, test)
+		rules = append(rules, t)
+	}
+	return rules
+}
+
+// parseTestProperties applies set_tests_properties() style PROPERTIES key/value
+// pairs to a test
+func parseTestProperties(test *CMakeTest, props []string) {
+	for i := 0; i+1 < len(props); i += 2 {
+		key, value := strings.ToUpper(props[i]), props[i+1]
+		switch key {
+		case "LABELS":
+			test.Labels = append(test.Labels, strings.Split(value, ";")...)
+		case "ENVIRONMENT":
+			if test.Env == nil {
+				test.Env = make(map[string]string)
+			}
+			for _, entry := range strings.Split(value, ";") {
+				if k, v, ok := strings.Cut(entry, "="); ok {
+					test.Env[k] = v
+				}
+			}
+		case "TIMEOUT":
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+				test.Timeout = seconds
+			}
+		case "WILL_FAIL":
+			test.WillFail = isTruthy(value)
+		case "DISABLED":
+			test.Disabled = isTruthy(value)
+		}
+	}
+}
+
+// isTruthy reports whether a CMake value is a true constant
+// (1, ON, YES, TRUE, Y or a non-zero number)
+func isTruthy(value string) bool {
+	switch strings.ToUpper(value) {
+	case "1", "ON", "YES", "TRUE", "Y":
+		return true
+	}
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		return n != 0
+	}
+	return false
+}
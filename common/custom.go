@@ -0,0 +1,297 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// customCommandKeywords start the sections of add_custom_command() and
+// add_custom_target() arguments
+var customCommandKeywords = map[string]bool{
+	"OUTPUT": true, "BYPRODUCTS": true, "COMMAND": true, "DEPENDS": true,
+	"MAIN_DEPENDENCY": true, "IMPLICIT_DEPENDS": true, "WORKING_DIRECTORY": true,
+	"COMMENT": true, "DEPFILE": true, "JOB_POOL": true, "JOB_SERVER_AWARE": true,
+	"SOURCES": true,
+}
+
+// customCommandOptions are the keywords of add_custom_command() and
+// add_custom_target() that take no value
+var customCommandOptions = map[string]bool{
+	"ALL": true, "APPEND": true, "VERBATIM": true, "USES_TERMINAL": true,
+	"COMMAND_EXPAND_LISTS": true, "DEPENDS_EXPLICIT_ONLY": true, "CODEGEN": true,
+}
+
+// parseCustomCommand parses the arguments of add_custom_command(OUTPUT ...),
+// or the ones of add_custom_target() after the name when implicitCommand is
+// set, since a custom target may start with a command without COMMAND. It
+// also reports whether APPEND was given. Outputs are relative to the current
+// binary directory and dependencies to the current source directory, like in
+// CMake. Arguments naming files of the package or outputs are made relative
+// to the package, and the files the commands run or read become dependencies.
+func parseCustomCommand(in *cmakeInterpreter, args []string, implicitCommand bool) (*CMakeCustomCommand, bool) {
+	cmd := &CMakeCustomCommand{Directory: in.packageDirectory()}
+	appendMode := false
+	keyword := ""
+	if implicitCommand {
+		keyword = "COMMAND"
+		cmd.Commands = append(cmd.Commands, nil)
+	}
+	for _, arg := range args {
+		switch {
+		case arg == "COMMAND":
+			cmd.Commands = append(cmd.Commands, nil)
+			keyword = arg
+			continue
+		case customCommandKeywords[arg]:
+			keyword = arg
+			continue
+		case arg == "APPEND":
+			appendMode = true
+			continue
+		case customCommandOptions[arg], arg == "ARGS" && keyword == "COMMAND":
+			continue
+		}
+		switch keyword {
+		case "OUTPUT", "BYPRODUCTS":
+			cmd.Outputs = appendIfMissing(cmd.Outputs, in.packageOutputPath(arg))
+		case "DEPENDS", "MAIN_DEPENDENCY":
+			if in.hasTarget(arg) {
+				cmd.DependsTargets = appendIfMissing(cmd.DependsTargets, arg)
+			} else {
+				cmd.Depends = appendIfMissing(cmd.Depends, in.packagePath(arg))
+			}
+		case "COMMAND":
+			cmd.Commands[len(cmd.Commands)-1] = append(cmd.Commands[len(cmd.Commands)-1], arg)
+		case "WORKING_DIRECTORY":
+			if dir := in.packageOutputPath(arg); dir != in.packageOutputPath(".") {
+				cmd.WorkingDirectory = dir
+			}
+		}
+	}
+
+	var commands [][]string
+	for _, command := range cmd.Commands {
+		if len(command) == 0 {
+			continue
+		}
+		for i, arg := range command {
+			if HasGenex(arg) {
+				continue
+			}
+			if p := in.packageOutputPath(arg); fileExists(p, cmd.Outputs) {
+				command[i] = p
+			} else if filepath.IsAbs(arg) && !filepath.IsAbs(p) {
+				// Files of the package the commands use by path
+				if info, err := os.Stat(arg); err == nil && info.Mode().IsRegular() {
+					command[i] = p
+					cmd.Depends = appendIfMissing(cmd.Depends, p)
+				}
+			}
+		}
+		commands = append(commands, command)
+	}
+	cmd.Commands = commands
+	return cmd, appendMode
+}
+
+// CustomCommandRuleName returns the name of the genrule generated for a custom
+// command: the name of the custom target, or one derived from the first
+// output like for configure_file()
+func CustomCommandRuleName(cmd *CMakeCustomCommand) string {
+	if cmd.Target != "" {
+		return cmd.Target
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(cmd.Outputs[0], ".", "_"), "/", "_")
+}
+
+// DescribeCustomCommand names a custom command in diagnostics
+func DescribeCustomCommand(cmd *CMakeCustomCommand) string {
+	if cmd.Target != "" {
+		return "custom target " + cmd.Target
+	}
+	return "the custom command generating " + strings.Join(cmd.Outputs, ", ")
+}
+
+// UsedCustomCommands returns the custom targets among commands, and the custom
+// commands generating files that targets build, directly or through the
+// files other custom commands read. CMake does not run the others.
+func UsedCustomCommands(commands []*CMakeCustomCommand, targets []*CMakeTarget) []*CMakeCustomCommand {
+	needed := make(map[string]bool)
+	for _, target := range targets {
+		for _, file := range append(append([]string{}, target.Sources...), target.Headers...) {
+			needed[file] = true
+		}
+		for _, values := range target.ConfigValues {
+			for _, file := range values.Sources {
+				needed[file] = true
+			}
+		}
+	}
+
+	used := make(map[*CMakeCustomCommand]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, cmd := range commands {
+			if used[cmd] {
+				continue
+			}
+			used[cmd] = cmd.Target != ""
+			for _, output := range cmd.Outputs {
+				used[cmd] = used[cmd] || needed[output]
+			}
+			if used[cmd] {
+				for _, dep := range cmd.Depends {
+					needed[dep] = true
+				}
+				changed = true
+			}
+		}
+	}
+
+	var result []*CMakeCustomCommand
+	for _, cmd := range commands {
+		if used[cmd] {
+			result = append(result, cmd)
+		}
+	}
+	return result
+}
+
+// CustomCommandRefs tells how the genrule of a custom command refers to the
+// files and targets the command uses
+type CustomCommandRefs struct {
+	// Output returns the name in outs of a file the command generates
+	Output func(file string) string
+	// File returns the label of a file the command reads
+	File func(file string) string
+	// Target returns the label of the rule of a target of the project and
+	// whether it is an executable, or "" if there is no such target
+	Target func(name string) (string, bool)
+}
+
+// cmakeToolCommands are the "cmake -E" commands custom commands use the most,
+// with the shell commands doing the same
+var cmakeToolCommands = map[string][]string{
+	"copy":              {"cp"},
+	"copy_if_different": {"cp"},
+	"copy_if_newer":     {"cp"},
+	"echo":              {"echo"},
+	"echo_append":       {"echo", "-n"},
+	"make_directory":    {"mkdir", "-p"},
+	"touch":             {"touch"},
+	"touch_nocreate":    {"touch", "-c"},
+	"remove":            {"rm", "-f"},
+	"rm":                {"rm"},
+	"cat":               {"cat"},
+	"true":              {"true"},
+	"false":             {"false"},
+}
+
+// shellOperators are the arguments the Makefile generators pass on to the
+// shell unquoted, which custom commands use to redirect output
+var shellOperators = map[string]bool{
+	">": true, ">>": true, "<": true, "|": true, "&&": true, "||": true, "2>": true, "2>&1": true,
+}
+
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_./=:,+@%-]+$`)
+
+// CustomCommandRule translates a custom command into a genrule running its
+// command lines from the execution root. Files the commands read or write are
+// passed with $(location), executables of the project with $(execpath), and
+// "cmake -E" commands are replaced by their shell equivalents. Commands that
+// cannot be translated, such as ones using generator expressions or files
+// outside of the project, return an error telling why.
+func CustomCommandRule(cmd *CMakeCustomCommand, refs CustomCommandRefs) (*rule.Rule, error) {
+	if len(cmd.Outputs) == 0 {
+		return nil, fmt.Errorf("it has no OUTPUT or BYPRODUCTS files for Bazel to build")
+	}
+	if len(cmd.Commands) == 0 {
+		return nil, fmt.Errorf("it has no COMMAND")
+	}
+	if cmd.WorkingDirectory != "" {
+		return nil, fmt.Errorf("WORKING_DIRECTORY %s is not supported, genrules run from the execution root", cmd.WorkingDirectory)
+	}
+
+	locations := make(map[string]string)
+	var outs, srcs, tools []string
+	for _, output := range cmd.Outputs {
+		out := refs.Output(output)
+		if strings.Contains(out, "$") || filepath.IsAbs(out) || strings.HasPrefix(out, "..") || strings.Contains(out, "//") {
+			return nil, fmt.Errorf("output %s is outside of the package", output)
+		}
+		outs = append(outs, out)
+		locations[output] = "$(location " + out + ")"
+	}
+	for _, dep := range cmd.Depends {
+		if _, ok := locations[dep]; ok {
+			continue
+		}
+		if strings.Contains(dep, "$") || filepath.IsAbs(dep) {
+			return nil, fmt.Errorf("dependency %s is outside of the project", dep)
+		}
+		label := refs.File(dep)
+		srcs = appendIfMissing(srcs, label)
+		locations[dep] = "$(location " + label + ")"
+	}
+	// Only the executables a command runs are needed to build its outputs
+	for _, name := range cmd.DependsTargets {
+		if label, executable := refs.Target(name); label != "" && executable {
+			tools = appendIfMissing(tools, label)
+		}
+	}
+
+	var lines []string
+	for _, command := range cmd.Commands {
+		var words []string
+		args := command
+		if label, executable := refs.Target(command[0]); label != "" {
+			if !executable {
+				return nil, fmt.Errorf("it runs %s, which is not an executable", command[0])
+			}
+			tools = appendIfMissing(tools, label)
+			words = append(words, "$(execpath "+label+")")
+			args = command[1:]
+		} else if filepath.Base(command[0]) == "cmake" && len(command) > 2 && command[1] == "-E" {
+			shell, ok := cmakeToolCommands[command[2]]
+			if !ok {
+				return nil, fmt.Errorf("cmake -E %s has no shell equivalent", command[2])
+			}
+			words = append(words, shell...)
+			args = command[3:]
+		} else if filepath.Base(command[0]) == "cmake" {
+			return nil, fmt.Errorf("it runs cmake %s", strings.Join(command[1:], " "))
+		}
+
+		for _, arg := range args {
+			switch location, ok := locations[arg]; {
+			case ok:
+				words = append(words, location)
+			case HasGenex(arg):
+				return nil, fmt.Errorf("generator expression %s cannot be evaluated", arg)
+			case filepath.IsAbs(arg):
+				return nil, fmt.Errorf("%s is outside of the project", arg)
+			case shellOperators[arg], shellSafeRegex.MatchString(arg):
+				words = append(words, arg)
+			default:
+				words = append(words, "'"+strings.ReplaceAll(strings.ReplaceAll(arg, "'", `'\''`), "$", "$$")+"'")
+			}
+		}
+		lines = append(lines, strings.Join(words, " "))
+	}
+
+	r := rule.NewRule("genrule", CustomCommandRuleName(cmd))
+	if len(srcs) > 0 {
+		r.SetAttr("srcs", srcs)
+	}
+	r.SetAttr("outs", outs)
+	r.SetAttr("cmd", strings.Join(lines, " && "))
+	if len(tools) > 0 {
+		r.SetAttr("tools", tools)
+	}
+	return r, nil
+}
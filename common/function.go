@@ -0,0 +1,216 @@
+package common
+
+import (
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// userCommand is a command defined with function() or macro()
+type userCommand struct {
+	name     string // As written in the definition
+	params   []string
+	body     []CMakeCommand
+	macro    bool
+	listFile string // File the command was defined in
+	line     int
+}
+
+// define records a function() or macro() definition. Defining a command again
+// keeps the previous definition available as _<name>, like CMake does.
+func (in *cmakeInterpreter) define(cmd CMakeCommand, body []CMakeCommand, macro bool) {
+	args := cmd.ExpandArguments(in.lookup)
+	if len(args) == 0 {
+		log.Printf("%s() at line %d has no name, ignoring it.", cmd.Name, cmd.Pos.Line)
+		return
+	}
+	name := strings.ToLower(args[0])
+	if previous, ok := in.commands[name]; ok {
+		in.commands["_"+name] = previous
+	}
+	in.commands[name] = &userCommand{
+		name:     args[0],
+		params:   args[1:],
+		body:     body,
+		macro:    macro,
+		listFile: in.scope.vars["CMAKE_CURRENT_LIST_FILE"],
+		line:     cmd.Pos.Line,
+	}
+}
+
+// bindings returns the variables a function or macro binds for the arguments
+// of an invocation, or false if there are fewer arguments than parameters
+func (command *userCommand) bindings(args []string) (map[string]string, bool) {
+	if len(args) < len(command.params) {
+		return nil, false
+	}
+	bindings := map[string]string{
+		"ARGC": strconv.Itoa(len(args)),
+		"ARGV": strings.Join(args, ";"),
+		"ARGN": strings.Join(args[len(command.params):], ";"),
+	}
+	for i, arg := range args {
+		bindings["ARGV"+strconv.Itoa(i)] = arg
+	}
+	for i, param := range command.params {
+		bindings[param] = args[i]
+	}
+	return bindings, true
+}
+
+// invoke runs a function or macro for the invocation cmd
+func (in *cmakeInterpreter) invoke(command *userCommand, cmd CMakeCommand) {
+	if in.depth >= maxRecursionDepth {
+		log.Printf("%s() at line %d exceeds the maximum recursion depth of %d, skipping.", cmd.Name, cmd.Pos.Line, maxRecursionDepth)
+		return
+	}
+	bindings, ok := command.bindings(cmd.ExpandArguments(in.lookup))
+	if !ok {
+		log.Printf("%s() at line %d needs at least %d arguments, skipping.", cmd.Name, cmd.Pos.Line, len(command.params))
+		return
+	}
+	in.depth++
+	defer func() { in.depth-- }()
+
+	if command.macro {
+		// Macro arguments are not variables: references to them are replaced
+		// in the body before it runs in the scope of the caller
+		in.run(substituteMacroArguments(command.body, bindings))
+		return
+	}
+
+	parent := in.scope
+	in.scope = newCMakeScope(parent)
+	for k, v := range bindings {
+		in.scope.vars[k] = v
+	}
+	in.scope.vars["CMAKE_CURRENT_FUNCTION"] = command.name
+	in.scope.vars["CMAKE_CURRENT_FUNCTION_LIST_FILE"] = command.listFile
+	in.scope.vars["CMAKE_CURRENT_FUNCTION_LIST_DIR"] = filepath.Dir(command.listFile)
+	in.scope.vars["CMAKE_CURRENT_FUNCTION_LIST_LINE"] = strconv.Itoa(command.line)
+	in.run(command.body)
+	in.flow = flowNormal // return() ends the function
+	in.scope = parent
+}
+
+// substituteMacroArguments returns a copy of the body of a macro with the
+// references to its arguments replaced by their values
+func substituteMacroArguments(body []CMakeCommand, bindings map[string]string) []CMakeCommand {
+	var pairs []string
+	for k, v := range bindings {
+		pairs = append(pairs, "${"+k+"}", v)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	substituted := make([]CMakeCommand, len(body))
+	for i, cmd := range body {
+		substituted[i] = cmd
+		substituted[i].Arguments = make([]CMakeArgument, len(cmd.Arguments))
+		for j, arg := range cmd.Arguments {
+			if arg.Kind != BracketArgument {
+				arg.Raw = replacer.Replace(arg.Raw)
+			}
+			substituted[i].Arguments[j] = arg
+		}
+	}
+	return substituted
+}
+
+// parseArguments handles
+// cmake_parse_arguments(<prefix> <options> <one_value_keywords> <multi_value_keywords> <args>...)
+// and cmake_parse_arguments(PARSE_ARGV <N> <prefix> <options> <one_value_keywords> <multi_value_keywords>)
+func (in *cmakeInterpreter) parseArguments(args []string) {
+	var values []string
+	parseArgv := len(args) > 0 && args[0] == "PARSE_ARGV"
+	if parseArgv {
+		if len(args) < 6 {
+			log.Printf("cmake_parse_arguments(PARSE_ARGV) needs 6 arguments, got %d.", len(args))
+			return
+		}
+		start, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Printf("cmake_parse_arguments(PARSE_ARGV %s): invalid argument index.", args[1])
+			return
+		}
+		// Arguments are taken as they were passed, so each is one value
+		argc, _ := strconv.Atoi(in.scope.vars["ARGC"])
+		for i := start; i < argc; i++ {
+			values = append(values, strings.ReplaceAll(in.scope.vars["ARGV"+strconv.Itoa(i)], ";", `\;`))
+		}
+		args = args[2:]
+	} else {
+		if len(args) < 4 {
+			log.Printf("cmake_parse_arguments() needs at least 4 arguments, got %d.", len(args))
+			return
+		}
+		for _, arg := range args[4:] {
+			values = append(values, SplitCMakeList(arg)...)
+		}
+	}
+
+	const (
+		optionKeyword = iota
+		oneValueKeyword
+		multiValueKeyword
+	)
+	prefix := args[0]
+	keywords := make(map[string]int)
+	for kind, list := range args[1:4] {
+		for _, keyword := range SplitCMakeList(list) {
+			keywords[keyword] = kind
+		}
+	}
+
+	given := make(map[string]bool)
+	parsed := make(map[string][]string)
+	var unparsed, missing []string
+	current := "" // Keyword the next values belong to
+	endKeyword := func() {
+		if current != "" && len(parsed[current]) == 0 {
+			missing = appendIfMissing(missing, current)
+		}
+		current = ""
+	}
+	for _, value := range values {
+		kind, isKeyword := keywords[value]
+		switch {
+		case isKeyword:
+			endKeyword()
+			given[value] = true
+			if kind == oneValueKeyword {
+				parsed[value] = nil
+			}
+			if kind != optionKeyword {
+				current = value
+			}
+		case current == "":
+			unparsed = append(unparsed, value)
+		case keywords[current] == oneValueKeyword:
+			parsed[current] = []string{value}
+			current = ""
+		default:
+			parsed[current] = append(parsed[current], value)
+		}
+	}
+	endKeyword()
+
+	setOrUnset := func(name string, list []string) {
+		if len(list) == 0 {
+			delete(in.scope.vars, prefix+"_"+name)
+			return
+		}
+		in.scope.vars[prefix+"_"+name] = strings.Join(list, ";")
+	}
+	for keyword, kind := range keywords {
+		if kind != optionKeyword {
+			setOrUnset(keyword, parsed[keyword])
+		} else if given[keyword] {
+			in.scope.vars[prefix+"_"+keyword] = "TRUE"
+		} else {
+			in.scope.vars[prefix+"_"+keyword] = "FALSE"
+		}
+	}
+	setOrUnset("UNPARSED_ARGUMENTS", unparsed)
+	setOrUnset("KEYWORDS_MISSING_VALUES", missing)
+}
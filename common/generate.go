@@ -1,13 +1,14 @@
 package common
 
 import (
-	"bufio"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/language"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
@@ -44,216 +45,948 @@ func fileExists(file string, fileList []string) bool {
 	return false
 }
 
-// generateRulesFromCMakeFile attempts to parse a CMakeLists.txt file and extract target information.
-func generateRulesFromCMakeFile(args language.GenerateArgs, cmakeFilePath string, cfg *CMakeConfig) language.GenerateResult {
-	res := language.GenerateResult{}
-	targets := make(map[string]*CMakeTarget) // Map of target name to CMakeTarget
-	variables := make(map[string]string)     // CMake variables from set() commands
+// packageFileExists checks if a file relative to the package exists, either
+// in the package directory itself or in a subdirectory of it
+func packageFileExists(args language.GenerateArgs, file string) bool {
+	if fileExists(file, args.RegularFiles) {
+		return true
+	}
+	if filepath.IsAbs(file) || file == ".." || strings.HasPrefix(file, "../") {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(args.Dir, file))
+	return err == nil && info.Mode().IsRegular()
+}
 
-	file, err := os.Open(cmakeFilePath)
-	if err != nil {
-		log.Printf("Error opening CMakeLists.txt %s: %v", cmakeFilePath, err)
-		return res
+// hasBuildFile checks if a directory contains a BUILD file, making it a
+// Bazel package of its own
+func hasBuildFile(c *config.Config, dir string) bool {
+	names := c.ValidBuildFileNames
+	if len(names) == 0 {
+		names = config.DefaultValidBuildFileNames
 	}
-	defer file.Close()
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
 
-	log.Printf("Parsing CMakeLists.txt: %s (Rel: %s)", cmakeFilePath, args.Rel)
+// subpackageOf returns the innermost directory between dir and the package,
+// both relative to the package, that has a BUILD file of its own, or "" if
+// the files of dir belong to the package. Sources outside the repository,
+// like those of a cmake_source directive, have no packages in it, so all
+// their files belong to the package.
+func subpackageOf(args language.GenerateArgs, dir string) string {
+	if args.Config != nil && args.Config.RepoRoot != "" && filepath.Join(args.Config.RepoRoot, args.Rel) != filepath.Clean(args.Dir) {
+		return ""
+	}
+	for ; dir != "" && dir != "." && dir != ".." && !strings.HasPrefix(dir, "../"); dir = path.Dir(dir) {
+		if hasBuildFile(args.Config, filepath.Join(args.Dir, dir)) {
+			return dir
+		}
+	}
+	return ""
+}
 
-	// Simplified parsing logic focusing on key commands.
-	// A real CMake parser is much more complex.
-	// This version will still use regex for command extraction but be more stateful.
+// inParentCMakeProject checks if a directory of the repository between the
+// package and the repository root has a CMakeLists.txt
+func inParentCMakeProject(args language.GenerateArgs) bool {
+	if args.Rel == "" || args.Config == nil || args.Config.RepoRoot == "" {
+		return false
+	}
+	for rel := path.Dir(args.Rel); ; rel = path.Dir(rel) {
+		if rel == "." {
+			rel = ""
+		}
+		if _, err := os.Stat(filepath.Join(args.Config.RepoRoot, rel, "CMakeLists.txt")); err == nil {
+			return true
+		}
+		if rel == "" {
+			return false
+		}
+	}
+}
 
-	// Regex to identify CMake commands (e.g., add_library(...))
-	// Captures: 1=command, 2=arguments string
-	commandRegex := regexp.MustCompile(`(?im)^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\(([\s\S]*?)\)\s*$`)
-	// Regex to split arguments (very basic, won't handle all CMake quoting/escaping)
-	argSplitRegex := regexp.MustCompile(`\s+`) // Simple split by space
+// NormalizeIncludeDirectory converts an include directory as written in a
+// CMakeLists.txt into a path relative to the directory of that file. It returns
+// false for directories that cannot be expressed that way, such as absolute
+// paths, install-time paths or unexpanded variables.
+func NormalizeIncludeDirectory(dir string) (string, bool) {
+	for _, prefix := range []string{"${CMAKE_CURRENT_SOURCE_DIR}", "${CMAKE_CURRENT_LIST_DIR}"} {
+		if dir == prefix {
+			dir = "."
+		} else if strings.HasPrefix(dir, prefix+"/") {
+			dir = strings.TrimPrefix(dir, prefix+"/")
+		}
+	}
+	if dir == "" || filepath.IsAbs(dir) || strings.Contains(dir, "$") {
+		return "", false
+	}
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	if dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", false
+	}
+	return dir, true
+}
 
-	scanner := bufio.NewScanner(file)
-	var currentContent strings.Builder
-	for scanner.Scan() {
-		currentContent.WriteString(scanner.Text() + "\n")
+// relativeToPackage converts an absolute path built from the source or binary
+// directory variables into one relative to the package. Files configured into
+// the binary directory are generated into the package itself, so both
+// directories map onto it. Other paths are returned unchanged.
+func relativeToPackage(p, sourceDir, binaryDir string) string {
+	for _, dir := range []string{binaryDir, sourceDir} {
+		if p == dir {
+			return "."
+		}
+		if strings.HasPrefix(p, dir+"/") {
+			return strings.TrimPrefix(p, dir+"/")
+		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading CMakeLists.txt %s: %v", cmakeFilePath, err)
-		return res
+	return p
+}
+
+// CMakeListsModel holds the targets and configure_file commands the fallback
+// parser found in a CMakeLists.txt and the files it includes or adds with
+// add_subdirectory(). Paths are relative to the directory of the CMakeLists.txt.
+type CMakeListsModel struct {
+	Targets        map[string]*CMakeTarget // Map of target name to CMakeTarget
+	ConfigureFiles []*CMakeConfigureFile
+	CustomCommands []*CMakeCustomCommand
+	Variables      map[string]string // CMake variables from set() commands
+	// CheckResults are the variables check_*() commands, try_compile() and
+	// try_run() set, whose values depend on the toolchain
+	CheckResults map[string]bool
+}
+
+// ParseCMakeLists extracts target information from a CMakeLists.txt file
+// without running cmake, interpreting the commands of the file in order.
+func ParseCMakeLists(cmakeFilePath string) (*CMakeListsModel, error) {
+	return ParseCMakeListsWithDefines(cmakeFilePath, nil)
+}
+
+// ParseCMakeListsWithDefines is ParseCMakeLists with cache entries set as if
+// passed to cmake with -D, such as those from cmake_define directives.
+func ParseCMakeListsWithDefines(cmakeFilePath string, defines map[string]string) (*CMakeListsModel, error) {
+	model := &CMakeListsModel{
+		Targets:      make(map[string]*CMakeTarget),
+		Variables:    make(map[string]string),
+		CheckResults: make(map[string]bool),
 	}
+	targets := model.Targets
+	var tests []*CMakeTest // Tests from add_test() commands
+	testExecutables := make(map[*CMakeTest]string)
 
-	fileContent := currentContent.String()
-	allCommands := commandRegex.FindAllStringSubmatch(fileContent, -1)
+	commands, err := ParseCMakeFile(cmakeFilePath)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, cmdMatch := range allCommands {
-		commandName := strings.ToLower(cmdMatch[1])
-		argsString := strings.TrimSpace(cmdMatch[2])
+	// Commands that create and configure targets, with variable references
+	// already expanded by the interpreter. Paths are made relative to the
+	// package as they are recorded, since they are relative to the directory
+	// of the command.
+	var interp *cmakeInterpreter
+
+	// forEachValue evaluates the generator expressions in the values of a
+	// target command for every compilation mode, and calls add with each
+	// resulting element and the mode it applies to, or "" for all modes.
+	// Targets whose objects $<TARGET_OBJECTS> refers to are linked instead.
+	forEachValue := func(target *CMakeTarget, values []string, add func(mode, value string)) {
+		hasGenex := false
+		for _, value := range values {
+			hasGenex = hasGenex || HasGenex(value)
+		}
+		if !hasGenex {
+			for _, value := range values {
+				add("", value)
+			}
+			return
+		}
 
-		// Split arguments. This is a major simplification.
-		// CMake uses space, semicolon for lists, quotes, variable expansion etc.
-		rawArgs := argSplitRegex.Split(argsString, -1)
-		var cmdArgs []string
-		for _, arg := range rawArgs {
-			if arg != "" { // Remove empty strings resulting from multiple spaces
-				cmdArgs = append(cmdArgs, strings.Trim(arg, `"`)) // Basic quote stripping
+		buildType, _ := interp.variable("CMAKE_BUILD_TYPE")
+		configs := CompilationModeConfigs(buildType)
+		contexts := make(map[string]*GenexContext)
+		byMode := EvaluateForModes(values, func(mode string) *GenexContext {
+			contexts[mode] = &GenexContext{
+				Config:    configs[mode],
+				Languages: targetLanguages(target),
+				Target:    target.Name,
+				TargetProperty: func(name, property string) (string, bool) {
+					if t, ok := targets[name]; ok {
+						return targetProperty(t, property, interp.sourceDir)
+					}
+					return "", false
+				},
+			}
+			return contexts[mode]
+		})
+		all, specific := SplitByMode(byMode)
+		for _, value := range all {
+			add("", value)
+		}
+		for _, mode := range CompilationModes {
+			for _, value := range specific[mode] {
+				add(mode, value)
 			}
 		}
 
+		objects := make(map[string][]string)
+		for mode, ctx := range contexts {
+			objects[mode] = ctx.TargetObjects
+		}
+		// The objects only become part of the target itself
+		all, specific = SplitByMode(objects)
+		for _, lib := range all {
+			addLinkedLibrary(target, "", "PRIVATE", lib)
+		}
+		for _, mode := range CompilationModes {
+			for _, lib := range specific[mode] {
+				addLinkedLibrary(target, mode, "PRIVATE", lib)
+			}
+		}
+	}
+	// addSource adds a source or header file of a target for a compilation
+	// mode. Files that only some modes build are compiled as srcs, which may
+	// hold headers too, and so are headers consumers cannot include.
+	addSource := func(target *CMakeTarget, mode, file string, privateHeader bool) {
+		file = interp.packagePath(file)
+		switch {
+		case privateHeader && mode == "" && isHeaderFile(file):
+			target.Sources = appendIfMissing(target.Sources, file)
+		case mode != "":
+			if isSourceFile(file) || isHeaderFile(file) {
+				values := target.configValues(mode)
+				values.Sources = appendIfMissing(values.Sources, file)
+			}
+		case isHeaderFile(file):
+			target.Headers = appendIfMissing(target.Headers, file)
+		case isSourceFile(file):
+			target.Sources = appendIfMissing(target.Sources, file)
+		}
+	}
+
+	// applyDirectory initializes a new target from the properties of the
+	// directory it is created in. INTERFACE libraries only have usage
+	// requirements, which the directory properties do not set.
+	applyDirectory := func(target *CMakeTarget) {
+		if target.Type == "interface" {
+			return
+		}
+		// Directory properties are not propagated to consumers
+		dir := interp.directory
+		forEachValue(target, dir.includeDirectories, func(mode, includeDir string) {
+			addIncludeDirectory(target, mode, "PRIVATE", interp.packagePath(includeDir))
+		})
+		forEachValue(target, dir.compileDefinitions, func(mode, define string) {
+			addCompileDefinition(target, mode, "PRIVATE", define)
+		})
+		forEachValue(target, dir.compileOptions, func(mode, option string) {
+			addCompileOption(target, mode, "PRIVATE", option)
+		})
+		forEachValue(target, dir.linkLibraries, func(mode, linkedLib string) {
+			addLinkedLibrary(target, mode, "PRIVATE", linkedLib)
+		})
+	}
+	// directoryTargets returns the targets created so far in the current
+	// directory, which some directory commands apply to as well
+	directoryTargets := func() []*CMakeTarget {
+		var result []*CMakeTarget
+		dir := interp.packageDirectory()
+		for _, target := range targets {
+			if target.Directory == dir && target.Type != "interface" {
+				result = append(result, target)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+		return result
+	}
+
+	// templateValues returns the values the variables of a configure_file()
+	// template have at the point the command configures it
+	templateValues := func(template string, atOnly bool) map[string]string {
+		values := make(map[string]string)
+		for _, variable := range TemplateVariables(template, atOnly) {
+			if value, ok := interp.variable(variable); ok {
+				values[variable] = value
+			}
+		}
+		return values
+	}
+
+	handleCommand := func(commandName string, cmdArgs []string) {
 		if len(cmdArgs) == 0 {
-			continue
+			return
 		}
 		targetName := cmdArgs[0] // First argument is usually the target name
+		for _, variable := range CheckResultVariables(commandName, cmdArgs) {
+			model.CheckResults[variable] = true
+		}
 
 		switch commandName {
 		case "add_library":
 			if len(cmdArgs) < 2 {
-				continue
+				return
 			}
 			target, ok := targets[targetName]
 			if !ok {
-				target = &CMakeTarget{Name: targetName, Type: "library"}
+				target = &CMakeTarget{Name: targetName, Type: "library", Directory: interp.packageDirectory()}
 				targets[targetName] = target
 			}
-			target.Type = "library"               // Ensure type is library
-			for _, srcFile := range cmdArgs[1:] { // Simplification: assumes all following args are sources
-				// Basic check for header/source, could be improved
-				if isHeaderFile(srcFile) {
-					target.Headers = appendIfMissing(target.Headers, srcFile)
-				} else if isSourceFile(srcFile) {
-					target.Sources = appendIfMissing(target.Sources, srcFile)
-				}
+			target.Type = "library" // Ensure type is library
+			switch libraryType := strings.ToUpper(cmdArgs[1]); libraryType {
+			case "INTERFACE":
+				target.Type = "interface" // Header-only library without sources of its own
+			case "STATIC", "SHARED", "MODULE", "OBJECT":
+				target.LibraryType = libraryType
+			}
+			// Simplification: assumes all following args are sources
+			forEachValue(target, cmdArgs[1:], func(mode, srcFile string) {
+				addSource(target, mode, srcFile, false)
+			})
+			if !ok {
+				applyDirectory(target)
 			}
 		case "add_executable":
 			if len(cmdArgs) < 2 {
-				continue
+				return
 			}
 			target, ok := targets[targetName]
 			if !ok {
-				target = &CMakeTarget{Name: targetName, Type: "executable"}
+				target = &CMakeTarget{Name: targetName, Type: "executable", Directory: interp.packageDirectory()}
 				targets[targetName] = target
 			}
 			target.Type = "executable" // Ensure type
-			for _, srcFile := range cmdArgs[1:] {
-				if isSourceFile(srcFile) { // Executables usually don't list headers here
-					target.Sources = appendIfMissing(target.Sources, srcFile)
-				} else if isHeaderFile(srcFile) { // Though sometimes they might
-					target.Headers = appendIfMissing(target.Headers, srcFile)
-				}
+			forEachValue(target, cmdArgs[1:], func(mode, srcFile string) {
+				addSource(target, mode, srcFile, false)
+			})
+			if !ok {
+				applyDirectory(target)
 			}
 		case "target_sources": // Assumes target_sources(target_name PRIVATE src1 src2 ...)
 			if len(cmdArgs) < 3 {
-				continue
+				return
 			} // target_name, scope, src1
 			targetNameFromArgs := cmdArgs[0] // target_sources's first arg is the target name
 			target, ok := targets[targetNameFromArgs]
 			if !ok {
-				continue
+				return
 			} // Target must exist
-			// Skipping scope (PRIVATE/PUBLIC/INTERFACE) for simplicity for now
-			for _, srcFile := range cmdArgs[2:] { // Source files start from the third argument
-				if isHeaderFile(srcFile) {
-					target.Headers = appendIfMissing(target.Headers, srcFile)
-				} else if isSourceFile(srcFile) {
-					target.Sources = appendIfMissing(target.Sources, srcFile)
+			// Headers listed as PRIVATE are not part of the interface of the
+			// target, and the BASE_DIRS of file sets are include directories
+			scope, keyword := "", ""
+			for _, arg := range cmdArgs[1:] {
+				switch strings.ToUpper(arg) {
+				case "PRIVATE", "PUBLIC", "INTERFACE":
+					scope, keyword = strings.ToUpper(arg), ""
+					continue
+				case "FILE_SET", "TYPE", "BASE_DIRS", "FILES":
+					keyword = strings.ToUpper(arg)
+					continue
+				}
+				if keyword == "BASE_DIRS" {
+					forEachValue(target, []string{arg}, func(mode, dir string) {
+						addIncludeDirectory(target, mode, scope, interp.packagePath(dir))
+					})
+					continue
 				}
+				forEachValue(target, []string{arg}, func(mode, srcFile string) {
+					addSource(target, mode, srcFile, scope == "PRIVATE")
+				})
 			}
 		case "target_include_directories": // Assumes target_include_directories(target_name PRIVATE dir1 dir2 ...)
 			if len(cmdArgs) < 3 {
-				continue
+				return
 			}
 			targetNameFromArgs := cmdArgs[0]
 			target, ok := targets[targetNameFromArgs]
 			if !ok {
-				continue
+				return
 			}
-			// Skipping scope for simplicity
-			for _, inclDir := range cmdArgs[2:] {
-				// Here, inclDir might be relative to CMakeLists.txt or absolute.
-				// It could also be ${CMAKE_CURRENT_SOURCE_DIR} etc.
-				// For now, store as is. Resolution to Bazel paths is complex.
-				target.IncludeDirectories = appendIfMissing(target.IncludeDirectories, inclDir)
+			scope := ""
+			for _, inclDir := range cmdArgs[1:] {
+				switch keyword := strings.ToUpper(inclDir); keyword {
+				case "PRIVATE", "PUBLIC", "INTERFACE":
+					scope = keyword
+					continue
+				case "SYSTEM", "BEFORE", "AFTER":
+					continue
+				}
+				forEachValue(target, []string{inclDir}, func(mode, dir string) {
+					addIncludeDirectory(target, mode, scope, interp.packagePath(dir))
+				})
+			}
+		case "target_compile_definitions": // Handle target_compile_definitions(target_name [scope] def1 def2 ...)
+			target, ok := targets[targetName]
+			if !ok {
+				return
+			}
+			scope := ""
+			for _, arg := range cmdArgs[1:] {
+				switch keyword := strings.ToUpper(arg); keyword {
+				case "PRIVATE", "PUBLIC", "INTERFACE":
+					scope = keyword
+					continue
+				}
+				forEachValue(target, []string{arg}, func(mode, define string) {
+					// A leading -D is allowed and ignored by CMake
+					addCompileDefinition(target, mode, scope, strings.TrimPrefix(define, "-D"))
+				})
+			}
+		case "target_compile_options": // Handle target_compile_options(target_name [BEFORE] [scope] opt1 opt2 ...)
+			target, ok := targets[targetName]
+			if !ok {
+				return
+			}
+			scope := ""
+			for _, arg := range cmdArgs[1:] {
+				switch keyword := strings.ToUpper(arg); keyword {
+				case "PRIVATE", "PUBLIC", "INTERFACE":
+					scope = keyword
+					continue
+				case "BEFORE":
+					continue
+				}
+				forEachValue(target, []string{arg}, func(mode, option string) {
+					addCompileOption(target, mode, scope, option)
+				})
 			}
 		case "target_link_libraries": // Handle target_link_libraries(target_name [scope] lib1 lib2 ...)
 			if len(cmdArgs) < 2 {
-				continue
+				return
 			}
 			targetNameFromArgs := cmdArgs[0]
 			target, ok := targets[targetNameFromArgs]
 			if !ok {
-				continue
+				return
 			}
 
 			// Handle both formats:
-			// target_link_libraries(target lib1 lib2) and
+			// target_link_libraries(target lib1 lib2), whose items propagate, and
 			// target_link_libraries(target PRIVATE/PUBLIC/INTERFACE lib1 lib2)
-			startIdx := 1
-			if len(cmdArgs) >= 3 {
-				scope := strings.ToUpper(cmdArgs[1])
-				if scope == "PRIVATE" || scope == "PUBLIC" || scope == "INTERFACE" {
-					startIdx = 2 // Skip the scope keyword
+			scope := ""
+			items := cmdArgs[1:]
+			for i := 0; i < len(items); i++ {
+				switch keyword := strings.ToUpper(items[i]); keyword {
+				case "PRIVATE", "PUBLIC", "INTERFACE", "LINK_PRIVATE", "LINK_PUBLIC", "LINK_INTERFACE_LIBRARIES":
+					scope = keyword
+					continue
 				}
+				var item string
+				item, i = linkItem(items, i)
+				forEachValue(target, []string{item}, func(mode, linkedLib string) {
+					addLinkedLibrary(target, mode, scope, linkedLib)
+				})
 			}
-
-			for _, linkedLib := range cmdArgs[startIdx:] {
-				target.LinkedLibraries = appendIfMissing(target.LinkedLibraries, linkedLib)
+		case "include_directories": // Handle include_directories([AFTER|BEFORE] [SYSTEM] dir1 dir2 ...)
+			var dirs []string
+			for _, includeDir := range cmdArgs {
+				switch strings.ToUpper(includeDir) {
+				case "AFTER", "BEFORE", "SYSTEM":
+					continue
+				}
+				if !HasGenex(includeDir) && !filepath.IsAbs(includeDir) {
+					includeDir = filepath.Join(interp.scope.vars["CMAKE_CURRENT_SOURCE_DIR"], includeDir)
+				}
+				dirs = append(dirs, includeDir)
+				interp.directory.includeDirectories = appendIfMissing(interp.directory.includeDirectories, includeDir)
 			}
-		case "set": // Handle set(VAR value) for CMake variables
-			if len(cmdArgs) >= 2 {
-				varName := cmdArgs[0]
-				varValue := cmdArgs[1]
-				variables[varName] = varValue
-				log.Printf("Found CMake variable: %s = %s", varName, varValue)
+			// Like CMake, also add them to the targets the directory already has
+			for _, target := range directoryTargets() {
+				forEachValue(target, dirs, func(mode, includeDir string) {
+					addIncludeDirectory(target, mode, "PRIVATE", interp.packagePath(includeDir))
+				})
+			}
+		case "add_definitions", "add_compile_definitions":
+			// add_definitions() takes -D flags and passes any other flag to the
+			// compiler, add_compile_definitions() takes the definitions themselves
+			var defines, options []string
+			for _, arg := range cmdArgs {
+				switch {
+				case commandName == "add_compile_definitions":
+					defines = append(defines, arg)
+				case strings.HasPrefix(arg, "-D") || strings.HasPrefix(arg, "/D"):
+					defines = append(defines, arg[2:])
+				default:
+					options = append(options, arg)
+				}
+			}
+			dir := interp.directory
+			for _, define := range defines {
+				dir.compileDefinitions = appendIfMissing(dir.compileDefinitions, define)
+			}
+			for _, option := range options {
+				dir.compileOptions = appendIfMissing(dir.compileOptions, option)
 			}
+			// The definitions of a directory apply to all of its targets
+			for _, target := range directoryTargets() {
+				forEachValue(target, defines, func(mode, define string) {
+					addCompileDefinition(target, mode, "PRIVATE", define)
+				})
+				forEachValue(target, options, func(mode, option string) {
+					addCompileOption(target, mode, "PRIVATE", option)
+				})
+			}
+		case "add_compile_options": // Applies to targets created afterwards
+			for _, option := range cmdArgs {
+				interp.directory.compileOptions = appendIfMissing(interp.directory.compileOptions, option)
+			}
+		case "link_libraries": // Applies to targets created afterwards
+			for i := 0; i < len(cmdArgs); i++ {
+				var linkedLib string
+				linkedLib, i = linkItem(cmdArgs, i)
+				interp.directory.linkLibraries = appendIfMissing(interp.directory.linkLibraries, linkedLib)
+			}
+		case "set_target_properties": // Handle set_target_properties(target1 [target2...] PROPERTIES key value ...)
+			for i, arg := range cmdArgs {
+				if strings.ToUpper(arg) != "PROPERTIES" {
+					continue
+				}
+				for _, name := range cmdArgs[:i] {
+					if target, ok := targets[name]; ok {
+						parseTargetProperties(target, cmdArgs[i+1:])
+					}
+				}
+				break
+			}
+		case "add_test": // Handle add_test(NAME name COMMAND exe args...) and add_test(name exe args...)
+			test := &CMakeTest{}
+			var command []string
+			if strings.ToUpper(cmdArgs[0]) == "NAME" {
+				keyword := ""
+				for _, arg := range cmdArgs {
+					switch strings.ToUpper(arg) {
+					case "NAME", "COMMAND", "CONFIGURATIONS", "WORKING_DIRECTORY":
+						keyword = strings.ToUpper(arg)
+						continue
+					case "COMMAND_EXPAND_LISTS":
+						continue
+					}
+					switch keyword {
+					case "NAME":
+						test.Name = arg
+					case "COMMAND":
+						command = append(command, arg)
+					}
+				}
+			} else {
+				test.Name = cmdArgs[0]
+				command = cmdArgs[1:]
+			}
+			if test.Name == "" || len(command) == 0 {
+				return
+			}
+			test.Args = command[1:]
+			tests = append(tests, test)
+			testExecutables[test] = command[0]
+		case "set_tests_properties": // Handle set_tests_properties(test1 [test2...] PROPERTIES key value ...)
+			for i, arg := range cmdArgs {
+				if strings.ToUpper(arg) != "PROPERTIES" {
+					continue
+				}
+				for _, name := range cmdArgs[:i] {
+					for _, test := range tests {
+						if test.Name == name {
+							parseTestProperties(test, cmdArgs[i+1:])
+						}
+					}
+				}
+				break
+			}
+		case "add_custom_command":
+			if targetName == "TARGET" {
+				if len(cmdArgs) > 2 {
+					log.Printf("add_custom_command(TARGET %s %s) runs while the target is built, which Bazel cannot do, skipping.", cmdArgs[1], cmdArgs[2])
+				}
+				return
+			}
+			command, appendMode := parseCustomCommand(interp, cmdArgs, false)
+			if len(command.Outputs) == 0 {
+				return
+			}
+			// APPEND adds commands and dependencies to the command that
+			// generates the first output
+			if appendMode {
+				for _, existing := range model.CustomCommands {
+					if existing.Target == "" && fileExists(command.Outputs[0], existing.Outputs) {
+						existing.Commands = append(existing.Commands, command.Commands...)
+						for _, dep := range command.Depends {
+							existing.Depends = appendIfMissing(existing.Depends, dep)
+						}
+						for _, dep := range command.DependsTargets {
+							existing.DependsTargets = appendIfMissing(existing.DependsTargets, dep)
+						}
+						return
+					}
+				}
+			}
+			model.CustomCommands = append(model.CustomCommands, command)
+		case "add_custom_target":
+			command, _ := parseCustomCommand(interp, cmdArgs[1:], true)
+			command.Target = targetName
+			model.CustomCommands = append(model.CustomCommands, command)
 		case "configure_file": // Handle configure_file(input output) for backward compatibility
 			if len(cmdArgs) >= 2 {
-				inputFile := cmdArgs[0]
-				outputFile := cmdArgs[1]
-				
+				inputFile := interp.packagePath(cmdArgs[0])
+				outputFile := interp.packageOutputPath(cmdArgs[1])
+
 				// Generate rule name based on output file (e.g., config.h -> config_h)
 				ruleName := strings.ReplaceAll(strings.ReplaceAll(outputFile, ".", "_"), "/", "_")
-				
-				// Create configure file info 
+
 				configFile := &CMakeConfigureFile{
 					Name:       ruleName,
 					InputFile:  inputFile,
 					OutputFile: outputFile,
 					Variables:  make(map[string]string),
 				}
-				
-				// Only include defines from gazelle directives (not variables discovered by parsing)
-				for k, v := range cfg.CMakeDefines {
-					configFile.Variables[k] = v
+				ParseConfigureOptions(configFile, cmdArgs[2:])
+				templatePath := cmdArgs[0]
+				if !filepath.IsAbs(templatePath) {
+					templatePath = filepath.Join(interp.scope.vars["CMAKE_CURRENT_SOURCE_DIR"], templatePath)
 				}
-				
-				// Generate cmake_configure_file rule
-				r := rule.NewRule("cmake_configure_file", configFile.Name)
-				r.SetAttr("out", configFile.OutputFile)
-				
-				// Set cmake_binary to reference the examples cmake target for examples directory
-				r.SetAttr("cmake_binary", "//:cmake")
-				
-				// Set cmake_source_dir to current directory (where CMakeLists.txt is)
-				r.SetAttr("cmake_source_dir", ".")
-				
-				// Include CMakeLists.txt and the input template file as sources
-				sourceFiles := []string{"CMakeLists.txt"}
-				if configFile.InputFile != "" && configFile.InputFile != "CMakeLists.txt" {
-					sourceFiles = append(sourceFiles, configFile.InputFile)
+				if template, err := os.ReadFile(templatePath); err == nil {
+					configFile.Values = templateValues(string(template), configFile.AtOnly)
 				}
-				r.SetAttr("cmake_source_files", sourceFiles)
-				
-				// Always set defines attribute (even if empty for backward compatibility with tests)
-				r.SetAttr("defines", configFile.Variables)
-				r.SetPrivateAttr("cmake_configure_output", configFile.OutputFile)
-				
-				res.Gen = append(res.Gen, r)
-				log.Printf("Generated cmake_configure_file %s: %s -> %s with defines: %v",
-					r.Name(), configFile.InputFile, configFile.OutputFile, configFile.Variables)
+				model.ConfigureFiles = append(model.ConfigureFiles, configFile)
+			}
+		case "file": // file() subcommands the interpreter leaves to targets, such as file(CONFIGURE)
+			if targetName != "CONFIGURE" {
+				return
+			}
+			if configFile, ok := ParseFileConfigure(cmdArgs[1:]); ok {
+				configFile.OutputFile = interp.packageOutputPath(configFile.OutputFile)
+				configFile.Name = strings.ReplaceAll(strings.ReplaceAll(configFile.OutputFile, ".", "_"), "/", "_")
+				configFile.Values = templateValues(configFile.Content, configFile.AtOnly)
+				model.ConfigureFiles = append(model.ConfigureFiles, configFile)
+			}
+		}
+	}
+
+	interp = newCMakeInterpreter(cmakeFilePath, defines, handleCommand)
+	interp.hasTarget = func(name string) bool {
+		_, ok := targets[name]
+		return ok
+	}
+	interp.run(commands)
+	for k, v := range interp.scope.vars {
+		model.Variables[k] = v
+	}
+
+	// Items linked by name that are not targets of this file are system
+	// libraries or linker flags, unless they look like targets defined elsewhere
+	classifyLinkItems := func(target *CMakeTarget) {
+		var linkedLibraries []string
+		for _, linkedLib := range target.LinkedLibraries {
+			if _, exists := targets[linkedLib]; exists || !ClassifyLinkItem(target, linkedLib) {
+				linkedLibraries = append(linkedLibraries, linkedLib)
+			}
+		}
+		target.LinkedLibraries = linkedLibraries
+	}
+	for _, target := range targets {
+		classifyLinkItems(target)
+		for _, values := range target.ConfigValues {
+			modeTarget := &CMakeTarget{LinkedLibraries: values.LinkedLibraries}
+			classifyLinkItems(modeTarget)
+			values.LinkedLibraries = modeTarget.LinkedLibraries
+			values.SystemLibraries = modeTarget.SystemLibraries
+			values.LinkOptions = modeTarget.LinkOptions
+		}
+	}
+
+	propagateCompileOptions(targets)
+
+	// Attach tests to the executables they run
+	for _, test := range tests {
+		if target, ok := targets[testExecutables[test]]; ok && target.Type == "executable" {
+			target.Tests = append(target.Tests, *test)
+		} else {
+			log.Printf("Test %s does not run an executable target of this project, skipping.", test.Name)
+		}
+	}
+
+	for _, target := range targets {
+		AttachGlobs(target, interp.globs)
+	}
+
+	return model, nil
+}
+
+// addScopedValue adds a value to a list of a target and records its scope in
+// the list of the target's private values
+func addScopedValue(list, private *[]string, scope, value string) {
+	existed := fileExists(value, *list)
+	*list = appendIfMissing(*list, value)
+	*private = updateScope(*private, value, isPrivateScope(scope), existed)
+}
+
+// addIncludeDirectory adds an include directory of a target with the given
+// scope for a compilation mode, or for all modes if mode is ""
+func addIncludeDirectory(target *CMakeTarget, mode, scope, dir string) {
+	list := &target.IncludeDirectories
+	if mode != "" {
+		list = &target.configValues(mode).IncludeDirectories
+	}
+	addScopedValue(list, &target.PrivateIncludeDirectories, scope, dir)
+}
+
+// addCompileDefinition adds a preprocessor definition of a target with the
+// given scope for a compilation mode, or for all modes if mode is ""
+func addCompileDefinition(target *CMakeTarget, mode, scope, define string) {
+	if define == "" {
+		return
+	}
+	list := &target.CompileDefinitions
+	if mode != "" {
+		list = &target.configValues(mode).CompileDefinitions
+	}
+	addScopedValue(list, &target.PrivateCompileDefinitions, scope, define)
+}
+
+// addCompileOption adds a compiler flag of a target with the given scope for
+// a compilation mode, or for all modes if mode is ""
+func addCompileOption(target *CMakeTarget, mode, scope, option string) {
+	list := &target.CompileOptions
+	if mode != "" {
+		list = &target.configValues(mode).CompileOptions
+	}
+	addScopedValue(list, &target.PrivateCompileOptions, scope, option)
+}
+
+// addLinkedLibrary adds an item linked by a target with the given scope for a
+// compilation mode, or for all modes if mode is ""
+func addLinkedLibrary(target *CMakeTarget, mode, scope, linkedLib string) {
+	list := &target.LinkedLibraries
+	if mode != "" {
+		list = &target.configValues(mode).LinkedLibraries
+	}
+	addScopedValue(list, &target.PrivateLinkedLibraries, scope, linkedLib)
+}
+
+// linkItem returns the item linked by args[i] of link_libraries() or
+// target_link_libraries() and the index of its last argument. The item after
+// debug or optimized is only linked in that configuration, and a -framework
+// flag is kept with the name of the framework after it.
+func linkItem(args []string, i int) (string, int) {
+	if args[i] == "-framework" && i+1 < len(args) {
+		return args[i] + " " + args[i+1], i + 1
+	}
+	keyword := strings.ToLower(args[i])
+	if (keyword != "debug" && keyword != "optimized" && keyword != "general") || i+1 >= len(args) {
+		return args[i], i
+	}
+	switch item := args[i+1]; keyword {
+	case "debug":
+		return "$<$<CONFIG:Debug>:" + item + ">", i + 1
+	case "optimized":
+		return "$<$<NOT:$<CONFIG:Debug>>:" + item + ">", i + 1
+	default:
+		return item, i + 1
+	}
+}
+
+// targetLanguages returns the languages of the sources of a target, for
+// $<COMPILE_LANGUAGE>. Targets without sources are taken to use C and C++.
+func targetLanguages(target *CMakeTarget) []string {
+	var languages []string
+	for _, src := range target.Sources {
+		if strings.ToLower(filepath.Ext(src)) == ".c" {
+			languages = appendIfMissing(languages, "C")
+		} else {
+			languages = appendIfMissing(languages, "CXX")
+		}
+	}
+	if len(languages) == 0 {
+		return []string{"C", "CXX"}
+	}
+	return languages
+}
+
+// targetProperty returns a property of a target for $<TARGET_PROPERTY>.
+// Paths are made absolute again using the directory of the package, since
+// the expression may be evaluated for a target in another directory. Usage
+// requirements are not told apart from the target's own settings.
+func targetProperty(target *CMakeTarget, property, packageDir string) (string, bool) {
+	absolute := func(paths []string) string {
+		var result []string
+		for _, p := range paths {
+			if !filepath.IsAbs(p) {
+				p = filepath.ToSlash(filepath.Join(packageDir, p))
 			}
+			result = append(result, p)
+		}
+		return strings.Join(result, ";")
+	}
+	switch strings.TrimPrefix(property, "INTERFACE_") {
+	case "NAME":
+		return target.Name, true
+	case "TYPE":
+		switch {
+		case target.Type == "executable":
+			return "EXECUTABLE", true
+		case target.Type == "interface":
+			return "INTERFACE_LIBRARY", true
+		case target.LibraryType != "":
+			return target.LibraryType + "_LIBRARY", true
+		}
+		return "STATIC_LIBRARY", true
+	case "OUTPUT_NAME":
+		return target.OutputName, target.OutputName != ""
+	case "VERSION":
+		return target.Version, target.Version != ""
+	case "SOVERSION":
+		return target.SOVersion, target.SOVersion != ""
+	case "SOURCES":
+		return absolute(append(append([]string{}, target.Sources...), target.Headers...)), true
+	case "INCLUDE_DIRECTORIES":
+		return absolute(target.IncludeDirectories), true
+	case "COMPILE_DEFINITIONS":
+		return strings.Join(target.CompileDefinitions, ";"), true
+	case "COMPILE_OPTIONS":
+		return strings.Join(target.CompileOptions, ";"), true
+	case "LINK_LIBRARIES":
+		return strings.Join(target.LinkedLibraries, ";"), true
+	}
+	log.Printf("Unsupported property %s in $<TARGET_PROPERTY:%s,%s>, ignoring it.", property, target.Name, property)
+	return "", false
+}
+
+// parseTargetProperties applies set_target_properties() style PROPERTIES
+// key/value pairs to a target
+func parseTargetProperties(target *CMakeTarget, props []string) {
+	for i := 0; i+1 < len(props); i += 2 {
+		key, value := strings.ToUpper(props[i]), props[i+1]
+		switch key {
+		case "OUTPUT_NAME":
+			target.OutputName = value
+		case "VERSION":
+			target.Version = value
+		case "SOVERSION":
+			target.SOVersion = value
 		}
 	}
+}
+
+// generateRulesFromCMakeFile attempts to parse a CMakeLists.txt file and extract target information.
+func generateRulesFromCMakeFile(args language.GenerateArgs, cmakeFilePath string, cfg *CMakeConfig) language.GenerateResult {
+	res := language.GenerateResult{}
+
+	log.Printf("Parsing CMakeLists.txt: %s (Rel: %s)", cmakeFilePath, args.Rel)
+	model, err := ParseCMakeListsWithDefines(cmakeFilePath, cfg.CMakeDefines)
+	if err != nil {
+		log.Printf("Error reading CMakeLists.txt %s: %v", cmakeFilePath, err)
+		return res
+	}
+	// A CMakeLists.txt without project() in a directory that has no BUILD file
+	// yet belongs to the project of a parent directory, whose package already
+	// holds its targets
+	if args.File == nil && model.Variables["PROJECT_NAME"] == "" && inParentCMakeProject(args) {
+		log.Printf("%s is a subdirectory of a CMake project in a parent package, skipping.", cmakeFilePath)
+		return res
+	}
+	targets := model.Targets
+
+	// Targets declared in a subdirectory that is a package of its own are
+	// generated there from its CMakeLists.txt, and only referenced from here
+	subpackageLabels := make(map[string]string)
+	localTargets := make(map[string]*CMakeTarget)
+	var localNames []string
+	for name, cmTarget := range targets {
+		if subpackage := subpackageOf(args, cmTarget.Directory); subpackage != "" {
+			subpackageLabels[name] = "//" + path.Join(args.Rel, subpackage) + ":" + name
+			continue
+		}
+		localTargets[name] = cmTarget
+		localNames = append(localNames, name)
+	}
+	sort.Strings(localNames)
+
+	for _, configFile := range model.ConfigureFiles {
+		// Only include defines from gazelle directives (not variables discovered by parsing)
+		for k, v := range cfg.CMakeDefines {
+			configFile.Variables[k] = v
+		}
+
+		// Templates are configured without cmake, unless they use the
+		// results of checks
+		if r := configureTemplateRule(args, configFile, model.CheckResults); r != nil {
+			r.SetAttr("out", configFile.OutputFile)
+			r.SetPrivateAttr("cmake_configure_output", configFile.OutputFile)
+			res.Gen = append(res.Gen, r)
+			log.Printf("Generated cmake_configure_template %s: %s -> %s", r.Name(), configFile.InputFile, configFile.OutputFile)
+			continue
+		}
+
+		// Generate cmake_configure_file rule
+		r := rule.NewRule("cmake_configure_file", configFile.Name)
+		r.SetAttr("out", configFile.OutputFile)
+
+		// Set cmake_binary to reference the examples cmake target for examples directory
+		r.SetAttr("cmake_binary", "//:cmake")
+
+		// Set cmake_source_dir to current directory (where CMakeLists.txt is)
+		r.SetAttr("cmake_source_dir", ".")
+
+		// Include CMakeLists.txt and the input template file as sources
+		sourceFiles := []string{"CMakeLists.txt"}
+		if configFile.InputFile != "" && configFile.InputFile != "CMakeLists.txt" {
+			sourceFiles = append(sourceFiles, configFile.InputFile)
+		}
+		r.SetAttr("cmake_source_files", sourceFiles)
+
+		// Always set defines attribute (even if empty for backward compatibility with tests)
+		r.SetAttr("defines", configFile.Variables)
+		r.SetPrivateAttr("cmake_configure_output", configFile.OutputFile)
+
+		res.Gen = append(res.Gen, r)
+		log.Printf("Generated cmake_configure_file %s: %s -> %s with defines: %v",
+			r.Name(), configFile.InputFile, configFile.OutputFile, configFile.Variables)
+	}
+
+	// Custom commands generating files the targets build become genrules.
+	// Their outputs are listed by the targets like files of the package.
+	var packageTargets []*CMakeTarget
+	for _, name := range localNames {
+		packageTargets = append(packageTargets, localTargets[name])
+	}
+	generatedFiles := make(map[string]bool)
+	for _, cmd := range UsedCustomCommands(model.CustomCommands, packageTargets) {
+		if subpackageOf(args, cmd.Directory) != "" {
+			continue
+		}
+		r, err := CustomCommandRule(cmd, CustomCommandRefs{
+			Output: func(file string) string { return file },
+			File:   func(file string) string { return file },
+			Target: func(name string) (string, bool) {
+				if cmTarget, ok := localTargets[name]; ok {
+					return ":" + name, cmTarget.Type == "executable"
+				}
+				if label, ok := subpackageLabels[name]; ok {
+					return label, targets[name].Type == "executable"
+				}
+				return "", false
+			},
+		})
+		if err != nil {
+			log.Printf("Cannot generate a genrule for %s: %v, skipping.", DescribeCustomCommand(cmd), err)
+			continue
+		}
+		for _, output := range cmd.Outputs {
+			generatedFiles[output] = true
+		}
+		res.Gen = append(res.Gen, r)
+		log.Printf("Generated genrule %s in %s for %s", r.Name(), args.Rel, DescribeCustomCommand(cmd))
+	}
+	fileExistsOrGenerated := func(file string) bool {
+		return generatedFiles[file] || packageFileExists(args, file)
+	}
 
 	// Convert CMakeTargets to Gazelle rules
-	for _, cmTarget := range targets {
+	for _, name := range localNames {
+		cmTarget := localTargets[name]
 		var r *rule.Rule
-		if cmTarget.Type == "library" {
+		if cmTarget.Type == "library" || cmTarget.Type == "interface" {
 			r = rule.NewRule("cc_library", cmTarget.Name)
 		} else if cmTarget.Type == "executable" {
 			r = rule.NewRule("cc_binary", cmTarget.Name)
@@ -262,68 +995,186 @@ func generateRulesFromCMakeFile(args language.GenerateArgs, cmakeFilePath string
 			continue
 		}
 
-		// Filter sources/headers against args.RegularFiles (files actually in this directory)
-		// This is a major simplification. CMake sources can be in subdirs.
+		// Filter sources/headers against the files of the package, which
+		// include those of subdirectories declared with add_subdirectory()
 		var finalSrcs, finalHdrs []string
 		for _, s := range cmTarget.Sources {
-			if fileExists(s, args.RegularFiles) {
+			if fileExistsOrGenerated(s) {
 				finalSrcs = append(finalSrcs, s)
 			} else {
-				log.Printf("Source file %s for target %s not found in current directory's regular files, skipping.", s, cmTarget.Name)
+				log.Printf("Source file %s for target %s not found in the package, skipping.", s, cmTarget.Name)
 			}
 		}
 		for _, h := range cmTarget.Headers {
-			if fileExists(h, args.RegularFiles) {
+			if fileExistsOrGenerated(h) {
 				finalHdrs = append(finalHdrs, h)
 			} else {
-				log.Printf("Header file %s for target %s not found in current directory's regular files, skipping.", h, cmTarget.Name)
+				log.Printf("Header file %s for target %s not found in the package, skipping.", h, cmTarget.Name)
 			}
 		}
 
-		if len(finalSrcs) > 0 {
-			r.SetAttr("srcs", finalSrcs)
+		// Files only some compilation modes build
+		modeSrcs := ConfigValuesByMode(cmTarget, func(values *CMakeConfigValues) []string {
+			var srcs []string
+			for _, s := range values.Sources {
+				if fileExistsOrGenerated(s) {
+					srcs = append(srcs, s)
+				} else {
+					log.Printf("Source file %s for target %s not found in the package, skipping.", s, cmTarget.Name)
+				}
+			}
+			return srcs
+		})
+
+		if len(finalSrcs) > 0 || len(modeSrcs) > 0 {
+			SetConfigAttr(r, "srcs", finalSrcs, modeSrcs)
 		}
 		if len(finalHdrs) > 0 {
 			r.SetAttr("hdrs", finalHdrs)
 		}
 
-		// 'copts' from include_directories (very simplified)
-		// A proper version would convert paths and use "includes" or "-I" prefixes.
-		if len(cmTarget.IncludeDirectories) > 0 {
-			var copts []string
-			for _, dir := range cmTarget.IncludeDirectories {
-				// This is a placeholder. Actual mapping of CMake include dirs to Bazel copts/includes is complex.
-				// e.g., if dir is relative "inc", it might become "-Iinc" or "includes = ["inc"]"
-				// For now, just add a placeholder to show it was captured.
-				copts = append(copts, "-I"+dir) // Highly simplified!
+		// Generate deps attribute for locally linked libraries
+		linkAttrs := func(linkedLibraries []string, linkTarget *CMakeTarget) ([]string, []string) {
+			var deps []string
+			for _, linkedLib := range linkedLibraries {
+				// Check if the linked library matches another target in this directory
+				if _, exists := localTargets[linkedLib]; exists {
+					deps = appendIfMissing(deps, ":"+linkedLib) // Use Bazel label syntax for local targets
+				} else if label, ok := subpackageLabels[linkedLib]; ok {
+					deps = appendIfMissing(deps, label)
+				} else if mapped, ok := cfg.ResolveLabel(linkedLib, args.Rel); ok {
+					deps = appendIfMissing(deps, mapped) // Mapped with a cmake_resolve directive
+				}
+			}
+			// System libraries and linker flags, unless mapped to labels by directives
+			linkopts, linkDeps := LinkAttrs(linkTarget, cfg, args.Rel)
+			for _, dep := range linkDeps {
+				deps = appendIfMissing(deps, dep)
 			}
-			if len(copts) > 0 {
-				// r.SetAttr("copts", copts) // Example, might need adjustment based on rules_cc behavior
+			return deps, linkopts
+		}
+		// Libraries linked PRIVATE are implementation_deps of a cc_library,
+		// so that their headers do not reach the targets depending on it
+		privateLibs := cmTarget.PrivateLinkedLibraries
+		if r.Kind() != "cc_library" {
+			privateLibs = nil
+		}
+		publicLibs, ownLibs := SplitByScope(cmTarget.LinkedLibraries, privateLibs)
+		deps, linkopts := linkAttrs(publicLibs, cmTarget)
+		implementationDeps, _ := linkAttrs(ownLibs, &CMakeTarget{})
+		modeDeps := make(map[string][]string)
+		modeImplementationDeps := make(map[string][]string)
+		modeLinkopts := make(map[string][]string)
+		for mode, values := range cmTarget.ConfigValues {
+			publicLibs, ownLibs := SplitByScope(values.LinkedLibraries, privateLibs)
+			modeDeps[mode], modeLinkopts[mode] = linkAttrs(publicLibs, &CMakeTarget{
+				SystemLibraries: values.SystemLibraries,
+				LinkOptions:     values.LinkOptions,
+			})
+			modeImplementationDeps[mode], _ = linkAttrs(ownLibs, &CMakeTarget{})
+		}
+		setAttr := func(key string, values []string, byMode map[string][]string) {
+			for mode, list := range byMode {
+				if len(list) == 0 {
+					delete(byMode, mode)
+				}
+			}
+			if len(values) > 0 || len(byMode) > 0 {
+				SetConfigAttr(r, key, values, byMode)
 			}
 		}
+		setAttr("deps", deps, modeDeps)
+		setAttr("implementation_deps", implementationDeps, modeImplementationDeps)
+		setAttr("linkopts", linkopts, modeLinkopts)
 
-		// Generate deps attribute for locally linked libraries
-		var deps []string
-		for _, linkedLib := range cmTarget.LinkedLibraries {
-			// Check if the linked library matches another target in this directory
-			if _, exists := targets[linkedLib]; exists {
-				deps = append(deps, ":"+linkedLib) // Use Bazel label syntax for local targets
+		// Propagated include directories become includes. The ones only the
+		// target itself uses are passed with -I relative to the execution root.
+		normalizeIncludes := func(dirs []string) []string {
+			var includes []string
+			for _, dir := range dirs {
+				if includeDir, ok := NormalizeIncludeDirectory(dir); ok {
+					includes = appendIfMissing(includes, includeDir)
+				}
+			}
+			return includes
+		}
+		privateIncludeCopts := func(dirs []string) []string {
+			var copts []string
+			for _, dir := range normalizeIncludes(dirs) {
+				copts = append(copts, "-I"+path.Join(args.Rel, dir))
 			}
+			return copts
 		}
-		if len(deps) > 0 {
-			r.SetAttr("deps", deps)
+		publicDirs, ownDirs := SplitByScope(cmTarget.IncludeDirectories, cmTarget.PrivateIncludeDirectories)
+		modePublicDirs, modeOwnDirs := SplitModesByScope(ConfigValuesByMode(cmTarget, func(values *CMakeConfigValues) []string {
+			return values.IncludeDirectories
+		}), cmTarget.PrivateIncludeDirectories)
+		modeIncludes := make(map[string][]string)
+		for mode, dirs := range modePublicDirs {
+			modeIncludes[mode] = normalizeIncludes(dirs)
+		}
+		setAttr("includes", normalizeIncludes(publicDirs), modeIncludes)
+
+		// Propagated definitions of a library become defines, the others
+		// local_defines. An INTERFACE library only carries usage requirements.
+		privateDefines := cmTarget.PrivateCompileDefinitions
+		if r.Kind() != "cc_library" {
+			privateDefines = cmTarget.CompileDefinitions
+			for _, values := range cmTarget.ConfigValues {
+				privateDefines = append(privateDefines, values.CompileDefinitions...)
+			}
+		}
+		publicDefines, ownDefines := SplitByScope(cmTarget.CompileDefinitions, privateDefines)
+		modePublicDefines, modeOwnDefines := SplitModesByScope(ConfigValuesByMode(cmTarget, func(values *CMakeConfigValues) []string {
+			return values.CompileDefinitions
+		}), privateDefines)
+		setAttr("defines", publicDefines, modePublicDefines)
+		if cmTarget.Type != "interface" {
+			setAttr("local_defines", ownDefines, modeOwnDefines)
+
+			copts := append(privateIncludeCopts(ownDirs), cmTarget.CompileOptions...)
+			modeCopts := make(map[string][]string)
+			for mode, dirs := range modeOwnDirs {
+				modeCopts[mode] = privateIncludeCopts(dirs)
+			}
+			for mode, values := range cmTarget.ConfigValues {
+				modeCopts[mode] = append(modeCopts[mode], values.CompileOptions...)
+			}
+			setAttr("copts", copts, modeCopts)
 		}
 
 		// Store linked libraries for dependency resolution (external libraries, includes, etc.)
 		if len(cmTarget.LinkedLibraries) > 0 {
 			r.SetPrivateAttr("cmake_linked_libraries", cmTarget.LinkedLibraries)
 		}
-		if len(cmTarget.IncludeDirectories) > 0 {
-			r.SetPrivateAttr("cmake_include_directories", cmTarget.IncludeDirectories)
+		// Consumers only reach headers through the propagated include directories
+		if len(publicDirs) > 0 {
+			r.SetPrivateAttr("cmake_include_directories", publicDirs)
+		}
+		scanned := append(finalSrcs, finalHdrs...)
+		for _, mode := range CompilationModes {
+			scanned = append(scanned, modeSrcs[mode]...)
 		}
+		r.SetPrivateAttr("cmake_includes", ScanIncludes(args.Dir, scanned))
 
-		if r.Attr("srcs") != nil || r.Attr("hdrs") != nil { // Only add rule if it has sources/headers
-			res.Gen = append(res.Gen, r)
+		// Only add rule if it has sources/headers. Interface libraries are kept
+		// regardless, since consumers depend on them for includes and defines.
+		if r.Attr("srcs") != nil || r.Attr("hdrs") != nil || cmTarget.Type == "interface" {
+			// Shared libraries of this directory are linked dynamically, like CMake does
+			dynamicDeps := DynamicDeps(cmTarget, localTargets)
+			var rules []*rule.Rule
+			if cmTarget.Type == "executable" {
+				if len(dynamicDeps) > 0 {
+					r.SetAttr("dynamic_deps", dynamicDeps)
+				}
+				rules = TestRules(r, cmTarget.Tests)
+			} else {
+				rules = LibraryRules(r, cmTarget, dynamicDeps)
+			}
+			if cfg.PreserveGlobs {
+				PreserveGlobs(rules, cmTarget.Globs)
+			}
+			res.Gen = append(res.Gen, rules...)
 			// Don't add empty rules for now to fix deps generation
 			// res.Empty = append(res.Empty, rule.NewRule(r.Kind(), r.Name()))
 			log.Printf("Generated %s %s in %s with srcs: %v, hdrs: %v, includes: %v, links: %v",
@@ -335,13 +1186,39 @@ func generateRulesFromCMakeFile(args language.GenerateArgs, cmakeFilePath string
 
 	// Note: cmake_configure_file rule generation moved to CMake File API approach in language/cmake.go
 
-	// Gazelle expects Imports to have the same length as Gen. Populate with nils for now.
-	if len(res.Gen) > 0 && len(res.Imports) == 0 {
-		res.Imports = make([]interface{}, len(res.Gen))
+	// Gazelle expects Imports to have the same length as Gen
+	res.Imports = make([]interface{}, len(res.Gen))
+	for i, r := range res.Gen {
+		res.Imports[i] = r.PrivateAttr("cmake_includes")
 	}
 	return res
 }
 
+// configureTemplateRule returns the cmake_configure_template rule for a
+// configure file of the fallback parser, with its src or content set, or nil
+// if it needs to be configured by cmake
+func configureTemplateRule(args language.GenerateArgs, configFile *CMakeConfigureFile, checkResults map[string]bool) *rule.Rule {
+	template := configFile.Content
+	if configFile.InputFile != "" {
+		data, err := os.ReadFile(filepath.Join(args.Dir, configFile.InputFile))
+		if err != nil || configFile.Values == nil {
+			return nil
+		}
+		template = string(data)
+	}
+	r, reason := ConfigureTemplateRule(configFile, template, configFile.Values, checkResults, []string{args.Dir})
+	if r == nil {
+		log.Printf("Template of %s uses %s, configuring it with cmake.", configFile.OutputFile, reason)
+		return nil
+	}
+	if configFile.InputFile != "" {
+		r.SetAttr("src", configFile.InputFile)
+	} else {
+		r.SetAttr("content", configFile.Content)
+	}
+	return r
+}
+
 // GenerateRules is the main GenerateRules function (updated to use CMake File API)
 func GenerateRules(args language.GenerateArgs) language.GenerateResult {
 	return GenerateRulesWithDefines(args, make(map[string]string))
@@ -357,12 +1234,18 @@ func GenerateRulesWithDefines(args language.GenerateArgs, packageDefines map[str
 		return language.GenerateResult{}
 	}
 
+	// The cmake_build_type directive stands for a -DCMAKE_BUILD_TYPE
+	packageDefines = WithBuildType(packageDefines, cfg.BuildType)
+
 	// Create a modified config with package-scoped defines
 	packageCfg := &CMakeConfig{
-		CMakeExecutable: cfg.CMakeExecutable,
-		CMakeDefines:    packageDefines,
+		CMakeExecutable:  cfg.CMakeExecutable,
+		CMakeDefines:     packageDefines,
+		ResolveMappings:  cfg.ResolveMappings,
+		LinkoptsMappings: cfg.LinkoptsMappings,
+		PreserveGlobs:    cfg.PreserveGlobs,
 	}
 
-	// Use regex-based parsing (fallback method)
+	// Parse the CMakeLists.txt directly (fallback method)
 	return generateRulesFromCMakeFile(args, cmakeFilePath, packageCfg)
-}
\ No newline at end of file
+}
@@ -0,0 +1,511 @@
+package common
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// CompilationModes are the Bazel compilation modes that values depending on
+// the build configuration are selected on
+var CompilationModes = []string{"dbg", "fastbuild", "opt"}
+
+// CompilationModeCondition returns the label of the config_setting matching a
+// compilation mode
+func CompilationModeCondition(mode string) string {
+	return "@gazelle-foreign-cc//conditions:" + mode
+}
+
+// CompilationModeConfigs returns the CMake build configuration generator
+// expressions are evaluated for in each compilation mode. fastbuild stands for
+// a build with the default CMAKE_BUILD_TYPE.
+func CompilationModeConfigs(buildType string) map[string]string {
+	return map[string]string{
+		"dbg":       "Debug",
+		"fastbuild": buildType,
+		"opt":       "Release",
+	}
+}
+
+// WithBuildType returns defines with CMAKE_BUILD_TYPE set to buildType, unless
+// buildType is empty or defines set it already
+func WithBuildType(defines map[string]string, buildType string) map[string]string {
+	if _, ok := defines["CMAKE_BUILD_TYPE"]; ok || buildType == "" {
+		return defines
+	}
+	result := make(map[string]string, len(defines)+1)
+	for key, value := range defines {
+		result[key] = value
+	}
+	result["CMAKE_BUILD_TYPE"] = buildType
+	return result
+}
+
+// maxGenexDepth bounds the nesting of generator expressions, including the
+// ones found in target properties that $<TARGET_PROPERTY> evaluates
+const maxGenexDepth = 100
+
+// GenexContext is what generator expressions are evaluated against
+type GenexContext struct {
+	Config    string   // Build configuration, e.g. "Debug"
+	Platform  string   // PLATFORM_ID, "Linux" if empty
+	Languages []string // Languages of the sources the value applies to, e.g. "CXX"
+	Target    string   // Target the value belongs to
+	// TargetProperty returns a property of a target, for $<TARGET_PROPERTY>
+	TargetProperty func(target, property string) (string, bool)
+	// TargetObjects collects the targets $<TARGET_OBJECTS> referred to. Their
+	// objects are linked by depending on them instead.
+	TargetObjects []string
+
+	depth int
+}
+
+// HasGenex reports whether a value contains a generator expression
+func HasGenex(value string) bool {
+	return strings.Contains(value, "$<")
+}
+
+// genexEnd returns the index of the ">" closing the generator expression
+// starting at start, or -1 if it is not closed
+func genexEnd(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "$<"):
+			depth++
+			i++
+		case s[i] == '>':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitGenex splits s at the separator outside of nested generator expressions
+func splitGenex(s string, sep byte, n int) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s) && (n < 0 || len(parts) < n-1); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "$<"):
+			depth++
+			i++
+		case s[i] == '>' && depth > 0:
+			depth--
+		case s[i] == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Evaluate replaces the generator expressions in s by their values.
+// Unsupported expressions evaluate to nothing.
+func (ctx *GenexContext) Evaluate(s string) string {
+	if !HasGenex(s) {
+		return s
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		if !strings.HasPrefix(s[i:], "$<") {
+			out.WriteByte(s[i])
+			i++
+			continue
+		}
+		end := genexEnd(s, i)
+		if end < 0 {
+			log.Printf("Unterminated generator expression in %q, keeping it as is.", s)
+			out.WriteString(s[i:])
+			break
+		}
+		out.WriteString(ctx.evaluateExpression(s[i+2 : end]))
+		i = end + 1
+	}
+	return out.String()
+}
+
+func genexBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// evaluateExpression evaluates the content of $<...>. Arguments are only
+// evaluated when needed, so that a false condition has no side effects.
+func (ctx *GenexContext) evaluateExpression(content string) string {
+	if ctx.depth >= maxGenexDepth {
+		log.Printf("Generator expressions nested deeper than %d, ignoring $<%s>.", maxGenexDepth, content)
+		return ""
+	}
+	ctx.depth++
+	defer func() { ctx.depth-- }()
+
+	parts := splitGenex(content, ':', 2)
+	name := ctx.Evaluate(parts[0])
+	hasArgs := len(parts) == 2
+	rawArgs := ""
+	if hasArgs {
+		rawArgs = parts[1]
+	}
+	args := func() []string {
+		var values []string
+		for _, arg := range splitGenex(rawArgs, ',', -1) {
+			values = append(values, ctx.Evaluate(arg))
+		}
+		return values
+	}
+	// matches reports whether value is one of the comma separated arguments
+	matches := func(value string, fold bool) bool {
+		for _, arg := range args() {
+			if arg == value || (fold && strings.EqualFold(arg, value)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch name {
+	case "0":
+		return ""
+	case "1":
+		return ctx.Evaluate(rawArgs)
+	case "BOOL":
+		return genexBool(!isFalseConstant(ctx.Evaluate(rawArgs)))
+	case "NOT":
+		return genexBool(ctx.Evaluate(rawArgs) == "0")
+	case "AND":
+		for _, arg := range splitGenex(rawArgs, ',', -1) {
+			if ctx.Evaluate(arg) != "1" {
+				return "0"
+			}
+		}
+		return "1"
+	case "OR":
+		for _, arg := range splitGenex(rawArgs, ',', -1) {
+			if ctx.Evaluate(arg) == "1" {
+				return "1"
+			}
+		}
+		return "0"
+	case "IF":
+		parts := splitGenex(rawArgs, ',', 3)
+		if len(parts) != 3 {
+			log.Printf("$<IF> needs 3 arguments, got %d.", len(parts))
+			return ""
+		}
+		if ctx.Evaluate(parts[0]) == "1" {
+			return ctx.Evaluate(parts[1])
+		}
+		return ctx.Evaluate(parts[2])
+	case "STREQUAL", "EQUAL":
+		values := args()
+		if len(values) != 2 {
+			return "0"
+		}
+		if name == "EQUAL" {
+			x, errX := strconv.ParseFloat(values[0], 64)
+			y, errY := strconv.ParseFloat(values[1], 64)
+			return genexBool(errX == nil && errY == nil && x == y)
+		}
+		return genexBool(values[0] == values[1])
+	case "IN_LIST":
+		values := args()
+		if len(values) != 2 {
+			return "0"
+		}
+		for _, element := range cmakeListElements(values[1]) {
+			if element == values[0] {
+				return "1"
+			}
+		}
+		return "0"
+	case "CONFIG":
+		if !hasArgs {
+			return ctx.Config
+		}
+		return genexBool(matches(ctx.Config, true))
+	case "PLATFORM_ID":
+		platform := ctx.Platform
+		if platform == "" {
+			platform = "Linux"
+		}
+		if !hasArgs {
+			return platform
+		}
+		return genexBool(matches(platform, false))
+	case "COMPILE_LANGUAGE":
+		if !hasArgs {
+			if len(ctx.Languages) == 1 {
+				return ctx.Languages[0]
+			}
+			return ""
+		}
+		for _, language := range ctx.Languages {
+			if matches(language, false) {
+				return "1"
+			}
+		}
+		return "0"
+	case "BUILD_INTERFACE", "BUILD_LOCAL_INTERFACE", "LINK_ONLY", "COMPILE_ONLY":
+		return ctx.Evaluate(rawArgs)
+	case "INSTALL_INTERFACE", "INSTALL_PREFIX":
+		return ""
+	case "TARGET_OBJECTS":
+		if target := ctx.Evaluate(rawArgs); target != "" {
+			ctx.TargetObjects = appendIfMissing(ctx.TargetObjects, target)
+		}
+		return ""
+	case "TARGET_PROPERTY":
+		values := args()
+		target, property := ctx.Target, ""
+		switch len(values) {
+		case 1:
+			property = values[0]
+		case 2:
+			target, property = values[0], values[1]
+		default:
+			log.Printf("$<TARGET_PROPERTY> needs 1 or 2 arguments, got %d.", len(values))
+			return ""
+		}
+		if ctx.TargetProperty == nil {
+			return ""
+		}
+		value, ok := ctx.TargetProperty(target, property)
+		if !ok {
+			return ""
+		}
+		// Properties may hold generator expressions themselves, which apply to
+		// the target that has the property
+		saved := ctx.Target
+		ctx.Target = target
+		value = ctx.Evaluate(value)
+		ctx.Target = saved
+		return value
+	case "TARGET_NAME":
+		return ctx.Evaluate(rawArgs)
+	case "LOWER_CASE":
+		return strings.ToLower(ctx.Evaluate(rawArgs))
+	case "UPPER_CASE":
+		return strings.ToUpper(ctx.Evaluate(rawArgs))
+	case "ANGLE-R":
+		return ">"
+	case "COMMA":
+		return ","
+	case "SEMICOLON":
+		return ";"
+	}
+	log.Printf("Unsupported generator expression $<%s>, ignoring it.", content)
+	return ""
+}
+
+// EvaluateForModes evaluates the generator expressions of values once for
+// each compilation mode, splitting the results into list elements and
+// dropping empty ones. newContext returns the context of a mode.
+func EvaluateForModes(values []string, newContext func(mode string) *GenexContext) map[string][]string {
+	byMode := make(map[string][]string)
+	for _, mode := range CompilationModes {
+		ctx := newContext(mode)
+		for _, value := range values {
+			for _, element := range SplitCMakeList(ctx.Evaluate(value)) {
+				if element != "" {
+					byMode[mode] = append(byMode[mode], element)
+				}
+			}
+		}
+	}
+	return byMode
+}
+
+// SplitByMode separates the values of every compilation mode into those all
+// modes have, in order, and those only some have. The map is nil if every
+// value applies to all modes.
+func SplitByMode(byMode map[string][]string) ([]string, map[string][]string) {
+	count := make(map[string]int)
+	for _, mode := range CompilationModes {
+		seen := make(map[string]bool)
+		for _, value := range byMode[mode] {
+			if !seen[value] {
+				seen[value] = true
+				count[value]++
+			}
+		}
+	}
+
+	var common []string
+	var specific map[string][]string
+	for _, mode := range CompilationModes {
+		for _, value := range byMode[mode] {
+			if count[value] == len(CompilationModes) {
+				if mode == CompilationModes[0] {
+					common = appendIfMissing(common, value)
+				}
+				continue
+			}
+			if specific == nil {
+				specific = make(map[string][]string)
+			}
+			specific[mode] = appendIfMissing(specific[mode], value)
+		}
+	}
+	return common, specific
+}
+
+// configValues returns the values of a target for a compilation mode,
+// creating them if needed
+func (cmTarget *CMakeTarget) configValues(mode string) *CMakeConfigValues {
+	if cmTarget.ConfigValues == nil {
+		cmTarget.ConfigValues = make(map[string]*CMakeConfigValues)
+	}
+	values, ok := cmTarget.ConfigValues[mode]
+	if !ok {
+		values = &CMakeConfigValues{}
+		cmTarget.ConfigValues[mode] = values
+	}
+	return values
+}
+
+// SplitConfigurations keeps the sources, headers, definitions and compile
+// options a target has in every compilation mode, and moves the others to
+// its ConfigValues. byMode holds the target as configured for each mode, like
+// the build configurations of a multi-config generator. The compile groups of
+// the target lose the values that are not in every mode too. Headers only
+// some modes have become sources, which may hold headers.
+func SplitConfigurations(cmTarget *CMakeTarget, byMode map[string]*CMakeTarget) {
+	split := func(field func(*CMakeTarget) []string) ([]string, map[string][]string) {
+		values := make(map[string][]string)
+		differ := false
+		for _, mode := range CompilationModes {
+			values[mode] = field(cmTarget)
+			if modeTarget, ok := byMode[mode]; ok {
+				values[mode] = field(modeTarget)
+			}
+			differ = differ || strings.Join(values[mode], "\x00") != strings.Join(field(cmTarget), "\x00")
+		}
+		if !differ {
+			return field(cmTarget), nil
+		}
+		return SplitByMode(values)
+	}
+	// The values only some modes have, which the compile groups drop
+	specificValues := make(map[string]bool)
+	record := func(values []string, specific map[string][]string) []string {
+		for _, list := range specific {
+			for _, value := range list {
+				specificValues[value] = true
+			}
+		}
+		return values
+	}
+
+	sources, modeSources := split(func(t *CMakeTarget) []string { return t.Sources })
+	headers, modeHeaders := split(func(t *CMakeTarget) []string { return t.Headers })
+	defines, modeDefines := split(func(t *CMakeTarget) []string { return t.CompileDefinitions })
+	options, modeOptions := split(func(t *CMakeTarget) []string { return t.CompileOptions })
+	cmTarget.Sources = record(sources, modeSources)
+	cmTarget.Headers = record(headers, modeHeaders)
+	cmTarget.CompileDefinitions = record(defines, modeDefines)
+	cmTarget.CompileOptions = record(options, modeOptions)
+	for _, mode := range CompilationModes {
+		if len(modeSources[mode])+len(modeHeaders[mode])+len(modeDefines[mode])+len(modeOptions[mode]) == 0 {
+			continue
+		}
+		values := cmTarget.configValues(mode)
+		values.Sources = append(append(values.Sources, modeSources[mode]...), modeHeaders[mode]...)
+		values.CompileDefinitions = append(values.CompileDefinitions, modeDefines[mode]...)
+		values.CompileOptions = append(values.CompileOptions, modeOptions[mode]...)
+	}
+
+	if len(specificValues) == 0 {
+		return
+	}
+	without := func(values []string) []string {
+		var result []string
+		for _, value := range values {
+			if !specificValues[value] {
+				result = append(result, value)
+			}
+		}
+		return result
+	}
+	for i := range cmTarget.CompileGroups {
+		group := &cmTarget.CompileGroups[i]
+		group.Sources = without(group.Sources)
+		group.CompileDefinitions = without(group.CompileDefinitions)
+		group.CompileOptions = without(group.CompileOptions)
+	}
+}
+
+// ConfigValuesByMode collects one field of the config-dependent values of a
+// target, by compilation mode
+func ConfigValuesByMode(cmTarget *CMakeTarget, field func(*CMakeConfigValues) []string) map[string][]string {
+	var byMode map[string][]string
+	for mode, values := range cmTarget.ConfigValues {
+		if list := field(values); len(list) > 0 {
+			if byMode == nil {
+				byMode = make(map[string][]string)
+			}
+			byMode[mode] = list
+		}
+	}
+	return byMode
+}
+
+// ConfigSelect is the value of an attribute whose values partly depend on the
+// compilation mode: a list followed by a select() on the mode
+type ConfigSelect struct {
+	Values []string
+	ByMode map[string][]string
+}
+
+var _ rule.Merger = ConfigSelect{}
+
+func (s ConfigSelect) BzlExpr() bzl.Expr {
+	selectValue := make(rule.SelectStringListValue)
+	for _, mode := range CompilationModes {
+		selectValue[CompilationModeCondition(mode)] = append([]string{}, s.ByMode[mode]...)
+	}
+	if len(s.Values) == 0 {
+		return selectValue.BzlExpr()
+	}
+	return &bzl.BinaryExpr{X: rule.ExprFromValue(s.Values), Op: "+", Y: selectValue.BzlExpr()}
+}
+
+// Merge replaces the existing value, since the select() is regenerated as a whole
+func (s ConfigSelect) Merge(other bzl.Expr) bzl.Expr {
+	return s.BzlExpr()
+}
+
+// configSelectAttr is the private attribute holding the ConfigSelect an
+// attribute was set to
+func configSelectAttr(key string) string {
+	return "cmake_select_" + key
+}
+
+// SetConfigAttr sets an attribute to values, followed by a select() on the
+// compilation mode for the values in byMode, if any
+func SetConfigAttr(r *rule.Rule, key string, values []string, byMode map[string][]string) {
+	if len(byMode) == 0 {
+		r.SetAttr(key, values)
+		r.SetPrivateAttr(configSelectAttr(key), nil)
+		return
+	}
+	value := ConfigSelect{Values: values, ByMode: byMode}
+	r.SetAttr(key, value)
+	r.SetPrivateAttr(configSelectAttr(key), value)
+}
+
+// ConfigAttr returns the values of an attribute that apply to every
+// compilation mode and, by mode, the ones SetConfigAttr put in a select()
+func ConfigAttr(r *rule.Rule, key string) ([]string, map[string][]string) {
+	if value, ok := r.PrivateAttr(configSelectAttr(key)).(ConfigSelect); ok {
+		return append([]string{}, value.Values...), value.ByMode
+	}
+	return r.AttrStrings(key), nil
+}
@@ -0,0 +1,336 @@
+package common
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// auxSourceExtensions are the extensions of the files aux_source_directory()
+// collects: the sources of the C and C++ languages
+var auxSourceExtensions = map[string]bool{
+	".c": true, ".C": true, ".c++": true, ".cc": true, ".cpp": true, ".cxx": true,
+}
+
+// fileCommand handles the file() subcommands the fallback understands
+func (in *cmakeInterpreter) fileCommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	switch args[0] {
+	case "GLOB":
+		in.fileGlob(args[1:], false)
+	case "GLOB_RECURSE":
+		in.fileGlob(args[1:], true)
+	case "CONFIGURE":
+		in.handler("file", args)
+	}
+}
+
+// fileGlob handles file(GLOB|GLOB_RECURSE <variable> [LIST_DIRECTORIES <bool>]
+// [RELATIVE <path>] [CONFIGURE_DEPENDS] [FOLLOW_SYMLINKS] <expressions>...)
+// against the files on disk. Each expression is recorded, so that rules can
+// list the files it matched with glob().
+func (in *cmakeInterpreter) fileGlob(args []string, recurse bool) {
+	if len(args) == 0 {
+		return
+	}
+	variable := args[0]
+	listDirectories := !recurse
+	relative := ""
+	var expressions []string
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "LIST_DIRECTORIES":
+			if i+1 < len(args) {
+				listDirectories = !isFalseConstant(args[i+1])
+				i++
+			}
+		case "RELATIVE":
+			if i+1 < len(args) {
+				relative = args[i+1]
+				i++
+			}
+		case "CONFIGURE_DEPENDS", "FOLLOW_SYMLINKS":
+		default:
+			expressions = append(expressions, args[i])
+		}
+	}
+
+	var matches []string
+	for _, expression := range expressions {
+		if !filepath.IsAbs(expression) {
+			expression = filepath.Join(in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"], expression)
+		}
+		files, dirs := globFiles(expression, recurse, in.binaryDir)
+		glob := CMakeGlob{}
+		glob.Pattern, _ = BazelGlobPattern(in.packagePath(expression), recurse)
+		for _, file := range files {
+			glob.Files = append(glob.Files, in.packagePath(file))
+		}
+		in.globs = append(in.globs, glob)
+
+		matches = append(matches, files...)
+		if listDirectories {
+			matches = append(matches, dirs...)
+		}
+	}
+	sort.Strings(matches)
+
+	var result []string
+	for _, match := range matches {
+		if relative != "" {
+			if rel, err := filepath.Rel(relative, match); err == nil {
+				match = rel
+			}
+		}
+		result = appendIfMissing(result, filepath.ToSlash(match))
+	}
+	in.scope.vars[variable] = strings.Join(result, ";")
+}
+
+// globFiles returns the files and directories matching a CMake globbing
+// expression. A recursive expression matches its last component in every
+// subdirectory of the directories its other components match. Nothing under
+// skipDir, the binary directory of the fallback, is matched.
+func globFiles(expression string, recurse bool, skipDir string) ([]string, []string) {
+	var files, dirs []string
+	add := func(p string, isDir bool) {
+		if p == skipDir || strings.HasPrefix(p, skipDir+string(filepath.Separator)) {
+			return
+		}
+		if isDir {
+			dirs = append(dirs, p)
+		} else {
+			files = append(files, p)
+		}
+	}
+
+	if !recurse {
+		matches, err := filepath.Glob(expression)
+		if err != nil {
+			log.Printf("Invalid file(GLOB) expression %s: %v", expression, err)
+			return nil, nil
+		}
+		for _, match := range matches {
+			add(match, isDirectory(match))
+		}
+		return files, dirs
+	}
+
+	baseDirs, err := filepath.Glob(filepath.Dir(expression))
+	if err != nil {
+		log.Printf("Invalid file(GLOB_RECURSE) expression %s: %v", expression, err)
+		return nil, nil
+	}
+	pattern := filepath.Base(expression)
+	for _, baseDir := range baseDirs {
+		filepath.WalkDir(baseDir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || p == baseDir {
+				return nil
+			}
+			if d.IsDir() && p == skipDir {
+				return filepath.SkipDir
+			}
+			if matched, _ := filepath.Match(pattern, d.Name()); matched {
+				add(p, d.IsDir())
+			}
+			return nil
+		})
+	}
+	return files, dirs
+}
+
+func isDirectory(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+// auxSourceDirectory handles aux_source_directory(<dir> <variable>), which
+// appends the C and C++ sources in a directory to a variable
+func (in *cmakeInterpreter) auxSourceDirectory(args []string) {
+	if len(args) < 2 {
+		return
+	}
+	dir := args[0]
+	absDir := dir
+	if !filepath.IsAbs(absDir) {
+		absDir = filepath.Join(in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"], dir)
+	}
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		log.Printf("aux_source_directory(%s): %v", dir, err)
+		return
+	}
+
+	sources, _ := in.variable(args[1])
+	extensions := make(map[string][]string)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || !auxSourceExtensions[ext] {
+			continue
+		}
+		if sources != "" {
+			sources += ";"
+		}
+		sources += dir + "/" + entry.Name()
+		extensions[ext] = append(extensions[ext], in.packagePath(filepath.Join(absDir, entry.Name())))
+	}
+	in.scope.vars[args[1]] = sources
+
+	// One glob per extension, since a pattern that matches nothing is an
+	// error for Bazel
+	var exts []string
+	for ext := range extensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	for _, ext := range exts {
+		glob := CMakeGlob{Files: extensions[ext]}
+		glob.Pattern, _ = BazelGlobPattern(in.packagePath(filepath.Join(absDir, "*"+ext)), false)
+		in.globs = append(in.globs, glob)
+	}
+}
+
+// BazelGlobPattern converts a CMake globbing expression relative to the
+// package into a Bazel glob pattern. It returns false for expressions Bazel
+// cannot express, such as ones outside of the package or with ? or [...].
+func BazelGlobPattern(expression string, recurse bool) (string, bool) {
+	expression = filepath.ToSlash(expression)
+	if path.IsAbs(expression) || expression == ".." || strings.HasPrefix(expression, "../") ||
+		strings.ContainsAny(expression, "?[]$") || strings.Contains(expression, "**") {
+		return "", false
+	}
+	if recurse {
+		dir, file := path.Split(expression)
+		return dir + "**/" + file, true
+	}
+	return expression, true
+}
+
+// AttachGlobs records on a target the globs whose files it lists
+func AttachGlobs(cmTarget *CMakeTarget, globs []CMakeGlob) {
+	files := make(map[string]bool)
+	for _, f := range append(append([]string{}, cmTarget.Sources...), cmTarget.Headers...) {
+		files[f] = true
+	}
+	for _, glob := range globs {
+		for _, f := range glob.Files {
+			if files[f] {
+				cmTarget.Globs = append(cmTarget.Globs, glob)
+				break
+			}
+		}
+	}
+}
+
+// GlobbedFiles is the value of a srcs or hdrs attribute that lists files
+// through a glob() where CMake found them with file(GLOB), followed by the
+// files it does not match
+type GlobbedFiles struct {
+	Glob  rule.GlobValue
+	Other []string
+}
+
+var _ rule.Merger = GlobbedFiles{}
+
+func (g GlobbedFiles) BzlExpr() bzl.Expr {
+	if len(g.Other) == 0 {
+		return g.Glob.BzlExpr()
+	}
+	return &bzl.BinaryExpr{X: g.Glob.BzlExpr(), Op: "+", Y: rule.ExprFromValue(g.Other)}
+}
+
+// Merge replaces the existing value, since the glob() stands for the files
+// CMake would find
+func (g GlobbedFiles) Merge(other bzl.Expr) bzl.Expr {
+	return g.BzlExpr()
+}
+
+// globbedFilesAttr is the private attribute holding the files of an attribute
+// that PreserveGlobs replaced with a glob()
+func globbedFilesAttr(key string) string {
+	return "cmake_globbed_" + key
+}
+
+// PreserveGlobs replaces the srcs and hdrs of rules generated for a target
+// with glob() calls for the globs of the target, so that files added later are
+// built without running Gazelle again. A glob is only used if the attribute
+// lists every file it matched. Attributes with a select() on the compilation
+// mode are kept as they are.
+func PreserveGlobs(rules []*rule.Rule, globs []CMakeGlob) {
+	for _, r := range rules {
+		for _, key := range []string{"srcs", "hdrs"} {
+			files := r.AttrStrings(key)
+			if len(files) == 0 {
+				continue
+			}
+			if value, ok := globbedFiles(files, globs); ok {
+				r.SetAttr(key, value)
+				r.SetPrivateAttr(globbedFilesAttr(key), files)
+			}
+		}
+	}
+}
+
+func globbedFiles(files []string, globs []CMakeGlob) (GlobbedFiles, bool) {
+	listed := make(map[string]bool)
+	for _, f := range files {
+		listed[f] = true
+	}
+
+	var value GlobbedFiles
+	covered := make(map[string]bool)
+	for _, glob := range globs {
+		if glob.Pattern == "" || len(glob.Files) == 0 {
+			continue
+		}
+		all := true
+		for _, f := range glob.Files {
+			all = all && listed[f]
+		}
+		if !all {
+			continue
+		}
+		value.Glob.Patterns = appendIfMissing(value.Glob.Patterns, glob.Pattern)
+		if strings.Contains(glob.Pattern, "**") {
+			// The binary directory of the fallback is not part of the sources
+			value.Glob.Excludes = appendIfMissing(value.Glob.Excludes, ".cmake-build/**")
+		}
+		for _, f := range glob.Files {
+			covered[f] = true
+		}
+	}
+	if len(value.Glob.Patterns) == 0 {
+		return GlobbedFiles{}, false
+	}
+	sort.Strings(value.Glob.Patterns)
+	for _, f := range files {
+		if !covered[f] {
+			value.Other = append(value.Other, f)
+		}
+	}
+	return value, true
+}
+
+// RuleFiles returns the files of a srcs or hdrs attribute, including the ones
+// PreserveGlobs replaced with a glob() and the ones of every compilation mode
+func RuleFiles(r *rule.Rule, key string) []string {
+	files, byMode := ConfigAttr(r, key)
+	if globbed, ok := r.PrivateAttr(globbedFilesAttr(key)).([]string); ok {
+		files = append([]string{}, globbed...)
+	}
+	for _, mode := range CompilationModes {
+		for _, f := range byMode[mode] {
+			files = appendIfMissing(files, f)
+		}
+	}
+	return files
+}
@@ -0,0 +1,1098 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cmakeScope holds the normal variables of a directory or function call. A new
+// scope starts with a copy of the variables of its parent, like in CMake.
+type cmakeScope struct {
+	vars   map[string]string
+	parent *cmakeScope
+}
+
+func newCMakeScope(parent *cmakeScope) *cmakeScope {
+	scope := &cmakeScope{vars: make(map[string]string), parent: parent}
+	if parent != nil {
+		for k, v := range parent.vars {
+			scope.vars[k] = v
+		}
+	}
+	return scope
+}
+
+// cmakeDirectory holds the properties of a source directory that commands
+// such as include_directories() set for the targets of the directory. A
+// subdirectory starts with a copy of the properties of its parent, like in
+// CMake. Include directories are absolute unless they hold generator
+// expressions.
+type cmakeDirectory struct {
+	includeDirectories []string // include_directories()
+	compileDefinitions []string // add_definitions() and add_compile_definitions()
+	compileOptions     []string // add_compile_options() and flags passed to add_definitions()
+	linkLibraries      []string // link_libraries()
+}
+
+func newCMakeDirectory(parent *cmakeDirectory) *cmakeDirectory {
+	if parent == nil {
+		return &cmakeDirectory{}
+	}
+	return &cmakeDirectory{
+		includeDirectories: append([]string{}, parent.includeDirectories...),
+		compileDefinitions: append([]string{}, parent.compileDefinitions...),
+		compileOptions:     append([]string{}, parent.compileOptions...),
+		linkLibraries:      append([]string{}, parent.linkLibraries...),
+	}
+}
+
+// commandHandler is called for every command the interpreter does not handle
+// itself, with its arguments expanded
+type commandHandler func(name string, args []string)
+
+// controlFlow tells the interpreter to leave the commands it is running
+type controlFlow int
+
+const (
+	flowNormal   controlFlow = iota
+	flowBreak                // break() out of the innermost loop
+	flowContinue             // continue() with the next iteration
+	flowReturn               // return() from the file or function
+)
+
+// maxLoopIterations bounds while() loops whose condition never becomes false
+// because the fallback does not model some command in their body
+const maxLoopIterations = 10000
+
+// maxRecursionDepth bounds nested include() and add_subdirectory() calls and
+// invocations of functions and macros, like CMAKE_MAXIMUM_RECURSION_DEPTH does
+// in CMake
+const maxRecursionDepth = 1000
+
+// fallbackCMakeVersion is the CMake version the fallback reports through
+// CMAKE_VERSION, so that version checks take the code paths of current CMake
+const fallbackCMakeVersion = "3.28.0"
+
+// fallbackPlatformVariables describe the platform rules are generated for.
+// Generated rules target Linux, so platform specific blocks such as if(WIN32)
+// or if(APPLE) are skipped. cmake_define directives override them.
+var fallbackPlatformVariables = map[string]string{
+	"UNIX":                   "1",
+	"LINUX":                  "1",
+	"CMAKE_SYSTEM_NAME":      "Linux",
+	"CMAKE_HOST_UNIX":        "1",
+	"CMAKE_HOST_LINUX":       "1",
+	"CMAKE_HOST_SYSTEM_NAME": "Linux",
+	"CMAKE_SIZEOF_VOID_P":    "8",
+}
+
+// builtinCommands are the commands if(COMMAND ...) reports as defined besides
+// user-defined functions and macros
+var builtinCommands = map[string]bool{
+	"add_compile_definitions": true, "add_compile_options": true, "add_custom_command": true,
+	"add_custom_target": true, "add_definitions": true, "add_dependencies": true,
+	"add_executable": true, "add_library": true, "add_link_options": true,
+	"add_subdirectory": true, "add_test": true, "aux_source_directory": true,
+	"break": true, "cmake_minimum_required": true, "cmake_parse_arguments": true,
+	"cmake_path": true, "cmake_policy": true, "configure_file": true, "continue": true,
+	"enable_language": true, "enable_testing": true, "execute_process": true, "file": true,
+	"find_file": true, "find_library": true, "find_package": true, "find_path": true,
+	"find_program": true, "foreach": true, "function": true, "get_filename_component": true,
+	"get_property": true, "get_target_property": true, "if": true, "include": true,
+	"include_directories": true, "install": true, "link_directories": true,
+	"link_libraries": true, "list": true, "macro": true, "math": true, "message": true,
+	"option": true, "project": true, "return": true, "set": true, "set_property": true,
+	"set_target_properties": true, "set_tests_properties": true, "string": true,
+	"target_compile_definitions": true, "target_compile_features": true,
+	"target_compile_options": true, "target_include_directories": true,
+	"target_link_libraries": true, "target_link_options": true, "target_sources": true,
+	"unset": true, "while": true,
+}
+
+// cmakeInterpreter evaluates the commands of CMake files that affect variables
+// and passes everything else to a commandHandler. It does not run cmake, so it
+// only understands the subset of the language needed to discover targets.
+type cmakeInterpreter struct {
+	sourceDir  string // Top-level source directory, the directory of the package
+	binaryDir  string // Top-level binary directory, which maps onto the package as well
+	scope      *cmakeScope
+	directory  *cmakeDirectory   // Properties of the current source directory
+	cache      map[string]string // Cache entries, seeded from cmake_define directives
+	env        map[string]string // Environment variables set with set(ENV{...})
+	handler    commandHandler
+	hasTarget  func(name string) bool // Answers if(TARGET ...)
+	flow       controlFlow
+	depth      int                     // Number of files and user-defined commands being run
+	activeDirs map[string]bool         // Source directories being run, which add_subdirectory() cannot add again
+	commands   map[string]*userCommand // Functions and macros by lowercase name
+	globs      []CMakeGlob             // Globbing expressions evaluated by file(GLOB) and aux_source_directory()
+}
+
+// newCMakeInterpreter creates an interpreter for the CMakeLists.txt at
+// cmakeFilePath. defines are treated as -D cache entries.
+func newCMakeInterpreter(cmakeFilePath string, defines map[string]string, handler commandHandler) *cmakeInterpreter {
+	in := &cmakeInterpreter{
+		scope:     newCMakeScope(nil),
+		directory: newCMakeDirectory(nil),
+		cache:     make(map[string]string),
+		env:       make(map[string]string),
+		handler:   handler,
+	}
+	for k, v := range defines {
+		in.cache[k] = v
+	}
+
+	sourceDir := filepath.Dir(cmakeFilePath)
+	if abs, err := filepath.Abs(sourceDir); err == nil {
+		sourceDir = abs
+	}
+	binaryDir := filepath.Join(sourceDir, ".cmake-build")
+	in.sourceDir, in.binaryDir = sourceDir, binaryDir
+	in.activeDirs = map[string]bool{sourceDir: true}
+	in.commands = make(map[string]*userCommand)
+	for k, v := range map[string]string{
+		"CMAKE_SOURCE_DIR":         sourceDir,
+		"CMAKE_BINARY_DIR":         binaryDir,
+		"CMAKE_CURRENT_SOURCE_DIR": sourceDir,
+		"CMAKE_CURRENT_BINARY_DIR": binaryDir,
+		"CMAKE_CURRENT_LIST_DIR":   sourceDir,
+		"CMAKE_CURRENT_LIST_FILE":  filepath.Join(sourceDir, filepath.Base(cmakeFilePath)),
+		// Custom commands running cmake -E are translated to shell commands
+		"CMAKE_COMMAND": "cmake",
+	} {
+		in.scope.vars[k] = v
+	}
+	platformVariables := map[string]string{
+		"CMAKE_VERSION":       fallbackCMakeVersion,
+		"CMAKE_MAJOR_VERSION": strings.Split(fallbackCMakeVersion, ".")[0],
+		"CMAKE_MINOR_VERSION": strings.Split(fallbackCMakeVersion, ".")[1],
+		"CMAKE_PATCH_VERSION": strings.Split(fallbackCMakeVersion, ".")[2],
+	}
+	for k, v := range fallbackPlatformVariables {
+		platformVariables[k] = v
+	}
+	for k, v := range platformVariables {
+		if _, ok := defines[k]; !ok {
+			in.scope.vars[k] = v
+		}
+	}
+	return in
+}
+
+// isCommand reports whether name is a command if(COMMAND) considers defined
+func (in *cmakeInterpreter) isCommand(name string) bool {
+	name = strings.ToLower(name)
+	return builtinCommands[name] || in.commands[name] != nil
+}
+
+// lookup resolves variable references. Normal variables hide cache entries of
+// the same name.
+func (in *cmakeInterpreter) lookup(kind, name string) string {
+	switch kind {
+	case "ENV":
+		if value, ok := in.env[name]; ok {
+			return value
+		}
+		return os.Getenv(name)
+	case "CACHE":
+		return in.cache[name]
+	}
+	if value, ok := in.scope.vars[name]; ok {
+		return value
+	}
+	return in.cache[name]
+}
+
+// variable returns the value of a variable and whether it is defined
+func (in *cmakeInterpreter) variable(name string) (string, bool) {
+	if value, ok := in.scope.vars[name]; ok {
+		return value, true
+	}
+	value, ok := in.cache[name]
+	return value, ok
+}
+
+// findBlockEnd returns the index of the command closing the block opened by
+// commands[start], such as the endif() of an if(), or len(commands) if the
+// block is not closed
+func findBlockEnd(commands []CMakeCommand, start int, open, close string) int {
+	depth := 0
+	for i := start; i < len(commands); i++ {
+		switch strings.ToLower(commands[i].Name) {
+		case open:
+			depth++
+		case close:
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	log.Printf("%s() at line %d is missing its %s().", commands[start].Name, commands[start].Pos.Line, close)
+	return len(commands)
+}
+
+// run evaluates commands in the current scope until they end or control flow
+// leaves them
+func (in *cmakeInterpreter) run(commands []CMakeCommand) {
+	for i := 0; i < len(commands) && in.flow == flowNormal; i++ {
+		cmd := commands[i]
+		name := strings.ToLower(cmd.Name)
+		switch name {
+		case "if":
+			end := findBlockEnd(commands, i, "if", "endif")
+			in.runIf(commands[i:end])
+			i = end
+			continue
+		case "foreach":
+			end := findBlockEnd(commands, i, "foreach", "endforeach")
+			in.runForeach(cmd, commands[i+1:end])
+			i = end
+			continue
+		case "while":
+			end := findBlockEnd(commands, i, "while", "endwhile")
+			in.runWhile(cmd, commands[i+1:end])
+			i = end
+			continue
+		case "function", "macro":
+			end := findBlockEnd(commands, i, name, "end"+name)
+			in.define(cmd, commands[i+1:end], name == "macro")
+			i = end
+			continue
+		case "break":
+			in.flow = flowBreak
+			continue
+		case "continue":
+			in.flow = flowContinue
+			continue
+		case "return":
+			in.flow = flowReturn
+			continue
+		}
+
+		if command, ok := in.commands[name]; ok {
+			in.invoke(command, cmd)
+			continue
+		}
+		if overridden := strings.TrimPrefix(name, "_"); overridden != name && in.commands[overridden] != nil {
+			name = overridden // _name calls the command a function or macro replaced
+		}
+
+		args := cmd.ExpandArguments(in.lookup)
+		switch name {
+		case "set":
+			in.set(args)
+		case "unset":
+			in.unset(args)
+		case "option":
+			in.option(args)
+		case "list":
+			in.list(args)
+		case "project":
+			in.project(args)
+		case "include":
+			in.include(args)
+		case "add_subdirectory":
+			in.addSubdirectory(args)
+		case "cmake_parse_arguments":
+			in.parseArguments(args)
+		case "file":
+			in.fileCommand(args)
+		case "aux_source_directory":
+			in.auxSourceDirectory(args)
+		default:
+			in.handler(name, args)
+		}
+	}
+}
+
+// runIf runs the branch of an if() block whose condition holds. commands
+// starts with the if() and ends before its endif().
+func (in *cmakeInterpreter) runIf(commands []CMakeCommand) {
+	condition := commands[0]
+	start, depth := 1, 0
+	for i := 1; i <= len(commands); i++ {
+		if i < len(commands) {
+			switch strings.ToLower(commands[i].Name) {
+			case "if":
+				depth++
+				continue
+			case "endif":
+				depth--
+				continue
+			case "elseif", "else":
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		// commands[start:i] is the body of the branch opened by condition
+		if strings.ToLower(condition.Name) == "else" || in.evaluateCondition(in.conditionArguments(condition)) {
+			in.run(commands[start:i])
+			return
+		}
+		if i < len(commands) {
+			condition, start = commands[i], i+1
+		}
+	}
+}
+
+// runLoopBody runs one iteration of a loop and reports whether to go on
+func (in *cmakeInterpreter) runLoopBody(body []CMakeCommand) bool {
+	in.run(body)
+	switch in.flow {
+	case flowBreak:
+		in.flow = flowNormal
+		return false
+	case flowContinue:
+		in.flow = flowNormal
+	case flowReturn:
+		return false
+	}
+	return true
+}
+
+// runForeach handles foreach(<var> <items>...), foreach(<var> RANGE ...),
+// foreach(<var> IN [LISTS ...] [ITEMS ...]) and foreach(<vars>... IN ZIP_LISTS ...)
+func (in *cmakeInterpreter) runForeach(cmd CMakeCommand, body []CMakeCommand) {
+	args := cmd.ExpandArguments(in.lookup)
+	if len(args) == 0 {
+		return
+	}
+
+	// Loop variables only live for the duration of the loop
+	var loopVars []string
+	saved := make(map[string]*string)
+	defer func() {
+		for _, name := range loopVars {
+			if value := saved[name]; value != nil {
+				in.scope.vars[name] = *value
+			} else {
+				delete(in.scope.vars, name)
+			}
+		}
+	}()
+	bind := func(names ...string) {
+		for _, name := range names {
+			if _, ok := saved[name]; ok {
+				continue
+			}
+			loopVars = append(loopVars, name)
+			if value, ok := in.scope.vars[name]; ok {
+				saved[name] = &value
+			} else {
+				saved[name] = nil
+			}
+		}
+	}
+
+	inIndex := -1
+	for i, arg := range args {
+		if arg == "IN" {
+			inIndex = i
+			break
+		}
+	}
+
+	switch {
+	case len(args) > 1 && args[1] == "RANGE":
+		var bounds []int
+		for _, arg := range args[2:] {
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				log.Printf("Invalid foreach(RANGE) bound %q, skipping loop.", arg)
+				return
+			}
+			bounds = append(bounds, n)
+		}
+		start, stop, step := 0, 0, 1
+		switch len(bounds) {
+		case 1:
+			stop = bounds[0]
+		case 2:
+			start, stop = bounds[0], bounds[1]
+		case 3:
+			start, stop, step = bounds[0], bounds[1], bounds[2]
+		default:
+			return
+		}
+		if step <= 0 {
+			return
+		}
+		bind(args[0])
+		for n := start; n <= stop; n += step {
+			in.scope.vars[args[0]] = strconv.Itoa(n)
+			if !in.runLoopBody(body) {
+				return
+			}
+		}
+	case inIndex > 0 && inIndex+1 < len(args) && args[inIndex+1] == "ZIP_LISTS":
+		names := args[:inIndex]
+		var lists [][]string
+		length := 0
+		for _, listName := range args[inIndex+2:] {
+			value, _ := in.variable(listName)
+			lists = append(lists, cmakeListElements(value))
+			length = max(length, len(lists[len(lists)-1]))
+		}
+		if len(names) == 1 {
+			prefix := names[0]
+			names = nil
+			for i := range lists {
+				names = append(names, prefix+"_"+strconv.Itoa(i))
+			}
+		} else if len(names) != len(lists) {
+			log.Printf("foreach(ZIP_LISTS) needs one variable per list, skipping loop.")
+			return
+		}
+		bind(names...)
+		for n := 0; n < length; n++ {
+			for i, list := range lists {
+				if n < len(list) {
+					in.scope.vars[names[i]] = list[n]
+				} else {
+					delete(in.scope.vars, names[i])
+				}
+			}
+			if !in.runLoopBody(body) {
+				return
+			}
+		}
+	case inIndex == 1:
+		var items []string
+		keyword := ""
+		for _, arg := range args[2:] {
+			if arg == "LISTS" || arg == "ITEMS" {
+				keyword = arg
+				continue
+			}
+			if keyword == "LISTS" {
+				value, _ := in.variable(arg)
+				items = append(items, cmakeListElements(value)...)
+			} else if keyword == "ITEMS" {
+				items = append(items, arg)
+			}
+		}
+		in.foreachItems(args[0], items, body, bind)
+	default:
+		in.foreachItems(args[0], args[1:], body, bind)
+	}
+}
+
+func (in *cmakeInterpreter) foreachItems(name string, items []string, body []CMakeCommand, bind func(...string)) {
+	bind(name)
+	for _, item := range items {
+		in.scope.vars[name] = item
+		if !in.runLoopBody(body) {
+			return
+		}
+	}
+}
+
+// runWhile handles while(<condition>)
+func (in *cmakeInterpreter) runWhile(cmd CMakeCommand, body []CMakeCommand) {
+	for i := 0; in.evaluateCondition(in.conditionArguments(cmd)); i++ {
+		if i == maxLoopIterations {
+			log.Printf("while() at line %d did not terminate after %d iterations, stopping.", cmd.Pos.Line, maxLoopIterations)
+			return
+		}
+		if !in.runLoopBody(body) {
+			return
+		}
+	}
+}
+
+// packagePath converts a path as written in the CMake file being interpreted
+// into one relative to the package. Relative paths are relative to the
+// current source directory. Paths outside the package are returned absolute.
+func (in *cmakeInterpreter) packagePath(p string) string {
+	return in.resolvePackagePath(p, in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"])
+}
+
+// packageDirectory returns the current source directory relative to the
+// package, or "" for the directory of the package itself
+func (in *cmakeInterpreter) packageDirectory() string {
+	if dir := in.packagePath("."); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// packageOutputPath is packagePath for files CMake generates, whose relative
+// paths are relative to the current binary directory
+func (in *cmakeInterpreter) packageOutputPath(p string) string {
+	return in.resolvePackagePath(p, in.scope.vars["CMAKE_CURRENT_BINARY_DIR"])
+}
+
+func (in *cmakeInterpreter) resolvePackagePath(p, base string) string {
+	if p == "" || strings.Contains(p, "$") {
+		return p
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(base, p)
+	}
+	return filepath.ToSlash(relativeToPackage(filepath.Clean(p), in.sourceDir, in.binaryDir))
+}
+
+// runFile runs the commands of another CMake file, such as an included file or
+// the CMakeLists.txt of a subdirectory, in the current scope. A return() in
+// the file only ends that file.
+func (in *cmakeInterpreter) runFile(path string) error {
+	if in.depth >= maxRecursionDepth {
+		return fmt.Errorf("maximum recursion depth of %d exceeded", maxRecursionDepth)
+	}
+	commands, err := ParseCMakeFile(path)
+	if err != nil {
+		return err
+	}
+	in.depth++
+	defer func() { in.depth-- }()
+	listDir, listFile := in.scope.vars["CMAKE_CURRENT_LIST_DIR"], in.scope.vars["CMAKE_CURRENT_LIST_FILE"]
+	in.scope.vars["CMAKE_CURRENT_LIST_DIR"] = filepath.Dir(path)
+	in.scope.vars["CMAKE_CURRENT_LIST_FILE"] = path
+	in.run(commands)
+	if in.flow == flowReturn {
+		in.flow = flowNormal
+	}
+	in.scope.vars["CMAKE_CURRENT_LIST_DIR"], in.scope.vars["CMAKE_CURRENT_LIST_FILE"] = listDir, listFile
+	return nil
+}
+
+// include handles include(<file|module> [OPTIONAL] [RESULT_VARIABLE <var>]).
+// Modules are looked up in CMAKE_MODULE_PATH; CMake's own modules are not
+// available to the fallback and are skipped.
+func (in *cmakeInterpreter) include(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	optional, resultVariable := false, ""
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "OPTIONAL":
+			optional = true
+		case "RESULT_VARIABLE":
+			if i+1 < len(args) {
+				resultVariable = args[i+1]
+				i++
+			}
+		}
+	}
+
+	path := ""
+	if name := args[0]; !strings.Contains(name, "/") && !strings.HasSuffix(name, ".cmake") {
+		modulePath, _ := in.variable("CMAKE_MODULE_PATH")
+		for _, dir := range cmakeListElements(modulePath) {
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"], dir)
+			}
+			if candidate := filepath.Join(dir, name+".cmake"); fileIsRegular(candidate) {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			log.Printf("include(%s): module not found in CMAKE_MODULE_PATH, skipping.", name)
+		}
+	} else {
+		path = name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"], path)
+		}
+		if !fileIsRegular(path) {
+			if !optional {
+				log.Printf("include(%s): file not found, skipping.", name)
+			}
+			path = ""
+		}
+	}
+
+	result := "NOTFOUND"
+	if path != "" {
+		if err := in.runFile(path); err != nil {
+			log.Printf("include(%s): %v", args[0], err)
+		} else {
+			result = path
+		}
+	}
+	if resultVariable != "" {
+		in.scope.vars[resultVariable] = result
+	}
+}
+
+// addSubdirectory handles add_subdirectory(<source_dir> [<binary_dir>] ...).
+// The subdirectory runs in a new scope, so only PARENT_SCOPE assignments and
+// cache entries are visible to the caller afterwards, and starts with the
+// directory properties of the caller. Directories outside of the package
+// cannot contribute files to it and are not followed.
+func (in *cmakeInterpreter) addSubdirectory(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	currentSourceDir := in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"]
+	sourceDir := args[0]
+	if !filepath.IsAbs(sourceDir) {
+		sourceDir = filepath.Join(currentSourceDir, sourceDir)
+	}
+	if rel, err := filepath.Rel(in.sourceDir, sourceDir); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		log.Printf("add_subdirectory(%s) is outside of the package, skipping.", args[0])
+		return
+	}
+
+	binaryDir := ""
+	if len(args) > 1 && args[1] != "EXCLUDE_FROM_ALL" && args[1] != "SYSTEM" {
+		binaryDir = args[1]
+		if !filepath.IsAbs(binaryDir) {
+			binaryDir = filepath.Join(in.scope.vars["CMAKE_CURRENT_BINARY_DIR"], binaryDir)
+		}
+	} else {
+		rel, _ := filepath.Rel(currentSourceDir, sourceDir)
+		binaryDir = filepath.Join(in.scope.vars["CMAKE_CURRENT_BINARY_DIR"], rel)
+	}
+
+	cmakeFilePath := filepath.Join(sourceDir, "CMakeLists.txt")
+	if !fileIsRegular(cmakeFilePath) {
+		log.Printf("add_subdirectory(%s): %s not found, skipping.", args[0], cmakeFilePath)
+		return
+	}
+	if in.activeDirs[sourceDir] {
+		log.Printf("add_subdirectory(%s) adds a directory that is being processed, skipping.", args[0])
+		return
+	}
+	in.activeDirs[sourceDir] = true
+	defer delete(in.activeDirs, sourceDir)
+
+	parent, parentDirectory := in.scope, in.directory
+	in.scope = newCMakeScope(parent)
+	in.directory = newCMakeDirectory(parentDirectory)
+	in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"] = sourceDir
+	in.scope.vars["CMAKE_CURRENT_BINARY_DIR"] = binaryDir
+	if err := in.runFile(cmakeFilePath); err != nil {
+		log.Printf("add_subdirectory(%s): %v", args[0], err)
+	}
+	in.scope, in.directory = parent, parentDirectory
+}
+
+func fileIsRegular(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// set handles set(<var> <value>... [PARENT_SCOPE]),
+// set(<var> <value>... CACHE <type> <doc> [FORCE]) and set(ENV{<var>} <value>)
+func (in *cmakeInterpreter) set(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	name, values := args[0], args[1:]
+
+	if strings.HasPrefix(name, "ENV{") && strings.HasSuffix(name, "}") {
+		value := ""
+		if len(values) > 0 {
+			value = values[0]
+		}
+		in.env[strings.TrimSuffix(strings.TrimPrefix(name, "ENV{"), "}")] = value
+		return
+	}
+
+	for i, arg := range values {
+		if arg != "CACHE" || i+1 >= len(values) {
+			continue
+		}
+		force := values[i+1] == "INTERNAL" || (len(values) > i+3 && values[i+3] == "FORCE")
+		if _, exists := in.cache[name]; !exists || force {
+			in.cache[name] = strings.Join(values[:i], ";")
+		}
+		return
+	}
+
+	scope := in.scope
+	if len(values) > 0 && values[len(values)-1] == "PARENT_SCOPE" {
+		values = values[:len(values)-1]
+		if scope = in.scope.parent; scope == nil {
+			log.Printf("set(%s ... PARENT_SCOPE) used at the top-level scope, ignoring.", name)
+			return
+		}
+	}
+	if len(values) == 0 {
+		delete(scope.vars, name)
+		return
+	}
+	scope.vars[name] = strings.Join(values, ";")
+}
+
+// unset handles unset(<var> [CACHE | PARENT_SCOPE]) and unset(ENV{<var>})
+func (in *cmakeInterpreter) unset(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	name := args[0]
+	if strings.HasPrefix(name, "ENV{") && strings.HasSuffix(name, "}") {
+		in.env[strings.TrimSuffix(strings.TrimPrefix(name, "ENV{"), "}")] = ""
+		return
+	}
+	switch {
+	case len(args) > 1 && args[1] == "CACHE":
+		delete(in.cache, name)
+	case len(args) > 1 && args[1] == "PARENT_SCOPE":
+		if in.scope.parent != nil {
+			delete(in.scope.parent.vars, name)
+		}
+	default:
+		delete(in.scope.vars, name)
+	}
+}
+
+// option handles option(<var> "<help>" [value]). Like CMake with policy
+// CMP0077 set, it does nothing when a normal variable of that name exists.
+func (in *cmakeInterpreter) option(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	name := args[0]
+	if _, ok := in.scope.vars[name]; ok {
+		return
+	}
+	if _, ok := in.cache[name]; ok {
+		return
+	}
+	value := "OFF"
+	if len(args) > 2 {
+		value = args[2]
+	}
+	in.cache[name] = value
+}
+
+// project handles project(<name> [VERSION <version>] ...)
+func (in *cmakeInterpreter) project(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	name := args[0]
+	sourceDir := in.scope.vars["CMAKE_CURRENT_SOURCE_DIR"]
+	binaryDir := in.scope.vars["CMAKE_CURRENT_BINARY_DIR"]
+	in.scope.vars["PROJECT_NAME"] = name
+	in.scope.vars["PROJECT_SOURCE_DIR"] = sourceDir
+	in.scope.vars["PROJECT_BINARY_DIR"] = binaryDir
+	in.cache[name+"_SOURCE_DIR"] = sourceDir
+	in.cache[name+"_BINARY_DIR"] = binaryDir
+	if _, ok := in.variable("CMAKE_PROJECT_NAME"); !ok {
+		in.cache["CMAKE_PROJECT_NAME"] = name
+	}
+
+	version := ""
+	for i, arg := range args {
+		if arg == "VERSION" && i+1 < len(args) {
+			version = args[i+1]
+		}
+	}
+	components := strings.Split(version, ".")
+	for _, prefix := range []string{"PROJECT", name} {
+		in.scope.vars[prefix+"_VERSION"] = version
+		for i, suffix := range []string{"MAJOR", "MINOR", "PATCH", "TWEAK"} {
+			value := ""
+			if version != "" && i < len(components) {
+				value = components[i]
+			}
+			in.scope.vars[prefix+"_VERSION_"+suffix] = value
+		}
+	}
+}
+
+// cmakeListElements splits the value of a list variable for list(). Unlike
+// command arguments, empty elements are kept.
+func cmakeListElements(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ";")
+}
+
+// listIndex converts a possibly negative list() index to a position in a list
+// of length n
+func listIndex(index string, n int) (int, bool) {
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return 0, false
+	}
+	if i < 0 {
+		i += n
+	}
+	return i, i >= 0 && i < n
+}
+
+// list handles the list() subcommands that read and modify list variables
+func (in *cmakeInterpreter) list(args []string) {
+	if len(args) < 2 {
+		return
+	}
+	subcommand, listName, rest := args[0], args[1], args[2:]
+	value, _ := in.variable(listName)
+	elements := cmakeListElements(value)
+	setList := func(name string, elements []string) {
+		in.scope.vars[name] = strings.Join(elements, ";")
+	}
+
+	switch subcommand {
+	case "LENGTH":
+		if len(rest) == 1 {
+			in.scope.vars[rest[0]] = strconv.Itoa(len(elements))
+		}
+	case "GET":
+		if len(rest) < 2 {
+			return
+		}
+		var result []string
+		for _, index := range rest[:len(rest)-1] {
+			if i, ok := listIndex(index, len(elements)); ok {
+				result = append(result, elements[i])
+			}
+		}
+		setList(rest[len(rest)-1], result)
+	case "JOIN":
+		if len(rest) == 2 {
+			in.scope.vars[rest[1]] = strings.Join(elements, rest[0])
+		}
+	case "SUBLIST":
+		if len(rest) != 3 {
+			return
+		}
+		begin, err1 := strconv.Atoi(rest[0])
+		length, err2 := strconv.Atoi(rest[1])
+		if err1 != nil || err2 != nil || begin < 0 || begin > len(elements) {
+			return
+		}
+		end := len(elements)
+		if length >= 0 && begin+length < end {
+			end = begin + length
+		}
+		setList(rest[2], elements[begin:end])
+	case "FIND":
+		if len(rest) != 2 {
+			return
+		}
+		index := -1
+		for i, element := range elements {
+			if element == rest[0] {
+				index = i
+				break
+			}
+		}
+		in.scope.vars[rest[1]] = strconv.Itoa(index)
+	case "APPEND":
+		setList(listName, append(elements, rest...))
+	case "PREPEND":
+		setList(listName, append(append([]string{}, rest...), elements...))
+	case "INSERT":
+		if len(rest) == 0 {
+			return
+		}
+		i, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return
+		}
+		if i < 0 {
+			i += len(elements)
+		}
+		if i < 0 || i > len(elements) {
+			return
+		}
+		result := append(append(append([]string{}, elements[:i]...), rest[1:]...), elements[i:]...)
+		setList(listName, result)
+	case "POP_BACK", "POP_FRONT":
+		count := len(rest)
+		if count == 0 {
+			count = 1
+		}
+		for i := 0; i < count && len(elements) > 0; i++ {
+			var popped string
+			if subcommand == "POP_BACK" {
+				popped, elements = elements[len(elements)-1], elements[:len(elements)-1]
+			} else {
+				popped, elements = elements[0], elements[1:]
+			}
+			if i < len(rest) {
+				in.scope.vars[rest[i]] = popped
+			}
+		}
+		setList(listName, elements)
+	case "REMOVE_ITEM":
+		remove := make(map[string]bool)
+		for _, item := range rest {
+			remove[item] = true
+		}
+		var result []string
+		for _, element := range elements {
+			if !remove[element] {
+				result = append(result, element)
+			}
+		}
+		setList(listName, result)
+	case "REMOVE_AT":
+		remove := make(map[int]bool)
+		for _, index := range rest {
+			if i, ok := listIndex(index, len(elements)); ok {
+				remove[i] = true
+			}
+		}
+		var result []string
+		for i, element := range elements {
+			if !remove[i] {
+				result = append(result, element)
+			}
+		}
+		setList(listName, result)
+	case "REMOVE_DUPLICATES":
+		var result []string
+		for _, element := range elements {
+			result = appendIfMissing(result, element)
+		}
+		setList(listName, result)
+	case "REVERSE":
+		result := make([]string, len(elements))
+		for i, element := range elements {
+			result[len(elements)-1-i] = element
+		}
+		setList(listName, result)
+	case "SORT":
+		insensitive, descending := false, false
+		for i := 0; i+1 < len(rest); i += 2 {
+			switch rest[i] {
+			case "CASE":
+				insensitive = rest[i+1] == "INSENSITIVE"
+			case "ORDER":
+				descending = rest[i+1] == "DESCENDING"
+			}
+		}
+		sort.SliceStable(elements, func(i, j int) bool {
+			a, b := elements[i], elements[j]
+			if insensitive {
+				a, b = strings.ToLower(a), strings.ToLower(b)
+			}
+			if descending {
+				return a > b
+			}
+			return a < b
+		})
+		setList(listName, elements)
+	case "FILTER":
+		// list(FILTER <list> INCLUDE|EXCLUDE REGEX <regex>)
+		if len(rest) != 3 || rest[1] != "REGEX" {
+			return
+		}
+		re, err := regexp.Compile(rest[2])
+		if err != nil {
+			log.Printf("Invalid regular expression in list(FILTER %s): %v", listName, err)
+			return
+		}
+		var result []string
+		for _, element := range elements {
+			if re.MatchString(element) == (rest[0] == "INCLUDE") {
+				result = append(result, element)
+			}
+		}
+		setList(listName, result)
+	case "TRANSFORM":
+		in.listTransform(listName, elements, rest)
+	}
+}
+
+// listTransform handles list(TRANSFORM <list> <action> [<selector>]
+// [OUTPUT_VARIABLE <out>]) for the actions APPEND, PREPEND, TOLOWER, TOUPPER,
+// STRIP and REPLACE and the selectors AT and REGEX
+func (in *cmakeInterpreter) listTransform(listName string, elements []string, args []string) {
+	if len(args) == 0 {
+		return
+	}
+	action, args := args[0], args[1:]
+	var actionArgs []string
+	switch action {
+	case "APPEND", "PREPEND":
+		if len(args) < 1 {
+			return
+		}
+		actionArgs, args = args[:1], args[1:]
+	case "REPLACE":
+		if len(args) < 2 {
+			return
+		}
+		actionArgs, args = args[:2], args[2:]
+	case "TOLOWER", "TOUPPER", "STRIP":
+	default:
+		log.Printf("Unsupported list(TRANSFORM %s) action %s, ignoring.", listName, action)
+		return
+	}
+
+	output := listName
+	selected := func(i int, element string) bool { return true }
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "OUTPUT_VARIABLE":
+			if i+1 < len(args) {
+				output = args[i+1]
+				i++
+			}
+		case "REGEX":
+			if i+1 < len(args) {
+				re, err := regexp.Compile(args[i+1])
+				if err != nil {
+					log.Printf("Invalid regular expression in list(TRANSFORM %s): %v", listName, err)
+					return
+				}
+				selected = func(_ int, element string) bool { return re.MatchString(element) }
+				i++
+			}
+		case "AT":
+			indexes := make(map[int]bool)
+			for i+1 < len(args) && args[i+1] != "OUTPUT_VARIABLE" {
+				if index, ok := listIndex(args[i+1], len(elements)); ok {
+					indexes[index] = true
+				}
+				i++
+			}
+			selected = func(i int, _ string) bool { return indexes[i] }
+		}
+	}
+
+	var replace *regexp.Regexp
+	if action == "REPLACE" {
+		var err error
+		if replace, err = regexp.Compile(actionArgs[0]); err != nil {
+			log.Printf("Invalid regular expression in list(TRANSFORM %s REPLACE): %v", listName, err)
+			return
+		}
+	}
+
+	result := make([]string, len(elements))
+	for i, element := range elements {
+		if !selected(i, element) {
+			result[i] = element
+			continue
+		}
+		switch action {
+		case "APPEND":
+			element += actionArgs[0]
+		case "PREPEND":
+			element = actionArgs[0] + element
+		case "TOLOWER":
+			element = strings.ToLower(element)
+		case "TOUPPER":
+			element = strings.ToUpper(element)
+		case "STRIP":
+			element = strings.TrimSpace(element)
+		case "REPLACE":
+			// CMake refers to groups as \1, Go as ${1}
+			element = replace.ReplaceAllString(element, cmakeReplacementRegex.ReplaceAllString(actionArgs[1], "$${$1}"))
+		}
+		result[i] = element
+	}
+	in.scope.vars[output] = strings.Join(result, ";")
+}
+
+var cmakeReplacementRegex = regexp.MustCompile(`\\([0-9])`)
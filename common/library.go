@@ -0,0 +1,110 @@
+package common
+
+import (
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// SharedLibraryRuleName returns the name of the cc_shared_library generated for
+// the SHARED library target with the given name
+func SharedLibraryRuleName(name string) string {
+	return name + "_shared"
+}
+
+// libraryOutputName returns the OUTPUT_NAME of a target, defaulting to its name
+func libraryOutputName(cmTarget *CMakeTarget) string {
+	if cmTarget.OutputName != "" {
+		return cmTarget.OutputName
+	}
+	return cmTarget.Name
+}
+
+// SharedLibraryName returns the file name consumers of a SHARED library load at
+// runtime: lib<OUTPUT_NAME>.so followed by the SOVERSION, like the SONAME CMake
+// gives the library on ELF platforms.
+func SharedLibraryName(cmTarget *CMakeTarget) string {
+	name := "lib" + libraryOutputName(cmTarget) + ".so"
+	if cmTarget.SOVersion != "" {
+		name += "." + cmTarget.SOVersion
+	}
+	return name
+}
+
+// ModuleLibraryName returns the file name CMake produces for a MODULE library.
+// Modules are loaded with dlopen() rather than linked, so they are not versioned.
+func ModuleLibraryName(cmTarget *CMakeTarget) string {
+	return "lib" + libraryOutputName(cmTarget) + ".so"
+}
+
+// DynamicDeps returns the labels of the cc_shared_library rules for the SHARED
+// libraries among targets that cmTarget links directly
+func DynamicDeps(cmTarget *CMakeTarget, targets map[string]*CMakeTarget) []string {
+	var dynamicDeps []string
+	for _, lib := range cmTarget.LinkedLibraries {
+		if linked, ok := targets[lib]; ok && lib != cmTarget.Name && linked.Type == "library" && linked.LibraryType == "SHARED" {
+			dynamicDeps = appendIfMissing(dynamicDeps, ":"+SharedLibraryRuleName(lib))
+		}
+	}
+	return dynamicDeps
+}
+
+// LibraryRules adapts the cc_library generated for a CMake library to the kind
+// of library CMake builds and returns the rules to emit for it:
+//   - OBJECT libraries keep every object file (alwayslink)
+//   - SHARED libraries also get a cc_shared_library exporting the cc_library
+//   - MODULE libraries become a cc_binary with linkshared, named after the
+//     file CMake produces so that plugin loaders find it
+//
+// dynamicDeps lists the cc_shared_library rules the library links against.
+func LibraryRules(r *rule.Rule, cmTarget *CMakeTarget, dynamicDeps []string) []*rule.Rule {
+	if cmTarget.Type != "library" {
+		return []*rule.Rule{r}
+	}
+
+	switch cmTarget.LibraryType {
+	case "OBJECT":
+		r.SetAttr("alwayslink", true)
+	case "SHARED":
+		shared := rule.NewRule("cc_shared_library", SharedLibraryRuleName(r.Name()))
+		shared.SetAttr("deps", []string{":" + r.Name()})
+		if len(dynamicDeps) > 0 {
+			shared.SetAttr("dynamic_deps", dynamicDeps)
+		}
+		shared.SetAttr("shared_lib_name", SharedLibraryName(cmTarget))
+		return []*rule.Rule{r, shared}
+	case "MODULE":
+		r.SetKind("cc_binary")
+		r.SetName(ModuleLibraryName(cmTarget))
+		r.SetAttr("linkshared", true)
+		// cc_binary has neither hdrs, defines nor implementation_deps
+		if hdrs := r.AttrStrings("hdrs"); len(hdrs) > 0 {
+			srcs, modeSrcs := ConfigAttr(r, "srcs")
+			SetConfigAttr(r, "srcs", append(srcs, hdrs...), modeSrcs)
+			r.DelAttr("hdrs")
+		}
+		if defines, modeDefines := ConfigAttr(r, "defines"); len(defines) > 0 || len(modeDefines) > 0 {
+			SetConfigAttr(r, "local_defines", append(defines, r.AttrStrings("local_defines")...), modeDefines)
+			r.SetPrivateAttr(configSelectAttr("defines"), nil)
+			r.DelAttr("defines")
+		}
+		if implementationDeps, modeDeps := ConfigAttr(r, "implementation_deps"); len(implementationDeps) > 0 || len(modeDeps) > 0 {
+			deps, depsByMode := ConfigAttr(r, "deps")
+			for _, dep := range implementationDeps {
+				deps = appendIfMissing(deps, dep)
+			}
+			for mode, list := range modeDeps {
+				if depsByMode == nil {
+					depsByMode = make(map[string][]string)
+				}
+				depsByMode[mode] = append(depsByMode[mode], list...)
+			}
+			SetConfigAttr(r, "deps", deps, depsByMode)
+			r.SetPrivateAttr(configSelectAttr("implementation_deps"), nil)
+			r.DelAttr("implementation_deps")
+		}
+		r.DelAttr("alwayslink")
+		if len(dynamicDeps) > 0 {
+			r.SetAttr("dynamic_deps", dynamicDeps)
+		}
+	}
+	return []*rule.Rule{r}
+}
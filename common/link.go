@@ -0,0 +1,92 @@
+package common
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// knownSystemLibraries are libraries commonly linked by bare name that are
+// provided by the C runtime or the compiler rather than by a CMake target.
+var knownSystemLibraries = map[string]bool{
+	"atomic":  true,
+	"c":       true,
+	"c++":     true,
+	"dl":      true,
+	"gcc_s":   true,
+	"m":       true,
+	"pthread": true,
+	"resolv":  true,
+	"rt":      true,
+	"stdc++":  true,
+	"util":    true,
+}
+
+// libraryFileRegex matches the file names of libraries, with the version after
+// the extension on Linux and before it on macOS, e.g. "libz.so.1" or
+// "libz.1.2.dylib"
+var libraryFileRegex = regexp.MustCompile(`^lib(.+?)(?:\.(?:a|so|tbd)(?:\.[0-9.]+)?|(?:\.[0-9]+)*\.dylib)$`)
+
+// SystemLibraryName returns the name of the library an item of a link line
+// refers to, for "-lname", for bare names and for library file paths such as
+// "/usr/lib/libz.so". It returns false for linker flags and other items.
+func SystemLibraryName(item string) (string, bool) {
+	if strings.HasPrefix(item, "-l") && len(item) > 2 {
+		return item[2:], true
+	}
+	if strings.HasPrefix(item, "-") || strings.Contains(item, "$") || strings.Contains(item, "::") {
+		return "", false
+	}
+	if matches := libraryFileRegex.FindStringSubmatch(filepath.Base(item)); matches != nil {
+		return matches[1], true
+	}
+	if !strings.ContainsAny(item, `/\.`) {
+		return item, true
+	}
+	return "", false
+}
+
+// ClassifyLinkItem sorts an item passed to target_link_libraries() that is not
+// a target of the project into the target's system libraries or linker flags.
+// Bare names are only taken as system libraries when they are well known,
+// since the fallback parser cannot tell them apart from targets it did not see.
+func ClassifyLinkItem(cmTarget *CMakeTarget, item string) bool {
+	if fields := strings.Fields(item); len(fields) == 2 && fields[0] == "-framework" {
+		// "-framework Name" stays one linkopt, which Bazel splits
+		cmTarget.LinkOptions = appendIfMissing(cmTarget.LinkOptions, "-framework "+fields[1])
+		return true
+	}
+	if strings.HasPrefix(item, "-") && !strings.HasPrefix(item, "-l") {
+		cmTarget.LinkOptions = appendIfMissing(cmTarget.LinkOptions, item)
+		return true
+	}
+	name, ok := SystemLibraryName(item)
+	if !ok || (!strings.HasPrefix(item, "-l") && !knownSystemLibraries[name]) {
+		return false
+	}
+	cmTarget.SystemLibraries = appendIfMissing(cmTarget.SystemLibraries, name)
+	return true
+}
+
+// LinkAttrs returns the linkopts and extra deps for the system libraries and
+// linker flags of a target. A system library is linked with -l<name> unless a
+// cmake_linkopts directive overrides its linkopts or a cmake_resolve directive
+// maps it to a Bazel label. Labels are relative to the package pkg.
+func LinkAttrs(cmTarget *CMakeTarget, cfg *CMakeConfig, pkg string) ([]string, []string) {
+	var linkopts, deps []string
+	for _, lib := range cmTarget.SystemLibraries {
+		if mapped, ok := cfg.ResolveLabel(lib, pkg); ok {
+			deps = appendIfMissing(deps, mapped)
+		} else if opts, ok := cfg.LinkoptsMappings[lib]; ok {
+			for _, opt := range opts {
+				linkopts = appendIfMissing(linkopts, opt)
+			}
+		} else {
+			linkopts = appendIfMissing(linkopts, "-l"+lib)
+		}
+	}
+	for _, opt := range cmTarget.LinkOptions {
+		linkopts = appendIfMissing(linkopts, opt)
+	}
+	return linkopts, deps
+}
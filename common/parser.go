@@ -0,0 +1,480 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Position is a 1-based line and column in a CMake source file
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// ArgumentKind tells how a command argument was written
+type ArgumentKind int
+
+const (
+	UnquotedArgument ArgumentKind = iota // foo, ${VAR}, a;b
+	QuotedArgument                       // "foo bar"
+	BracketArgument                      // [[foo]], [==[foo]==]
+)
+
+// CMakeArgument is a single argument of a command invocation
+type CMakeArgument struct {
+	Kind ArgumentKind
+	// Raw is the text of the argument without its quotes or brackets. Escape
+	// sequences and variable references are kept as written, since CMake
+	// evaluates both together.
+	Raw string
+	Pos Position
+}
+
+// CMakeCommand is a command invocation such as add_library(foo foo.cpp)
+type CMakeCommand struct {
+	Name      string // As written; CMake command names are case-insensitive
+	Arguments []CMakeArgument
+	Pos       Position // Position of the command name
+}
+
+// ParseError reports a CMake source file that does not follow the grammar
+type ParseError struct {
+	Filename string
+	Pos      Position
+	Msg      string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%s: %s", e.Filename, e.Pos, e.Msg)
+}
+
+// ParseCMakeFile reads and parses a CMake source file such as CMakeLists.txt
+func ParseCMakeFile(path string) ([]CMakeCommand, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCMake(path, content)
+}
+
+// ParseCMake parses CMake source code into its command invocations, following
+// the grammar of cmake-language(7). filename is only used in errors.
+func ParseCMake(filename string, src []byte) ([]CMakeCommand, error) {
+	p := &cmakeParser{filename: filename, src: src, line: 1, col: 1}
+	var commands []CMakeCommand
+	for {
+		if err := p.skipSeparation(true); err != nil {
+			return nil, err
+		}
+		if p.eof() {
+			return commands, nil
+		}
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+		if err := p.expectLineEnding(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type cmakeParser struct {
+	filename string
+	src      []byte
+	off      int
+	line     int
+	col      int
+}
+
+func (p *cmakeParser) eof() bool {
+	return p.off >= len(p.src)
+}
+
+// peek returns the byte n positions ahead, or 0 at the end of the input
+func (p *cmakeParser) peek(n int) byte {
+	if p.off+n >= len(p.src) {
+		return 0
+	}
+	return p.src[p.off+n]
+}
+
+func (p *cmakeParser) pos() Position {
+	return Position{Line: p.line, Column: p.col}
+}
+
+func (p *cmakeParser) advance() byte {
+	c := p.src[p.off]
+	p.off++
+	if c == '\n' {
+		p.line++
+		p.col = 1
+	} else if c&0xC0 != 0x80 { // Columns count characters, not UTF-8 continuation bytes
+		p.col++
+	}
+	return c
+}
+
+func (p *cmakeParser) errorf(pos Position, format string, args ...interface{}) error {
+	return &ParseError{Filename: p.filename, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || (c >= '0' && c <= '9')
+}
+
+// bracketOpenLength returns the length of the bracket_open at the current
+// position ("[", any number of "=", "["), or 0 if there is none
+func (p *cmakeParser) bracketOpenLength() int {
+	if p.peek(0) != '[' {
+		return 0
+	}
+	n := 1
+	for p.peek(n) == '=' {
+		n++
+	}
+	if p.peek(n) != '[' {
+		return 0
+	}
+	return n + 1
+}
+
+// skipSeparation skips spaces and comments, and newlines if newlines is set
+func (p *cmakeParser) skipSeparation(newlines bool) error {
+	for !p.eof() {
+		c := p.peek(0)
+		switch {
+		case isSpace(c) || (newlines && c == '\n'):
+			p.advance()
+		case c == '#':
+			if err := p.skipComment(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// skipComment skips a bracket comment or a line comment. The newline ending a
+// line comment is left in place.
+func (p *cmakeParser) skipComment() error {
+	start := p.pos()
+	p.advance() // #
+	if p.bracketOpenLength() > 0 {
+		if _, err := p.parseBracketContent(start, "bracket comment"); err != nil {
+			return err
+		}
+		return nil
+	}
+	for !p.eof() && p.peek(0) != '\n' {
+		p.advance()
+	}
+	return nil
+}
+
+// expectLineEnding checks that nothing but spaces and comments follow a
+// command invocation on its line
+func (p *cmakeParser) expectLineEnding() error {
+	if err := p.skipSeparation(false); err != nil {
+		return err
+	}
+	if p.eof() {
+		return nil
+	}
+	if p.peek(0) != '\n' {
+		return p.errorf(p.pos(), "expected a newline after command invocation, got %q", p.peek(0))
+	}
+	p.advance()
+	return nil
+}
+
+func (p *cmakeParser) parseCommand() (CMakeCommand, error) {
+	cmd := CMakeCommand{Pos: p.pos()}
+	if !isIdentifierStart(p.peek(0)) {
+		return cmd, p.errorf(cmd.Pos, "expected a command name, got %q", p.peek(0))
+	}
+	start := p.off
+	for !p.eof() && isIdentifierChar(p.peek(0)) {
+		p.advance()
+	}
+	cmd.Name = string(p.src[start:p.off])
+
+	for isSpace(p.peek(0)) {
+		p.advance()
+	}
+	if p.peek(0) != '(' {
+		return cmd, p.errorf(p.pos(), "expected '(' after command name %s", cmd.Name)
+	}
+	p.advance()
+
+	// Nested parentheses are passed to the command as arguments of their own,
+	// which is how if() and while() conditions are grouped
+	depth := 0
+	for {
+		if err := p.skipSeparation(true); err != nil {
+			return cmd, err
+		}
+		if p.eof() {
+			return cmd, p.errorf(cmd.Pos, "unterminated %s command, missing ')'", cmd.Name)
+		}
+		pos := p.pos()
+		switch c := p.peek(0); {
+		case c == '(':
+			p.advance()
+			depth++
+			cmd.Arguments = append(cmd.Arguments, CMakeArgument{Kind: UnquotedArgument, Raw: "(", Pos: pos})
+		case c == ')':
+			p.advance()
+			if depth == 0 {
+				return cmd, nil
+			}
+			depth--
+			cmd.Arguments = append(cmd.Arguments, CMakeArgument{Kind: UnquotedArgument, Raw: ")", Pos: pos})
+		case c == '"':
+			arg, err := p.parseQuotedArgument()
+			if err != nil {
+				return cmd, err
+			}
+			cmd.Arguments = append(cmd.Arguments, arg)
+		case p.bracketOpenLength() > 0:
+			raw, err := p.parseBracketContent(pos, "bracket argument")
+			if err != nil {
+				return cmd, err
+			}
+			cmd.Arguments = append(cmd.Arguments, CMakeArgument{Kind: BracketArgument, Raw: raw, Pos: pos})
+		default:
+			arg, err := p.parseUnquotedArgument()
+			if err != nil {
+				return cmd, err
+			}
+			cmd.Arguments = append(cmd.Arguments, arg)
+		}
+	}
+}
+
+// parseBracketContent parses "[" "="* "[" content "]" "="* "]" and returns the
+// content. A newline right after the opening bracket is not part of it.
+func (p *cmakeParser) parseBracketContent(start Position, what string) (string, error) {
+	n := p.bracketOpenLength()
+	closing := "]" + strings.Repeat("=", n-2) + "]"
+	for i := 0; i < n; i++ {
+		p.advance()
+	}
+	if p.peek(0) == '\r' && p.peek(1) == '\n' {
+		p.advance()
+	}
+	if p.peek(0) == '\n' {
+		p.advance()
+	}
+	contentStart := p.off
+	for !p.eof() {
+		if bytes.HasPrefix(p.src[p.off:], []byte(closing)) {
+			content := string(p.src[contentStart:p.off])
+			for i := 0; i < len(closing); i++ {
+				p.advance()
+			}
+			return content, nil
+		}
+		p.advance()
+	}
+	return "", p.errorf(start, "unterminated %s, missing %s", what, closing)
+}
+
+func (p *cmakeParser) parseQuotedArgument() (CMakeArgument, error) {
+	arg := CMakeArgument{Kind: QuotedArgument, Pos: p.pos()}
+	p.advance() // "
+	start := p.off
+	for !p.eof() {
+		switch p.peek(0) {
+		case '\\':
+			p.advance()
+			if !p.eof() {
+				p.advance()
+			}
+		case '"':
+			arg.Raw = string(p.src[start:p.off])
+			p.advance()
+			return arg, nil
+		default:
+			p.advance()
+		}
+	}
+	return arg, p.errorf(arg.Pos, "unterminated quoted argument")
+}
+
+// parseUnquotedArgument parses an unquoted argument. Quoted sections inside it,
+// as in -DFOO="a b", are kept verbatim like CMake does for legacy code.
+func (p *cmakeParser) parseUnquotedArgument() (CMakeArgument, error) {
+	arg := CMakeArgument{Kind: UnquotedArgument, Pos: p.pos()}
+	start := p.off
+loop:
+	for !p.eof() {
+		switch c := p.peek(0); {
+		case isSpace(c) || c == '\n' || c == '(' || c == ')' || c == '#':
+			break loop
+		case c == '\\':
+			p.advance()
+			if p.eof() {
+				return arg, p.errorf(arg.Pos, "unterminated escape sequence")
+			}
+			p.advance()
+		case c == '"':
+			quotePos := p.pos()
+			p.advance()
+			for !p.eof() && p.peek(0) != '"' {
+				if p.advance() == '\\' && !p.eof() {
+					p.advance()
+				}
+			}
+			if p.eof() {
+				return arg, p.errorf(quotePos, "unterminated quoted section in argument")
+			}
+			p.advance()
+		default:
+			p.advance()
+		}
+	}
+	arg.Raw = string(p.src[start:p.off])
+	return arg, nil
+}
+
+// VariableLookup returns the value of a variable reference. kind is "" for
+// ${name}, "ENV" for $ENV{name} and "CACHE" for $CACHE{name}.
+type VariableLookup func(kind, name string) string
+
+// Value returns the value of the argument with escape sequences evaluated.
+// Variable references are not expanded.
+func (a CMakeArgument) Value() string {
+	return a.Expand(nil)
+}
+
+// Expand returns the value of the argument with escape sequences evaluated and
+// variable references replaced using lookup. References may be nested, as in
+// ${FOO_${BAR}}. A nil lookup leaves references as written.
+func (a CMakeArgument) Expand(lookup VariableLookup) string {
+	if a.Kind == BracketArgument || !strings.ContainsAny(a.Raw, `\$`) {
+		return a.Raw
+	}
+	value, _, _ := expandReferences(a.Raw, 0, false, lookup)
+	return value
+}
+
+// variableReferenceOpen returns the kind of the variable reference starting at
+// s[i] and the length of its opening, or -1 if there is none
+func variableReferenceOpen(s string, i int) (string, int) {
+	for _, kind := range []string{"", "ENV", "CACHE"} {
+		if open := "$" + kind + "{"; strings.HasPrefix(s[i:], open) {
+			return kind, len(open)
+		}
+	}
+	return "", -1
+}
+
+// expandReferences evaluates s from i on. Inside a reference it stops at the
+// closing brace and reports whether one was found.
+func expandReferences(s string, i int, inReference bool, lookup VariableLookup) (string, int, bool) {
+	var b strings.Builder
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			switch e := s[i+1]; e {
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case ';':
+				// \; stays escaped so that it does not divide a list
+				b.WriteString(`\;`)
+			case '\n':
+				// Line continuation inside a quoted argument
+			default:
+				b.WriteByte(e)
+			}
+			i += 2
+			continue
+		case c == '}' && inReference:
+			return b.String(), i + 1, true
+		case c == '$' && lookup != nil:
+			if kind, n := variableReferenceOpen(s, i); n > 0 {
+				name, end, closed := expandReferences(s, i+n, true, lookup)
+				if closed {
+					b.WriteString(lookup(kind, name))
+				} else {
+					b.WriteString(s[i:end])
+				}
+				i = end
+				continue
+			}
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String(), i, false
+}
+
+// ArgumentValues returns the arguments the command receives. Unquoted
+// arguments are split into list elements on unescaped semicolons and empty
+// elements are dropped; quoted and bracket arguments are passed as one value.
+// Variable references are not expanded.
+func (c CMakeCommand) ArgumentValues() []string {
+	return c.ExpandArguments(nil)
+}
+
+// ExpandArguments is like ArgumentValues but replaces variable references
+// using lookup before unquoted arguments are split into list elements
+func (c CMakeCommand) ExpandArguments(lookup VariableLookup) []string {
+	var values []string
+	for _, arg := range c.Arguments {
+		if arg.Kind != UnquotedArgument {
+			values = append(values, arg.Expand(lookup))
+			continue
+		}
+		values = append(values, SplitCMakeList(arg.Expand(lookup))...)
+	}
+	return values
+}
+
+// SplitCMakeList splits a CMake list on semicolons that are not escaped as \;
+// and drops empty elements
+func SplitCMakeList(list string) []string {
+	var elements []string
+	var b strings.Builder
+	for i := 0; i < len(list); i++ {
+		switch {
+		case list[i] == '\\' && i+1 < len(list) && list[i+1] == ';':
+			b.WriteByte(';')
+			i++
+		case list[i] == ';':
+			if b.Len() > 0 {
+				elements = append(elements, b.String())
+			}
+			b.Reset()
+		default:
+			b.WriteByte(list[i])
+		}
+	}
+	if b.Len() > 0 {
+		elements = append(elements, b.String())
+	}
+	return elements
+}
@@ -0,0 +1,219 @@
+package common
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/repo"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+var includeRegex = regexp.MustCompile(`^\s*#\s*include\s*([<"])([^>"]+)([>"])`)
+
+// IncludeDirective is a single #include line found in a source or header file.
+type IncludeDirective struct {
+	Path    string // The path as written between the quotes or angle brackets
+	Quoted  bool   // true for #include "...", false for #include <...>
+	FromDir string // Directory of the including file, relative to the package
+}
+
+// LabelToPath converts a source reference used in srcs/hdrs into a path relative
+// to the package (or to the external repository root for "@repo//:path" labels).
+// It returns "" for references to other rules (e.g. ":config_h").
+func LabelToPath(src string) string {
+	if strings.HasPrefix(src, "@") {
+		if idx := strings.Index(src, "//:"); idx != -1 {
+			return src[idx+3:]
+		}
+		return ""
+	}
+	if strings.HasPrefix(src, ":") || strings.HasPrefix(src, "//") {
+		return ""
+	}
+	return src
+}
+
+// ScanIncludes reads the given files (relative to dir) and returns every #include
+// directive found in them, deduplicated and in a stable order.
+func ScanIncludes(dir string, files []string) []IncludeDirective {
+	seen := make(map[IncludeDirective]bool)
+	var includes []IncludeDirective
+
+	for _, f := range files {
+		relPath := LabelToPath(f)
+		if relPath == "" {
+			continue
+		}
+
+		file, err := os.Open(filepath.Join(dir, relPath))
+		if err != nil {
+			continue
+		}
+
+		fromDir := path.Dir(filepath.ToSlash(relPath))
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			matches := includeRegex.FindStringSubmatch(scanner.Text())
+			if len(matches) != 4 {
+				continue
+			}
+			inc := IncludeDirective{Path: matches[2], Quoted: matches[1] == `"`, FromDir: fromDir}
+			if !seen[inc] {
+				seen[inc] = true
+				includes = append(includes, inc)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("Error scanning file %s for includes: %v", relPath, err)
+		}
+		file.Close()
+	}
+
+	sort.Slice(includes, func(i, j int) bool {
+		if includes[i].Path != includes[j].Path {
+			return includes[i].Path < includes[j].Path
+		}
+		return includes[i].FromDir < includes[j].FromDir
+	})
+	return includes
+}
+
+// HeaderImports returns the include paths under which the given headers can be
+// reached by consumers. Each header is published by its workspace-relative path
+// and by its path relative to every include directory that contains it.
+func HeaderImports(pkg string, hdrs, includeDirs []string) []string {
+	var imports []string
+	for _, h := range hdrs {
+		relPath := LabelToPath(h)
+		if relPath == "" {
+			continue
+		}
+		relPath = path.Clean(filepath.ToSlash(relPath))
+		imports = appendIfMissing(imports, path.Join(pkg, relPath))
+
+		for _, dir := range includeDirs {
+			dir = path.Clean(filepath.ToSlash(dir))
+			if dir == "." {
+				imports = appendIfMissing(imports, relPath)
+			} else if strings.HasPrefix(relPath, dir+"/") {
+				imports = appendIfMissing(imports, strings.TrimPrefix(relPath, dir+"/"))
+			}
+		}
+	}
+	return imports
+}
+
+// ResolveDeps analyzes the dependencies for a given rule.
+func ResolveDeps(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, r *rule.Rule, lang language.Language, from label.Label) []resolve.FindResult {
+	results := []resolve.FindResult{}
+	cfg := GetCMakeConfig(c)
+
+	// --- 1. Resolve based on target_link_libraries (from CMake File API) ---
+	linkedLibsAttr := r.PrivateAttr("cmake_linked_libraries")
+	if linkedLibs, ok := linkedLibsAttr.([]string); ok && len(linkedLibs) > 0 {
+		log.Printf("Rule %s (%s): Found linked libraries: %v", r.Name(), from.String(), linkedLibs)
+		for _, libName := range linkedLibs {
+			if _, mapped := cfg.ResolveMappings[libName]; mapped {
+				continue // Added to deps at generation time from a cmake_resolve directive
+			}
+			findResults := ix.FindRulesByImport(resolve.ImportSpec{Lang: "cc", Imp: libName}, lang.Name())
+			if len(findResults) == 0 {
+				log.Printf("Rule %s (%s): Could not resolve linked library %s to any target.", r.Name(), from.String(), libName)
+				continue
+			}
+			for _, findResult := range findResults {
+				if !findResult.IsSelfImport(from) {
+					results = append(results, findResult)
+					log.Printf("Rule %s (%s): Resolved linked library %s to %s", r.Name(), from.String(), libName, findResult.Label.String())
+				}
+			}
+		}
+	}
+
+	// --- 2. Resolve based on #include directives ---
+	// Includes are normally scanned at generation time, where the real source
+	// directory (which may be an external repository) is known.
+	includes, ok := r.PrivateAttr("cmake_includes").([]IncludeDirective)
+	if !ok {
+		allFiles := append(RuleFiles(r, "srcs"), RuleFiles(r, "hdrs")...)
+		includes = ScanIncludes(filepath.Join(c.RepoRoot, from.Pkg), allFiles)
+	}
+
+	for _, inc := range includes {
+		var candidates []string
+		if inc.Quoted {
+			// Quoted includes are searched relative to the including file first
+			candidates = append(candidates, path.Join(from.Pkg, inc.FromDir, inc.Path))
+		}
+		candidates = append(candidates, path.Clean(inc.Path))
+
+		var found []resolve.FindResult
+		for _, candidate := range candidates {
+			found = ix.FindRulesByImport(resolve.ImportSpec{Lang: "cc", Imp: candidate}, lang.Name())
+			if len(found) > 0 {
+				break
+			}
+		}
+
+		var matches []resolve.FindResult
+		for _, findResult := range found {
+			if findResult.IsSelfImport(from) {
+				continue
+			}
+			matches = append(matches, findResult)
+		}
+		if len(found) > 0 && len(matches) == 0 {
+			continue // Provided by the rule itself
+		}
+
+		switch len(matches) {
+		case 0:
+			log.Printf("Rule %s (%s): Could not resolve include '%s'.", r.Name(), from.String(), inc.Path)
+		case 1:
+			results = append(results, matches[0])
+			log.Printf("Rule %s (%s): Resolved include '%s' to %s", r.Name(), from.String(), inc.Path, matches[0].Label.String())
+		default:
+			// Prefer a provider in the same package, otherwise the include is ambiguous
+			var local []resolve.FindResult
+			for _, m := range matches {
+				if m.Label.Repo == from.Repo && m.Label.Pkg == from.Pkg {
+					local = append(local, m)
+				}
+			}
+			if len(local) == 1 {
+				results = append(results, local[0])
+				continue
+			}
+			var labels []string
+			for _, m := range matches {
+				labels = append(labels, m.Label.String())
+			}
+			log.Printf("Rule %s (%s): Include '%s' is provided by multiple rules %v, skipping.", r.Name(), from.String(), inc.Path, labels)
+		}
+	}
+
+	// Deduplicate results
+	finalResults := []resolve.FindResult{}
+	seen := make(map[label.Label]bool)
+	for _, res := range results {
+		if !seen[res.Label] {
+			finalResults = append(finalResults, res)
+			seen[res.Label] = true
+		}
+	}
+
+	if len(finalResults) > 0 {
+		log.Printf("Rule %s (%s): Final resolved dependencies: %v", r.Name(), from.String(), finalResults)
+	}
+	return finalResults
+}
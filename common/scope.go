@@ -0,0 +1,128 @@
+package common
+
+import "strings"
+
+// isPrivateScope reports whether values given with a scope keyword of
+// target_include_directories() and friends stay with the target. Values
+// without a keyword propagate, like the plain target_link_libraries()
+// signature does.
+func isPrivateScope(scope string) bool {
+	switch strings.ToUpper(scope) {
+	case "PRIVATE", "LINK_PRIVATE":
+		return true
+	}
+	return false
+}
+
+// updateScope records the scope of a value added to a target in the list of
+// its private values. A value is private as long as every command that added
+// it used the PRIVATE scope. existed tells whether the target had the value
+// before.
+func updateScope(private []string, value string, scopePrivate, existed bool) []string {
+	if !scopePrivate {
+		return removeString(private, value)
+	}
+	if existed {
+		return private
+	}
+	return appendIfMissing(private, value)
+}
+
+func removeString(slice []string, str string) []string {
+	var result []string
+	for _, s := range slice {
+		if s != str {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// SplitByScope separates values into the ones that propagate to the targets
+// linking a target and the ones listed in private, keeping their order
+func SplitByScope(values, private []string) ([]string, []string) {
+	isPrivate := make(map[string]bool)
+	for _, value := range private {
+		isPrivate[value] = true
+	}
+	var propagated, own []string
+	for _, value := range values {
+		if isPrivate[value] {
+			own = append(own, value)
+		} else {
+			propagated = append(propagated, value)
+		}
+	}
+	return propagated, own
+}
+
+// SplitModesByScope is SplitByScope for values by compilation mode
+func SplitModesByScope(byMode map[string][]string, private []string) (map[string][]string, map[string][]string) {
+	var propagated, own map[string][]string
+	for mode, values := range byMode {
+		modePropagated, modeOwn := SplitByScope(values, private)
+		if len(modePropagated) > 0 {
+			if propagated == nil {
+				propagated = make(map[string][]string)
+			}
+			propagated[mode] = modePropagated
+		}
+		if len(modeOwn) > 0 {
+			if own == nil {
+				own = make(map[string][]string)
+			}
+			own[mode] = modeOwn
+		}
+	}
+	return propagated, own
+}
+
+// propagateCompileOptions adds the compile options the targets linked by a
+// target propagate to it, including the ones of the libraries they propagate
+// in turn. Bazel has no attribute that propagates compiler flags, so every
+// consumer lists them in its own copts.
+func propagateCompileOptions(targets map[string]*CMakeTarget) {
+	// Options propagated by each target, by compilation mode or "" for all
+	propagated := make(map[string]map[string][]string)
+	var usage func(name string) map[string][]string
+	usage = func(name string) map[string][]string {
+		if options, ok := propagated[name]; ok {
+			return options
+		}
+		options := make(map[string][]string)
+		propagated[name] = options // Also ends link cycles
+		target, ok := targets[name]
+		if !ok {
+			return options
+		}
+		options[""], _ = SplitByScope(target.CompileOptions, target.PrivateCompileOptions)
+		for mode, values := range target.ConfigValues {
+			options[mode], _ = SplitByScope(values.CompileOptions, target.PrivateCompileOptions)
+		}
+		publicLinks, _ := SplitByScope(target.LinkedLibraries, target.PrivateLinkedLibraries)
+		for _, linked := range publicLinks {
+			for mode, values := range usage(linked) {
+				for _, value := range values {
+					options[mode] = appendIfMissing(options[mode], value)
+				}
+			}
+		}
+		return options
+	}
+	for name := range targets {
+		usage(name)
+	}
+
+	for _, target := range targets {
+		if target.Type == "interface" {
+			continue
+		}
+		for _, linked := range target.LinkedLibraries {
+			for mode, options := range propagated[linked] {
+				for _, option := range options {
+					addCompileOption(target, mode, "PRIVATE", option)
+				}
+			}
+		}
+	}
+}
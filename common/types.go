@@ -3,17 +3,106 @@ package common
 // CMakeTarget represents a target defined in CMakeLists.txt
 type CMakeTarget struct {
 	Name               string
-	Type               string // "library", "executable"
+	Type               string // "library", "executable", "interface" (header-only INTERFACE library)
+	Directory          string // CMake source directory that declared the target, relative to the package; empty for the package itself
+	LibraryType        string // "STATIC", "SHARED", "MODULE" or "OBJECT" for libraries, empty if unknown
+	OutputName         string // OUTPUT_NAME property, empty if the target name is used
+	Version            string // VERSION property of a library
+	SOVersion          string // SOVERSION property of a shared library
 	Sources            []string
 	Headers            []string // If explicitly listed or inferred
 	IncludeDirectories []string
 	LinkedLibraries    []string
+	SystemLibraries    []string // Libraries linked by name that are not CMake targets, e.g. "pthread"
+	LinkOptions        []string // Linker flags, e.g. "-Wl,--as-needed" or "-L/opt/lib"
+	CompileDefinitions []string // Preprocessor definitions, e.g. "ZMQ_STATIC" or "FOO=1"
+	// The include directories, definitions, compile options and linked
+	// libraries, including the ones of ConfigValues, that only the target
+	// itself uses (PRIVATE scope). The others propagate to the targets linking
+	// it (PUBLIC and INTERFACE).
+	PrivateIncludeDirectories []string
+	PrivateCompileDefinitions []string
+	PrivateCompileOptions     []string
+	PrivateLinkedLibraries    []string
+	CompileOptions            []string // Compiler flags not controlled by Bazel itself
+	LanguageStandard          string   // e.g. "c++17" or "c11", empty if CMake did not set one
+	Sysroot                   string   // Compiler sysroot, empty if none
+	// CompileGroups holds the full settings of every compile group. The fields
+	// above only carry what all groups have in common.
+	CompileGroups []CMakeCompileGroup
+	// Tests registered for this executable with add_test()
+	Tests []CMakeTest
+	// Globs whose files the target lists, for the cmake_preserve_globs directive
+	Globs []CMakeGlob
+	// Values that only apply to some build configurations, from generator
+	// expressions such as $<$<CONFIG:Debug>:...>, by Bazel compilation mode
+	ConfigValues map[string]*CMakeConfigValues
+}
+
+// CMakeConfigValues holds the values of a target that only apply in one
+// compilation mode, in addition to the ones of the target itself
+type CMakeConfigValues struct {
+	Sources            []string
+	IncludeDirectories []string
+	LinkedLibraries    []string
+	SystemLibraries    []string
+	LinkOptions        []string
+	CompileDefinitions []string
+	CompileOptions     []string
+}
+
+// CMakeGlob is a globbing expression of file(GLOB) or file(GLOB_RECURSE)
+type CMakeGlob struct {
+	Pattern string   // Equivalent Bazel glob pattern relative to the package, empty if there is none
+	Files   []string // Files the expression matched, relative to the package
+}
+
+// CMakeCompileGroup holds the compile settings CMake uses for a subset of a
+// target's sources. CMake emits one group per language and per distinct set
+// of source file properties.
+type CMakeCompileGroup struct {
+	Language           string // "C", "CXX", ...
+	Sources            []string
+	CompileDefinitions []string
+	CompileOptions     []string
+	LanguageStandard   string
 }
 
 // CMakeConfigureFile represents a configure_file command in CMakeLists.txt
 type CMakeConfigureFile struct {
-	Name       string            // Generated rule name
-	InputFile  string            // Input template file
-	OutputFile string            // Output configured file
-	Variables  map[string]string // CMake variables for substitution
-}
\ No newline at end of file
+	Name         string            // Generated rule name
+	InputFile    string            // Input template file, empty for file(CONFIGURE)
+	OutputFile   string            // Output configured file
+	Variables    map[string]string // CMake variables for substitution
+	Content      string            // Template of file(CONFIGURE)
+	CopyOnly     bool              // COPYONLY: the template is copied as is
+	AtOnly       bool              // @ONLY: ${VAR} references are left alone
+	EscapeQuotes bool              // ESCAPE_QUOTES: quotes in substituted values are escaped
+	NewlineStyle string            // "UNIX" or "DOS" from NEWLINE_STYLE, empty to keep the template's
+	// Values of the variables the template uses when the fallback parser
+	// reaches the command, nil if it could not read the template
+	Values map[string]string
+}
+
+// CMakeCustomCommand represents a command generating files, from
+// add_custom_command(OUTPUT ...) or an add_custom_target() with BYPRODUCTS
+type CMakeCustomCommand struct {
+	Target           string     // Name of the custom target, empty for add_custom_command()
+	Directory        string     // CMake source directory of the command, relative to the package
+	Outputs          []string   // Generated files, relative to the package
+	Commands         [][]string // Command lines, run one after the other
+	Depends          []string   // Files the commands read, relative to the package
+	DependsTargets   []string   // Targets the commands depend on, such as the tools they run
+	WorkingDirectory string     // WORKING_DIRECTORY, empty for the current binary directory
+}
+
+// CMakeTest represents a test registered with add_test() and its CTest properties
+type CMakeTest struct {
+	Name     string
+	Args     []string          // Command line arguments after the executable
+	Env      map[string]string // ENVIRONMENT property
+	Labels   []string          // LABELS property
+	Timeout  float64           // TIMEOUT property in seconds, 0 if unset
+	WillFail bool              // WILL_FAIL property
+	Disabled bool              // DISABLED property
+}
@@ -1,6 +1,9 @@
 package gazelle
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
@@ -142,4 +145,176 @@ func TestCMakeDefineDirectiveKnown(t *testing.T) {
 	if !found {
 		t.Error("cmake_define directive not found in KnownDirectives")
 	}
-}
\ No newline at end of file
+}
+
+func TestCMakeResolveDirective(t *testing.T) {
+	cfg := NewCMakeConfig()
+	c := &config.Config{
+		Exts: make(map[string]interface{}),
+	}
+	c.Exts["cmake"] = cfg
+
+	f := &rule.File{
+		Directives: []rule.Directive{
+			{Key: "cmake_resolve", Value: "ZLIB::ZLIB @zlib//:zlib"},
+			{Key: "cmake_resolve", Value: "OpenSSL::SSL //third_party/openssl:ssl"},
+			{Key: "cmake_resolve", Value: "MISSING_LABEL"},
+		},
+	}
+
+	cfg.Configure(c, "test/package", f)
+
+	expected := map[string]string{
+		"ZLIB::ZLIB":   "@zlib//:zlib",
+		"OpenSSL::SSL": "//third_party/openssl:ssl",
+	}
+	if !reflect.DeepEqual(cfg.ResolveMappings, expected) {
+		t.Errorf("Expected ResolveMappings %v, got %v", expected, cfg.ResolveMappings)
+	}
+
+	// Labels are made relative to the package using them
+	if mapped, ok := cfg.ResolveLabel("OpenSSL::SSL", "third_party/openssl"); !ok || mapped != ":ssl" {
+		t.Errorf("Expected OpenSSL::SSL to resolve to ':ssl', got '%s'", mapped)
+	}
+	if _, ok := cfg.ResolveLabel("Threads::Threads", "test/package"); ok {
+		t.Error("Expected Threads::Threads to have no mapping")
+	}
+}
+
+func TestCMakeResolveFileDirective(t *testing.T) {
+	repoRoot := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repoRoot, "third_party"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mappingFile := "# Imported targets of find_package() modules\n" +
+		"ZLIB::ZLIB   @zlib//:zlib\n" +
+		"\n" +
+		"OpenSSL::SSL @openssl//:ssl\n"
+	if err := os.WriteFile(filepath.Join(repoRoot, "third_party", "cmake_deps.txt"), []byte(mappingFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewCMakeConfig()
+	c := &config.Config{
+		RepoRoot: repoRoot,
+		Exts:     make(map[string]interface{}),
+	}
+	c.Exts["cmake"] = cfg
+
+	f := &rule.File{
+		Directives: []rule.Directive{
+			{Key: "cmake_resolve_file", Value: "cmake_deps.txt"},
+			{Key: "cmake_resolve", Value: "ZLIB::ZLIB @zlib_ng//:zlib"},
+		},
+	}
+
+	// The file is relative to the package declaring the directive, and later
+	// directives override its entries
+	cfg.Configure(c, "third_party", f)
+
+	expected := map[string]string{
+		"ZLIB::ZLIB":   "@zlib_ng//:zlib",
+		"OpenSSL::SSL": "@openssl//:ssl",
+	}
+	if !reflect.DeepEqual(cfg.ResolveMappings, expected) {
+		t.Errorf("Expected ResolveMappings %v, got %v", expected, cfg.ResolveMappings)
+	}
+}
+
+func TestCMakeLinkoptsDirective(t *testing.T) {
+	cfg := NewCMakeConfig()
+	c := &config.Config{
+		Exts: make(map[string]interface{}),
+	}
+	c.Exts["cmake"] = cfg
+
+	f := &rule.File{
+		Directives: []rule.Directive{
+			{Key: "cmake_linkopts", Value: "pthread -pthread"},
+			{Key: "cmake_linkopts", Value: "rt"},
+		},
+	}
+
+	cfg.Configure(c, "test/package", f)
+
+	expected := map[string][]string{
+		"pthread": {"-pthread"},
+		"rt":      {},
+	}
+	if !reflect.DeepEqual(cfg.LinkoptsMappings, expected) {
+		t.Errorf("Expected LinkoptsMappings %v, got %v", expected, cfg.LinkoptsMappings)
+	}
+}
+
+func TestCMakePreserveGlobsDirective(t *testing.T) {
+	cfg := NewCMakeConfig()
+	c := &config.Config{
+		Exts: make(map[string]interface{}),
+	}
+	c.Exts["cmake"] = cfg
+
+	f := &rule.File{
+		Directives: []rule.Directive{
+			{Key: "cmake_preserve_globs", Value: ""},
+		},
+	}
+	cfg.Configure(c, "test/package", f)
+	if !cfg.PreserveGlobs {
+		t.Error("Expected an empty cmake_preserve_globs to enable PreserveGlobs")
+	}
+
+	// Invalid values are ignored, keeping the previous setting
+	for _, tc := range []struct {
+		value    string
+		expected bool
+	}{
+		{"false", false},
+		{"invalid", false},
+		{"true", true},
+	} {
+		f.Directives = []rule.Directive{{Key: "cmake_preserve_globs", Value: tc.value}}
+		cfg.Configure(c, "test/package", f)
+		if cfg.PreserveGlobs != tc.expected {
+			t.Errorf("Expected PreserveGlobs %v after cmake_preserve_globs %q, got %v", tc.expected, tc.value, cfg.PreserveGlobs)
+		}
+	}
+}
+
+func TestCMakeLayoutDirective(t *testing.T) {
+	cfg := NewCMakeConfig()
+	c := &config.Config{
+		Exts: make(map[string]interface{}),
+	}
+	c.Exts["cmake"] = cfg
+
+	if cfg.Layout != "flat" {
+		t.Errorf("Expected the flat layout by default, got %q", cfg.Layout)
+	}
+
+	f := &rule.File{
+		Directives: []rule.Directive{
+			{Key: "cmake_layout", Value: "mirror"},
+			{Key: "cmake_define", Value: "BUILD_TESTING OFF"},
+			{Key: "cmake_source", Value: "@somelib"},
+		},
+	}
+	cfg.Configure(c, "thirdparty/somelib", f)
+	if cfg.Layout != "mirror" {
+		t.Errorf("Expected the mirror layout, got %q", cfg.Layout)
+	}
+	if cfg.SourcePackage != "thirdparty/somelib" || cfg.Source != "@somelib" {
+		t.Errorf("Expected cmake_source @somelib in thirdparty/somelib, got %s in %s", cfg.Source, cfg.SourcePackage)
+	}
+	if expected := map[string]string{"BUILD_TESTING": "OFF"}; !reflect.DeepEqual(cfg.SourceDefines, expected) {
+		t.Errorf("Expected source defines %v, got %v", expected, cfg.SourceDefines)
+	}
+
+	// Subpackages inherit the layout and the source, and invalid values are ignored
+	sub := cfg.Clone()
+	sub.Configure(c, "thirdparty/somelib/src", &rule.File{
+		Directives: []rule.Directive{{Key: "cmake_layout", Value: "nested"}},
+	})
+	if sub.Layout != "mirror" || sub.SourcePackage != "thirdparty/somelib" {
+		t.Errorf("Expected the mirror layout of thirdparty/somelib, got %q of %q", sub.Layout, sub.SourcePackage)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/goniz/gazelle-foreign-cc/common"
@@ -255,14 +256,15 @@ func TestGenerateRules_ConfigureFile(t *testing.T) {
 		rulesByName[r.Name()] = r
 	}
 	
-	// Check that cmake_configure_file rule was generated
+	// Check that the template is configured without running cmake, since it
+	// does not use check results
 	configRule := rulesByName["config_h"]
 	if configRule == nil {
-		t.Fatal("Expected to find 'config_h' cmake_configure_file rule")
+		t.Fatal("Expected to find 'config_h' cmake_configure_template rule")
 	}
 	
-	if configRule.Kind() != "cmake_configure_file" {
-		t.Errorf("Expected rule kind 'cmake_configure_file', got '%s'", configRule.Kind())
+	if configRule.Kind() != "cmake_configure_template" {
+		t.Errorf("Expected rule kind 'cmake_configure_template', got '%s'", configRule.Kind())
 	}
 	
 	// Check attributes
@@ -270,44 +272,23 @@ func TestGenerateRules_ConfigureFile(t *testing.T) {
 	if out != "config.h" {
 		t.Errorf("Expected out 'config.h', got '%s'", out)
 	}
-	
-	// Check new attributes
-	cmakeBinary := configRule.AttrString("cmake_binary")
-	if cmakeBinary != "//:cmake" {
-		t.Errorf("Expected cmake_binary '//:cmake', got '%s'", cmakeBinary)
-	}
-	
-	cmakeSourceDir := configRule.AttrString("cmake_source_dir")
-	if cmakeSourceDir != "." {
-		t.Errorf("Expected cmake_source_dir '.', got '%s'", cmakeSourceDir)
-	}
-	
-	generatedFilePath := configRule.AttrString("generated_file_path")
-	// generated_file_path should be optional when it equals the out attribute
-	// If not set explicitly, the rule should default it to the out path
-	if generatedFilePath != "" && generatedFilePath != "config.h" {
-		t.Errorf("Expected generated_file_path to be empty or 'config.h', got '%s'", generatedFilePath)
+	if src := configRule.AttrString("src"); src != "config.h.in" {
+		t.Errorf("Expected src 'config.h.in', got '%s'", src)
 	}
-	
-	// Check that cmake_source_files includes CMakeLists.txt and the input file
-	cmakeSourceFiles := configRule.AttrStrings("cmake_source_files")
-	expectedFiles := []string{"CMakeLists.txt", "config.h.in"}
-	if len(cmakeSourceFiles) != len(expectedFiles) {
-		t.Errorf("Expected cmake_source_files %v, got %v", expectedFiles, cmakeSourceFiles)
-	} else {
-		for i, expected := range expectedFiles {
-			if i >= len(cmakeSourceFiles) || cmakeSourceFiles[i] != expected {
-				t.Errorf("Expected cmake_source_files[%d] '%s', got '%s'", i, expected, cmakeSourceFiles[i])
-				break
-			}
+	// Check that defines hold the values of the variables the template uses
+	formatted := formatRule(configRule)
+	for _, expected := range []string{
+		`at_only = True`,
+		`"PROJECT_NAME": "ConfigureFileExample"`,
+		`"PROJECT_VERSION": "1.2.3"`,
+		`"PROJECT_DESCRIPTION": "A test project for configure_file"`,
+		`"ENABLE_FEATURE": "ON"`,
+	} {
+		if !strings.Contains(formatted, expected) {
+			t.Errorf("Expected %s in:\n%s", expected, formatted)
 		}
 	}
 	
-	// Check that defines were set (stored as a private attribute)
-	if !hasDefines(configRule) {
-		t.Error("Expected defines to be set, but rule does not have defines attribute")
-	}
-	
 	// Check that regular cc_library and cc_binary rules were also generated
 	libRule := rulesByName["mylib"]
 	if libRule == nil {
@@ -330,3 +311,629 @@ func TestGenerateRules_ConfigureFile(t *testing.T) {
 func hasDefines(r *rule.Rule) bool {
 	return r.Attr("defines") != nil
 }
+
+// formatRule returns a rule as it is written to a BUILD file
+func formatRule(r *rule.Rule) string {
+	f := rule.EmptyFile("BUILD.bazel", "")
+	r.Insert(f)
+	return string(f.Format())
+}
+
+func TestGenerateRules_ConfigureFileOptions(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Options VERSION 2.0)
+include(CheckIncludeFile)
+check_include_file(unistd.h HAVE_UNISTD_H)
+set(GREETING "hi")
+configure_file(
+  version.h.in
+  version.h
+  NEWLINE_STYLE CRLF
+  ESCAPE_QUOTES)
+configure_file(data.txt data.txt COPYONLY)
+configure_file(checks.h.in checks.h)
+file(CONFIGURE OUTPUT greeting.h CONTENT "#define GREETING \"@GREETING@\"" @ONLY)
+`,
+		"version.h.in": "#define VERSION \"${PROJECT_VERSION}\"\n#cmakedefine GREETING\n",
+		"data.txt":     "@NOT_SUBSTITUTED@\n",
+		"checks.h.in":  "#cmakedefine HAVE_UNISTD_H\n",
+	}
+	var regularFiles []string
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		regularFiles = append(regularFiles, name)
+	}
+
+	c := config.New()
+	c.RepoRoot = dir
+	common.GetCMakeConfig(c)
+	result := GenerateRules(language.GenerateArgs{Config: c, Dir: dir, RegularFiles: regularFiles})
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+
+	tests := []struct {
+		name     string
+		kind     string
+		expected []string
+	}{
+		{"version_h", "cmake_configure_template", []string{`src = "version.h.in"`, `out = "version.h"`, `"GREETING": "hi"`, `"PROJECT_VERSION": "2.0"`, `escape_quotes = True`, `newline_style = "DOS"`}},
+		{"data_txt", "cmake_configure_template", []string{`src = "data.txt"`, `copy_only = True`}},
+		{"greeting_h", "cmake_configure_template", []string{`content = "#define GREETING \"@GREETING@\""`, `"GREETING": "hi"`, `at_only = True`}},
+		// Check results are only known to cmake
+		{"checks_h", "cmake_configure_file", []string{`cmake_source_files = [`, `"checks.h.in"`}},
+	}
+	for _, tt := range tests {
+		r := rules[tt.name]
+		if r == nil {
+			t.Errorf("Expected a rule %s", tt.name)
+			continue
+		}
+		if r.Kind() != tt.kind {
+			t.Errorf("Expected %s to be a %s, got %s", tt.name, tt.kind, r.Kind())
+		}
+		formatted := formatRule(r)
+		for _, expected := range tt.expected {
+			if !strings.Contains(formatted, expected) {
+				t.Errorf("Expected %s in:\n%s", expected, formatted)
+			}
+		}
+	}
+}
+
+func TestGenerateRules_ComplexCCProject_Tests(t *testing.T) {
+	// Executables registered with add_test() become cc_test rules
+	projectRelDir := "testdata/complex_cc_project"
+
+	args := createMockGenerateArgs(t,
+		projectRelDir,
+		[]string{"src/main.cpp", "src/core.cpp", "src/manager.cpp", "src/utils.cpp", "src/helper.cpp", "tests/test_main.cpp", "tests/test_utils.cpp", "CMakeLists.txt"},
+	)
+
+	result := GenerateRules(args)
+
+	var testRule *rule.Rule
+	for _, r := range result.Gen {
+		if r.Name() == "test_runner" {
+			testRule = r
+		}
+	}
+	if testRule == nil {
+		t.Fatal("Expected to find 'test_runner' rule")
+	}
+
+	if testRule.Kind() != "cc_test" {
+		t.Errorf("Expected test_runner to be cc_test, got %s", testRule.Kind())
+	}
+	if args := testRule.AttrStrings("args"); !reflect.DeepEqual(args, []string{"--verbose"}) {
+		t.Errorf("Expected args [--verbose], got %v", args)
+	}
+	if tags := testRule.AttrStrings("tags"); !reflect.DeepEqual(tags, []string{"unit"}) {
+		t.Errorf("Expected tags [unit], got %v", tags)
+	}
+	if timeout := testRule.AttrString("timeout"); timeout != "short" {
+		t.Errorf("Expected timeout 'short', got '%s'", timeout)
+	}
+}
+
+func TestGenerateRules_InterfaceLibrary(t *testing.T) {
+	// INTERFACE libraries become header-only cc_library rules carrying their usage requirements
+	projectRelDir := "testdata/interface_library_project"
+
+	args := createMockGenerateArgs(t,
+		projectRelDir,
+		[]string{"main.cpp", "include/mathutil/vec.h", "CMakeLists.txt"},
+	)
+
+	result := GenerateRules(args)
+
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+
+	mathutil, ok := rules["mathutil"]
+	if !ok {
+		t.Fatal("Expected to find 'mathutil' rule")
+	}
+	if mathutil.Kind() != "cc_library" {
+		t.Errorf("Expected mathutil to be cc_library, got %s", mathutil.Kind())
+	}
+	if srcs := mathutil.AttrStrings("srcs"); len(srcs) != 0 {
+		t.Errorf("Expected no srcs for mathutil, got %v", srcs)
+	}
+	if hdrs := mathutil.AttrStrings("hdrs"); !reflect.DeepEqual(hdrs, []string{"include/mathutil/vec.h"}) {
+		t.Errorf("Expected hdrs [include/mathutil/vec.h], got %v", hdrs)
+	}
+	if includes := mathutil.AttrStrings("includes"); !reflect.DeepEqual(includes, []string{"include"}) {
+		t.Errorf("Expected includes [include], got %v", includes)
+	}
+	if defines := mathutil.AttrStrings("defines"); !reflect.DeepEqual(defines, []string{"MATHUTIL_HEADER_ONLY"}) {
+		t.Errorf("Expected defines [MATHUTIL_HEADER_ONLY], got %v", defines)
+	}
+
+	calc, ok := rules["calc"]
+	if !ok {
+		t.Fatal("Expected to find 'calc' rule")
+	}
+	if deps := calc.AttrStrings("deps"); !reflect.DeepEqual(deps, []string{":mathutil"}) {
+		t.Errorf("Expected calc deps [:mathutil], got %v", deps)
+	}
+}
+
+func TestGenerateRules_ComplexCCProject_SharedLibrary(t *testing.T) {
+	// SHARED libraries get a cc_shared_library that executables link dynamically
+	projectRelDir := "testdata/complex_cc_project"
+
+	args := createMockGenerateArgs(t,
+		projectRelDir,
+		[]string{"src/main.cpp", "src/core.cpp", "src/manager.cpp", "src/utils.cpp", "src/helper.cpp", "CMakeLists.txt"},
+	)
+
+	result := GenerateRules(args)
+
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+
+	shared, ok := rules["core_shared"]
+	if !ok {
+		t.Fatal("Expected to find 'core_shared' rule")
+	}
+	if shared.Kind() != "cc_shared_library" {
+		t.Errorf("Expected core_shared to be cc_shared_library, got %s", shared.Kind())
+	}
+	if deps := shared.AttrStrings("deps"); !reflect.DeepEqual(deps, []string{":core"}) {
+		t.Errorf("Expected core_shared deps [:core], got %v", deps)
+	}
+	if name := shared.AttrString("shared_lib_name"); name != "libcore.so" {
+		t.Errorf("Expected shared_lib_name 'libcore.so', got '%s'", name)
+	}
+
+	if _, ok := rules["utils_shared"]; ok {
+		t.Error("Did not expect a cc_shared_library for the STATIC library utils")
+	}
+	if dynamicDeps := rules["main_app"].AttrStrings("dynamic_deps"); !reflect.DeepEqual(dynamicDeps, []string{":core_shared"}) {
+		t.Errorf("Expected main_app dynamic_deps [:core_shared], got %v", dynamicDeps)
+	}
+}
+
+func TestGenerateRules_RegexFallback_Linkopts(t *testing.T) {
+	// System libraries and linker flags passed to target_link_libraries become linkopts
+	projectRelDir := "testdata/regex_fallback_project"
+
+	args := createMockGenerateArgs(t,
+		projectRelDir,
+		[]string{"main.cpp", "utils.cpp", "helper.cpp", "CMakeLists.txt"},
+	)
+
+	result := GenerateRules(args)
+
+	var app *rule.Rule
+	for _, r := range result.Gen {
+		if r.Name() == "simple_app" {
+			app = r
+		}
+	}
+	if app == nil {
+		t.Fatal("Expected to find 'simple_app' rule")
+	}
+	if deps := app.AttrStrings("deps"); !reflect.DeepEqual(deps, []string{":simple_lib"}) {
+		t.Errorf("Expected deps [:simple_lib], got %v", deps)
+	}
+	if linkopts := app.AttrStrings("linkopts"); !reflect.DeepEqual(linkopts, []string{"-lm", "-Wl,--as-needed"}) {
+		t.Errorf("Expected linkopts [-lm -Wl,--as-needed], got %v", linkopts)
+	}
+
+	// A cmake_linkopts directive overrides how a system library is linked
+	common.GetCMakeConfig(args.Config).LinkoptsMappings["m"] = nil
+	result = GenerateRules(args)
+	for _, r := range result.Gen {
+		if r.Name() == "simple_app" {
+			if linkopts := r.AttrStrings("linkopts"); !reflect.DeepEqual(linkopts, []string{"-Wl,--as-needed"}) {
+				t.Errorf("Expected linkopts [-Wl,--as-needed] with m dropped, got %v", linkopts)
+			}
+		}
+	}
+}
+
+func TestGenerateRules_RegexFallback_Frameworks(t *testing.T) {
+	// A macOS framework stays one linkopt with its name, however it is written
+	dir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Frameworks)
+add_executable(app main.cpp)
+target_link_libraries(app "-framework CoreFoundation" -framework Security)
+`,
+		"main.cpp": "",
+	}
+	var regularFiles []string
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		regularFiles = append(regularFiles, name)
+	}
+
+	c := config.New()
+	c.RepoRoot = dir
+	common.GetCMakeConfig(c)
+	result := GenerateRules(language.GenerateArgs{Config: c, Dir: dir, RegularFiles: regularFiles})
+	if len(result.Gen) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(result.Gen))
+	}
+	expected := []string{"-framework CoreFoundation", "-framework Security"}
+	if linkopts := result.Gen[0].AttrStrings("linkopts"); !reflect.DeepEqual(linkopts, expected) {
+		t.Errorf("Expected linkopts %v, got %v", expected, linkopts)
+	}
+}
+
+func TestGenerateRules_RegexFallback_Variables(t *testing.T) {
+	// Source lists built with set() and list() are expanded into srcs
+	projectRelDir := "testdata/regex_fallback_project"
+
+	args := createMockGenerateArgs(t,
+		projectRelDir,
+		[]string{"main.cpp", "utils.cpp", "helper.cpp", "CMakeLists.txt"},
+	)
+
+	result := GenerateRules(args)
+
+	expectedSrcs := map[string][]string{
+		"simple_app": {"main.cpp", "utils.cpp"},
+		"simple_lib": {"helper.cpp"},
+	}
+	for _, r := range result.Gen {
+		expected, ok := expectedSrcs[r.Name()]
+		if !ok {
+			continue
+		}
+		delete(expectedSrcs, r.Name())
+		if srcs := r.AttrStrings("srcs"); !reflect.DeepEqual(srcs, expected) {
+			t.Errorf("Expected %s srcs %v, got %v", r.Name(), expected, srcs)
+		}
+	}
+	for name := range expectedSrcs {
+		t.Errorf("Expected to find '%s' rule", name)
+	}
+}
+
+func TestGenerateRules_SubdirectoryProject(t *testing.T) {
+	// Targets of add_subdirectory() directories without a BUILD file of their
+	// own are generated in the package, with paths relative to it
+	projectRelDir := "testdata/subdirectory_project"
+
+	args := createMockGenerateArgs(t,
+		projectRelDir,
+		[]string{"main.cpp", "CMakeLists.txt"},
+	)
+
+	result := GenerateRules(args)
+
+	rulesByName := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rulesByName[r.Name()] = r
+	}
+	if _, ok := rulesByName["greeter"]; ok {
+		t.Error("Expected 'greeter' to be left to the package of its own directory")
+	}
+
+	app := rulesByName["app"]
+	if app == nil {
+		t.Fatal("Expected to find 'app' rule")
+	}
+	if expected := []string{"main.cpp"}; !reflect.DeepEqual(app.AttrStrings("srcs"), expected) {
+		t.Errorf("Expected app srcs %v, got %v", expected, app.AttrStrings("srcs"))
+	}
+	expectedDeps := []string{":mathlib", "//testdata/subdirectory_project/plugin:greeter"}
+	if deps := app.AttrStrings("deps"); !reflect.DeepEqual(deps, expectedDeps) {
+		t.Errorf("Expected app deps %v, got %v", expectedDeps, deps)
+	}
+
+	mathlib := rulesByName["mathlib"]
+	if mathlib == nil {
+		t.Fatal("Expected to find 'mathlib' rule")
+	}
+	if expected := []string{"lib/mathlib.cpp"}; !reflect.DeepEqual(mathlib.AttrStrings("srcs"), expected) {
+		t.Errorf("Expected mathlib srcs %v, got %v", expected, mathlib.AttrStrings("srcs"))
+	}
+	if expected := []string{"lib/mathlib.h"}; !reflect.DeepEqual(mathlib.AttrStrings("hdrs"), expected) {
+		t.Errorf("Expected mathlib hdrs %v, got %v", expected, mathlib.AttrStrings("hdrs"))
+	}
+}
+
+func TestGenerateRules_SubdirectoryProjectOutsideRepository(t *testing.T) {
+	// The BUILD files of sources outside the repository are no packages of it,
+	// so the targets of all their directories are generated in the package
+	args := createMockGenerateArgs(t, "testdata/subdirectory_project", []string{"main.cpp", "CMakeLists.txt"})
+	args.Config.RepoRoot = t.TempDir()
+	args.Rel = "third_party/subdirectory"
+
+	rulesByName := make(map[string]*rule.Rule)
+	for _, r := range GenerateRules(args).Gen {
+		rulesByName[r.Name()] = r
+	}
+	if greeter := rulesByName["greeter"]; greeter == nil {
+		t.Error("Expected 'greeter' to be generated in the package")
+	} else if expected := []string{"plugin/greeter.cpp"}; !reflect.DeepEqual(greeter.AttrStrings("srcs"), expected) {
+		t.Errorf("Expected greeter srcs %v, got %v", expected, greeter.AttrStrings("srcs"))
+	}
+	app := rulesByName["app"]
+	if app == nil {
+		t.Fatal("Expected to find 'app' rule")
+	}
+	if expected := []string{":mathlib", ":greeter"}; !reflect.DeepEqual(app.AttrStrings("deps"), expected) {
+		t.Errorf("Expected app deps %v, got %v", expected, app.AttrStrings("deps"))
+	}
+}
+
+func TestGenerateRules_SubdirectoryOfParentProject(t *testing.T) {
+	// Without a BUILD file, the directory is covered by the parent package
+	args := createMockGenerateArgs(t, "testdata/subdirectory_project/lib", []string{"mathlib.cpp", "mathlib.h", "CMakeLists.txt"})
+	args.Config.RepoRoot = filepath.Dir(filepath.Dir(filepath.Dir(args.Dir)))
+
+	if result := GenerateRules(args); len(result.Gen) != 0 {
+		t.Errorf("Expected no rules for a subdirectory of a parent CMake project, got %d", len(result.Gen))
+	}
+}
+
+func TestGenerateRules_PreserveGlobs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Globs)
+file(GLOB SOURCES src/*.cpp)
+file(GLOB_RECURSE HEADERS RELATIVE ${CMAKE_CURRENT_SOURCE_DIR} include/*.h)
+add_library(core ${SOURCES} ${HEADERS} extra.cpp)
+`,
+		"src/a.cpp":          "",
+		"src/b.cpp":          "",
+		"extra.cpp":          "",
+		"include/core.h":     "",
+		"include/sub/util.h": "",
+	}
+	var regularFiles []string
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(name) == "." {
+			regularFiles = append(regularFiles, name)
+		}
+	}
+
+	c := config.New()
+	c.RepoRoot = dir
+	common.GetCMakeConfig(c).PreserveGlobs = true
+	args := language.GenerateArgs{
+		Config:       c,
+		Dir:          dir,
+		RegularFiles: regularFiles,
+	}
+
+	result := GenerateRules(args)
+
+	var core *rule.Rule
+	for _, r := range result.Gen {
+		if r.Name() == "core" {
+			core = r
+		}
+	}
+	if core == nil {
+		t.Fatal("Expected to find 'core' rule")
+	}
+
+	f := rule.EmptyFile("BUILD.bazel", "")
+	core.Insert(f)
+	content := string(f.Format())
+	for _, expected := range []string{
+		`srcs = glob(["src/*.cpp"]) + ["extra.cpp"]`,
+		`"include/**/*.h"`,
+		`exclude = [".cmake-build/**"]`,
+	} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected generated rule to contain %s, got:\n%s", expected, content)
+		}
+	}
+
+	// The files the globs matched are still known to the resolver
+	expectedSrcs := []string{"extra.cpp", "src/a.cpp", "src/b.cpp"}
+	srcs := common.RuleFiles(core, "srcs")
+	sort.Strings(srcs)
+	if !reflect.DeepEqual(srcs, expectedSrcs) {
+		t.Errorf("Expected core files %v, got %v", expectedSrcs, srcs)
+	}
+}
+
+func TestGenerateRules_DirectoryProperties(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Legacy)
+include_directories(include)
+add_definitions(-DLEGACY -Wall)
+add_executable(app main.cpp)
+`,
+		"main.cpp": "",
+	}
+	var regularFiles []string
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		regularFiles = append(regularFiles, name)
+	}
+
+	c := config.New()
+	c.RepoRoot = dir
+	common.GetCMakeConfig(c)
+	result := GenerateRules(language.GenerateArgs{Config: c, Dir: dir, RegularFiles: regularFiles})
+	if len(result.Gen) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(result.Gen))
+	}
+	app := result.Gen[0]
+	// Directory properties are private to the targets of the directory
+	if includes := app.AttrStrings("includes"); len(includes) > 0 {
+		t.Errorf("Expected no includes, got %v", includes)
+	}
+	if expected := []string{"LEGACY"}; !reflect.DeepEqual(app.AttrStrings("local_defines"), expected) {
+		t.Errorf("Expected local_defines %v, got %v", expected, app.AttrStrings("local_defines"))
+	}
+	if expected := []string{"-Iinclude", "-Wall"}; !reflect.DeepEqual(app.AttrStrings("copts"), expected) {
+		t.Errorf("Expected copts %v, got %v", expected, app.AttrStrings("copts"))
+	}
+}
+
+func TestGenerateRules_Scopes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Scopes)
+add_library(util util.cpp)
+add_library(core core.cpp)
+target_include_directories(core PUBLIC include PRIVATE src)
+target_compile_definitions(core PUBLIC CORE_API INTERFACE CORE_USER PRIVATE CORE_BUILD)
+target_compile_options(core INTERFACE -fno-exceptions PRIVATE -Wall)
+target_link_libraries(core PRIVATE util)
+add_executable(app main.cpp)
+target_link_libraries(app PRIVATE core)
+`,
+		"util.cpp": "",
+		"core.cpp": "",
+		"main.cpp": "",
+	}
+	var regularFiles []string
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		regularFiles = append(regularFiles, name)
+	}
+
+	c := config.New()
+	c.RepoRoot = dir
+	common.GetCMakeConfig(c)
+	result := GenerateRules(language.GenerateArgs{Config: c, Dir: dir, RegularFiles: regularFiles})
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+
+	core := rules["core"]
+	if core == nil {
+		t.Fatal("Expected a rule for core")
+	}
+	if expected := []string{"include"}; !reflect.DeepEqual(core.AttrStrings("includes"), expected) {
+		t.Errorf("Expected includes %v, got %v", expected, core.AttrStrings("includes"))
+	}
+	if expected := []string{"-Isrc", "-fno-exceptions", "-Wall"}; !reflect.DeepEqual(core.AttrStrings("copts"), expected) {
+		t.Errorf("Expected copts %v, got %v", expected, core.AttrStrings("copts"))
+	}
+	if expected := []string{"CORE_API", "CORE_USER"}; !reflect.DeepEqual(core.AttrStrings("defines"), expected) {
+		t.Errorf("Expected defines %v, got %v", expected, core.AttrStrings("defines"))
+	}
+	if expected := []string{"CORE_BUILD"}; !reflect.DeepEqual(core.AttrStrings("local_defines"), expected) {
+		t.Errorf("Expected local_defines %v, got %v", expected, core.AttrStrings("local_defines"))
+	}
+	if deps := core.AttrStrings("deps"); len(deps) > 0 {
+		t.Errorf("Expected no deps, got %v", deps)
+	}
+	if expected := []string{":util"}; !reflect.DeepEqual(core.AttrStrings("implementation_deps"), expected) {
+		t.Errorf("Expected implementation_deps %v, got %v", expected, core.AttrStrings("implementation_deps"))
+	}
+
+	// Executables have no consumers, so PRIVATE links stay in deps
+	if expected := []string{":core"}; !reflect.DeepEqual(rules["app"].AttrStrings("deps"), expected) {
+		t.Errorf("Expected app deps %v, got %v", expected, rules["app"].AttrStrings("deps"))
+	}
+	// Bazel does not propagate copts, so consumers list the propagated options
+	if expected := []string{"-fno-exceptions"}; !reflect.DeepEqual(rules["app"].AttrStrings("copts"), expected) {
+		t.Errorf("Expected app copts %v, got %v", expected, rules["app"].AttrStrings("copts"))
+	}
+}
+
+func TestGenerateRules_CustomCommands(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Custom)
+add_executable(mkversion mkversion.c)
+add_custom_command(
+  OUTPUT ${CMAKE_CURRENT_BINARY_DIR}/version.c
+  COMMAND mkversion ${CMAKE_CURRENT_SOURCE_DIR}/version.txt > version.c
+  DEPENDS mkversion version.txt
+  VERBATIM)
+add_custom_command(
+  OUTPUT table.h
+  COMMAND ${CMAKE_COMMAND} -E copy ${CMAKE_CURRENT_SOURCE_DIR}/table.h.in table.h)
+add_custom_command(
+  OUTPUT config.c
+  COMMAND generate $<TARGET_FILE:mkversion> config.c)
+add_library(core core.c ${CMAKE_CURRENT_BINARY_DIR}/version.c table.h config.c)
+add_custom_target(docs COMMAND doxygen)
+`,
+		"mkversion.c": "",
+		"version.txt": "",
+		"table.h.in":  "",
+		"core.c":      "",
+	}
+	var regularFiles []string
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		regularFiles = append(regularFiles, name)
+	}
+
+	c := config.New()
+	c.RepoRoot = dir
+	common.GetCMakeConfig(c)
+	result := GenerateRules(language.GenerateArgs{Config: c, Dir: dir, RegularFiles: regularFiles})
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+
+	version := rules["version_c"]
+	if version == nil || version.Kind() != "genrule" {
+		t.Fatalf("Expected a genrule version_c, got %v", version)
+	}
+	if expected := []string{"version.txt"}; !reflect.DeepEqual(version.AttrStrings("srcs"), expected) {
+		t.Errorf("Expected srcs %v, got %v", expected, version.AttrStrings("srcs"))
+	}
+	if expected := []string{"version.c"}; !reflect.DeepEqual(version.AttrStrings("outs"), expected) {
+		t.Errorf("Expected outs %v, got %v", expected, version.AttrStrings("outs"))
+	}
+	if expected := []string{":mkversion"}; !reflect.DeepEqual(version.AttrStrings("tools"), expected) {
+		t.Errorf("Expected tools %v, got %v", expected, version.AttrStrings("tools"))
+	}
+	if expected := "$(execpath :mkversion) $(location version.txt) > $(location version.c)"; version.AttrString("cmd") != expected {
+		t.Errorf("Expected cmd %q, got %q", expected, version.AttrString("cmd"))
+	}
+
+	// cmake -E is replaced by the shell command doing the same
+	if expected := "cp $(location table.h.in) $(location table.h)"; rules["table_h"] == nil || rules["table_h"].AttrString("cmd") != expected {
+		t.Errorf("Expected a genrule table_h with cmd %q, got %v", expected, rules["table_h"])
+	}
+
+	// Generator expressions and custom targets without outputs cannot be
+	// translated, and their outputs are not listed
+	if rules["config_c"] != nil || rules["docs"] != nil {
+		t.Errorf("Expected no genrules for config.c and docs")
+	}
+	core := rules["core"]
+	if core == nil {
+		t.Fatal("Expected a rule for core")
+	}
+	if expected := []string{"core.c", "version.c"}; !reflect.DeepEqual(core.AttrStrings("srcs"), expected) {
+		t.Errorf("Expected srcs %v, got %v", expected, core.AttrStrings("srcs"))
+	}
+	if expected := []string{"table.h"}; !reflect.DeepEqual(core.AttrStrings("hdrs"), expected) {
+		t.Errorf("Expected hdrs %v, got %v", expected, core.AttrStrings("hdrs"))
+	}
+}
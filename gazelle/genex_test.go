@@ -0,0 +1,199 @@
+package gazelle
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/goniz/gazelle-foreign-cc/common"
+)
+
+func TestGenex_Evaluate(t *testing.T) {
+	properties := map[string]string{
+		"core.INCLUDE_DIRECTORIES": "/src/include;$<$<CONFIG:Debug>:/src/debug>",
+		"core.TYPE":                "STATIC_LIBRARY",
+	}
+	newContext := func() *common.GenexContext {
+		return &common.GenexContext{
+			Config:    "Debug",
+			Languages: []string{"CXX"},
+			Target:    "app",
+			TargetProperty: func(target, property string) (string, bool) {
+				value, ok := properties[target+"."+property]
+				return value, ok
+			},
+		}
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"plain.cpp", "plain.cpp"},
+		{"$<BUILD_INTERFACE:${CMAKE_CURRENT_SOURCE_DIR}/include>", "${CMAKE_CURRENT_SOURCE_DIR}/include"},
+		{"$<INSTALL_INTERFACE:include>", ""},
+		{"$<$<CONFIG:Debug>:foo.cpp>", "foo.cpp"},
+		{"$<$<CONFIG:Release,RelWithDebInfo>:foo.cpp>", ""},
+		{"$<$<CONFIG:debug>:ci>", "ci"},
+		{"$<CONFIG>", "Debug"},
+		{"$<PLATFORM_ID>", "Linux"},
+		{"$<$<PLATFORM_ID:Windows>:win.cpp>", ""},
+		{"$<$<COMPILE_LANGUAGE:CXX>:-fno-rtti>", "-fno-rtti"},
+		{"$<$<COMPILE_LANGUAGE:C>:-std=c99>", ""},
+		{"$<BOOL:OFF>", "0"},
+		{"$<BOOL:ON>", "1"},
+		{"$<NOT:$<BOOL:>>", "1"},
+		{"$<AND:1,$<CONFIG:Debug>>", "1"},
+		{"$<AND:1,$<CONFIG:Release>>", "0"},
+		{"$<OR:0,$<PLATFORM_ID:Linux>>", "1"},
+		{"$<IF:$<CONFIG:Debug>,debug.cpp,release.cpp>", "debug.cpp"},
+		{"$<STREQUAL:a,a>", "1"},
+		{"$<TARGET_PROPERTY:core,TYPE>", "STATIC_LIBRARY"},
+		{"$<TARGET_PROPERTY:core,INCLUDE_DIRECTORIES>", "/src/include;/src/debug"},
+		{"$<TARGET_PROPERTY:core,MISSING>", ""},
+		{"a$<COMMA>b$<SEMICOLON>c$<ANGLE-R>", "a,b;c>"},
+		{"$<LOWER_CASE:ABC>", "abc"},
+		{"$<UNKNOWN_GENEX:x>", ""},
+	}
+	for _, test := range tests {
+		if got := newContext().Evaluate(test.input); got != test.expected {
+			t.Errorf("Evaluate(%q) = %q, expected %q", test.input, got, test.expected)
+		}
+	}
+
+	// $<TARGET_OBJECTS> contributes nothing to the value but records the target
+	ctx := newContext()
+	if got := ctx.Evaluate("main.cpp;$<TARGET_OBJECTS:objlib>"); got != "main.cpp;" {
+		t.Errorf("Expected TARGET_OBJECTS to evaluate to nothing, got %q", got)
+	}
+	if expected := []string{"objlib"}; !reflect.DeepEqual(ctx.TargetObjects, expected) {
+		t.Errorf("Expected target objects %v, got %v", expected, ctx.TargetObjects)
+	}
+}
+
+func TestGenex_SplitByMode(t *testing.T) {
+	byMode := common.EvaluateForModes([]string{"main.cpp", "$<$<CONFIG:Debug>:debug.cpp>", "$<$<NOT:$<CONFIG:Debug>>:-DNDEBUG>"},
+		func(mode string) *common.GenexContext {
+			return &common.GenexContext{Config: common.CompilationModeConfigs("")[mode]}
+		})
+	all, specific := common.SplitByMode(byMode)
+	if expected := []string{"main.cpp"}; !reflect.DeepEqual(all, expected) {
+		t.Errorf("Expected values of all modes %v, got %v", expected, all)
+	}
+	expected := map[string][]string{
+		"dbg":       {"debug.cpp"},
+		"fastbuild": {"-DNDEBUG"},
+		"opt":       {"-DNDEBUG"},
+	}
+	if !reflect.DeepEqual(specific, expected) {
+		t.Errorf("Expected mode specific values %v, got %v", expected, specific)
+	}
+}
+
+func TestInterpreter_GeneratorExpressions(t *testing.T) {
+	src := `project(Genex)
+set(CMAKE_BUILD_TYPE Release)
+add_library(objlib OBJECT obj.cpp)
+add_library(core
+    core.cpp
+    $<$<CONFIG:Debug>:debug.cpp>
+    $<$<PLATFORM_ID:Windows>:win.cpp>
+    $<TARGET_OBJECTS:objlib>)
+target_include_directories(core PUBLIC
+    $<BUILD_INTERFACE:${CMAKE_CURRENT_SOURCE_DIR}/include>
+    $<INSTALL_INTERFACE:include>)
+target_compile_definitions(core PRIVATE $<$<CONFIG:Debug>:CORE_DEBUG> CORE)
+target_link_libraries(core PRIVATE $<$<NOT:$<CONFIG:Debug>>:-Wl,-O1> m)
+`
+	model := parseCMakeListsSource(t, src, nil)
+	core := model.Targets["core"]
+	if core == nil {
+		t.Fatal("Expected target core")
+	}
+	if expected := []string{"core.cpp"}; !reflect.DeepEqual(core.Sources, expected) {
+		t.Errorf("Expected sources %v, got %v", expected, core.Sources)
+	}
+	if expected := []string{"include"}; !reflect.DeepEqual(core.IncludeDirectories, expected) {
+		t.Errorf("Expected include directories %v, got %v", expected, core.IncludeDirectories)
+	}
+	if expected := []string{"CORE"}; !reflect.DeepEqual(core.CompileDefinitions, expected) {
+		t.Errorf("Expected compile definitions %v, got %v", expected, core.CompileDefinitions)
+	}
+	if expected := []string{"objlib"}; !reflect.DeepEqual(core.LinkedLibraries, expected) {
+		t.Errorf("Expected linked libraries %v, got %v", expected, core.LinkedLibraries)
+	}
+	if expected := []string{"m"}; !reflect.DeepEqual(core.SystemLibraries, expected) {
+		t.Errorf("Expected system libraries %v, got %v", expected, core.SystemLibraries)
+	}
+
+	debug := core.ConfigValues["dbg"]
+	if debug == nil {
+		t.Fatal("Expected values for the dbg compilation mode")
+	}
+	if expected := []string{"debug.cpp"}; !reflect.DeepEqual(debug.Sources, expected) {
+		t.Errorf("Expected dbg sources %v, got %v", expected, debug.Sources)
+	}
+	if expected := []string{"CORE_DEBUG"}; !reflect.DeepEqual(debug.CompileDefinitions, expected) {
+		t.Errorf("Expected dbg compile definitions %v, got %v", expected, debug.CompileDefinitions)
+	}
+	for _, mode := range []string{"fastbuild", "opt"} {
+		values := core.ConfigValues[mode]
+		if values == nil || !reflect.DeepEqual(values.LinkOptions, []string{"-Wl,-O1"}) {
+			t.Errorf("Expected %s link options [-Wl,-O1], got %+v", mode, values)
+		}
+	}
+}
+
+func TestGenerateRules_GeneratorExpressions(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Genex)
+add_library(core core.cpp $<$<CONFIG:Debug>:debug.cpp>)
+target_link_libraries(core PRIVATE $<$<CONFIG:Debug>:dl>)
+`,
+		"core.cpp":  "",
+		"debug.cpp": "",
+	}
+	var regularFiles []string
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		regularFiles = append(regularFiles, name)
+	}
+
+	c := config.New()
+	c.RepoRoot = dir
+	common.GetCMakeConfig(c)
+	result := GenerateRules(language.GenerateArgs{Config: c, Dir: dir, RegularFiles: regularFiles})
+	if len(result.Gen) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(result.Gen))
+	}
+	core := result.Gen[0]
+
+	f := rule.EmptyFile("BUILD.bazel", "")
+	core.Insert(f)
+	content := string(f.Format())
+	compact := strings.Join(strings.Fields(content), "")
+	for _, expected := range []string{
+		`srcs=["core.cpp"]+select({`,
+		`"@gazelle-foreign-cc//conditions:dbg":["debug.cpp",],`,
+		`"@gazelle-foreign-cc//conditions:opt":[],`,
+		`linkopts=select({`,
+		`"@gazelle-foreign-cc//conditions:dbg":["-ldl",],`,
+	} {
+		if !strings.Contains(compact, expected) {
+			t.Errorf("Expected generated rule to contain %s, got:\n%s", expected, content)
+		}
+	}
+
+	// The files of every mode are known to the resolver
+	if expected := []string{"core.cpp", "debug.cpp"}; !reflect.DeepEqual(common.RuleFiles(core, "srcs"), expected) {
+		t.Errorf("Expected core files %v, got %v", expected, common.RuleFiles(core, "srcs"))
+	}
+}
@@ -0,0 +1,686 @@
+package gazelle
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/goniz/gazelle-foreign-cc/common"
+)
+
+// parseCMakeListsSource writes src to a CMakeLists.txt in a temporary
+// directory and parses it with the fallback parser
+func parseCMakeListsSource(t *testing.T, src string, defines map[string]string) *common.CMakeListsModel {
+	t.Helper()
+	cmakeFilePath := filepath.Join(t.TempDir(), "CMakeLists.txt")
+	if err := os.WriteFile(cmakeFilePath, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	model, err := common.ParseCMakeListsWithDefines(cmakeFilePath, defines)
+	if err != nil {
+		t.Fatalf("ParseCMakeListsWithDefines failed: %v", err)
+	}
+	return model
+}
+
+func TestInterpreter_Variables(t *testing.T) {
+	t.Setenv("GAZELLE_CMAKE_TEST_DIR", "from_env")
+
+	src := `project(Demo VERSION 2.5.1)
+set(SRCS a.cpp b.cpp)
+set(SUFFIX cpp)
+set(NAME_cpp c.cpp)
+set(NESTED ${NAME_${SUFFIX}})
+set(QUOTED "x;y")
+set(EMPTY "")
+set(REMOVED value)
+set(REMOVED)
+set(ENV{GAZELLE_CMAKE_TEST_OVERRIDE} overridden)
+set(ENV_DIR $ENV{GAZELLE_CMAKE_TEST_DIR} $ENV{GAZELLE_CMAKE_TEST_OVERRIDE})
+set(ESCAPED \${SRCS})
+set(PROJECT_INFO ${PROJECT_NAME} ${PROJECT_VERSION_MINOR} ${Demo_VERSION})
+add_library(demo ${SRCS} ${NESTED} ${CMAKE_CURRENT_SOURCE_DIR}/d.cpp "${UNDEFINED}e.cpp")
+`
+	model := parseCMakeListsSource(t, src, nil)
+
+	expectedVars := map[string]string{
+		"SRCS":         "a.cpp;b.cpp",
+		"NESTED":       "c.cpp",
+		"QUOTED":       "x;y",
+		"EMPTY":        "",
+		"ENV_DIR":      "from_env;overridden",
+		"ESCAPED":      "${SRCS}",
+		"PROJECT_INFO": "Demo;5;2.5.1",
+	}
+	for name, expected := range expectedVars {
+		if actual, ok := model.Variables[name]; !ok || actual != expected {
+			t.Errorf("Expected %s = %q, got %q (defined: %v)", name, expected, actual, ok)
+		}
+	}
+	if _, ok := model.Variables["REMOVED"]; ok {
+		t.Error("Expected set() without a value to unset REMOVED")
+	}
+
+	demo := model.Targets["demo"]
+	if demo == nil {
+		t.Fatal("Expected to find 'demo' target")
+	}
+	if expected := []string{"a.cpp", "b.cpp", "c.cpp", "d.cpp", "e.cpp"}; !reflect.DeepEqual(demo.Sources, expected) {
+		t.Errorf("Expected sources %v, got %v", expected, demo.Sources)
+	}
+}
+
+func TestInterpreter_CacheVariables(t *testing.T) {
+	src := `set(CACHED cached CACHE STRING "doc")
+set(CACHED ignored CACHE STRING "doc")
+set(FORCED first CACHE STRING "doc")
+set(FORCED second CACHE STRING "doc" FORCE)
+set(FROM_DEFINE default CACHE STRING "doc")
+option(WITH_FEATURE "Enable the feature" ON)
+option(WITHOUT_VALUE "Defaults to OFF")
+set(SHADOWED normal)
+set(SHADOWED cached CACHE STRING "doc")
+set(RESULT ${CACHED} ${FORCED} ${FROM_DEFINE} ${WITH_FEATURE} ${WITHOUT_VALUE} ${SHADOWED} $CACHE{SHADOWED})
+`
+	model := parseCMakeListsSource(t, src, map[string]string{"FROM_DEFINE": "directive"})
+
+	// Cache entries are not normal variables, but references fall back to them
+	for _, name := range []string{"CACHED", "FORCED", "FROM_DEFINE", "WITH_FEATURE"} {
+		if _, ok := model.Variables[name]; ok {
+			t.Errorf("Expected %s to be a cache entry only", name)
+		}
+	}
+	if expected := "cached;second;directive;ON;OFF;normal;cached"; model.Variables["RESULT"] != expected {
+		t.Errorf("Expected RESULT = %q, got %q", expected, model.Variables["RESULT"])
+	}
+}
+
+func TestInterpreter_ListCommands(t *testing.T) {
+	src := `set(L c a b)
+list(APPEND L d)
+list(PREPEND L z)
+list(LENGTH L LEN)
+list(GET L 0 -1 ENDS)
+list(FIND L b FOUND)
+list(FIND L missing NOT_FOUND)
+list(JOIN L "," JOINED)
+list(SUBLIST L 1 2 SUB)
+set(SORTED ${L})
+list(SORT SORTED)
+set(REMOVED ${L})
+list(REMOVE_ITEM REMOVED a z)
+list(REMOVE_AT REMOVED -1)
+set(INSERTED a d)
+list(INSERT INSERTED 1 b c)
+set(DUPS a b a c b)
+list(REMOVE_DUPLICATES DUPS)
+set(REVERSED a b c)
+list(REVERSE REVERSED)
+set(POPPED a b c)
+list(POP_FRONT POPPED FIRST)
+list(POP_BACK POPPED LAST)
+set(FILES a.cpp b.h c.cpp)
+list(FILTER FILES INCLUDE REGEX "\\.cpp$")
+set(PATHS a.cpp b.cpp)
+list(TRANSFORM PATHS PREPEND src/ OUTPUT_VARIABLE PREFIXED)
+list(TRANSFORM PATHS REPLACE "(.*)\\.cpp" "\\1.cc")
+`
+	model := parseCMakeListsSource(t, src, nil)
+
+	expectedVars := map[string]string{
+		"L":         "z;c;a;b;d",
+		"LEN":       "5",
+		"ENDS":      "z;d",
+		"FOUND":     "3",
+		"NOT_FOUND": "-1",
+		"JOINED":    "z,c,a,b,d",
+		"SUB":       "c;a",
+		"SORTED":    "a;b;c;d;z",
+		"REMOVED":   "c;b",
+		"INSERTED":  "a;b;c;d",
+		"DUPS":      "a;b;c",
+		"REVERSED":  "c;b;a",
+		"POPPED":    "b",
+		"FIRST":     "a",
+		"LAST":      "c",
+		"FILES":     "a.cpp;c.cpp",
+		"PREFIXED":  "src/a.cpp;src/b.cpp",
+		"PATHS":     "a.cc;b.cc",
+	}
+	for name, expected := range expectedVars {
+		if actual := model.Variables[name]; actual != expected {
+			t.Errorf("Expected %s = %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestInterpreter_Conditions(t *testing.T) {
+	tests := []struct {
+		condition string
+		expected  bool
+	}{
+		{"TRUE", true},
+		{"OFF", false},
+		{"2", true},
+		{"0.0", false},
+		{"foo-NOTFOUND", false},
+		{"ENABLED", true},
+		{"DISABLED", false},
+		{"UNDEFINED_VARIABLE", false},
+		{`"ENABLED"`, false},
+		{"NOT DISABLED", true},
+		{"ENABLED AND DISABLED", false},
+		{"ENABLED OR DISABLED", true},
+		{"NOT ENABLED OR ENABLED AND NOT DISABLED", true},
+		{"(ENABLED OR DISABLED) AND NOT (DISABLED)", true},
+		{"NOT (ENABLED AND (DISABLED OR ENABLED))", false},
+		{"DEFINED ENABLED", true},
+		{"DEFINED UNDEFINED_VARIABLE", false},
+		{"DEFINED CACHE{FROM_DEFINE}", true},
+		{"NAME STREQUAL \"demo\"", true},
+		{"\"NAME\" STREQUAL \"demo\"", false},
+		{"${NAME} STREQUAL demo", true},
+		{"COUNT EQUAL 3", true},
+		{"COUNT GREATER 3", false},
+		{"COUNT LESS_EQUAL 3", true},
+		{"CMAKE_VERSION VERSION_GREATER_EQUAL 3.12", true},
+		{"1.2.10 VERSION_GREATER 1.2.9", true},
+		{"1.2 VERSION_EQUAL 1.2.0", true},
+		{"NAME MATCHES \"^d(e)\"", true},
+		{"b IN_LIST LETTERS", true},
+		{"z IN_LIST LETTERS", false},
+		{"EXISTS ${CMAKE_CURRENT_SOURCE_DIR}/CMakeLists.txt", true},
+		{"EXISTS ${CMAKE_CURRENT_SOURCE_DIR}/missing.txt", false},
+		{"IS_DIRECTORY ${CMAKE_CURRENT_SOURCE_DIR}", true},
+		{"IS_ABSOLUTE relative/path", false},
+		{"COMMAND add_library", true},
+		{"COMMAND no_such_command", false},
+		{"POLICY CMP0077", true},
+		{"TARGET demo", true},
+		{"TARGET missing", false},
+		{"UNIX AND NOT WIN32 AND NOT APPLE", true},
+		{"CMAKE_SYSTEM_NAME STREQUAL \"Linux\"", true},
+		{"FROM_DEFINE", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			src := `set(ENABLED ON)
+set(DISABLED OFF)
+set(NAME demo)
+set(COUNT 3)
+set(LETTERS a b c)
+add_library(demo demo.cpp)
+if(` + tt.condition + `)
+  set(RESULT TRUE)
+else()
+  set(RESULT FALSE)
+endif()
+`
+			model := parseCMakeListsSource(t, src, map[string]string{"FROM_DEFINE": "1"})
+			if actual := model.Variables["RESULT"] == "TRUE"; actual != tt.expected {
+				t.Errorf("Expected if(%s) to be %v", tt.condition, tt.expected)
+			}
+		})
+	}
+}
+
+func TestInterpreter_ConditionalTargets(t *testing.T) {
+	src := `option(BUILD_TOOLS "Build the tools" OFF)
+option(WITH_SSL "Use SSL" ON)
+
+set(SRCS common.cpp)
+if(WIN32)
+  list(APPEND SRCS platform_win32.cpp)
+elseif(APPLE)
+  list(APPEND SRCS platform_darwin.cpp)
+elseif(UNIX)
+  list(APPEND SRCS platform_unix.cpp)
+  if(NOT WITH_SSL)
+    list(APPEND SRCS nossl.cpp)
+  else()
+    list(APPEND SRCS ssl.cpp)
+  endif()
+else()
+  list(APPEND SRCS platform_other.cpp)
+endif()
+add_library(core ${SRCS})
+
+if(BUILD_TOOLS)
+  add_executable(tool tool.cpp)
+endif()
+`
+	model := parseCMakeListsSource(t, src, nil)
+	core := model.Targets["core"]
+	if core == nil {
+		t.Fatal("Expected to find 'core' target")
+	}
+	if expected := []string{"common.cpp", "platform_unix.cpp", "ssl.cpp"}; !reflect.DeepEqual(core.Sources, expected) {
+		t.Errorf("Expected sources %v, got %v", expected, core.Sources)
+	}
+	if _, ok := model.Targets["tool"]; ok {
+		t.Error("Expected 'tool' to be skipped while BUILD_TOOLS is OFF")
+	}
+
+	// cmake_define directives set options like -D does
+	model = parseCMakeListsSource(t, src, map[string]string{"BUILD_TOOLS": "ON", "WITH_SSL": "OFF"})
+	if _, ok := model.Targets["tool"]; !ok {
+		t.Error("Expected 'tool' to be generated with BUILD_TOOLS=ON")
+	}
+	if expected := []string{"common.cpp", "platform_unix.cpp", "nossl.cpp"}; !reflect.DeepEqual(model.Targets["core"].Sources, expected) {
+		t.Errorf("Expected sources %v with WITH_SSL=OFF, got %v", expected, model.Targets["core"].Sources)
+	}
+}
+
+func TestInterpreter_Loops(t *testing.T) {
+	src := `set(ITEM outer)
+foreach(ITEM a b c)
+  list(APPEND ITEMS ${ITEM})
+endforeach()
+set(NAMES x y)
+foreach(NAME IN LISTS NAMES ITEMS z)
+  list(APPEND IN_LISTS ${NAME})
+endforeach()
+foreach(N RANGE 3)
+  list(APPEND RANGE ${N})
+endforeach()
+foreach(N RANGE 1 9 4)
+  list(APPEND STEPPED ${N})
+endforeach()
+foreach(N RANGE 10)
+  if(N EQUAL 2)
+    continue()
+  elseif(N GREATER 4)
+    break()
+  endif()
+  list(APPEND CONTROLLED ${N})
+endforeach()
+set(LETTERS a b)
+set(NUMBERS 1 2)
+foreach(L D IN ZIP_LISTS LETTERS NUMBERS)
+  list(APPEND ZIPPED ${L}${D})
+endforeach()
+set(QUEUE one two three)
+while(QUEUE)
+  list(POP_FRONT QUEUE HEAD)
+  list(APPEND DRAINED ${HEAD})
+endwhile()
+foreach(MODULE core util)
+  add_library(${MODULE} ${MODULE}.cpp)
+endforeach()
+`
+	model := parseCMakeListsSource(t, src, nil)
+
+	expectedVars := map[string]string{
+		"ITEM":       "outer",
+		"ITEMS":      "a;b;c",
+		"IN_LISTS":   "x;y;z",
+		"RANGE":      "0;1;2;3",
+		"STEPPED":    "1;5;9",
+		"CONTROLLED": "0;1;3;4",
+		"ZIPPED":     "a1;b2",
+		"DRAINED":    "one;two;three",
+	}
+	for name, expected := range expectedVars {
+		if actual := model.Variables[name]; actual != expected {
+			t.Errorf("Expected %s = %q, got %q", name, expected, actual)
+		}
+	}
+	for _, name := range []string{"core", "util"} {
+		if target := model.Targets[name]; target == nil || !reflect.DeepEqual(target.Sources, []string{name + ".cpp"}) {
+			t.Errorf("Expected target %s with source %s.cpp, got %+v", name, name, target)
+		}
+	}
+}
+
+func TestInterpreter_Subdirectories(t *testing.T) {
+	sourceDir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Demo)
+set(LOCAL root)
+include(cmake/Sources.cmake RESULT_VARIABLE INCLUDED)
+include(cmake/Missing.cmake OPTIONAL RESULT_VARIABLE MISSING)
+set(LIST_DIR_AFTER_INCLUDE ${CMAKE_CURRENT_LIST_DIR})
+add_subdirectory(src)
+add_subdirectory(outside/.. ignored_binary_dir)
+include(cmake/Recursive.cmake)
+add_executable(app ${APP_SOURCES})
+target_link_libraries(app PRIVATE ${CORE_NAME})
+`,
+		"cmake/Sources.cmake": `set(APP_SOURCES ${CMAKE_CURRENT_LIST_DIR}/../main.cpp)
+set(INCLUDED_LIST_DIR ${CMAKE_CURRENT_LIST_DIR})
+return()
+set(APP_SOURCES after_return.cpp)
+`,
+		"cmake/Recursive.cmake": "include(${CMAKE_CURRENT_LIST_FILE})\n",
+		"src/CMakeLists.txt": `set(LOCAL src)
+set(CORE_NAME core PARENT_SCOPE)
+add_library(core core.cpp ${CMAKE_CURRENT_SOURCE_DIR}/core.h)
+target_include_directories(core PUBLIC include ${CMAKE_CURRENT_SOURCE_DIR}/..)
+configure_file(config.h.in ${CMAKE_CURRENT_BINARY_DIR}/config.h)
+`,
+	}
+	for name, content := range files {
+		p := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	model, err := common.ParseCMakeListsWithDefines(filepath.Join(sourceDir, "CMakeLists.txt"), nil)
+	if err != nil {
+		t.Fatalf("ParseCMakeListsWithDefines failed: %v", err)
+	}
+
+	expectedVars := map[string]string{
+		"LOCAL":                  "root", // The subdirectory has a scope of its own
+		"CORE_NAME":              "core",
+		"INCLUDED":               filepath.Join(sourceDir, "cmake", "Sources.cmake"),
+		"INCLUDED_LIST_DIR":      filepath.Join(sourceDir, "cmake"),
+		"MISSING":                "NOTFOUND",
+		"LIST_DIR_AFTER_INCLUDE": sourceDir,
+	}
+	for name, expected := range expectedVars {
+		if actual := model.Variables[name]; actual != expected {
+			t.Errorf("Expected %s = %q, got %q", name, expected, actual)
+		}
+	}
+
+	app := model.Targets["app"]
+	if app == nil {
+		t.Fatal("Expected to find 'app' target")
+	}
+	if expected := []string{"main.cpp"}; !reflect.DeepEqual(app.Sources, expected) {
+		t.Errorf("Expected app sources %v, got %v", expected, app.Sources)
+	}
+	if expected := []string{"core"}; !reflect.DeepEqual(app.LinkedLibraries, expected) {
+		t.Errorf("Expected app to link %v, got %v", expected, app.LinkedLibraries)
+	}
+	if app.Directory != "" {
+		t.Errorf("Expected app to be declared in the package directory, got %q", app.Directory)
+	}
+
+	core := model.Targets["core"]
+	if core == nil {
+		t.Fatal("Expected to find 'core' target")
+	}
+	if core.Directory != "src" {
+		t.Errorf("Expected core to be declared in src, got %q", core.Directory)
+	}
+	if expected := []string{"src/core.cpp"}; !reflect.DeepEqual(core.Sources, expected) {
+		t.Errorf("Expected core sources %v, got %v", expected, core.Sources)
+	}
+	if expected := []string{"src/core.h"}; !reflect.DeepEqual(core.Headers, expected) {
+		t.Errorf("Expected core headers %v, got %v", expected, core.Headers)
+	}
+	if expected := []string{"src/include", "."}; !reflect.DeepEqual(core.IncludeDirectories, expected) {
+		t.Errorf("Expected core include directories %v, got %v", expected, core.IncludeDirectories)
+	}
+
+	if len(model.ConfigureFiles) != 1 {
+		t.Fatalf("Expected 1 configure_file, got %d", len(model.ConfigureFiles))
+	}
+	if configFile := model.ConfigureFiles[0]; configFile.InputFile != "src/config.h.in" || configFile.OutputFile != "src/config.h" {
+		t.Errorf("Expected src/config.h.in -> src/config.h, got %s -> %s", configFile.InputFile, configFile.OutputFile)
+	}
+}
+
+func TestInterpreter_DirectoryProperties(t *testing.T) {
+	sourceDir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Demo)
+add_library(early early.cpp)
+include_directories(include)
+add_definitions(-DLEGACY -Wall)
+add_compile_definitions(VERSION=2)
+add_compile_options(-fno-strict-aliasing)
+link_libraries(pthread debug dl)
+add_library(headers INTERFACE)
+add_subdirectory(src)
+add_executable(app main.cpp)
+target_link_libraries(app PRIVATE optimized m)
+`,
+		"src/CMakeLists.txt": `include_directories(${CMAKE_CURRENT_SOURCE_DIR}/private)
+add_library(core core.cpp)
+`,
+	}
+	for name, content := range files {
+		p := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	model, err := common.ParseCMakeListsWithDefines(filepath.Join(sourceDir, "CMakeLists.txt"), nil)
+	if err != nil {
+		t.Fatalf("ParseCMakeListsWithDefines failed: %v", err)
+	}
+
+	tests := []struct {
+		target             string
+		includeDirectories []string
+		compileDefinitions []string
+		compileOptions     []string
+		systemLibraries    []string
+	}{
+		// Include directories and add_definitions() also apply to the targets
+		// the directory already has, add_compile_options() and libraries do not
+		{"early", []string{"include"}, []string{"LEGACY", "VERSION=2"}, []string{"-Wall"}, nil},
+		{"headers", nil, nil, nil, nil},
+		{"core", []string{"include", "src/private"}, []string{"LEGACY", "VERSION=2"}, []string{"-Wall", "-fno-strict-aliasing"}, []string{"pthread"}},
+		{"app", []string{"include"}, []string{"LEGACY", "VERSION=2"}, []string{"-Wall", "-fno-strict-aliasing"}, []string{"pthread"}},
+	}
+	for _, test := range tests {
+		target := model.Targets[test.target]
+		if target == nil {
+			t.Fatalf("Expected to find %q target", test.target)
+		}
+		if !reflect.DeepEqual(target.IncludeDirectories, test.includeDirectories) {
+			t.Errorf("Expected %s include directories %v, got %v", test.target, test.includeDirectories, target.IncludeDirectories)
+		}
+		if !reflect.DeepEqual(target.CompileDefinitions, test.compileDefinitions) {
+			t.Errorf("Expected %s compile definitions %v, got %v", test.target, test.compileDefinitions, target.CompileDefinitions)
+		}
+		if !reflect.DeepEqual(target.CompileOptions, test.compileOptions) {
+			t.Errorf("Expected %s compile options %v, got %v", test.target, test.compileOptions, target.CompileOptions)
+		}
+		if !reflect.DeepEqual(target.SystemLibraries, test.systemLibraries) {
+			t.Errorf("Expected %s system libraries %v, got %v", test.target, test.systemLibraries, target.SystemLibraries)
+		}
+	}
+
+	// link_libraries(debug ...) only links in the Debug configuration
+	if values := model.Targets["app"].ConfigValues["dbg"]; values == nil || !reflect.DeepEqual(values.SystemLibraries, []string{"dl"}) {
+		t.Errorf("Expected app to link dl in dbg mode, got %+v", values)
+	}
+	// and target_link_libraries(optimized ...) in the others
+	if values := model.Targets["app"].ConfigValues["opt"]; values == nil || !reflect.DeepEqual(values.SystemLibraries, []string{"m"}) {
+		t.Errorf("Expected app to link m in opt mode, got %+v", values)
+	}
+}
+
+func TestInterpreter_Functions(t *testing.T) {
+	src := `function(my_add_library NAME)
+  cmake_parse_arguments(ARG "STATIC" "OUTPUT" "SRCS;DEPS" ${ARGN})
+  if(NOT ARG_SRCS)
+    return()
+  endif()
+  if(ARG_STATIC)
+    add_library(${NAME} STATIC ${ARG_SRCS})
+  else()
+    add_library(${NAME} ${ARG_SRCS})
+  endif()
+  if(ARG_DEPS)
+    target_link_libraries(${NAME} PRIVATE ${ARG_DEPS})
+  endif()
+  set(LOCAL_TO_FUNCTION ${NAME})
+  set(LAST_LIBRARY ${NAME} PARENT_SCOPE)
+  set(FUNCTION_NAME ${CMAKE_CURRENT_FUNCTION} PARENT_SCOPE)
+endfunction()
+
+macro(add_tools)
+  foreach(tool ${ARGN})
+    add_executable(${tool} ${tool}.cpp)
+  endforeach()
+  set(TOOL_COUNT ${ARGC})
+endmacro()
+
+function(parse_argv)
+  cmake_parse_arguments(PARSE_ARGV 0 P "" "ONE" "MULTI")
+  set(PARSED_ONE "${P_ONE}" PARENT_SCOPE)
+  set(PARSED_MULTI "${P_MULTI}" PARENT_SCOPE)
+endfunction()
+
+function(recurse)
+  recurse()
+endfunction()
+
+macro(add_tools)
+  _add_tools(${ARGV} extra)
+endmacro()
+
+my_add_library(core STATIC SRCS core.cpp core.h)
+my_add_library(app_lib SRCS app.cpp DEPS core)
+my_add_library(no_sources)
+add_tools(tool_a tool_b)
+parse_argv(ONE "x;y" MULTI a "b;c")
+recurse()
+cmake_parse_arguments(TOP "FLAG" "KEY" "" KEY FLAG leftover)
+if(COMMAND my_add_library)
+  set(IS_COMMAND TRUE)
+endif()
+`
+	model := parseCMakeListsSource(t, src, nil)
+
+	expectedVars := map[string]string{
+		"LAST_LIBRARY":                "app_lib",
+		"FUNCTION_NAME":               "my_add_library",
+		"TOOL_COUNT":                  "3",
+		"PARSED_ONE":                  `x\;y`,
+		"PARSED_MULTI":                `a;b\;c`,
+		"TOP_FLAG":                    "TRUE",
+		"TOP_UNPARSED_ARGUMENTS":      "leftover",
+		"TOP_KEYWORDS_MISSING_VALUES": "KEY",
+		"IS_COMMAND":                  "TRUE",
+	}
+	for name, expected := range expectedVars {
+		if actual, ok := model.Variables[name]; !ok || actual != expected {
+			t.Errorf("Expected %s = %q, got %q (defined: %v)", name, expected, actual, ok)
+		}
+	}
+	for _, name := range []string{"LOCAL_TO_FUNCTION", "TOP_KEY", "ARGN"} {
+		if value, ok := model.Variables[name]; ok {
+			t.Errorf("Expected %s to be undefined, got %q", name, value)
+		}
+	}
+
+	core := model.Targets["core"]
+	if core == nil {
+		t.Fatal("Expected to find 'core' target")
+	}
+	if core.LibraryType != "STATIC" {
+		t.Errorf("Expected core to be a STATIC library, got %q", core.LibraryType)
+	}
+	if expected := []string{"core.cpp"}; !reflect.DeepEqual(core.Sources, expected) {
+		t.Errorf("Expected core sources %v, got %v", expected, core.Sources)
+	}
+	appLib := model.Targets["app_lib"]
+	if appLib == nil {
+		t.Fatal("Expected to find 'app_lib' target")
+	}
+	if expected := []string{"core"}; !reflect.DeepEqual(appLib.LinkedLibraries, expected) {
+		t.Errorf("Expected app_lib to link %v, got %v", expected, appLib.LinkedLibraries)
+	}
+	if _, ok := model.Targets["no_sources"]; ok {
+		t.Error("Expected return() to end the function before add_library()")
+	}
+	for _, name := range []string{"tool_a", "tool_b", "extra"} {
+		if model.Targets[name] == nil {
+			t.Errorf("Expected to find '%s' target", name)
+		}
+	}
+}
+
+func TestInterpreter_Globs(t *testing.T) {
+	sourceDir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": `project(Demo)
+file(GLOB SOURCES CONFIGURE_DEPENDS src/*.cpp)
+file(GLOB ENTRIES LIST_DIRECTORIES false RELATIVE ${CMAKE_CURRENT_SOURCE_DIR} src/*)
+file(GLOB_RECURSE HEADERS RELATIVE ${CMAKE_CURRENT_SOURCE_DIR} *.h)
+file(GLOB_RECURSE WITH_DIRS LIST_DIRECTORIES true RELATIVE ${CMAKE_CURRENT_SOURCE_DIR} src/*)
+aux_source_directory(tools TOOL_SOURCES)
+add_library(core ${SOURCES} ${HEADERS})
+add_executable(tool ${TOOL_SOURCES})
+`,
+		"src/a.cpp":             "",
+		"src/b.cpp":             "",
+		"src/a.h":               "",
+		"src/nested/c.h":        "",
+		"tools/main.cc":         "",
+		"tools/util.c":          "",
+		"tools/README.md":       "",
+		".cmake-build/config.h": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	model, err := common.ParseCMakeListsWithDefines(filepath.Join(sourceDir, "CMakeLists.txt"), nil)
+	if err != nil {
+		t.Fatalf("ParseCMakeListsWithDefines failed: %v", err)
+	}
+
+	expectedVars := map[string]string{
+		"SOURCES":      filepath.Join(sourceDir, "src", "a.cpp") + ";" + filepath.Join(sourceDir, "src", "b.cpp"),
+		"ENTRIES":      "src/a.cpp;src/a.h;src/b.cpp",
+		"HEADERS":      "src/a.h;src/nested/c.h", // The binary directory is skipped
+		"WITH_DIRS":    "src/a.cpp;src/a.h;src/b.cpp;src/nested;src/nested/c.h",
+		"TOOL_SOURCES": "tools/main.cc;tools/util.c",
+	}
+	for name, expected := range expectedVars {
+		if actual := model.Variables[name]; actual != expected {
+			t.Errorf("Expected %s = %q, got %q", name, expected, actual)
+		}
+	}
+
+	core := model.Targets["core"]
+	if core == nil {
+		t.Fatal("Expected to find 'core' target")
+	}
+	if expected := []string{"src/a.cpp", "src/b.cpp"}; !reflect.DeepEqual(core.Sources, expected) {
+		t.Errorf("Expected core sources %v, got %v", expected, core.Sources)
+	}
+	var patterns []string
+	for _, glob := range core.Globs {
+		patterns = append(patterns, glob.Pattern)
+	}
+	if expected := []string{"src/*.cpp", "src/*", "**/*.h", "src/**/*"}; !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("Expected core globs %v, got %v", expected, patterns)
+	}
+
+	tool := model.Targets["tool"]
+	if tool == nil {
+		t.Fatal("Expected to find 'tool' target")
+	}
+	patterns = nil
+	for _, glob := range tool.Globs {
+		patterns = append(patterns, glob.Pattern)
+	}
+	if expected := []string{"tools/*.c", "tools/*.cc"}; !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("Expected tool globs %v, got %v", expected, patterns)
+	}
+}
@@ -0,0 +1,189 @@
+package gazelle
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/goniz/gazelle-foreign-cc/common"
+)
+
+func TestParseCMake(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		expected map[string][]string // Command name to argument values, one command per name
+	}{
+		{
+			name:     "quoted argument with spaces",
+			src:      `add_compile_definitions("GREETING=hello world")`,
+			expected: map[string][]string{"add_compile_definitions": {"GREETING=hello world"}},
+		},
+		{
+			name:     "bracket arguments",
+			src:      "set(A [[x ) y]] [==[a]]b]==])\n",
+			expected: map[string][]string{"set": {"A", "x ) y", "a]]b"}},
+		},
+		{
+			name:     "bracket argument drops first newline",
+			src:      "set(A [[\nline]])",
+			expected: map[string][]string{"set": {"A", "line"}},
+		},
+		{
+			name: "comments",
+			src: "#[[ add_library(commented out.cpp)\n]] add_library(lib a.cpp # b.cpp\n  c.cpp) # trailing\n" +
+				"#[=[ bracket comment ]=] add_executable(app main.cpp) #[[ after ]]\n",
+			expected: map[string][]string{"add_library": {"lib", "a.cpp", "c.cpp"}, "add_executable": {"app", "main.cpp"}},
+		},
+		{
+			name:     "escape sequences",
+			src:      `set(A "tab\there" \"quoted\" a\ b "cont\` + "\n" + `inued")`,
+			expected: map[string][]string{"set": {"A", "tab\there", `"quoted"`, "a b", "continued"}},
+		},
+		{
+			name:     "nested parentheses",
+			src:      "if((A OR B) AND C)\nendif()\n",
+			expected: map[string][]string{"if": {"(", "A", "OR", "B", ")", "AND", "C"}, "endif": nil},
+		},
+		{
+			name:     "semicolon lists",
+			src:      `set(SRCS a.cpp;b.cpp;;c\;d "e;f")`,
+			expected: map[string][]string{"set": {"SRCS", "a.cpp", "b.cpp", "c;d", "e;f"}},
+		},
+		{
+			name:     "legacy unquoted argument",
+			src:      `add_definitions(-DNAME="a b" -DOTHER)`,
+			expected: map[string][]string{"add_definitions": {`-DNAME="a b"`, "-DOTHER"}},
+		},
+		{
+			name:     "space before parenthesis and CRLF line endings",
+			src:      "project (Demo)\r\nadd_executable (app\r\n  main.cpp)\r\n",
+			expected: map[string][]string{"project": {"Demo"}, "add_executable": {"app", "main.cpp"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, err := common.ParseCMake("CMakeLists.txt", []byte(tt.src))
+			if err != nil {
+				t.Fatalf("ParseCMake failed: %v", err)
+			}
+			actual := make(map[string][]string)
+			for _, cmd := range commands {
+				actual[cmd.Name] = cmd.ArgumentValues()
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Expected commands %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseCMake_Positions(t *testing.T) {
+	src := "# header\nadd_library(foo\n    \"a b.cpp\" [[c.cpp]])\n  add_executable(app main.cpp)\n"
+	commands, err := common.ParseCMake("CMakeLists.txt", []byte(src))
+	if err != nil {
+		t.Fatalf("ParseCMake failed: %v", err)
+	}
+	if len(commands) != 2 {
+		t.Fatalf("Expected 2 commands, got %d", len(commands))
+	}
+
+	if pos := commands[0].Pos; pos != (common.Position{Line: 2, Column: 1}) {
+		t.Errorf("Expected add_library at 2:1, got %s", pos)
+	}
+	args := commands[0].Arguments
+	expected := []common.CMakeArgument{
+		{Kind: common.UnquotedArgument, Raw: "foo", Pos: common.Position{Line: 2, Column: 13}},
+		{Kind: common.QuotedArgument, Raw: "a b.cpp", Pos: common.Position{Line: 3, Column: 5}},
+		{Kind: common.BracketArgument, Raw: "c.cpp", Pos: common.Position{Line: 3, Column: 15}},
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected arguments %+v, got %+v", expected, args)
+	}
+	if pos := commands[1].Pos; pos != (common.Position{Line: 4, Column: 3}) {
+		t.Errorf("Expected add_executable at 4:3, got %s", pos)
+	}
+}
+
+func TestParseCMake_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		pos  common.Position
+	}{
+		{name: "missing closing parenthesis", src: "project(Demo)\nadd_library(foo a.cpp\n", pos: common.Position{Line: 2, Column: 1}},
+		{name: "unterminated quoted argument", src: `set(A "abc)`, pos: common.Position{Line: 1, Column: 7}},
+		{name: "unterminated bracket argument", src: "set(A [=[abc]])", pos: common.Position{Line: 1, Column: 7}},
+		{name: "two commands on one line", src: "set(A 1) set(B 2)\n", pos: common.Position{Line: 1, Column: 10}},
+		{name: "missing parenthesis", src: "set A 1\n", pos: common.Position{Line: 1, Column: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := common.ParseCMake("CMakeLists.txt", []byte(tt.src))
+			var parseErr *common.ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected a ParseError, got %v", err)
+			}
+			if parseErr.Pos != tt.pos {
+				t.Errorf("Expected error at %s, got %v", tt.pos, err)
+			}
+		})
+	}
+}
+
+func TestParseCMakeLists_Syntax(t *testing.T) {
+	// Constructs the old line-based parser got wrong
+	src := `cmake_minimum_required(VERSION 3.10)
+project(Syntax)
+
+add_library(core STATIC core.cpp "core util.cpp" # util is optional
+    core.h) # trailing comment
+#[[
+add_library(disabled disabled.cpp)
+]]
+add_executable(app
+  main.cpp
+)
+target_compile_definitions(app PRIVATE [[MESSAGE="hi (there)"]])
+target_link_libraries(app PRIVATE core)
+`
+	cmakeFilePath := filepath.Join(t.TempDir(), "CMakeLists.txt")
+	if err := os.WriteFile(cmakeFilePath, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	model, err := common.ParseCMakeLists(cmakeFilePath)
+	if err != nil {
+		t.Fatalf("ParseCMakeLists failed: %v", err)
+	}
+	if _, ok := model.Targets["disabled"]; ok {
+		t.Error("Expected target in bracket comment to be ignored")
+	}
+	core := model.Targets["core"]
+	if core == nil {
+		t.Fatal("Expected to find 'core' target")
+	}
+	if expected := []string{"core.cpp", "core util.cpp"}; !reflect.DeepEqual(core.Sources, expected) {
+		t.Errorf("Expected core sources %v, got %v", expected, core.Sources)
+	}
+	if expected := []string{"core.h"}; !reflect.DeepEqual(core.Headers, expected) {
+		t.Errorf("Expected core headers %v, got %v", expected, core.Headers)
+	}
+	app := model.Targets["app"]
+	if app == nil {
+		t.Fatal("Expected to find 'app' target")
+	}
+	if expected := []string{"main.cpp"}; !reflect.DeepEqual(app.Sources, expected) {
+		t.Errorf("Expected app sources %v, got %v", expected, app.Sources)
+	}
+	if expected := []string{`MESSAGE="hi (there)"`}; !reflect.DeepEqual(app.CompileDefinitions, expected) {
+		t.Errorf("Expected app defines %v, got %v", expected, app.CompileDefinitions)
+	}
+	if expected := []string{"core"}; !reflect.DeepEqual(app.LinkedLibraries, expected) {
+		t.Errorf("Expected app to link %v, got %v", expected, app.LinkedLibraries)
+	}
+}
@@ -6,12 +6,12 @@ toolchain go1.23.9
 
 require (
 	github.com/bazelbuild/bazel-gazelle v0.43.0
+	github.com/bazelbuild/buildtools v0.0.0-20240918101019-be1c24cc9a44
 	github.com/bazelbuild/rules_go v0.54.1
+	github.com/bmatcuk/doublestar/v4 v4.7.1
 )
 
 require (
-	github.com/bazelbuild/buildtools v0.0.0-20240918101019-be1c24cc9a44 // indirect
-	github.com/bmatcuk/doublestar/v4 v4.7.1 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/mock v1.7.0-rc.1 // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
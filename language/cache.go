@@ -0,0 +1,327 @@
+package language
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configureCacheVersion changes whenever what the cache stores changes, so
+// that entries written by other versions of the plugin are not reused
+const configureCacheVersion = 2
+
+// configureManifest describes a configure result stored in the cache with the
+// inputs it was computed from. It is reused as long as none of them changed.
+type configureManifest struct {
+	Version int `json:"version"`
+	// Inputs are the CMake files the configure read, other than the modules
+	// shipped with cmake, with the SHA-256 of their content
+	Inputs map[string]string `json:"inputs"`
+	// Globs are the file(GLOB CONFIGURE_DEPENDS) expressions, with the
+	// SHA-256 of the files they matched
+	Globs map[string]string `json:"globs"`
+	// Compilers are the compilers of the toolchains, with their size and
+	// modification time
+	Compilers map[string]string `json:"compilers"`
+}
+
+// Toolchains represents the toolchains object of the CMake File API
+type Toolchains struct {
+	Toolchains []struct {
+		Language string `json:"language"`
+		Compiler struct {
+			Path    string `json:"path"`
+			ID      string `json:"id"`
+			Version string `json:"version"`
+		} `json:"compiler"`
+	} `json:"toolchains"`
+}
+
+// cacheEntry returns the directory of the cache holding the configure result
+// of the project, which depends on the cmake version, the directories, the
+// generator and the defines it is configured with
+func (api *CMakeFileAPI) cacheEntry() (string, error) {
+	output, err := exec.Command(api.cmakeExe, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("cmake --version failed: %w", err)
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d\n%s\n%s\n%s\n%s\n-G%s\n", configureCacheVersion, output, api.cmakeExe, api.sourceDir, api.buildDir, api.generator)
+	for _, define := range api.sortedDefines() {
+		fmt.Fprintf(hash, "-D%s\n", define)
+	}
+	return filepath.Join(api.cacheDir, hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// sortedDefines returns the -D defines the project is configured with, as
+// KEY=VALUE in a stable order
+func (api *CMakeFileAPI) sortedDefines() []string {
+	var defines []string
+	for key, value := range api.defines() {
+		defines = append(defines, key+"="+value)
+	}
+	sort.Strings(defines)
+	return defines
+}
+
+// loadCachedConfigure reuses the configure result stored in the cache when
+// none of its inputs changed, and reports whether it did
+func (api *CMakeFileAPI) loadCachedConfigure() bool {
+	if api.cacheDir == "" {
+		return false
+	}
+	entry, err := api.cacheEntry()
+	if err != nil {
+		log.Printf("Warning: cannot look up the configure cache of %s: %v", api.sourceDir, err)
+		return false
+	}
+	api.cacheEntryDir = entry
+
+	data, err := os.ReadFile(filepath.Join(entry, "manifest.json"))
+	if err != nil {
+		return false
+	}
+	var manifest configureManifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Version != configureCacheVersion {
+		return false
+	}
+	if changed := api.changedInput(&manifest); changed != "" {
+		log.Printf("Configure cache of %s is stale: %s changed", api.sourceDir, changed)
+		return false
+	}
+
+	log.Printf("Reusing the configure result of %s cached in %s", api.sourceDir, entry)
+	api.cachedReplyDir = filepath.Join(entry, "reply")
+	return true
+}
+
+// changedInput returns an input of the manifest that no longer matches, or ""
+func (api *CMakeFileAPI) changedInput(manifest *configureManifest) string {
+	for _, input := range sortedKeys(manifest.Inputs) {
+		if hash, err := hashFile(api.inputPath(input)); err != nil || hash != manifest.Inputs[input] {
+			return input
+		}
+	}
+	for _, expression := range sortedKeys(manifest.Globs) {
+		if hashGlob(filepath.Join(api.sourceDir, expression)) != manifest.Globs[expression] {
+			return "the files matching " + expression
+		}
+	}
+	for _, compiler := range sortedKeys(manifest.Compilers) {
+		if compilerStamp(compiler) != manifest.Compilers[compiler] {
+			return compiler
+		}
+	}
+	return ""
+}
+
+// storeConfigure stores the File API reply of the configure that just ran in
+// the cache, with the hashes of its inputs. Failures are logged, since the
+// cache is only an optimization.
+func (api *CMakeFileAPI) storeConfigure() {
+	if api.cacheEntryDir == "" {
+		return
+	}
+	if err := api.writeCacheEntry(api.cacheEntryDir); err != nil {
+		log.Printf("Warning: failed to cache the configure result of %s: %v", api.sourceDir, err)
+		api.cacheEntryDir = ""
+	}
+}
+
+func (api *CMakeFileAPI) writeCacheEntry(entry string) error {
+	index, _, _, err := api.ReadAPIResponse()
+	if err != nil {
+		return err
+	}
+	manifest, err := api.inputManifest(index)
+	if err != nil {
+		return err
+	}
+	if toolchains, err := api.readToolchains(index); err == nil {
+		for _, toolchain := range toolchains.Toolchains {
+			if toolchain.Compiler.Path != "" {
+				manifest.Compilers[toolchain.Compiler.Path] = compilerStamp(toolchain.Compiler.Path)
+			}
+		}
+	}
+
+	// The entry is written next to its final location and renamed, so that
+	// other runs never see it partially written
+	if err := os.MkdirAll(api.cacheDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(api.cacheDir, filepath.Base(entry)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := copyDir(api.replyDir(), filepath.Join(tmp, "reply")); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "manifest.json"), data, 0644); err != nil {
+		return err
+	}
+	// The tests are read from the entry too, so it is only complete with them
+	ctestOutput, err := api.runCTest()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "ctest.json"), ctestOutput, 0644); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(entry); err != nil {
+		return err
+	}
+	return os.Rename(tmp, entry)
+}
+
+// inputManifest returns a manifest with the hashes of the CMake files and
+// file(GLOB CONFIGURE_DEPENDS) expressions the configure read
+func (api *CMakeFileAPI) inputManifest(index *APIIndex) (*configureManifest, error) {
+	files, err := api.ReadCMakeFiles(index)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &configureManifest{
+		Version:   configureCacheVersion,
+		Inputs:    make(map[string]string),
+		Globs:     make(map[string]string),
+		Compilers: make(map[string]string),
+	}
+	for _, input := range files.Inputs {
+		// Modules shipped with cmake change with its version, which is
+		// part of the key, and generated files with the other inputs
+		if input.IsCMake || input.IsGenerated {
+			continue
+		}
+		hash, err := hashFile(api.inputPath(input.Path))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Inputs[input.Path] = hash
+	}
+	for _, g := range files.GlobsDependent {
+		expression := relativeSourcePath(g.Expression, api.sourceDir)
+		manifest.Globs[expression] = hashGlob(filepath.Join(api.sourceDir, expression))
+	}
+	return manifest, nil
+}
+
+// inputPath returns the path of an input of the configure. Inputs outside the
+// source directory, such as toolchain files or package configuration files,
+// are reported as absolute paths.
+func (api *CMakeFileAPI) inputPath(input string) string {
+	if filepath.IsAbs(input) {
+		return input
+	}
+	return filepath.Join(api.sourceDir, input)
+}
+
+// readToolchains reads the toolchains object listed in the index
+func (api *CMakeFileAPI) readToolchains(index *APIIndex) (*Toolchains, error) {
+	for _, obj := range index.Objects {
+		if obj.Kind != "toolchains" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(api.replyDir(), obj.JSONFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read toolchains file: %w", err)
+		}
+		var toolchains Toolchains
+		if err := json.Unmarshal(data, &toolchains); err != nil {
+			return nil, fmt.Errorf("failed to parse toolchains file: %w", err)
+		}
+		return &toolchains, nil
+	}
+	return nil, fmt.Errorf("no toolchains found in index")
+}
+
+// hashFile returns the SHA-256 of the content of a file
+func hashFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashGlob returns the SHA-256 of the names of the files a glob expression
+// matches, looking through the subdirectories of the directory it starts
+// with like GLOB_RECURSE when it has none, so that adding or removing files
+// invalidates the entry. The names are relative to that directory, so that
+// the hash does not depend on where the sources are.
+func hashGlob(expression string) string {
+	dir, pattern := filepath.Split(expression)
+	dir = filepath.Clean(dir)
+	var matches []string
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if ok, _ := filepath.Match(pattern, d.Name()); ok {
+			rel, _ := filepath.Rel(dir, p)
+			matches = append(matches, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sum := sha256.Sum256([]byte(strings.Join(matches, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// compilerStamp identifies the version of a compiler binary by its size and
+// modification time, which is much cheaper than hashing it
+func compilerStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// copyDir copies the regular files of a directory into a new one
+func copyDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,140 @@
+package language
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFakeCMake writes a cmake script that reports a version and, when
+// configuring, copies a File API reply into the build directory and records
+// the run in a log file, with the number of configures running at the time
+func writeFakeCMake(t *testing.T, dir string, externalInputs ...string) (string, string) {
+	t.Helper()
+	reply := filepath.Join(dir, "reply")
+	if err := os.MkdirAll(reply, 0755); err != nil {
+		t.Fatal(err)
+	}
+	inputs := `{"path": "CMakeLists.txt"}, {"path": "/usr/share/cmake/Modules/CMakeCInformation.cmake", "isCMake": true}`
+	for _, input := range externalInputs {
+		inputs += fmt.Sprintf(`, {"path": %q, "isExternal": true}`, input)
+	}
+	files := map[string]string{
+		"index-1.json": `{"objects": [
+			{"kind": "codemodel", "version": {"major": 2, "minor": 6}, "jsonFile": "codemodel-v2-1.json"},
+			{"kind": "cmakeFiles", "version": {"major": 1, "minor": 0}, "jsonFile": "cmakeFiles-v1-1.json"}
+		]}`,
+		"codemodel-v2-1.json":  `{"configurations": [{"name": "", "directories": [], "targets": []}]}`,
+		"cmakeFiles-v1-1.json": `{"inputs": [` + inputs + `]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(reply, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs := filepath.Join(dir, "runs")
+	running := filepath.Join(dir, "running")
+	if err := os.MkdirAll(running, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmake := filepath.Join(dir, "cmake")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "--version" ]; then
+  echo "cmake version 3.28.0"
+  exit 0
+fi
+touch %[3]s/running.$$
+echo configure $(ls %[3]s | grep -c running) >> %[1]s
+sleep 0.2
+mkdir -p .cmake/api/v1/reply
+cp %[2]s/* .cmake/api/v1/reply/
+rm %[3]s/running.$$
+`, runs, reply, running)
+	if err := os.WriteFile(cmake, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctest := `#!/bin/sh
+echo '{"kind": "ctestInfo", "version": {"major": 1, "minor": 0}, "tests": []}'
+`
+	if err := os.WriteFile(filepath.Join(dir, "ctest"), []byte(ctest), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return cmake, runs
+}
+
+func TestConfigureCache(t *testing.T) {
+	tools := t.TempDir()
+	// Toolchain files and package configuration files are outside the sources
+	toolchain := filepath.Join(t.TempDir(), "toolchain.cmake")
+	if err := os.WriteFile(toolchain, []byte("set(CMAKE_C_COMPILER cc)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmake, runs := writeFakeCMake(t, tools, toolchain)
+	sourceDir := t.TempDir()
+	cacheDir := t.TempDir()
+	buildDir := filepath.Join(t.TempDir(), ".cmake-build")
+	if err := os.WriteFile(filepath.Join(sourceDir, "CMakeLists.txt"), []byte("project(Cached)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	configure := func(defines map[string]string) *CMakeFileAPI {
+		t.Helper()
+		api := NewCMakeFileAPI(sourceDir, buildDir, cmake, defines)
+		api.SetCacheDir(cacheDir)
+		if err := api.ensureConfigured(); err != nil {
+			t.Fatalf("ensureConfigured failed: %v", err)
+		}
+		if _, _, _, err := api.ReadAPIResponse(); err != nil {
+			t.Fatalf("ReadAPIResponse failed: %v", err)
+		}
+		return api
+	}
+	countRuns := func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "configure")
+	}
+
+	configure(nil)
+	if countRuns() != 1 {
+		t.Fatalf("Expected cmake to configure once, got %d runs", countRuns())
+	}
+
+	// The reply is read from the cache, even without the build directory
+	if err := os.RemoveAll(buildDir); err != nil {
+		t.Fatal(err)
+	}
+	if api := configure(nil); api.cachedReplyDir == "" || countRuns() != 1 {
+		t.Errorf("Expected the configure result to be reused, got %d runs", countRuns())
+	} else if _, err := api.ReadCTestInfo(); err != nil {
+		t.Errorf("Expected the ctest output to be cached with the reply: %v", err)
+	}
+
+	// Other defines are another entry
+	configure(map[string]string{"OPTION": "ON"})
+	if countRuns() != 2 {
+		t.Errorf("Expected other defines to configure again, got %d runs", countRuns())
+	}
+
+	// Changing an input invalidates the entry
+	if err := os.WriteFile(filepath.Join(sourceDir, "CMakeLists.txt"), []byte("project(Changed)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if api := configure(nil); api.cachedReplyDir != "" || countRuns() != 3 {
+		t.Errorf("Expected a changed CMakeLists.txt to configure again, got %d runs", countRuns())
+	}
+	configure(nil)
+	if countRuns() != 3 {
+		t.Errorf("Expected the new configure result to be reused, got %d runs", countRuns())
+	}
+
+	// and so does changing an input outside the sources
+	if err := os.WriteFile(toolchain, []byte("set(CMAKE_C_COMPILER clang)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if api := configure(nil); api.cachedReplyDir != "" || countRuns() != 4 {
+		t.Errorf("Expected a changed toolchain file to configure again, got %d runs", countRuns())
+	}
+}
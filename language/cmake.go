@@ -8,8 +8,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	gzflag "github.com/bazelbuild/bazel-gazelle/flag"
 	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/language"
 	"github.com/bazelbuild/bazel-gazelle/repo"
@@ -20,7 +22,21 @@ import (
 )
 
 // cmakeLang implements the language.Language interface for CMake.
-type cmakeLang struct{}
+type cmakeLang struct {
+	// projects holds the CMake projects configured or being configured, by
+	// source directory and defines. mu guards it, and jobs bounds the number
+	// of configures running at once.
+	mu       sync.Mutex
+	projects map[string]*cmakeProject
+	jobs     chan struct{}
+	// updateRels are the packages Gazelle updates, given on its command line,
+	// and updateNonRecursive tells whether their subpackages are left out
+	updateRels         []string
+	updateNonRecursive bool
+	// excludes are the -exclude patterns of the command line, which apply to
+	// the discovery of the projects like the exclude directives
+	excludes []string
+}
 
 // NewLanguage returns a new instance of the CMake language plugin.
 func NewLanguage() language.Language {
@@ -43,14 +59,38 @@ func (l *cmakeLang) Embeds(r *rule.Rule, from label.Label) []label.Label {
 // The syntax of options passed to Gazelle is determined by package flag.
 // All flags registered here become directives in BUILD files.
 func (l *cmakeLang) RegisterFlags(fs *flag.FlagSet, mode string, c *config.Config) {
-	// No flags registered for now.
+	common.GetCMakeConfig(c).RegisterFlags(fs, mode, c)
 }
 
 // CheckFlags validates command-line flags and items in config files.
 // Call fs.Visit to already-parsed flags.
 func (l *cmakeLang) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
-	// No flags to check for now.
-	return nil
+	// The directories to update, which the projects to configure in advance
+	// are discovered in
+	l.updateRels = nil
+	for _, dir := range fs.Args() {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(c.WorkDir, dir)
+		}
+		rel, err := filepath.Rel(c.RepoRoot, dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if rel = filepath.ToSlash(rel); rel == "." {
+			rel = ""
+		}
+		l.updateRels = append(l.updateRels, rel)
+	}
+	if recursive := fs.Lookup("r"); recursive != nil {
+		l.updateNonRecursive = recursive.Value.String() == "false"
+	}
+	l.excludes = nil
+	if exclude := fs.Lookup("exclude"); exclude != nil {
+		if excludes, ok := exclude.Value.(*gzflag.MultiFlag); ok && excludes.Values != nil {
+			l.excludes = append(l.excludes, *excludes.Values...)
+		}
+	}
+	return common.GetCMakeConfig(c).CheckFlags(fs, c)
 }
 
 // KnownDirectives returns a list of directive keys that this language
@@ -66,11 +106,18 @@ func (l *cmakeLang) KnownDirectives() []string {
 // Configure modifies the configuration using directives found in BUILD files.
 // Called with directives in root and package directories.
 func (l *cmakeLang) Configure(c *config.Config, rel string, f *rule.File) {
+	// Once the root is configured, the projects of the repository start
+	// configuring in the background
+	if rel == "" {
+		defer l.discoverProjects(c, f)
+	}
 	if f == nil {
 		return // Not a BUILD file, skip.
 	}
 
-	cfg := common.GetCMakeConfig(c)
+	// Directives apply to this package and its subpackages only
+	cfg := common.GetCMakeConfig(c).Clone()
+	c.Exts["cmake"] = cfg
 
 	// Let the CMakeConfig handle its own directives
 	cfg.Configure(c, rel, f)
@@ -98,24 +145,39 @@ func (l *cmakeLang) Kinds() map[string]rule.KindInfo {
 	return map[string]rule.KindInfo{
 		"cc_library": {
 			NonEmptyAttrs:  map[string]bool{"srcs": true, "hdrs": true},
-			MergeableAttrs: map[string]bool{"srcs": true, "hdrs": true, "deps": true},
-			ResolveAttrs:   map[string]bool{"deps": true},
+			MergeableAttrs: map[string]bool{"srcs": true, "hdrs": true, "deps": true, "implementation_deps": true, "linkopts": true, "includes": true, "defines": true, "local_defines": true, "copts": true, "conlyopts": true, "cxxopts": true, "alwayslink": true},
+			ResolveAttrs:   map[string]bool{"deps": true, "implementation_deps": true},
 		},
 		"cc_binary": {
 			NonEmptyAttrs:  map[string]bool{"srcs": true},
-			MergeableAttrs: map[string]bool{"srcs": true, "deps": true},
+			MergeableAttrs: map[string]bool{"srcs": true, "deps": true, "linkopts": true, "dynamic_deps": true, "includes": true, "local_defines": true, "copts": true, "conlyopts": true, "cxxopts": true, "linkshared": true},
 			ResolveAttrs:   map[string]bool{"deps": true},
 		},
 		"cc_test": {
-			NonEmptyAttrs:  map[string]bool{"srcs": true},
-			MergeableAttrs: map[string]bool{"srcs": true, "deps": true},
+			NonEmptyAttrs:  map[string]bool{"srcs": true, "deps": true},
+			MergeableAttrs: map[string]bool{"srcs": true, "deps": true, "linkopts": true, "dynamic_deps": true, "includes": true, "local_defines": true, "copts": true, "conlyopts": true, "cxxopts": true, "args": true, "env": true, "tags": true, "timeout": true},
 			ResolveAttrs:   map[string]bool{"deps": true},
 		},
+		"cc_shared_library": {
+			NonEmptyAttrs:  map[string]bool{"deps": true},
+			MergeableAttrs: map[string]bool{"deps": true, "dynamic_deps": true, "shared_lib_name": true},
+			ResolveAttrs:   map[string]bool{},
+		},
+		"genrule": {
+			NonEmptyAttrs:  map[string]bool{"outs": true},
+			MergeableAttrs: map[string]bool{"srcs": true, "outs": true, "cmd": true, "tools": true},
+			ResolveAttrs:   map[string]bool{},
+		},
 		"cmake_configure_file": {
 			NonEmptyAttrs:  map[string]bool{"src": true, "out": true},
 			MergeableAttrs: map[string]bool{"defines": true},
 			ResolveAttrs:   map[string]bool{},
 		},
+		"cmake_configure_template": {
+			NonEmptyAttrs:  map[string]bool{"out": true},
+			MergeableAttrs: map[string]bool{"src": true, "content": true, "defines": true, "at_only": true, "escape_quotes": true, "copy_only": true, "newline_style": true},
+			ResolveAttrs:   map[string]bool{},
+		},
 		"cmake_include_directories": {
 			NonEmptyAttrs:  map[string]bool{"srcs": true},
 			MergeableAttrs: map[string]bool{"includes": true, "additional_hdrs": true, "defines": true},
@@ -129,12 +191,16 @@ func (l *cmakeLang) Loads() []rule.LoadInfo {
 	return []rule.LoadInfo{
 		{
 			Name:    "@rules_cc//cc:defs.bzl",
-			Symbols: []string{"cc_library", "cc_binary", "cc_test"},
+			Symbols: []string{"cc_library", "cc_binary", "cc_shared_library", "cc_test"},
 		},
 		{
 			Name:    "@gazelle-foreign-cc//rules:cmake_configure_file.bzl",
 			Symbols: []string{"cmake_configure_file"},
 		},
+		{
+			Name:    "@gazelle-foreign-cc//rules:cmake_configure_template.bzl",
+			Symbols: []string{"cmake_configure_template"},
+		},
 		{
 			Name:    "@gazelle-foreign-cc//rules:cmake_include_directories.bzl",
 			Symbols: []string{"cmake_include_directories"},
@@ -177,6 +243,13 @@ func (l *cmakeLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 		return l.generateRulesFromExternalSource(args, cmakeSource, packageDefines)
 	}
 
+	// Packages below the one with a cmake_source directive mirror the
+	// directories of the external project
+	if cfg.Layout == common.LayoutMirror && cfg.Source != "" {
+		log.Printf("cmakeLang.GenerateRules: Mirroring the directories of %s from %s in package %s", cfg.Source, cfg.SourcePackage, args.Rel)
+		return l.generateRulesFromExternalSource(args, cfg.Source, cfg.SourceDefines)
+	}
+
 	// Otherwise, look for local CMakeLists.txt
 	cmakeFilePath := filepath.Join(args.Dir, "CMakeLists.txt")
 
@@ -187,18 +260,31 @@ func (l *cmakeLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 
 	log.Printf("cmakeLang.GenerateRules: Called for package %s", args.Rel)
 
-	// Try to use CMake File API first
-	buildDir := filepath.Join(args.Dir, ".cmake-build")
-	api := NewCMakeFileAPI(args.Dir, buildDir, cfg.CMakeExecutable, packageDefines)
+	// With the mirror layout, every directory of a project is generated from
+	// the configuration of its top-level directory
+	if cfg.Layout == common.LayoutMirror {
+		projectRel := cmakeProjectRel(args)
+		projectDir := filepath.Join(args.Config.RepoRoot, projectRel)
+		project := l.loadProject(args.Config, projectDir, cfg, cfg.SourceDefines, projectRel)
+		if project.err != nil {
+			log.Printf("CMake File API failed for %s: %v. Falling back to parsing CMakeLists.txt directly.", projectRel, project.err)
+			return common.GenerateRulesWithDefines(args, packageDefines)
+		}
+		projectArgs := args
+		projectArgs.Dir = projectDir
+		return l.generateRulesFromTargetsWithRepoAndAPI(projectArgs, project.targets, "", project.api, cfg.SourceDefines)
+	}
 
-	cmakeTargets, err := api.GenerateFromAPI(args.Rel)
+	// Try to use CMake File API first
+	project := l.loadProject(args.Config, args.Dir, cfg, packageDefines, args.Rel)
+	api, cmakeTargets, err := project.api, project.targets, project.err
 	if err != nil {
-		log.Printf("CMake File API failed for %s: %v. Falling back to regex parsing.", args.Rel, err)
-		// Fallback to regex-based parsing using the existing function from gazelle package
+		log.Printf("CMake File API failed for %s: %v. Falling back to parsing CMakeLists.txt directly.", args.Rel, err)
+		// Fallback to parsing CMakeLists.txt directly using the common package
 		return common.GenerateRulesWithDefines(args, packageDefines)
 	}
 
-	return l.generateRulesFromTargets(args, cmakeTargets, packageDefines)
+	return l.generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "", api, packageDefines)
 }
 
 // generateRulesFromExternalSource handles the cmake_source directive pointing to external sources
@@ -241,14 +327,21 @@ func (l *cmakeLang) generateRulesFromExternalSource(args language.GenerateArgs,
 
 	log.Printf("Found CMakeLists.txt in external repository at: %s", cmakeFilePath)
 
-	// Process the external CMake project
+	// Process the external CMake project. With the mirror layout, the packages
+	// mirroring its directories share one configuration.
 	cfg := common.GetCMakeConfig(args.Config)
-	buildDir := filepath.Join(externalRepoPath, ".cmake-build")
-	api := NewCMakeFileAPI(externalRepoPath, buildDir, cfg.CMakeExecutable, packageDefines)
-
-	cmakeTargets, err := api.GenerateFromAPI(args.Rel)
+	projectRel := args.Rel
+	if cfg.Layout == common.LayoutMirror {
+		projectRel = cfg.SourcePackage
+	}
+	project := l.loadProject(args.Config, externalRepoPath, cfg, packageDefines, projectRel)
+	api, cmakeTargets, err := project.api, project.targets, project.err
+	if err != nil && cfg.Layout == common.LayoutMirror && args.Rel != cfg.SourcePackage {
+		// The package of the cmake_source directive falls back to the parser
+		return language.GenerateResult{}
+	}
 	if err != nil {
-		log.Printf("CMake File API failed for external source %s: %v. Falling back to regex parsing.", sourceLabel, err)
+		log.Printf("CMake File API failed for external source %s: %v. Falling back to parsing CMakeLists.txt directly.", sourceLabel, err)
 		// Create a modified args for the external directory
 		externalArgs := args
 		externalArgs.Dir = externalRepoPath
@@ -323,17 +416,6 @@ func (l *cmakeLang) findRepoViaRunfiles(repoName string) string {
 	return ""
 }
 
-// generateRulesFromTargets converts CMakeTarget objects to Bazel rules
-func (l *cmakeLang) generateRulesFromTargets(args language.GenerateArgs, cmakeTargets []*common.CMakeTarget, packageDefines map[string]string) language.GenerateResult {
-	// Generate rules from CMake targets (this function handles both cc_* and cmake_configure_file rules)
-	result := l.generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "", nil, packageDefines)
-
-	// The configure_file logic is handled in generateRulesFromTargetsWithRepoAndAPI
-	// No additional processing needed here
-
-	return result
-}
-
 // Helper function to check if file exists in regular files
 func fileExistsInRegularFiles(filename string, regularFiles []string) bool {
 	for _, file := range regularFiles {
@@ -347,9 +429,48 @@ func fileExistsInRegularFiles(filename string, regularFiles []string) bool {
 // generateRulesFromTargetsWithRepoAndAPI converts CMakeTarget objects to Bazel rules, with optional external repository context and CMakeFileAPI
 func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.GenerateArgs, cmakeTargets []*common.CMakeTarget, externalRepo string, api *CMakeFileAPI, packageDefines map[string]string) language.GenerateResult {
 	res := language.GenerateResult{}
+	cfg := common.GetCMakeConfig(args.Config)
+
+	// With the mirror layout, the package only holds the targets of the CMake
+	// directories it mirrors, and refers to the others by label. Paths stay
+	// relative to the top-level CMake directory until rules are emitted.
+	projectTargets := cmakeTargets
+	var mirror *mirrorLayout
+	if cfg.Layout == common.LayoutMirror {
+		projectRel := cfg.SourcePackage
+		if externalRepo == "" {
+			projectRel = cmakeProjectRel(args)
+		}
+		var directories []string
+		if api != nil {
+			directories = api.directories
+		}
+		mirror = newMirrorLayout(args.Config.RepoRoot, projectRel, externalRepo == "", directories, projectTargets)
+		cmakeTargets = mirror.targets(projectTargets, args.Rel)
+	}
+
+	// fileRef converts the path of a file of the project into the label rules
+	// of this package refer to it with
+	fileRef := func(p string) string {
+		switch {
+		case externalRepo != "":
+			return "@" + externalRepo + "//:" + p
+		case mirror != nil:
+			return mirror.fileLabel(p, args.Rel)
+		}
+		return p
+	}
+	// targetRef does the same for the rules generated for targets
+	targetRef := func(name string) string {
+		if mirror != nil {
+			return mirror.label(name, args.Rel)
+		}
+		return ":" + name
+	}
 
 	// Additionally, detect configure_file commands using CMake File API approach
 	var configureFiles []*common.CMakeConfigureFile
+	configureAPI := api
 	if api != nil {
 		// Use the provided API instance (for external repositories)
 		var err error
@@ -360,11 +481,12 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 		}
 	} else {
 		// Create a new API instance for local directories
-		cfg := common.GetCMakeConfig(args.Config)
-		buildDir := filepath.Join(args.Dir, ".cmake-build")
-		localAPI := NewCMakeFileAPI(args.Dir, buildDir, cfg.CMakeExecutable, packageDefines)
+		buildDir := projectBuildDir(cfg, projectKey(args.Dir, cfg, packageDefines))
+		configureAPI = NewCMakeFileAPI(args.Dir, buildDir, cfg.CMakeExecutable, packageDefines)
+		configureAPI.SetCacheDir(cfg.CacheDir)
+		configureAPI.SetBuildConfiguration(cfg.Generator, cfg.BuildType)
 		var err error
-		configureFiles, err = localAPI.DetectConfigureFileCommands()
+		configureFiles, err = configureAPI.DetectConfigureFileCommands()
 		if err != nil {
 			log.Printf("CMake File API configure_file detection failed for %s: %v", args.Rel, err)
 			configureFiles = []*common.CMakeConfigureFile{}
@@ -372,13 +494,15 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 	}
 
 	// Discover headers that could match configure_file outputs
-	discoverConfigureFileHeaders(cmakeTargets, configureFiles, args.Dir)
+	discoverConfigureFileHeaders(projectTargets, configureFiles, args.Dir)
 
 	// First, collect all generated files that are actually referenced by CMake targets
 	referencedGeneratedFiles := make(map[string]*common.CMakeConfigureFile)
 
-	// Check which configure_file outputs are actually referenced by CMake targets
-	for _, cmTarget := range cmakeTargets {
+	// Check which configure_file outputs are actually referenced by CMake targets.
+	// With the mirror layout, their rules are generated in the package of the
+	// top-level CMake directory, next to the CMakeLists.txt configuring them.
+	for _, cmTarget := range projectTargets {
 		for _, header := range cmTarget.Headers {
 			// Check if this header matches any configure_file output
 			for _, configFile := range configureFiles {
@@ -393,11 +517,20 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 	// Create a mapping of generated file paths to target names for dependency resolution
 	generatedFileMap := make(map[string]string)
 
-	// Generate cmake_configure_file rules only for files that are actually referenced
+	// Generate configure rules only for files that are actually referenced
 	for _, configFile := range referencedGeneratedFiles {
+		configureLabel := ":" + configFile.Name
+		emitConfigure := true
+		if mirror != nil && args.Rel != mirror.projectRel {
+			configureLabel = "//" + mirror.projectRel + configureLabel
+			emitConfigure = false
+		}
+
 		// For external repos, we need to check if the input file exists in the external repo
 		var inputFileRef string
-		if externalRepo != "" {
+		if configFile.InputFile == "" {
+			// file(CONFIGURE) writes its content without a template file
+		} else if externalRepo != "" {
 			// Check if the input file exists in the external repository
 			inputFilePath := filepath.Join(args.Dir, configFile.InputFile)
 			if _, err := os.Stat(inputFilePath); err == nil {
@@ -410,14 +543,13 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 			}
 		} else {
 			// Check if the input file exists in the current directory
-			if !fileExistsInRegularFiles(configFile.InputFile, args.RegularFiles) {
+			if !fileExistsInRegularFiles(configFile.InputFile, args.RegularFiles) && (mirror == nil || !l.fileExistsInDir(configFile.InputFile, args.Dir)) {
 				log.Printf("Input file %s for configure_file not found in current directory, skipping.", configFile.InputFile)
 				continue
 			}
 			inputFileRef = configFile.InputFile
 		}
 
-		r := rule.NewRule("cmake_configure_file", configFile.Name)
 		// Use the full output path provided by CMake so that generated
 		// files appear in the expected directory structure (e.g.
 		// `.cmake-build/foo.h`).  This ensures include paths reported by
@@ -426,72 +558,166 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 		if !strings.HasPrefix(outputPath, ".cmake-build/") {
 			outputPath = ".cmake-build/" + filepath.Base(configFile.OutputFile)
 		}
-		r.SetAttr("out", outputPath)
 
-		// Bazel's rule implementation copies the file from the CMake
-		// build directory. The path inside that build directory is just
-		// the basename of the output file.
-		r.SetAttr("generated_file_path", filepath.Base(configFile.OutputFile))
+		// Templates substituting known values are configured without cmake
+		r := configureAPI.configureTemplateRule(configFile)
+		if r != nil {
+			if configFile.InputFile != "" {
+				r.SetAttr("src", inputFileRef)
+			}
+			r.SetAttr("out", outputPath)
+		} else {
+			r = rule.NewRule("cmake_configure_file", configFile.Name)
+			r.SetAttr("out", outputPath)
+
+			// Bazel's rule implementation copies the file from the CMake
+			// build directory. The path inside that build directory is just
+			// the basename of the output file.
+			r.SetAttr("generated_file_path", filepath.Base(configFile.OutputFile))
 
-		// Set cmake_binary to reference the examples cmake target for examples directory
-		r.SetAttr("cmake_binary", "//:cmake")
+			// Set cmake_binary to reference the examples cmake target for examples directory
+			r.SetAttr("cmake_binary", "//:cmake")
 
-		// Set cmake_source_dir to current directory (where CMakeLists.txt is)
-		r.SetAttr("cmake_source_dir", ".")
+			// Set cmake_source_dir to current directory (where CMakeLists.txt is)
+			r.SetAttr("cmake_source_dir", ".")
 
-		// Include CMakeLists.txt and the input template file as sources
-		var sourceFiles []string
-		if externalRepo != "" {
-			sourceFiles = []string{"@" + externalRepo + "//:srcs"}
-		} else {
-			sourceFiles = []string{"CMakeLists.txt"}
-			if configFile.InputFile != "" && configFile.InputFile != "CMakeLists.txt" {
-				sourceFiles = append(sourceFiles, configFile.InputFile)
+			// Include CMakeLists.txt and the input template file as sources
+			var sourceFiles []string
+			if externalRepo != "" {
+				sourceFiles = []string{"@" + externalRepo + "//:srcs"}
+			} else {
+				sourceFiles = []string{"CMakeLists.txt"}
+				if configFile.InputFile != "" && configFile.InputFile != "CMakeLists.txt" {
+					sourceFiles = append(sourceFiles, configFile.InputFile)
+				}
 			}
-		}
-		r.SetAttr("cmake_source_files", sourceFiles)
+			r.SetAttr("cmake_source_files", sourceFiles)
 
-		// Always set defines attribute (even if empty for backward compatibility with tests)
-		r.SetAttr("defines", configFile.Variables)
+			// Always set defines attribute (even if empty for backward compatibility with tests)
+			r.SetAttr("defines", configFile.Variables)
+		}
 
 		// Store the output file name for reference by other rules
 		r.SetPrivateAttr("cmake_configure_output", outputPath)
 
-		res.Gen = append(res.Gen, r)
+		if mirror != nil {
+			r.SetAttr("visibility", []string{"//" + mirror.projectRel + ":__subpackages__"})
+		}
+		if emitConfigure {
+			res.Gen = append(res.Gen, r)
+		}
 
 		// Store mapping from generated file path to target name for dependency resolution
 		if externalRepo != "" {
 			// For external repos, map the generated file path
-			generatedFileMap["@"+externalRepo+"//:"+outputPath] = ":" + configFile.Name
+			generatedFileMap["@"+externalRepo+"//:"+outputPath] = configureLabel
 			// Also map the base filename pattern that CMake might report
-			generatedFileMap["@"+externalRepo+"//:"+filepath.Base(configFile.OutputFile)] = ":" + configFile.Name
+			generatedFileMap["@"+externalRepo+"//:"+filepath.Base(configFile.OutputFile)] = configureLabel
 			// Map the original output file path as CMake File API might report it
-			generatedFileMap["@"+externalRepo+"//:"+configFile.OutputFile] = ":" + configFile.Name
+			generatedFileMap["@"+externalRepo+"//:"+configFile.OutputFile] = configureLabel
 			// Map common CMake build directory patterns
 			if strings.HasPrefix(configFile.OutputFile, ".cmake-build/") {
 				// Map without the .cmake-build prefix
 				relativeOutput := strings.TrimPrefix(configFile.OutputFile, ".cmake-build/")
-				generatedFileMap["@"+externalRepo+"//:.cmake-build/"+relativeOutput] = ":" + configFile.Name
+				generatedFileMap["@"+externalRepo+"//:.cmake-build/"+relativeOutput] = configureLabel
 			}
 			// Map additional patterns that CMake File API might report
-			generatedFileMap["@"+externalRepo+"//:.cmake-build/lib/"+filepath.Base(configFile.OutputFile)] = ":" + configFile.Name
-			generatedFileMap["@"+externalRepo+"//:.cmake-build/include/"+filepath.Base(configFile.OutputFile)] = ":" + configFile.Name
+			generatedFileMap["@"+externalRepo+"//:.cmake-build/lib/"+filepath.Base(configFile.OutputFile)] = configureLabel
+			generatedFileMap["@"+externalRepo+"//:.cmake-build/include/"+filepath.Base(configFile.OutputFile)] = configureLabel
 		} else {
-			generatedFileMap[outputPath] = ":" + configFile.Name
+			generatedFileMap[outputPath] = configureLabel
 			// Also map the base filename pattern that CMake might report
-			generatedFileMap[filepath.Base(configFile.OutputFile)] = ":" + configFile.Name
+			generatedFileMap[filepath.Base(configFile.OutputFile)] = configureLabel
 			// Map the original output file path as CMake File API might report it
-			generatedFileMap[configFile.OutputFile] = ":" + configFile.Name
+			generatedFileMap[configFile.OutputFile] = configureLabel
 		}
 
-		log.Printf("Generated cmake_configure_file %s in %s: %s -> %s with defines: %v",
-			r.Name(), args.Rel, inputFileRef, outputPath, configFile.Variables)
+		log.Printf("Generated %s %s in %s: %s -> %s with defines: %v",
+			r.Kind(), r.Name(), args.Rel, inputFileRef, outputPath, configFile.Variables)
 	}
 
-	// Create a map of target names for quick lookup to identify local targets
+	// Create a map of target names for quick lookup to identify the targets of
+	// the project, which targetRef gives labels to
 	targetNames := make(map[string]bool)
-	for _, cmTarget := range cmakeTargets {
+	targetsByName := make(map[string]*common.CMakeTarget)
+	for _, cmTarget := range projectTargets {
 		targetNames[cmTarget.Name] = true
+		targetsByName[cmTarget.Name] = cmTarget
+	}
+
+	// Custom commands generating files the targets build become genrules, in
+	// the package of the CMake directory of the command with the mirror layout.
+	// Their outputs are files of that package rather than of the project.
+	var customCommands []*common.CMakeCustomCommand
+	if api != nil {
+		customCommands = common.UsedCustomCommands(api.customCommands, projectTargets)
+	}
+	outputRef := func(p, from string) string {
+		if mirror != nil {
+			return mirror.fileLabel(p, from)
+		}
+		return p
+	}
+	customOutputs := make(map[string]bool)
+	for _, cmd := range customCommands {
+		for _, output := range cmd.Outputs {
+			customOutputs[output] = true
+		}
+	}
+	generatedFiles := make(map[string]bool)
+	for _, cmd := range customCommands {
+		commandRel := args.Rel
+		if mirror != nil {
+			commandRel = mirror.projectRel
+			if pkg, ok := mirror.packages[cmd.Directory]; ok {
+				commandRel = pkg
+			}
+		}
+		r, err := common.CustomCommandRule(cmd, common.CustomCommandRefs{
+			Output: func(file string) string { return outputRef(file, commandRel) },
+			File: func(file string) string {
+				if customOutputs[file] {
+					return outputRef(file, commandRel)
+				}
+				return fileRef(file)
+			},
+			Target: func(name string) (string, bool) {
+				if !targetNames[name] {
+					return "", false
+				}
+				return targetRef(name), targetsByName[name].Type == "executable"
+			},
+		})
+		if err != nil {
+			if commandRel == args.Rel {
+				log.Printf("Cannot generate a genrule for %s: %v, skipping.", common.DescribeCustomCommand(cmd), err)
+			}
+			continue
+		}
+		for _, output := range cmd.Outputs {
+			generatedFiles[output] = true
+		}
+		if commandRel != args.Rel {
+			continue
+		}
+		if mirror != nil {
+			r.SetAttr("visibility", []string{"//" + mirror.projectRel + ":__subpackages__"})
+		}
+		res.Gen = append(res.Gen, r)
+		log.Printf("Generated genrule %s in %s for %s", r.Name(), args.Rel, common.DescribeCustomCommand(cmd))
+	}
+	// srcRef is fileRef for the sources of targets, which may be generated
+	srcRef := func(p string) string {
+		if generatedFiles[p] {
+			return outputRef(p, args.Rel)
+		}
+		return fileRef(p)
+	}
+
+	// #include lines are scanned in the directory the rules list files relative to
+	scanDir := args.Dir
+	if mirror != nil && externalRepo == "" {
+		scanDir = filepath.Join(args.Config.RepoRoot, args.Rel)
 	}
 
 	// Collect unique include directory sets and generate cmake_include_directories targets
@@ -500,8 +726,10 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 		targets  []string // targets that use this include set
 	}
 
-	includeSetMap := make(map[string]*includeSet) // key is stringified include set
-	includeTargetMap := make(map[string]string)   // maps target name to include target name
+	includeSetMap := make(map[string]*includeSet)      // key is stringified include set
+	includeTargetMap := make(map[string]string)        // maps target name to include target name
+	privateIncludeTargetMap := make(map[string]string) // same, for PRIVATE include directories
+	privateIncludeTargets := make(map[string][]string) // targets using an include set for PRIVATE include directories
 
 	// Helper function to normalize includes for consistent comparison
 	normalizeIncludes := func(dirs []string, hasGeneratedDeps bool, isExternal bool) []string {
@@ -555,27 +783,35 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 			}
 		}
 
-		normalizedIncludes := normalizeIncludes(cmTarget.IncludeDirectories, hasGeneratedDeps, externalRepo != "")
-
-		// Only create include targets if there are actual includes
-		if len(normalizedIncludes) > 0 {
+		// PRIVATE include directories get an include set of their own, which
+		// the target does not pass on to its consumers
+		publicDirs, privateDirs := common.SplitByScope(cmTarget.IncludeDirectories, cmTarget.PrivateIncludeDirectories)
+		if mirror != nil && externalRepo == "" {
+			// includes are relative to the package the include target is in
+			publicDirs = mirror.relativeDirs(publicDirs, args.Rel)
+			privateDirs = mirror.relativeDirs(privateDirs, args.Rel)
+		}
+		addIncludeSet := func(normalizedIncludes []string, private bool) {
+			// Only create include targets if there are actual includes
+			if len(normalizedIncludes) == 0 {
+				return
+			}
 			includeKey := strings.Join(normalizedIncludes, ",")
-
-			if set, exists := includeSetMap[includeKey]; exists {
-				// Add this target to the existing include set
-				set.targets = append(set.targets, cmTarget.Name)
+			if _, exists := includeSetMap[includeKey]; !exists {
+				includeSetMap[includeKey] = &includeSet{includes: normalizedIncludes}
+			}
+			if private {
+				privateIncludeTargets[includeKey] = append(privateIncludeTargets[includeKey], cmTarget.Name)
 			} else {
-				// Create new include set
-				includeSetMap[includeKey] = &includeSet{
-					includes: normalizedIncludes,
-					targets:  []string{cmTarget.Name},
-				}
+				includeSetMap[includeKey].targets = append(includeSetMap[includeKey].targets, cmTarget.Name)
 			}
 		}
+		addIncludeSet(normalizeIncludes(publicDirs, hasGeneratedDeps, externalRepo != ""), false)
+		addIncludeSet(normalizeIncludes(privateDirs, false, externalRepo != ""), true)
 	}
 
 	// Generate cmake_include_directories targets
-	for i, set := range includeSetMap {
+	for key, set := range includeSetMap {
 		var includeName string
 		if externalRepo != "" {
 			// For external repositories: use repo name + "_includes"
@@ -620,17 +856,20 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 		for _, targetName := range set.targets {
 			includeTargetMap[targetName] = ":" + includeName
 		}
+		for _, targetName := range privateIncludeTargets[key] {
+			privateIncludeTargetMap[targetName] = ":" + includeName
+		}
 
 		log.Printf("Generated cmake_include_directories %s with includes: %v for targets: %v",
-			includeName, set.includes, set.targets)
-
-		// Avoid unused variable error
-		_ = i
+			includeName, set.includes, append(append([]string{}, set.targets...), privateIncludeTargets[key]...))
 	}
 
+	// Split compile definitions into propagated (defines) and private (local_defines)
+	publicDefines, localDefines := classifyCompileDefinitions(projectTargets)
+
 	for _, cmTarget := range cmakeTargets {
 		var r *rule.Rule
-		if cmTarget.Type == "library" {
+		if cmTarget.Type == "library" || cmTarget.Type == "interface" {
 			r = rule.NewRule("cc_library", cmTarget.Name)
 		} else if cmTarget.Type == "executable" {
 			r = rule.NewRule("cc_binary", cmTarget.Name)
@@ -663,25 +902,34 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 			}
 		}
 
+		// Sources whose compile group needs different flags than the rest of the
+		// target are built in helper libraries instead of the main rule
+		languageOpts, helperGroups := splitCompileGroups(cmTarget)
+		helperSources := make(map[string]bool)
+		for _, group := range helperGroups {
+			for _, src := range group.Sources {
+				helperSources[src] = true
+			}
+		}
+
 		// Filter sources/headers and generate appropriate labels
 		var finalSrcs, finalHdrs []string
 		for _, s := range cmTarget.Sources {
 			// If this .c file is intended to be included by another .c source,
 			// treat it as a header, not a compilation unit.
 			if includedCFiles[s] {
-				if externalRepo != "" {
-					finalHdrs = append(finalHdrs, "@"+externalRepo+"//:"+s)
-				} else {
-					finalHdrs = append(finalHdrs, s)
-				}
+				finalHdrs = append(finalHdrs, fileRef(s))
 				continue
 			}
-
-			if externalRepo != "" {
-				finalSrcs = append(finalSrcs, "@"+externalRepo+"//:"+s)
-			} else {
-				finalSrcs = append(finalSrcs, s)
+			if helperSources[s] {
+				continue
 			}
+			if customOutputs[s] && !generatedFiles[s] {
+				log.Printf("Source file %s for target %s is generated by a custom command without genrule, skipping.", s, cmTarget.Name)
+				continue
+			}
+
+			finalSrcs = append(finalSrcs, srcRef(s))
 		}
 
 		// Track dependencies on cmake_configure_file targets
@@ -696,8 +944,12 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 				headerRef = h
 			}
 
-			// Check if this header is generated by a cmake_configure_file rule
-			if targetName, isGenerated := generatedFileMap[headerRef]; isGenerated {
+			// Check if this header is generated by a genrule or a cmake_configure_file rule
+			if generatedFiles[h] {
+				finalHdrs = append(finalHdrs, outputRef(h, args.Rel))
+			} else if customOutputs[h] {
+				log.Printf("Header file %s for target %s is generated by a custom command without genrule, skipping.", h, cmTarget.Name)
+			} else if targetName, isGenerated := generatedFileMap[headerRef]; isGenerated {
 				// Reference the generated file via its target label as a dependency
 				generatedDeps = append(generatedDeps, targetName)
 				log.Printf("Target %s includes generated header %s via target %s", cmTarget.Name, h, targetName)
@@ -710,31 +962,68 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 					// as these are build artifacts that don't exist in the external repo source
 					if !strings.Contains(h, ".cmake-build") {
 						// For external repositories, generate labels that reference the external repo
-						finalHdrs = append(finalHdrs, "@"+externalRepo+"//:"+h)
+						finalHdrs = append(finalHdrs, fileRef(h))
 					}
 				} else {
-					finalHdrs = append(finalHdrs, h)
+					finalHdrs = append(finalHdrs, fileRef(h))
 				}
 			} else {
 				log.Printf("Header file %s for target %s not found in current directory, skipping.", h, cmTarget.Name)
 			}
 		}
 
-		if len(finalSrcs) > 0 {
-			r.SetAttr("srcs", finalSrcs)
+		// Files only some compilation modes build
+		modeSrcs := common.ConfigValuesByMode(cmTarget, func(values *common.CMakeConfigValues) []string {
+			var srcs []string
+			for _, s := range values.Sources {
+				if customOutputs[s] && !generatedFiles[s] {
+					log.Printf("Source file %s for target %s is generated by a custom command without genrule, skipping.", s, cmTarget.Name)
+					continue
+				}
+				srcs = append(srcs, srcRef(s))
+			}
+			return srcs
+		})
+
+		// setAttr sets an attribute to values, followed by a select() on the
+		// compilation mode for the values only some modes have
+		setAttr := func(r *rule.Rule, key string, values []string, byMode map[string][]string) {
+			for mode, list := range byMode {
+				if len(list) == 0 {
+					delete(byMode, mode)
+				}
+			}
+			if len(values) > 0 || len(byMode) > 0 {
+				common.SetConfigAttr(r, key, values, byMode)
+			}
 		}
+		setAttr(r, "srcs", finalSrcs, modeSrcs)
 		// Only set hdrs for cc_library targets, not cc_binary
-		if len(finalHdrs) > 0 && cmTarget.Type == "library" {
+		if len(finalHdrs) > 0 && cmTarget.Type != "executable" {
 			r.SetAttr("hdrs", finalHdrs)
 		}
 
-		// Generate deps attribute for locally linked libraries, cmake_configure_file targets, and include targets
-		var deps []string
+		// Generate deps attribute for locally linked libraries, cmake_configure_file targets, and include targets.
+		// What a library links or includes PRIVATE goes to implementation_deps,
+		// which Bazel does not pass on to the targets depending on the library.
+		var deps, implementationDeps []string
+		addDep := func(dep string, private bool) {
+			if private {
+				implementationDeps = appendIfMissing(implementationDeps, dep)
+			} else {
+				deps = appendIfMissing(deps, dep)
+			}
+		}
+		isLibrary := cmTarget.Type != "executable"
 		for _, linkedLib := range cmTarget.LinkedLibraries {
+			private := isLibrary && containsString(cmTarget.PrivateLinkedLibraries, linkedLib)
 			// Check if the linked library matches another target in this directory
 			if targetNames[linkedLib] {
-				// For local targets, use local label syntax
-				deps = append(deps, ":"+linkedLib)
+				// For targets of the project, use their label
+				addDep(targetRef(linkedLib), private)
+			} else if mapped, ok := cfg.ResolveLabel(linkedLib, args.Rel); ok {
+				// Targets outside the project, mapped with a cmake_resolve directive
+				addDep(mapped, private)
 			}
 		}
 		// Add cmake_configure_file targets as dependencies
@@ -744,21 +1033,157 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 		if includeTarget, hasIncludes := includeTargetMap[cmTarget.Name]; hasIncludes {
 			deps = append(deps, includeTarget)
 		}
+		if includeTarget, hasIncludes := privateIncludeTargetMap[cmTarget.Name]; hasIncludes {
+			addDep(includeTarget, isLibrary)
+		}
+
+		// System libraries and linker flags, unless mapped to labels by directives
+		linkopts, linkDeps := common.LinkAttrs(cmTarget, cfg, args.Rel)
+		for _, dep := range linkDeps {
+			deps = appendIfMissing(deps, dep)
+		}
 
 		if len(deps) > 0 {
 			r.SetAttr("deps", deps)
 		}
+		if len(implementationDeps) > 0 {
+			r.SetAttr("implementation_deps", implementationDeps)
+		}
+		if len(linkopts) > 0 {
+			r.SetAttr("linkopts", linkopts)
+		}
+
+		// Carry over the preprocessor definitions and flags CMake compiles
+		// with. The definitions only some compilation modes have propagate
+		// unless they are PRIVATE, or the target is not a library.
+		modeDefines := common.ConfigValuesByMode(cmTarget, func(values *common.CMakeConfigValues) []string {
+			return values.CompileDefinitions
+		})
+		var modePublicDefines, modeLocalDefines map[string][]string
+		switch cmTarget.Type {
+		case "interface":
+			modePublicDefines = modeDefines
+		case "library":
+			modePublicDefines, modeLocalDefines = common.SplitModesByScope(modeDefines, cmTarget.PrivateCompileDefinitions)
+		default:
+			modeLocalDefines = modeDefines
+		}
+		modeCopts := common.ConfigValuesByMode(cmTarget, func(values *common.CMakeConfigValues) []string {
+			return values.CompileOptions
+		})
+		setAttr(r, "defines", publicDefines[cmTarget.Name], modePublicDefines)
+		setAttr(r, "local_defines", localDefines[cmTarget.Name], modeLocalDefines)
+		setAttr(r, "copts", compileOptionsForTarget(cmTarget), modeCopts)
+		if opts := languageOpts["C"]; len(opts) > 0 {
+			r.SetAttr("conlyopts", opts)
+		}
+		if opts := languageOpts["CXX"]; len(opts) > 0 {
+			r.SetAttr("cxxopts", opts)
+		}
+
+		// Emit a helper library per compile group with its own flags. The helpers
+		// share the main rule's deps and headers, and the main rule depends on
+		// them. A library keeps them among its implementation_deps, so that what
+		// it uses PRIVATE does not reach its consumers through the helpers.
+		for i, group := range helperGroups {
+			helperName := fmt.Sprintf("%s_%s_%d", cmTarget.Name, strings.ToLower(group.Language), i+1)
+			helper := rule.NewRule("cc_library", helperName)
+
+			var helperSrcs []string
+			for _, src := range group.Sources {
+				helperSrcs = append(helperSrcs, srcRef(src))
+			}
+			helperSrcs = append(helperSrcs, finalHdrs...)
+			helper.SetAttr("srcs", helperSrcs)
+
+			helperDefines := append(append([]string{}, publicDefines[cmTarget.Name]...), localDefines[cmTarget.Name]...)
+			for _, define := range group.CompileDefinitions {
+				if !containsString(cmTarget.CompileDefinitions, define) {
+					helperDefines = append(helperDefines, define)
+				}
+			}
+			setAttr(helper, "local_defines", helperDefines, modeDefines)
+
+			helperCopts := compileOptionsForTarget(cmTarget)
+			helperCopts = append(helperCopts, group.CompileOptions[len(cmTarget.CompileOptions):]...)
+			if group.LanguageStandard != "" && cmTarget.LanguageStandard == "" && !hasStdFlag(helperCopts) {
+				helperCopts = append(helperCopts, "-std="+group.LanguageStandard)
+			}
+			setAttr(helper, "copts", helperCopts, modeCopts)
+
+			if len(deps) > 0 {
+				helper.SetAttr("deps", deps)
+			}
+			if len(implementationDeps) > 0 {
+				helper.SetAttr("implementation_deps", implementationDeps)
+			}
+			// Keep every object file, as CMake links all of the target's sources
+			helper.SetAttr("alwayslink", true)
+			helper.SetPrivateAttr("cmake_includes", common.ScanIncludes(scanDir, helperSrcs))
+
+			res.Gen = append(res.Gen, helper)
+			helperKey := "deps"
+			if isLibrary {
+				helperKey = "implementation_deps"
+			}
+			values, byMode := common.ConfigAttr(r, helperKey)
+			common.SetConfigAttr(r, helperKey, append(values, ":"+helperName), byMode)
+			log.Printf("Generated helper %s for %d %s sources of %s with distinct compile flags", helperName, len(group.Sources), group.Language, cmTarget.Name)
+		}
 
 		// Store linked libraries for dependency resolution
 		if len(cmTarget.LinkedLibraries) > 0 {
 			r.SetPrivateAttr("cmake_linked_libraries", cmTarget.LinkedLibraries)
 		}
-		if len(cmTarget.IncludeDirectories) > 0 {
-			r.SetPrivateAttr("cmake_include_directories", cmTarget.IncludeDirectories)
+		// Headers are only reachable through the include directories consumers
+		// get, relative to the package like the headers
+		publicDirs, _ := common.SplitByScope(cmTarget.IncludeDirectories, cmTarget.PrivateIncludeDirectories)
+		if mirror != nil && externalRepo == "" {
+			publicDirs = mirror.relativeDirs(publicDirs, args.Rel)
 		}
-
-		if r.Attr("srcs") != nil || r.Attr("hdrs") != nil {
-			res.Gen = append(res.Gen, r)
+		if len(publicDirs) > 0 {
+			r.SetPrivateAttr("cmake_include_directories", publicDirs)
+		}
+		// Scan #include lines now, while args.Dir still points at the real sources
+		scanned := append(finalSrcs, finalHdrs...)
+		for _, mode := range common.CompilationModes {
+			scanned = append(scanned, modeSrcs[mode]...)
+		}
+		r.SetPrivateAttr("cmake_includes", common.ScanIncludes(scanDir, scanned))
+
+		// Interface libraries are kept even without headers, since consumers
+		// depend on them for their include directories and defines
+		if r.Attr("srcs") != nil || r.Attr("hdrs") != nil || len(helperGroups) > 0 || cmTarget.Type == "interface" {
+			// Shared libraries of the project are linked dynamically, like CMake does
+			dynamicDeps := common.DynamicDeps(cmTarget, targetsByName)
+			for i, dep := range dynamicDeps {
+				dynamicDeps[i] = targetRef(strings.TrimPrefix(dep, ":"))
+			}
+			var rules []*rule.Rule
+			if cmTarget.Type == "executable" {
+				if len(dynamicDeps) > 0 {
+					r.SetAttr("dynamic_deps", dynamicDeps)
+				}
+				rules = common.TestRules(r, testsForPackage(cmTarget.Tests, args, externalRepo))
+			} else {
+				rules = common.LibraryRules(r, cmTarget, dynamicDeps)
+			}
+			if cfg.PreserveGlobs {
+				globs := cmTarget.Globs
+				if mirror != nil && externalRepo == "" {
+					globs = mirror.relativeGlobs(globs, args.Rel)
+				}
+				common.PreserveGlobs(rules, globs)
+			}
+			// Rules linked from the packages of other CMake directories are visible to them
+			if mirror != nil {
+				if visibility := mirror.visibility(cmTarget.Name); len(visibility) > 0 {
+					for _, generated := range rules {
+						generated.SetAttr("visibility", visibility)
+					}
+				}
+			}
+			res.Gen = append(res.Gen, rules...)
 			// Don't add empty rules for now to test if this fixes the deps issue
 			// res.Empty = append(res.Empty, rule.NewRule(r.Kind(), r.Name()))
 			log.Printf("Generated %s %s in %s with srcs: %v, hdrs: %v, includes: %v, links: %v",
@@ -768,8 +1193,10 @@ func (l *cmakeLang) generateRulesFromTargetsWithRepoAndAPI(args language.Generat
 		}
 	}
 
-	if len(res.Gen) > 0 && len(res.Imports) == 0 {
-		res.Imports = make([]interface{}, len(res.Gen))
+	// Gazelle expects Imports to have the same length as Gen
+	res.Imports = make([]interface{}, len(res.Gen))
+	for i, r := range res.Gen {
+		res.Imports[i] = r.PrivateAttr("cmake_includes")
 	}
 
 	return res
@@ -806,17 +1233,27 @@ func (l *cmakeLang) UpdateRules(args language.GenerateArgs) language.GenerateRes
 // 'r' is the rule to resolve. 'imports' is a list of imported strings.
 // 'from' is the label of the rule 'r'.
 func (l *cmakeLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, r *rule.Rule, imports interface{}, from label.Label) {
-	// Delegate to the ResolveDeps function in the gazelle package.
-	// The 'imports' interface{} parameter in language.Resolver is what GenerateRules
-	// returns in GenerateResult.Imports. Our current GenerateRules returns nil for Imports.
-	// A more complete GenerateRules would parse source files for #include statements
-	// and return them as []string in GenerateResult.Imports.
+	// The 'imports' interface{} parameter is what GenerateRules returned in
+	// GenerateResult.Imports, i.e. the []common.IncludeDirective scanned from the
+	// rule's sources. The same list is stored on the rule as the "cmake_includes"
+	// private attribute, which is what common.ResolveDeps consumes.
 	if r.Kind() != "cc_library" && r.Kind() != "cc_binary" && r.Kind() != "cc_test" {
 		return // We only resolve for our own rule kinds.
 	}
-	log.Printf("cmakeLang.Resolve: Called for rule %s %s, imports type: %T", r.Kind(), r.Name(), imports)
-	// For now, this is a no-op - this is a basic stub
-	// In a real implementation, this would resolve dependencies based on #include statements
+
+	// Keep the deps computed during generation (local links, configure_file and
+	// include targets) and add whatever the include scan resolved to.
+	// Deps that depend on the compilation mode stay in their select().
+	deps, modeDeps := common.ConfigAttr(r, "deps")
+	implementationDeps, _ := common.ConfigAttr(r, "implementation_deps")
+	for _, result := range common.ResolveDeps(c, ix, rc, r, l, from) {
+		if dep := result.Label.Rel(from.Repo, from.Pkg).String(); !containsString(implementationDeps, dep) {
+			deps = appendIfMissing(deps, dep)
+		}
+	}
+	if len(deps) > 0 || len(modeDeps) > 0 {
+		common.SetConfigAttr(r, "deps", deps, modeDeps)
+	}
 }
 
 // CanCrossResolve indicates whether this language can resolve dependencies
@@ -837,10 +1274,39 @@ func (l *cmakeLang) Fix(c *config.Config, f *rule.File) {
 }
 
 // Imports returns a list of imports for the given rule.
+// Libraries publish their headers, both by workspace-relative path and relative
+// to each of their CMake include directories, so that #include lines in other
+// rules can be resolved to them.
 func (l *cmakeLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
-	// For now, return empty list
-	// In a real implementation, this would parse source files for #include statements
-	return nil
+	pkg := ""
+	if f != nil {
+		pkg = f.Pkg
+	}
+
+	var headerImports []string
+	switch r.Kind() {
+	case "cc_library":
+		// Rules generated in this run carry the CMake include directories;
+		// rules read back from an existing BUILD file only have "includes".
+		includeDirs, _ := r.PrivateAttr("cmake_include_directories").([]string)
+		if len(includeDirs) == 0 {
+			includeDirs = r.AttrStrings("includes")
+		}
+		headerImports = common.HeaderImports(pkg, common.RuleFiles(r, "hdrs"), includeDirs)
+	case "cmake_configure_file", "cmake_configure_template":
+		// Generated headers are reachable through the directory they are written to
+		if out := r.AttrString("out"); out != "" {
+			headerImports = common.HeaderImports(pkg, []string{out}, []string{filepath.Dir(out)})
+		}
+	default:
+		return nil
+	}
+
+	var specs []resolve.ImportSpec
+	for _, imp := range headerImports {
+		specs = append(specs, resolve.ImportSpec{Lang: "cc", Imp: imp})
+	}
+	return specs
 }
 
 // matchesConfigureFileOutput checks if a header file matches a configure_file output.
@@ -934,3 +1400,201 @@ func targetIncludesDirectory(target *common.CMakeTarget, targetDir, sourceDir st
 	}
 	return false
 }
+
+// classifyCompileDefinitions splits each target's compile definitions into the
+// ones it propagates to consumers and the ones private to the target.
+// The File API reports the effective definitions of every target without their
+// scope, so a library's definition is considered PUBLIC/INTERFACE unless the
+// CMakeLists.txt files make it PRIVATE or a local target linking the library
+// is compiled without it, which CMake would have propagated to it otherwise.
+// Definitions a target receives from the libraries it links are dropped, since
+// Bazel propagates the library's defines through deps.
+func classifyCompileDefinitions(cmakeTargets []*common.CMakeTarget) (map[string][]string, map[string][]string) {
+	targetsByName := make(map[string]*common.CMakeTarget)
+	consumers := make(map[string][]*common.CMakeTarget)
+	for _, cmTarget := range cmakeTargets {
+		targetsByName[cmTarget.Name] = cmTarget
+	}
+	for _, cmTarget := range cmakeTargets {
+		for _, lib := range cmTarget.LinkedLibraries {
+			if _, ok := targetsByName[lib]; ok && lib != cmTarget.Name {
+				consumers[lib] = append(consumers[lib], cmTarget)
+			}
+		}
+	}
+
+	// Definitions each library exposes to its consumers
+	exported := make(map[string]map[string]bool)
+	for _, cmTarget := range cmakeTargets {
+		exported[cmTarget.Name] = make(map[string]bool)
+		if cmTarget.Type == "interface" {
+			// Everything an INTERFACE library defines is for its consumers
+			for _, define := range cmTarget.CompileDefinitions {
+				exported[cmTarget.Name][define] = true
+			}
+			continue
+		}
+		if cmTarget.Type != "library" {
+			continue
+		}
+		for _, define := range cmTarget.CompileDefinitions {
+			if containsString(cmTarget.PrivateCompileDefinitions, define) {
+				continue
+			}
+			sharedByAll := true
+			for _, consumer := range consumers[cmTarget.Name] {
+				if !containsString(consumer.CompileDefinitions, define) {
+					sharedByAll = false
+					break
+				}
+			}
+			if sharedByAll {
+				exported[cmTarget.Name][define] = true
+			}
+		}
+	}
+
+	// Definitions reaching a target through the libraries it (transitively) links
+	var inherited func(name string, visited map[string]bool) map[string]bool
+	inherited = func(name string, visited map[string]bool) map[string]bool {
+		result := make(map[string]bool)
+		cmTarget, ok := targetsByName[name]
+		if !ok {
+			return result
+		}
+		for _, lib := range cmTarget.LinkedLibraries {
+			if visited[lib] || targetsByName[lib] == nil {
+				continue
+			}
+			visited[lib] = true
+			for define := range exported[lib] {
+				result[define] = true
+			}
+			for define := range inherited(lib, visited) {
+				result[define] = true
+			}
+		}
+		return result
+	}
+
+	publicDefines := make(map[string][]string)
+	localDefines := make(map[string][]string)
+	for _, cmTarget := range cmakeTargets {
+		fromDeps := inherited(cmTarget.Name, map[string]bool{cmTarget.Name: true})
+		for _, define := range cmTarget.CompileDefinitions {
+			if fromDeps[define] {
+				continue
+			}
+			if exported[cmTarget.Name][define] {
+				publicDefines[cmTarget.Name] = append(publicDefines[cmTarget.Name], define)
+			} else {
+				localDefines[cmTarget.Name] = append(localDefines[cmTarget.Name], define)
+			}
+		}
+	}
+	return publicDefines, localDefines
+}
+
+// compileOptionsForTarget returns the copts for a target: its compile flags plus
+// the language standard and sysroot when they are not already among the flags.
+func compileOptionsForTarget(cmTarget *common.CMakeTarget) []string {
+	copts := append([]string{}, cmTarget.CompileOptions...)
+
+	if cmTarget.LanguageStandard != "" && !hasStdFlag(copts) {
+		copts = append(copts, "-std="+cmTarget.LanguageStandard)
+	}
+
+	if cmTarget.Sysroot != "" {
+		copts = appendIfMissing(copts, "--sysroot="+cmTarget.Sysroot)
+	}
+
+	return copts
+}
+
+// hasStdFlag reports whether the flags already select a language standard
+func hasStdFlag(flags []string) bool {
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, "-std=") || strings.HasPrefix(flag, "/std:") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCompileGroups works out how a target's compile groups map onto Bazel
+// attributes. For each language the group with the most sources is the main
+// one: whatever it adds on top of the target-wide settings is returned as that
+// language's options (conlyopts/cxxopts), with extra definitions written as -D
+// flags. Groups whose additions differ from the main group of their language
+// (e.g. from set_source_files_properties) are returned as helpers.
+func splitCompileGroups(cmTarget *common.CMakeTarget) (map[string][]string, []common.CMakeCompileGroup) {
+	languageOpts := make(map[string][]string)
+	var helpers []common.CMakeCompileGroup
+
+	extraOpts := func(group common.CMakeCompileGroup) []string {
+		var opts []string
+		if len(group.CompileOptions) > len(cmTarget.CompileOptions) {
+			opts = append(opts, group.CompileOptions[len(cmTarget.CompileOptions):]...)
+		}
+		if group.LanguageStandard != "" && cmTarget.LanguageStandard == "" && !hasStdFlag(opts) && !hasStdFlag(cmTarget.CompileOptions) {
+			opts = append(opts, "-std="+group.LanguageStandard)
+		}
+		for _, define := range group.CompileDefinitions {
+			if !containsString(cmTarget.CompileDefinitions, define) {
+				opts = append(opts, "-D"+define)
+			}
+		}
+		return opts
+	}
+
+	mainGroups := make(map[string]int)
+	for i, group := range cmTarget.CompileGroups {
+		if len(group.Sources) == 0 {
+			continue
+		}
+		if current, ok := mainGroups[group.Language]; !ok || len(group.Sources) > len(cmTarget.CompileGroups[current].Sources) {
+			mainGroups[group.Language] = i
+		}
+	}
+
+	for i, group := range cmTarget.CompileGroups {
+		mainIdx, ok := mainGroups[group.Language]
+		if !ok {
+			continue
+		}
+		opts := extraOpts(group)
+		if i == mainIdx {
+			if len(opts) > 0 {
+				languageOpts[group.Language] = opts
+			}
+			continue
+		}
+		if strings.Join(opts, "\x00") != strings.Join(extraOpts(cmTarget.CompileGroups[mainIdx]), "\x00") {
+			helpers = append(helpers, group)
+		}
+	}
+
+	return languageOpts, helpers
+}
+
+// testsForPackage rewrites test arguments that name files of a local package so
+// they are found from the test's working directory (the workspace root).
+func testsForPackage(tests []common.CMakeTest, args language.GenerateArgs, externalRepo string) []common.CMakeTest {
+	if externalRepo != "" || args.Rel == "" {
+		return tests
+	}
+
+	var result []common.CMakeTest
+	for _, test := range tests {
+		var testArgs []string
+		for _, arg := range test.Args {
+			if !filepath.IsAbs(arg) && !strings.HasPrefix(arg, "-") && fileExists(arg, args.RegularFiles) {
+				arg = filepath.ToSlash(filepath.Join(args.Rel, arg))
+			}
+			testArgs = append(testArgs, arg)
+		}
+		test.Args = testArgs
+		result = append(result, test)
+	}
+	return result
+}
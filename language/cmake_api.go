@@ -1,17 +1,17 @@
 package language
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"log"
 
+	"github.com/bazelbuild/bazel-gazelle/rule"
 	"github.com/goniz/gazelle-foreign-cc/common"
 )
 
@@ -129,19 +129,74 @@ type Target struct {
 		Name    string `json:"name"`
 		Sources []int  `json:"sources"`
 	} `json:"sourceGroups,omitempty"`
+	// FileSets is reported by codemodel v2.5 and later
+	FileSets []struct {
+		Name            string   `json:"name"`
+		Type            string   `json:"type"`
+		Visibility      string   `json:"visibility"`
+		BaseDirectories []string `json:"baseDirectories"`
+	} `json:"fileSets,omitempty"`
+	// LinkLibraries and InterfaceLinkLibraries are reported by newer codemodel
+	// versions and list the LINK_LIBRARIES and INTERFACE_LINK_LIBRARIES entries
+	LinkLibraries          []linkLibrary `json:"linkLibraries,omitempty"`
+	InterfaceLinkLibraries []linkLibrary `json:"interfaceLinkLibraries,omitempty"`
 	CompileGroups json.RawMessage `json:"compileGroups,omitempty"`
 	BacktraceGraph json.RawMessage `json:"backtraceGraph,omitempty"`
 	Folder string `json:"folder,omitempty"`
 }
 
+// linkLibrary is an entry of a target's linkLibraries or interfaceLinkLibraries.
+// ID is set when the entry names a target of the project.
+type linkLibrary struct {
+	ID        string `json:"id,omitempty"`
+	Fragment  string `json:"fragment,omitempty"`
+	Backtrace int    `json:"backtrace,omitempty"`
+}
+
 // CMakeFileAPI handles interaction with CMake File API
 type CMakeFileAPI struct {
-	sourceDir    string
+	sourceDir string
+	// buildDir is where cmake configures the project, out of the source tree.
+	// The paths of the reply inside it are read as if it was the .cmake-build
+	// directory of sourceDir, which the generated rules refer to.
 	buildDir     string
 	cmakeExe     string
 	cmakeDefines map[string]string
 	configured   bool
 	cache        map[string]string
+	// directories are the CMake source directories of the project, relative to
+	// sourceDir ("" for sourceDir itself)
+	directories []string
+	// customCommands are the custom commands and targets of the project, which
+	// the codemodel does not describe
+	customCommands []*common.CMakeCustomCommand
+	// checkResults are the variables set by the checks of the project, whose
+	// values only cmake can compute
+	checkResults map[string]bool
+	// fallbackConfigureFiles are the configure_file() and file(CONFIGURE)
+	// calls the fallback parser evaluated, by output file name
+	fallbackConfigureFiles map[string]*common.CMakeConfigureFile
+	// cacheDir is where configure results are cached across runs, or "" to
+	// always run cmake. cacheEntryDir is the entry of the project in it, and
+	// cachedReplyDir the File API reply read from it instead of buildDir.
+	cacheDir       string
+	cacheEntryDir  string
+	cachedReplyDir string
+	// cacheLoaded tells whether cache holds the cache-v2 reply already
+	cacheLoaded bool
+	// snapshotPath is the snapshot of the File API reply recorded or replayed
+	// as snapshotMode, one of the -cmake_snapshot modes
+	snapshotPath string
+	snapshotMode string
+	// ctestOutput is the output of ctest, with the build paths translated
+	ctestOutput []byte
+	// generator and buildType are the generator and CMAKE_BUILD_TYPE cmake
+	// configures with, "" for its defaults
+	generator string
+	buildType string
+	// testConfiguration is the configuration ctest lists the tests of, for
+	// multi-config generators
+	testConfiguration string
 }
 
 // NewCMakeFileAPI creates a new CMake File API handler
@@ -153,6 +208,7 @@ func NewCMakeFileAPI(sourceDir, buildDir, cmakeExe string, cmakeDefines map[stri
 		cmakeDefines: cmakeDefines,
 		configured:   false,
 		cache:        make(map[string]string),
+		checkResults: make(map[string]bool),
 	}
 }
 
@@ -181,18 +237,118 @@ func (api *CMakeFileAPI) CreateQuery() error {
 	return nil
 }
 
+// SetCacheDir makes the handler reuse the configure results cached in dir
+// while the CMake files they were computed from are unchanged, and cache new
+// ones there. An empty dir disables the cache.
+func (api *CMakeFileAPI) SetCacheDir(dir string) {
+	api.cacheDir = dir
+}
+
+// SetBuildConfiguration makes cmake configure with a generator and
+// CMAKE_BUILD_TYPE, unless they are empty. The build type also selects the
+// configuration of a multi-config generator the rules are generated from.
+func (api *CMakeFileAPI) SetBuildConfiguration(generator, buildType string) {
+	api.generator = generator
+	api.buildType = buildType
+}
+
+// defines returns the -D flags cmake configures with, including the build type
+func (api *CMakeFileAPI) defines() map[string]string {
+	return common.WithBuildType(api.cmakeDefines, api.buildType)
+}
+
+// SetSnapshot makes the handler replay the File API reply recorded in the
+// snapshot at path, or record it there, depending on mode
+func (api *CMakeFileAPI) SetSnapshot(path, mode string) {
+	api.snapshotPath = path
+	api.snapshotMode = mode
+}
+
+// ensureConfigured makes File API responses available, from a snapshot, the
+// cache or by running cmake
+func (api *CMakeFileAPI) ensureConfigured() error {
+	if api.configured {
+		return nil
+	}
+	if api.loadSnapshot() {
+		api.configured = true
+		return nil
+	}
+	if api.snapshotMode == common.SnapshotReplay {
+		return fmt.Errorf("no CMake snapshot to replay at %s", api.snapshotPath)
+	}
+	if api.loadCachedConfigure() {
+		api.configured = true
+		return nil
+	}
+
+	// Create query files
+	if err := api.CreateQuery(); err != nil {
+		return fmt.Errorf("failed to create File API query: %w", err)
+	}
+
+	// Run CMake configure
+	if err := api.Configure(); err != nil {
+		return fmt.Errorf("failed to run CMake configure: %w", err)
+	}
+	api.configured = true
+	api.storeConfigure()
+	return nil
+}
+
+// logicalBuildDir returns the build directory the generated rules refer to,
+// whatever the directory cmake configured the project in
+func (api *CMakeFileAPI) logicalBuildDir() string {
+	return filepath.Join(api.sourceDir, ".cmake-build")
+}
+
+// translateBuildPaths rewrites the paths inside the build directory that
+// cmake reports in JSON data into paths inside the logical build directory
+func (api *CMakeFileAPI) translateBuildPaths(data []byte) []byte {
+	logical := filepath.ToSlash(api.logicalBuildDir())
+	buildDirs := []string{filepath.ToSlash(api.buildDir)}
+	if resolved, err := filepath.EvalSymlinks(api.buildDir); err == nil && resolved != api.buildDir {
+		buildDirs = append(buildDirs, filepath.ToSlash(resolved))
+	}
+	for _, buildDir := range buildDirs {
+		if buildDir == logical {
+			continue
+		}
+		data = replacePathPrefix(data, buildDir, logical)
+	}
+	return data
+}
+
+// replacePathPrefix replaces the directory from, and the paths below it, with
+// to in JSON data
+func replacePathPrefix(data []byte, from, to string) []byte {
+	data = bytes.ReplaceAll(data, []byte(from+"/"), []byte(to+"/"))
+	return bytes.ReplaceAll(data, []byte(`"`+from+`"`), []byte(`"`+to+`"`))
+}
+
+// readReplyFile reads a file of the File API reply, with the paths of the
+// build directory translated
+func (api *CMakeFileAPI) readReplyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return api.translateBuildPaths(data), nil
+}
+
+// replyDir returns the directory holding the File API reply
+func (api *CMakeFileAPI) replyDir() string {
+	if api.cachedReplyDir != "" {
+		return api.cachedReplyDir
+	}
+	return filepath.Join(api.buildDir, ".cmake", "api", "v1", "reply")
+}
+
 // DetectConfigureFileCommands detects configure_file commands using CMake File API
 func (api *CMakeFileAPI) DetectConfigureFileCommands() ([]*common.CMakeConfigureFile, error) {
 	// Ensure we have File API responses available
-	if !api.configured {
-		if err := api.CreateQuery(); err != nil {
-			return nil, fmt.Errorf("failed to create File API query: %w", err)
-		}
-		
-		if err := api.Configure(); err != nil {
-			return nil, fmt.Errorf("failed to run CMake configure: %w", err)
-		}
-		api.configured = true
+	if err := api.ensureConfigured(); err != nil {
+		return nil, err
 	}
 	
 	// Load CMake cache to get actual variables
@@ -205,6 +361,11 @@ func (api *CMakeFileAPI) DetectConfigureFileCommands() ([]*common.CMakeConfigure
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse CMakeLists.txt for configure_file commands: %w", err)
 	}
+
+	// The values of the variables the templates use come from the fallback parser
+	if api.fallbackConfigureFiles == nil {
+		api.parseFallbackTargets()
+	}
 	
 	return configureFiles, nil
 }
@@ -216,9 +377,12 @@ func (api *CMakeFileAPI) Configure() error {
 		return fmt.Errorf("failed to create build directory: %w", err)
 	}
 
-	// Build cmake command with -D flags for defines
+	// Build cmake command with the generator and -D flags for defines
 	args := []string{}
-	for key, value := range api.cmakeDefines {
+	if api.generator != "" {
+		args = append(args, "-G", api.generator)
+	}
+	for key, value := range api.defines() {
 		args = append(args, fmt.Sprintf("-D%s=%s", key, value))
 	}
 	args = append(args, api.sourceDir)
@@ -240,7 +404,7 @@ func (api *CMakeFileAPI) Configure() error {
 
 // ReadAPIResponse reads and parses the CMake File API response
 func (api *CMakeFileAPI) ReadAPIResponse() (*APIIndex, *Codemodel, map[string]*Target, error) {
-	replyDir := filepath.Join(api.buildDir, ".cmake", "api", "v1", "reply")
+	replyDir := api.replyDir()
 	
 	// Find the index file
 	indexPattern := filepath.Join(replyDir, "index-*.json")
@@ -254,7 +418,7 @@ func (api *CMakeFileAPI) ReadAPIResponse() (*APIIndex, *Codemodel, map[string]*T
 
 	// Read the most recent index file (they're timestamped)
 	indexFile := indexFiles[len(indexFiles)-1]
-	indexData, err := ioutil.ReadFile(indexFile)
+	indexData, err := api.readReplyFile(indexFile)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to read index file: %w", err)
 	}
@@ -277,7 +441,7 @@ func (api *CMakeFileAPI) ReadAPIResponse() (*APIIndex, *Codemodel, map[string]*T
 	}
 
 	codemodelFile := filepath.Join(replyDir, codemodelJSONFile)
-	codemodelData, err := ioutil.ReadFile(codemodelFile)
+	codemodelData, err := api.readReplyFile(codemodelFile)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to read codemodel file: %w", err)
 	}
@@ -287,13 +451,55 @@ func (api *CMakeFileAPI) ReadAPIResponse() (*APIIndex, *Codemodel, map[string]*T
 		return nil, nil, nil, fmt.Errorf("failed to parse codemodel file: %w", err)
 	}
 
-	// Read all targets
+	return &index, &codemodel, api.readTargets(&codemodel, api.configuration(&codemodel)), nil
+}
+
+// configuration returns the index of the codemodel configuration rules are
+// generated from: the one of the build type, or else the first one, which a
+// multi-config generator builds by default
+func (api *CMakeFileAPI) configuration(codemodel *Codemodel) int {
+	if buildType := api.defines()["CMAKE_BUILD_TYPE"]; buildType != "" {
+		for i, config := range codemodel.Configurations {
+			if strings.EqualFold(config.Name, buildType) {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// modeConfigurations returns the index of the codemodel configuration each
+// compilation mode stands for, when a multi-config generator reported more
+// than one, and nil otherwise. dbg is Debug and opt Release, when the
+// project has them, and fastbuild the configuration of the build type.
+func (api *CMakeFileAPI) modeConfigurations(codemodel *Codemodel) map[string]int {
+	if len(codemodel.Configurations) < 2 {
+		return nil
+	}
+	selected := api.configuration(codemodel)
+	names := common.CompilationModeConfigs(codemodel.Configurations[selected].Name)
+	byMode := make(map[string]int)
+	for _, mode := range common.CompilationModes {
+		byMode[mode] = selected
+		for i, config := range codemodel.Configurations {
+			if strings.EqualFold(config.Name, names[mode]) {
+				byMode[mode] = i
+				break
+			}
+		}
+	}
+	return byMode
+}
+
+// readTargets reads the targets of a codemodel configuration, by ID
+func (api *CMakeFileAPI) readTargets(codemodel *Codemodel, configuration int) map[string]*Target {
+	replyDir := api.replyDir()
 	targets := make(map[string]*Target)
-	if len(codemodel.Configurations) > 0 {
-		config := codemodel.Configurations[0] // Use first configuration
+	if configuration < len(codemodel.Configurations) {
+		config := codemodel.Configurations[configuration]
 		for _, targetRef := range config.Targets {
 			targetFile := filepath.Join(replyDir, targetRef.JSONFile)
-			targetData, err := ioutil.ReadFile(targetFile)
+			targetData, err := api.readReplyFile(targetFile)
 			if err != nil {
 				log.Printf("Warning: failed to read target file %s: %v", targetFile, err)
 				continue
@@ -314,128 +520,791 @@ func (api *CMakeFileAPI) ReadAPIResponse() (*APIIndex, *Codemodel, map[string]*T
 			targets[target.ID] = &target
 		}
 	}
-
-	return &index, &codemodel, targets, nil
+	return targets
 }
 
 // GenerateFromAPI generates Bazel rules using CMake File API
 func (api *CMakeFileAPI) GenerateFromAPI(relativeDir string) ([]*common.CMakeTarget, error) {
 	// Ensure we have File API responses available
-	if !api.configured {
-		// Create query files
-		if err := api.CreateQuery(); err != nil {
-			return nil, fmt.Errorf("failed to create API query: %w", err)
-		}
-
-		// Run CMake configure
-		if err := api.Configure(); err != nil {
-			return nil, fmt.Errorf("failed to configure CMake: %w", err)
-		}
-		api.configured = true
+	if err := api.ensureConfigured(); err != nil {
+		return nil, err
 	}
 
 	// Read API response
-	_, _, targets, err := api.ReadAPIResponse()
+	index, codemodel, targets, err := api.ReadAPIResponse()
 	if err != nil {
 		return nil, fmt.Errorf("failed to read API response: %w", err)
 	}
+	// Cache variables are read with the rest of the reply
+	if err := api.loadCache(); err != nil {
+		log.Printf("Warning: failed to load CMake cache: %v", err)
+	}
+	if len(codemodel.Configurations) > 0 {
+		api.directories = nil
+		for _, dir := range codemodel.Configurations[api.configuration(codemodel)].Directories {
+			api.directories = append(api.directories, cmakeDirectory(dir.Source, api.sourceDir))
+		}
+	}
+	if len(codemodel.Configurations) > 1 {
+		api.testConfiguration = codemodel.Configurations[api.configuration(codemodel)].Name
+	}
 
-	// Convert targets to CMakeTarget format
-	var cmakeTargets []*common.CMakeTarget
+	// Globs CMake re-checks at build time, which rules can keep as glob()
+	var globs []common.CMakeGlob
+	if cmakeFiles, err := api.ReadCMakeFiles(index); err != nil {
+		log.Printf("Warning: failed to read cmakeFiles: %v", err)
+	} else {
+		globs = globsFromCMakeFiles(cmakeFiles, api.sourceDir)
+	}
 
-	for _, target := range targets {
-		// Skip utility targets and imported targets
-		if target.Type == "UTILITY" || strings.HasPrefix(target.Type, "INTERFACE") {
-			continue
+	// Tests registered with add_test(), keyed by the executable they run
+	testsByExecutable := api.readTests()
+	if api.snapshotMode == common.SnapshotRecord {
+		api.recordSnapshot()
+	}
+
+	// What the codemodel does not report is taken from the CMakeLists.txt files
+	parsedTargets := api.parseFallbackTargets()
+	parsedByName := make(map[string]*common.CMakeTarget)
+	for _, parsed := range parsedTargets {
+		parsedByName[parsed.Name] = parsed
+	}
+
+	// Files generated by custom commands, which the fallback parser places in
+	// the package like the build directory
+	customOutputs := make(map[string]bool)
+	customTargets := make(map[string]bool)
+	for _, cmd := range api.customCommands {
+		for _, output := range cmd.Outputs {
+			customOutputs[output] = true
 		}
+		if cmd.Target != "" {
+			customTargets[cmd.Target] = true
+		}
+	}
 
-		cmakeTarget := &common.CMakeTarget{
-			Name: target.Name,
+	// convertTargets converts the targets of a codemodel configuration to
+	// CMakeTarget format
+	convertTargets := func(targets map[string]*Target) []*common.CMakeTarget {
+		// The build type the compilation modes fall back to when evaluating
+		// generator expressions left in link command lines
+		buildType := api.defines()["CMAKE_BUILD_TYPE"]
+		if len(codemodel.Configurations) > 0 {
+			buildType = codemodel.Configurations[api.configuration(codemodel)].Name
 		}
 
-		// Map CMake target type to our type
-		switch target.Type {
-		case "STATIC_LIBRARY", "SHARED_LIBRARY", "MODULE_LIBRARY", "OBJECT_LIBRARY":
-			cmakeTarget.Type = "library"
-		case "EXECUTABLE":
-			cmakeTarget.Type = "executable"
-		default:
-			log.Printf("Unknown target type %s for target %s, skipping", target.Type, target.Name)
-			continue
+		// Libraries built by the project, by the name of the file they produce
+		projectLibraries := make(map[string]string)
+		for _, target := range targets {
+			if outputName, _ := parseLibraryFileName(target.NameOnDisk); outputName != "" && strings.HasSuffix(target.Type, "_LIBRARY") {
+				projectLibraries[outputName] = target.Name
+			}
+		}
+
+		var cmakeTargets []*common.CMakeTarget
+		for _, target := range targets {
+			// Utility targets only build something through the custom commands
+			// of add_custom_target(), which become genrules
+			if target.Type == "UTILITY" {
+				if !customTargets[target.Name] {
+					log.Printf("Utility target %s is not an add_custom_target() of the CMakeLists.txt files, skipping", target.Name)
+				}
+				continue
+			}
+
+			cmakeTarget := &common.CMakeTarget{
+				Name:      target.Name,
+				Directory: cmakeDirectory(target.Paths.Source, api.sourceDir),
+			}
+
+			// Map CMake target type to our type
+			switch target.Type {
+			case "STATIC_LIBRARY", "SHARED_LIBRARY", "MODULE_LIBRARY", "OBJECT_LIBRARY":
+				cmakeTarget.Type = "library"
+				cmakeTarget.LibraryType = strings.TrimSuffix(target.Type, "_LIBRARY")
+				cmakeTarget.OutputName, cmakeTarget.Version = parseLibraryFileName(target.NameOnDisk)
+				// The SOVERSION defaults to the VERSION and is not part of the file name
+				cmakeTarget.SOVersion = cmakeTarget.Version
+				if parsed, ok := parsedByName[target.Name]; ok && parsed.SOVersion != "" {
+					cmakeTarget.SOVersion = parsed.SOVersion
+				}
+			case "EXECUTABLE":
+				cmakeTarget.Type = "executable"
+			case "INTERFACE_LIBRARY":
+				cmakeTarget.Type = "interface"
+			default:
+				log.Printf("Unknown target type %s for target %s, skipping", target.Type, target.Name)
+				continue
+			}
+
+			// Extract sources and headers
+			for _, source := range target.Sources {
+				// Make path relative to the source directory if it's absolute
+				sourcePath := relativeSourcePath(source.Path, api.sourceDir)
+				if source.IsGenerated {
+					if generatedPath := relativeSourcePath(source.Path, api.logicalBuildDir()); customOutputs[generatedPath] {
+						sourcePath = generatedPath
+					} else if !customOutputs[sourcePath] {
+						log.Printf("Generated source %s of target %s is not the output of a custom command", sourcePath, target.Name)
+					}
+				}
+
+				// Only include files that are in the current directory or subdirectories
+				if !strings.HasPrefix(sourcePath, "..") {
+					if isHeaderFile(sourcePath) {
+						cmakeTarget.Headers = appendIfMissing(cmakeTarget.Headers, sourcePath)
+					} else if isSourceFile(sourcePath) {
+						cmakeTarget.Sources = appendIfMissing(cmakeTarget.Sources, sourcePath)
+					}
+				}
+			}
+
+			// Header file sets of an INTERFACE library name its include directories
+			if target.Type == "INTERFACE_LIBRARY" {
+				for _, fileSet := range target.FileSets {
+					if fileSet.Type != "HEADERS" || fileSet.Visibility == "PRIVATE" {
+						continue
+					}
+					for _, baseDir := range fileSet.BaseDirectories {
+						baseDir = relativeSourcePath(baseDir, api.sourceDir)
+						if !strings.HasPrefix(baseDir, "..") {
+							cmakeTarget.IncludeDirectories = appendIfMissing(cmakeTarget.IncludeDirectories, baseDir)
+						}
+					}
+				}
+			}
+
+			common.AttachGlobs(cmakeTarget, globs)
+
+			// Extract include directories
+			includeDirectories := extractIncludeDirectories(target, api.sourceDir)
+			cmakeTarget.IncludeDirectories = append(cmakeTarget.IncludeDirectories, includeDirectories...)
+
+			// Extract compile definitions and flags
+			extractCompileSettings(target, cmakeTarget, api.sourceDir)
+
+			// Attach tests registered with add_test() for this executable
+			if target.Type == "EXECUTABLE" {
+				for _, artifact := range target.Artifacts {
+					artifactPath := artifact.Path
+					if !filepath.IsAbs(artifactPath) {
+						artifactPath = filepath.Join(api.logicalBuildDir(), artifactPath)
+					}
+					cmakeTarget.Tests = append(cmakeTarget.Tests, testsByExecutable[filepath.Clean(artifactPath)]...)
+				}
+			}
+
+			// Extract linked libraries from dependencies
+			for _, dep := range target.Dependencies {
+				if depTarget, exists := targets[dep.ID]; exists {
+					cmakeTarget.LinkedLibraries = appendIfMissing(cmakeTarget.LinkedLibraries, depTarget.Name)
+				}
+			}
+
+			// Imported targets such as ZLIB::ZLIB are not part of the codemodel, which
+			// only reports the files they resolve to. Their names are needed to apply
+			// cmake_resolve mappings.
+			if parsed, ok := parsedByName[target.Name]; ok {
+				for _, lib := range parsed.LinkedLibraries {
+					if strings.Contains(lib, "::") {
+						cmakeTarget.LinkedLibraries = appendIfMissing(cmakeTarget.LinkedLibraries, lib)
+					}
+				}
+			}
+
+			// Extract linked libraries from the link library lists of newer codemodels,
+			// which also name INTERFACE libraries that are not build dependencies
+			linkLibraries := target.LinkLibraries
+			if target.Type == "INTERFACE_LIBRARY" {
+				linkLibraries = target.InterfaceLinkLibraries
+			}
+			for _, lib := range linkLibraries {
+				if depTarget, exists := targets[lib.ID]; exists {
+					cmakeTarget.LinkedLibraries = appendIfMissing(cmakeTarget.LinkedLibraries, depTarget.Name)
+				}
+			}
+
+			// Classify the link command line into project libraries, system libraries and linker flags
+			extractLinkSettings(target, cmakeTarget, projectLibraries, api.logicalBuildDir(), buildType)
+
+			cmakeTargets = append(cmakeTargets, cmakeTarget)
 		}
+		return cmakeTargets
+	}
+	cmakeTargets := convertTargets(targets)
 
-		// Extract sources and headers
-		for _, source := range target.Sources {
-			// Make path relative to the source directory if it's absolute
-			sourcePath := source.Path
-			if filepath.IsAbs(sourcePath) {
-				if relPath, err := filepath.Rel(api.sourceDir, sourcePath); err == nil {
-					sourcePath = relPath
+	// With a multi-config generator, what the configurations of the
+	// compilation modes build differently is selected on the mode
+	if modeConfigurations := api.modeConfigurations(codemodel); modeConfigurations != nil {
+		converted := make(map[int]map[string]*common.CMakeTarget)
+		for _, configuration := range modeConfigurations {
+			if converted[configuration] != nil {
+				continue
+			}
+			converted[configuration] = make(map[string]*common.CMakeTarget)
+			for _, cmakeTarget := range convertTargets(api.readTargets(codemodel, configuration)) {
+				converted[configuration][cmakeTarget.Name] = cmakeTarget
+			}
+		}
+		for _, cmakeTarget := range cmakeTargets {
+			byMode := make(map[string]*common.CMakeTarget)
+			for mode, configuration := range modeConfigurations {
+				if modeTarget, ok := converted[configuration][cmakeTarget.Name]; ok {
+					byMode[mode] = modeTarget
 				}
 			}
+			common.SplitConfigurations(cmakeTarget, byMode)
+		}
+	}
+
+	// The codemodel reports the values a target is built with, but not
+	// which of them are PRIVATE
+	for _, cmakeTarget := range cmakeTargets {
+		if parsed, ok := parsedByName[cmakeTarget.Name]; ok {
+			applyFallbackScopes(cmakeTarget, parsed)
+		}
+	}
+
+	cmakeTargets = mergeFallbackInterfaceTargets(parsedTargets, cmakeTargets)
+
+	log.Printf("Generated %d targets from CMake File API for directory %s", len(cmakeTargets), relativeDir)
+	return cmakeTargets, nil
+}
+
+// extractLinkSettings classifies the fragments of a target's link command line
+// by their role. Libraries built by the project (found by file name in
+// projectLibraries) become LinkedLibraries, any other library a SystemLibrary,
+// and linker flags as well as library and framework search paths LinkOptions.
+// Generator expressions CMake left in the fragments are evaluated for every
+// compilation mode, with the configurations buildType gives them, and what
+// only some modes link goes to the ConfigValues of the target.
+func extractLinkSettings(target *Target, cmakeTarget *common.CMakeTarget, projectLibraries map[string]string, buildDir, buildType string) {
+	if target.Link == nil {
+		return
+	}
 
-			// Only include files that are in the current directory or subdirectories
-			if !strings.HasPrefix(sourcePath, "..") {
-				if isHeaderFile(sourcePath) {
-					cmakeTarget.Headers = appendIfMissing(cmakeTarget.Headers, sourcePath)
-				} else if isSourceFile(sourcePath) {
-					cmakeTarget.Sources = appendIfMissing(cmakeTarget.Sources, sourcePath)
+	type fragment struct {
+		text string
+		role string
+	}
+	var fragments []fragment
+	for _, cmdFrag := range target.Link.CommandFragments {
+		fragments = append(fragments, fragment{cmdFrag.Fragment, cmdFrag.Role})
+	}
+	for _, flag := range target.Link.Flags {
+		fragments = append(fragments, fragment{flag.Fragment, "flags"})
+	}
+	for _, lib := range target.Link.Libraries {
+		fragments = append(fragments, fragment{lib.Fragment, "libraries"})
+	}
+
+	// classify adds the items of a fragment to the link settings of linked
+	classify := func(linked *common.CMakeTarget, text, role string) {
+		items := splitCommandFragment(text)
+		for i := 0; i < len(items); i++ {
+			item := items[i]
+			// A macOS framework is linked with -framework and its name, which
+			// stay together as one linkopt, since Bazel splits linkopts
+			if item == "-framework" && i+1 < len(items) {
+				i++
+				linked.LinkOptions = appendIfMissing(linked.LinkOptions, item+" "+items[i])
+				continue
+			}
+			if isCompileOnlyOrRpathFlag(item) || isToolchainControlledFlag(item) {
+				continue
+			}
+			switch role {
+			case "flags", "libraryPath", "frameworkPath":
+				linked.LinkOptions = appendIfMissing(linked.LinkOptions, item)
+			case "libraries":
+				if strings.HasPrefix(item, "-") && !strings.HasPrefix(item, "-l") {
+					linked.LinkOptions = appendIfMissing(linked.LinkOptions, item)
+					continue
+				}
+				name, ok := common.SystemLibraryName(item)
+				if !ok {
+					log.Printf("Target %s: unrecognized link item %s, skipping", target.Name, item)
+					continue
 				}
+				// Artifacts of the project live in the build tree
+				inBuildTree := !filepath.IsAbs(item) || strings.HasPrefix(filepath.Clean(item), filepath.Clean(buildDir)+string(filepath.Separator))
+				if targetName, isProject := projectLibraries[name]; isProject && inBuildTree && !strings.HasPrefix(item, "-l") {
+					linked.LinkedLibraries = appendIfMissing(linked.LinkedLibraries, targetName)
+				} else {
+					linked.SystemLibraries = appendIfMissing(linked.SystemLibraries, name)
+				}
+			}
+		}
+	}
+
+	// The link settings of each compilation mode, from the fragments with
+	// generator expressions, which CMake leaves unevaluated e.g. in the link
+	// interface of imported targets
+	var byMode map[string]*common.CMakeTarget
+	configs := common.CompilationModeConfigs(buildType)
+	for _, frag := range fragments {
+		if !common.HasGenex(frag.text) {
+			classify(cmakeTarget, frag.text, frag.role)
+			continue
+		}
+		if byMode == nil {
+			byMode = make(map[string]*common.CMakeTarget)
+			for _, mode := range common.CompilationModes {
+				byMode[mode] = &common.CMakeTarget{}
+			}
+		}
+		contexts := make(map[string]*common.GenexContext)
+		evaluated := common.EvaluateForModes([]string{frag.text}, func(mode string) *common.GenexContext {
+			contexts[mode] = &common.GenexContext{Config: configs[mode], Target: target.Name}
+			return contexts[mode]
+		})
+		for mode, ctx := range contexts {
+			for _, text := range evaluated[mode] {
+				classify(byMode[mode], text, frag.role)
+			}
+			for _, objectLibrary := range ctx.TargetObjects {
+				byMode[mode].LinkedLibraries = appendIfMissing(byMode[mode].LinkedLibraries, objectLibrary)
+			}
+		}
+	}
+	if byMode == nil {
+		return
+	}
+
+	// What every mode links belongs to the target itself
+	split := func(field func(*common.CMakeTarget) []string) ([]string, map[string][]string) {
+		values := make(map[string][]string)
+		for mode, linked := range byMode {
+			values[mode] = field(linked)
+		}
+		return common.SplitByMode(values)
+	}
+	libs, modeLibs := split(func(t *common.CMakeTarget) []string { return t.LinkedLibraries })
+	systemLibs, modeSystemLibs := split(func(t *common.CMakeTarget) []string { return t.SystemLibraries })
+	options, modeOptions := split(func(t *common.CMakeTarget) []string { return t.LinkOptions })
+	for _, lib := range libs {
+		cmakeTarget.LinkedLibraries = appendIfMissing(cmakeTarget.LinkedLibraries, lib)
+	}
+	for _, lib := range systemLibs {
+		cmakeTarget.SystemLibraries = appendIfMissing(cmakeTarget.SystemLibraries, lib)
+	}
+	for _, option := range options {
+		cmakeTarget.LinkOptions = appendIfMissing(cmakeTarget.LinkOptions, option)
+	}
+	for _, mode := range common.CompilationModes {
+		if len(modeLibs[mode])+len(modeSystemLibs[mode])+len(modeOptions[mode]) == 0 {
+			continue
+		}
+		if cmakeTarget.ConfigValues == nil {
+			cmakeTarget.ConfigValues = make(map[string]*common.CMakeConfigValues)
+		}
+		values := cmakeTarget.ConfigValues[mode]
+		if values == nil {
+			values = &common.CMakeConfigValues{}
+			cmakeTarget.ConfigValues[mode] = values
+		}
+		values.LinkedLibraries = append(values.LinkedLibraries, modeLibs[mode]...)
+		values.SystemLibraries = append(values.SystemLibraries, modeSystemLibs[mode]...)
+		values.LinkOptions = append(values.LinkOptions, modeOptions[mode]...)
+	}
+}
+
+// isCompileOnlyOrRpathFlag reports whether a flag on a link line has no effect
+// on a Bazel link: compile flags CMake repeats when linking, and run paths into
+// the CMake build tree, which Bazel computes itself.
+func isCompileOnlyOrRpathFlag(flag string) bool {
+	for _, prefix := range []string{"-D", "-I", "-std=", "-Wl,-rpath"} {
+		if strings.HasPrefix(flag, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFallbackInterfaceTargets fills in what the codemodel does not report
+// about INTERFACE libraries. CMake before 3.19 omits them entirely, and no
+// codemodel version reports their include directories or compile definitions
+// unless they come from a file set. The missing information is taken from the
+// CMakeLists.txt files using the fallback parser.
+func mergeFallbackInterfaceTargets(parsedTargets, cmakeTargets []*common.CMakeTarget) []*common.CMakeTarget {
+	targetsByName := make(map[string]*common.CMakeTarget)
+	for _, cmTarget := range cmakeTargets {
+		targetsByName[cmTarget.Name] = cmTarget
+	}
+
+	interfaceNames := make(map[string]bool)
+	for _, parsed := range parsedTargets {
+		if parsed.Type != "interface" {
+			continue
+		}
+		interfaceNames[parsed.Name] = true
+
+		cmTarget, exists := targetsByName[parsed.Name]
+		if !exists {
+			log.Printf("INTERFACE library %s is not reported by the CMake File API, using CMakeLists.txt instead", parsed.Name)
+			cmakeTargets = append(cmakeTargets, parsed)
+			targetsByName[parsed.Name] = parsed
+			continue
+		}
+		if cmTarget.Type != "interface" {
+			continue
+		}
+		if len(cmTarget.Headers) == 0 {
+			cmTarget.Headers = parsed.Headers
+		}
+		for _, dir := range parsed.IncludeDirectories {
+			cmTarget.IncludeDirectories = appendIfMissing(cmTarget.IncludeDirectories, dir)
+		}
+		for _, define := range parsed.CompileDefinitions {
+			cmTarget.CompileDefinitions = appendIfMissing(cmTarget.CompileDefinitions, define)
+		}
+		for _, lib := range parsed.LinkedLibraries {
+			cmTarget.LinkedLibraries = appendIfMissing(cmTarget.LinkedLibraries, lib)
+		}
+	}
+
+	// INTERFACE libraries are not build dependencies, so older codemodels do
+	// not list them among the dependencies of the targets linking them
+	for _, parsed := range parsedTargets {
+		cmTarget, exists := targetsByName[parsed.Name]
+		if !exists {
+			continue
+		}
+		for _, lib := range parsed.LinkedLibraries {
+			if interfaceNames[lib] {
+				cmTarget.LinkedLibraries = appendIfMissing(cmTarget.LinkedLibraries, lib)
+			}
+		}
+	}
+
+	return cmakeTargets
+}
+
+// applyFallbackScopes marks the include directories, compile definitions and
+// linked libraries of a target, including the ones of its ConfigValues, that
+// the CMakeLists.txt files give the PRIVATE scope as private
+func applyFallbackScopes(cmTarget, parsed *common.CMakeTarget) {
+	keep := func(private, values []string, modeValues func(*common.CMakeConfigValues) []string) []string {
+		values = append([]string{}, values...)
+		for _, configValues := range cmTarget.ConfigValues {
+			values = append(values, modeValues(configValues)...)
+		}
+		var result []string
+		for _, value := range private {
+			if containsString(values, value) {
+				result = appendIfMissing(result, value)
 			}
 		}
+		return result
+	}
+	cmTarget.PrivateIncludeDirectories = keep(parsed.PrivateIncludeDirectories, cmTarget.IncludeDirectories, func(values *common.CMakeConfigValues) []string { return values.IncludeDirectories })
+	cmTarget.PrivateCompileDefinitions = keep(parsed.PrivateCompileDefinitions, cmTarget.CompileDefinitions, func(values *common.CMakeConfigValues) []string { return values.CompileDefinitions })
+	cmTarget.PrivateLinkedLibraries = keep(parsed.PrivateLinkedLibraries, cmTarget.LinkedLibraries, func(values *common.CMakeConfigValues) []string { return values.LinkedLibraries })
+}
+
+// parseFallbackTargets parses the project with the fallback parser, which
+// follows add_subdirectory() itself. Its paths are relative to the top-level
+// source directory, like the ones read from the File API. The custom commands,
+// check results and configure files it finds are kept in api.
+func (api *CMakeFileAPI) parseFallbackTargets() []*common.CMakeTarget {
+	model, err := common.ParseCMakeListsWithDefines(filepath.Join(api.sourceDir, "CMakeLists.txt"), api.defines())
+	if err != nil {
+		log.Printf("Warning: failed to parse CMakeLists.txt in %s: %v", api.sourceDir, err)
+		return nil
+	}
+	api.customCommands = model.CustomCommands
+	for variable := range model.CheckResults {
+		api.checkResults[variable] = true
+	}
+	api.fallbackConfigureFiles = make(map[string]*common.CMakeConfigureFile)
+	for _, configFile := range model.ConfigureFiles {
+		if _, ok := api.fallbackConfigureFiles[filepath.Base(configFile.OutputFile)]; !ok {
+			api.fallbackConfigureFiles[filepath.Base(configFile.OutputFile)] = configFile
+		}
+	}
 
-		// Extract include directories
-		includeDirectories := extractIncludeDirectories(target, api.sourceDir)
-		cmakeTarget.IncludeDirectories = append(cmakeTarget.IncludeDirectories, includeDirectories...)
+	var parsedTargets []*common.CMakeTarget
+	for _, parsed := range model.Targets {
+		parsedTargets = append(parsedTargets, normalizeFallbackTarget(parsed))
+	}
+	return parsedTargets
+}
 
-		// Extract linked libraries from dependencies
-		for _, dep := range target.Dependencies {
-			if depTarget, exists := targets[dep.ID]; exists {
-				cmakeTarget.LinkedLibraries = appendIfMissing(cmakeTarget.LinkedLibraries, depTarget.Name)
+// parseLibraryFileName extracts the OUTPUT_NAME and VERSION of a library from
+// the name CMake gives its file on disk, e.g. "libfoo.so.1.2", "foo.dll" or
+// "libfoo.1.2.dylib" on macOS, where the version comes before the extension.
+func parseLibraryFileName(nameOnDisk string) (string, string) {
+	if nameOnDisk == "" {
+		return "", ""
+	}
+	name := strings.TrimPrefix(nameOnDisk, "lib")
+	if idx := strings.Index(name, ".so"); idx > 0 && (len(name) == idx+3 || name[idx+3] == '.') {
+		return name[:idx], strings.TrimPrefix(name[idx+3:], ".")
+	}
+	if base := strings.TrimSuffix(name, ".dylib"); base != name {
+		// The version is made of the numeric components at the end
+		parts := strings.Split(base, ".")
+		i := len(parts)
+		for i > 1 && isNumber(parts[i-1]) {
+			i--
+		}
+		return strings.Join(parts[:i], "."), strings.Join(parts[i:], ".")
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)), ""
+}
+
+// isNumber checks if a string is a non-empty sequence of decimal digits
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeFallbackTarget drops the paths of a target parsed from the
+// CMakeLists.txt files that cannot be expressed relative to the top-level
+// source directory.
+func normalizeFallbackTarget(cmTarget *common.CMakeTarget) *common.CMakeTarget {
+	normalize := func(paths []string) []string {
+		var result []string
+		for _, p := range paths {
+			if filepath.IsAbs(p) || strings.Contains(p, "$") {
+				continue
 			}
+			result = append(result, p)
 		}
+		return result
+	}
+
+	cmTarget.Sources = normalize(cmTarget.Sources)
+	cmTarget.Headers = normalize(cmTarget.Headers)
+
+	normalizeIncludes := func(dirs []string) []string {
+		var includeDirectories []string
+		for _, includeDir := range dirs {
+			if normalized, ok := common.NormalizeIncludeDirectory(includeDir); ok {
+				includeDirectories = appendIfMissing(includeDirectories, normalized)
+			}
+		}
+		return includeDirectories
+	}
+	cmTarget.IncludeDirectories = normalizeIncludes(cmTarget.IncludeDirectories)
+	cmTarget.PrivateIncludeDirectories = normalizeIncludes(cmTarget.PrivateIncludeDirectories)
+	return cmTarget
+}
+
+// CMakeFiles represents the cmakeFiles object from CMake File API
+type CMakeFiles struct {
+	Kind    string `json:"kind"`
+	Version struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+	} `json:"version"`
+	Paths struct {
+		Source string `json:"source"`
+		Build  string `json:"build"`
+	} `json:"paths"`
+	Inputs []struct {
+		Path        string `json:"path"`
+		IsGenerated bool   `json:"isGenerated"`
+		IsExternal  bool   `json:"isExternal"`
+		IsCMake     bool   `json:"isCMake"`
+	} `json:"inputs"`
+	GlobsDependent []struct {
+		Expression      string   `json:"expression"`
+		Recurse         bool     `json:"recurse"`
+		ListDirectories bool     `json:"listDirectories"`
+		FollowSymlinks  bool     `json:"followSymlinks"`
+		Relative        string   `json:"relative"`
+		Paths           []string `json:"paths"`
+	} `json:"globsDependent"`
+}
+
+// ReadCMakeFiles reads the cmakeFiles object listed in the index
+func (api *CMakeFileAPI) ReadCMakeFiles(index *APIIndex) (*CMakeFiles, error) {
+	var jsonFile string
+	for _, obj := range index.Objects {
+		if obj.Kind == "cmakeFiles" {
+			jsonFile = obj.JSONFile
+			break
+		}
+	}
+	if jsonFile == "" {
+		return nil, fmt.Errorf("no cmakeFiles found in index")
+	}
+
+	data, err := api.readReplyFile(filepath.Join(api.replyDir(), jsonFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cmakeFiles file: %w", err)
+	}
+	var files CMakeFiles
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("failed to parse cmakeFiles file: %w", err)
+	}
+	return &files, nil
+}
 
-		// Extract linked libraries from link information
-		if target.Link != nil {
-			// Check both Libraries and CommandFragments with role "libraries"
-			for _, lib := range target.Link.Libraries {
-				// Parse library names from fragments
-				libName := strings.TrimSpace(lib.Fragment)
-				if libName != "" && !strings.HasPrefix(libName, "-") {
-					cmakeTarget.LinkedLibraries = appendIfMissing(cmakeTarget.LinkedLibraries, libName)
+// globsFromCMakeFiles converts the file(GLOB CONFIGURE_DEPENDS) calls CMake
+// reports into globs relative to the source directory. Only cmakeFiles 1.1 and
+// later report them.
+func globsFromCMakeFiles(files *CMakeFiles, sourceDir string) []common.CMakeGlob {
+	var globs []common.CMakeGlob
+	for _, g := range files.GlobsDependent {
+		glob := common.CMakeGlob{}
+		glob.Pattern, _ = common.BazelGlobPattern(relativeSourcePath(g.Expression, sourceDir), g.Recurse)
+		for _, p := range g.Paths {
+			if g.Relative != "" && !filepath.IsAbs(p) {
+				p = filepath.Join(g.Relative, p)
+			}
+			if p = relativeSourcePath(p, sourceDir); !strings.HasPrefix(p, "..") {
+				glob.Files = append(glob.Files, filepath.ToSlash(p))
+			}
+		}
+		globs = append(globs, glob)
+	}
+	return globs
+}
+
+// CTestInfo represents the output of ctest --show-only=json-v1
+type CTestInfo struct {
+	Kind    string `json:"kind"`
+	Version struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+	} `json:"version"`
+	Tests []struct {
+		Name       string   `json:"name"`
+		Command    []string `json:"command"`
+		Properties []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"properties"`
+	} `json:"tests"`
+}
+
+// ctestExecutable returns the ctest binary that ships next to the configured cmake
+func (api *CMakeFileAPI) ctestExecutable() string {
+	if dir := filepath.Dir(api.cmakeExe); dir != "." {
+		return filepath.Join(dir, "ctest")
+	}
+	return "ctest"
+}
+
+// ReadCTestInfo queries CTest for the tests registered in the configured build
+// directory. Its output is stored with the configure result in the cache or
+// snapshot entry, and read from there when there is one.
+func (api *CMakeFileAPI) ReadCTestInfo() (*CTestInfo, error) {
+	var output []byte
+	var err error
+	if api.cacheEntryDir != "" {
+		output, err = ioutil.ReadFile(filepath.Join(api.cacheEntryDir, "ctest.json"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recorded ctest output: %w", err)
+		}
+	} else if output, err = api.runCTest(); err != nil {
+		return nil, err
+	}
+
+	api.ctestOutput = api.translateBuildPaths(output)
+	var info CTestInfo
+	if err := json.Unmarshal(api.ctestOutput, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse ctest output: %w", err)
+	}
+	return &info, nil
+}
+
+// runCTest returns the output of ctest --show-only=json-v1 in the build
+// directory
+func (api *CMakeFileAPI) runCTest() ([]byte, error) {
+	args := []string{"--show-only=json-v1"}
+	if api.testConfiguration != "" {
+		args = append(args, "-C", api.testConfiguration)
+	}
+	cmd := exec.Command(api.ctestExecutable(), args...)
+	cmd.Dir = api.buildDir
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ctest --show-only=json-v1 failed: %w", err)
+	}
+	return output, nil
+}
+
+// readTests returns the tests CTest knows about, keyed by the absolute path of the
+// executable they run. Failures are logged and result in no tests.
+func (api *CMakeFileAPI) readTests() map[string][]common.CMakeTest {
+	info, err := api.ReadCTestInfo()
+	if err != nil {
+		log.Printf("Warning: failed to read CTest information: %v", err)
+		return map[string][]common.CMakeTest{}
+	}
+
+	log.Printf("Found %d tests registered with CTest", len(info.Tests))
+	return testsFromCTestInfo(info, api.sourceDir)
+}
+
+// testsFromCTestInfo converts CTest's test list into CMakeTests keyed by executable.
+// Arguments pointing into the source directory are made relative to it.
+func testsFromCTestInfo(info *CTestInfo, sourceDir string) map[string][]common.CMakeTest {
+	testsByExecutable := make(map[string][]common.CMakeTest)
+
+	for _, t := range info.Tests {
+		if len(t.Command) == 0 {
+			continue // Tests without a command are not runnable (e.g. NOT_AVAILABLE)
+		}
+
+		test := common.CMakeTest{Name: t.Name}
+		for _, arg := range t.Command[1:] {
+			if filepath.IsAbs(arg) {
+				if rel, err := filepath.Rel(sourceDir, arg); err == nil && !strings.HasPrefix(rel, "..") {
+					arg = rel
 				}
 			}
-			
-			// Also check CommandFragments for libraries role
-			for _, cmdFrag := range target.Link.CommandFragments {
-				if cmdFrag.Role == "libraries" {
-					libName := strings.TrimSpace(cmdFrag.Fragment)
-					if libName != "" && !strings.HasPrefix(libName, "-") {
-						// Remove lib prefix and .a/.so suffixes if present
-						if strings.HasPrefix(libName, "lib") && (strings.HasSuffix(libName, ".a") || strings.HasSuffix(libName, ".so")) {
-							libName = strings.TrimPrefix(libName, "lib")
-							if strings.HasSuffix(libName, ".a") {
-								libName = strings.TrimSuffix(libName, ".a")
-							} else if strings.HasSuffix(libName, ".so") {
-								libName = strings.TrimSuffix(libName, ".so")
-							}
+			test.Args = append(test.Args, arg)
+		}
+
+		for _, prop := range t.Properties {
+			switch prop.Name {
+			case "ENVIRONMENT":
+				var entries []string
+				if err := json.Unmarshal(prop.Value, &entries); err == nil {
+					test.Env = make(map[string]string)
+					for _, entry := range entries {
+						if key, value, ok := strings.Cut(entry, "="); ok {
+							test.Env[key] = value
 						}
-						cmakeTarget.LinkedLibraries = appendIfMissing(cmakeTarget.LinkedLibraries, libName)
 					}
 				}
+			case "LABELS":
+				_ = json.Unmarshal(prop.Value, &test.Labels)
+			case "TIMEOUT":
+				_ = json.Unmarshal(prop.Value, &test.Timeout)
+			case "WILL_FAIL":
+				_ = json.Unmarshal(prop.Value, &test.WillFail)
+			case "DISABLED":
+				_ = json.Unmarshal(prop.Value, &test.Disabled)
 			}
 		}
 
-		cmakeTargets = append(cmakeTargets, cmakeTarget)
+		executable := filepath.Clean(t.Command[0])
+		testsByExecutable[executable] = append(testsByExecutable[executable], test)
 	}
 
-	log.Printf("Generated %d targets from CMake File API for directory %s", len(cmakeTargets), relativeDir)
-	return cmakeTargets, nil
+	return testsByExecutable
 }
 
 // loadCache loads CMake cache variables from cache-v2 API response
 func (api *CMakeFileAPI) loadCache() error {
-	replyDir := filepath.Join(api.buildDir, ".cmake", "api", "v1", "reply")
+	if api.cacheLoaded {
+		return nil
+	}
+	replyDir := api.replyDir()
 	
 	// Find cache response
 	cachePattern := filepath.Join(replyDir, "cache-*.json")
@@ -445,7 +1314,7 @@ func (api *CMakeFileAPI) loadCache() error {
 	}
 	
 	// Read cache response
-	cacheData, err := ioutil.ReadFile(cacheFiles[0])
+	cacheData, err := api.readReplyFile(cacheFiles[0])
 	if err != nil {
 		return fmt.Errorf("failed to read cache response: %w", err)
 	}
@@ -467,6 +1336,7 @@ func (api *CMakeFileAPI) loadCache() error {
 		api.cache[entry.Name] = entry.Value
 	}
 	
+	api.cacheLoaded = true
 	log.Printf("Loaded %d cache variables from CMake", len(api.cache))
 	return nil
 }
@@ -475,34 +1345,59 @@ func (api *CMakeFileAPI) loadCache() error {
 // parseCMakeListsForConfigureFile parses CMakeLists.txt for configure_file commands
 func (api *CMakeFileAPI) parseCMakeListsForConfigureFile() ([]*common.CMakeConfigureFile, error) {
 	cmakeListsPath := filepath.Join(api.sourceDir, "CMakeLists.txt")
-	
-	file, err := os.Open(cmakeListsPath)
+
+	commands, err := common.ParseCMakeFile(cmakeListsPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open CMakeLists.txt: %w", err)
+		return nil, fmt.Errorf("failed to parse CMakeLists.txt: %w", err)
 	}
-	defer file.Close()
-	
+
 	var configureFiles []*common.CMakeConfigureFile
 	variables := make(map[string]string)
-	
+
 	// Include cmake defines from gazelle directives
-	for k, v := range api.cmakeDefines {
+	for k, v := range api.defines() {
 		variables[k] = v
 	}
-	
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		
+
+	for _, cmd := range commands {
+		args := cmd.ArgumentValues()
+		for _, variable := range common.CheckResultVariables(cmd.Name, args) {
+			api.checkResults[variable] = true
+		}
+
+		// file(CONFIGURE) has no template file, only its content
+		if strings.EqualFold(cmd.Name, "file") && len(args) > 0 && args[0] == "CONFIGURE" {
+			configFile, ok := common.ParseFileConfigure(args[1:])
+			if !ok {
+				continue
+			}
+			outputFile := api.resolveCMakeVariables(configFile.OutputFile, variables)
+			if filepath.IsAbs(outputFile) {
+				if rel, err := filepath.Rel(api.sourceDir, outputFile); err == nil {
+					outputFile = rel
+				}
+			}
+			configFile.Name = strings.ReplaceAll(filepath.Base(outputFile), ".", "_")
+			configFile.OutputFile = outputFile
+			for k, v := range variables {
+				configFile.Variables[k] = v
+			}
+			configureFiles = append(configureFiles, configFile)
+			log.Printf("Found file(CONFIGURE): %s (rule: %s)", outputFile, configFile.Name)
+			continue
+		}
+
 		// Parse configure_file() commands (skip set() commands since we only want gazelle directive defines)
-		configMatch := regexp.MustCompile(`^configure_file\s*\(\s*([^)\s]+)\s+([^)\s]+)`).FindStringSubmatch(line)
-		if configMatch == nil {
+		if !strings.EqualFold(cmd.Name, "configure_file") {
 			continue
 		}
-		
-		inputFile := strings.Trim(configMatch[1], `"`)
-		outputFile := strings.Trim(configMatch[2], `"`)
-		
+		if len(args) < 2 {
+			continue
+		}
+
+		inputFile := args[0]
+		outputFile := args[1]
+
 		// Resolve CMake variables in paths
 		inputFile = api.resolveCMakeVariables(inputFile, variables)
 		outputFile = api.resolveCMakeVariables(outputFile, variables)
@@ -531,23 +1426,66 @@ func (api *CMakeFileAPI) parseCMakeListsForConfigureFile() ([]*common.CMakeConfi
 			configVars[k] = v
 		}
 		
-		configureFiles = append(configureFiles, &common.CMakeConfigureFile{
+		configFile := &common.CMakeConfigureFile{
 			Name:       ruleName,
 			InputFile:  inputFile,
 			OutputFile: outputFile,
 			Variables:  configVars,
-		})
+		}
+		common.ParseConfigureOptions(configFile, args[2:])
+		configureFiles = append(configureFiles, configFile)
 		
 		log.Printf("Found configure_file: %s -> %s (rule: %s)", inputFile, outputFile, ruleName)
 	}
-	
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to scan CMakeLists.txt: %w", err)
-	}
-	
+
 	return configureFiles, nil
 }
 
+// configureTemplateRule returns a cmake_configure_template rule generating the
+// output of a configure file from its template, with the values of the cache,
+// the cmake_define directives and the fallback parser, which follows set(),
+// or nil when the template cannot be read or uses the result of a check or a
+// path of this machine. The caller sets its src unless it is a
+// file(CONFIGURE), whose content is set.
+func (api *CMakeFileAPI) configureTemplateRule(configFile *common.CMakeConfigureFile) *rule.Rule {
+	fallback := api.fallbackConfigureFiles[filepath.Base(configFile.OutputFile)]
+	template := configFile.Content
+	if configFile.InputFile == "" && fallback != nil && fallback.InputFile == "" {
+		// CMake expands the variable references of the content before
+		// file(CONFIGURE) sees it
+		template = fallback.Content
+	} else if configFile.InputFile != "" {
+		content, err := os.ReadFile(filepath.Join(api.sourceDir, configFile.InputFile))
+		if err != nil {
+			return nil
+		}
+		template = string(content)
+	}
+
+	values := make(map[string]string)
+	for k, v := range api.cache {
+		values[k] = v
+	}
+	for k, v := range configFile.Variables {
+		values[k] = v
+	}
+	if fallback != nil {
+		for k, v := range fallback.Values {
+			values[k] = v
+		}
+	}
+
+	r, reason := common.ConfigureTemplateRule(configFile, template, values, api.checkResults, []string{api.sourceDir, api.buildDir})
+	if r == nil {
+		log.Printf("Template of %s uses %s, configuring it with cmake.", configFile.OutputFile, reason)
+		return nil
+	}
+	if configFile.InputFile == "" {
+		r.SetAttr("content", template)
+	}
+	return r
+}
+
 // resolveCMakeVariables resolves CMake variables in a string
 func (api *CMakeFileAPI) resolveCMakeVariables(input string, variables map[string]string) string {
 	result := input
@@ -580,33 +1518,51 @@ func (api *CMakeFileAPI) resolveCMakeVariables(input string, variables map[strin
 
 // Helper functions
 
-// extractIncludeDirectories safely extracts include directories from CompileGroups
-func extractIncludeDirectories(target *Target, sourceDir string) []string {
-	var includeDirectories []string
-	
+// compileGroup mirrors one entry of a target's compileGroups array
+type compileGroup struct {
+	SourceIndexes           []int  `json:"sourceIndexes"`
+	Language                string `json:"language"`
+	CompileCommandFragments []struct {
+		Fragment string `json:"fragment"`
+	} `json:"compileCommandFragments,omitempty"`
+	Includes []struct {
+		Path      string `json:"path"`
+		IsSystem  bool   `json:"isSystem,omitempty"`
+		Backtrace int    `json:"backtrace,omitempty"`
+	} `json:"includes,omitempty"`
+	Defines []struct {
+		Define    string `json:"define"`
+		Backtrace int    `json:"backtrace,omitempty"`
+	} `json:"defines,omitempty"`
+	Sysroot *struct {
+		Path string `json:"path"`
+	} `json:"sysroot,omitempty"`
+	LanguageStandard *struct {
+		Standard string `json:"standard"`
+	} `json:"languageStandard,omitempty"`
+}
+
+// parseCompileGroups safely decodes the CompileGroups of a target
+func parseCompileGroups(target *Target) []compileGroup {
 	if len(target.CompileGroups) == 0 {
-		return includeDirectories
-	}
-	
-	// Parse the CompileGroups JSON
-	var compileGroups []struct {
-		SourceIndexes []int `json:"sourceIndexes"`
-		Language      string `json:"language"`
-		Includes []struct {
-			Path      string `json:"path"`
-			IsSystem  bool   `json:"isSystem,omitempty"`
-			Backtrace int    `json:"backtrace,omitempty"`
-		} `json:"includes,omitempty"`
+		return nil
 	}
-	
+
+	var compileGroups []compileGroup
 	if err := json.Unmarshal(target.CompileGroups, &compileGroups); err != nil {
 		log.Printf("Warning: failed to parse CompileGroups for target %s: %v", target.Name, err)
-		return includeDirectories
+		return nil
 	}
+	return compileGroups
+}
+
+// extractIncludeDirectories safely extracts include directories from CompileGroups,
+// merging the includes of every group in order of first appearance
+func extractIncludeDirectories(target *Target, sourceDir string) []string {
+	var includeDirectories []string
 	
-	// Extract includes from the first compile group
-	if len(compileGroups) > 0 {
-		for _, include := range compileGroups[0].Includes {
+	for _, group := range parseCompileGroups(target) {
+		for _, include := range group.Includes {
 			includePath := include.Path
 			if filepath.IsAbs(includePath) {
 				if relPath, err := filepath.Rel(sourceDir, includePath); err == nil {
@@ -622,5 +1578,167 @@ func extractIncludeDirectories(target *Target, sourceDir string) []string {
 	return includeDirectories
 }
 
+// extractCompileSettings copies defines, compile flags, sysroot and language
+// standard from the compile groups into the CMakeTarget. Every group is kept in
+// CompileGroups; the target-level fields receive the settings all groups share.
+func extractCompileSettings(target *Target, cmakeTarget *common.CMakeTarget, sourceDir string) {
+	compileGroups := parseCompileGroups(target)
+	if len(compileGroups) == 0 {
+		return
+	}
+
+	for _, group := range compileGroups {
+		cmGroup := common.CMakeCompileGroup{Language: group.Language}
+
+		for _, idx := range group.SourceIndexes {
+			if idx < 0 || idx >= len(target.Sources) {
+				continue
+			}
+			sourcePath := relativeSourcePath(target.Sources[idx].Path, sourceDir)
+			if !strings.HasPrefix(sourcePath, "..") && isSourceFile(sourcePath) {
+				cmGroup.Sources = append(cmGroup.Sources, sourcePath)
+			}
+		}
+
+		for _, define := range group.Defines {
+			if define.Define != "" {
+				cmGroup.CompileDefinitions = appendIfMissing(cmGroup.CompileDefinitions, define.Define)
+			}
+		}
+
+		for _, fragment := range group.CompileCommandFragments {
+			for _, flag := range splitCommandFragment(fragment.Fragment) {
+				if !isToolchainControlledFlag(flag) {
+					cmGroup.CompileOptions = append(cmGroup.CompileOptions, flag)
+				}
+			}
+		}
+
+		if group.LanguageStandard != nil && group.LanguageStandard.Standard != "" {
+			switch group.Language {
+			case "C":
+				cmGroup.LanguageStandard = "c" + group.LanguageStandard.Standard
+			case "CXX":
+				cmGroup.LanguageStandard = "c++" + group.LanguageStandard.Standard
+			}
+		}
+
+		if group.Sysroot != nil && cmakeTarget.Sysroot == "" {
+			cmakeTarget.Sysroot = group.Sysroot.Path
+		}
+
+		cmakeTarget.CompileGroups = append(cmakeTarget.CompileGroups, cmGroup)
+	}
+
+	// Target-wide settings: definitions present in every group, the flags every
+	// group starts with, and the language standard if all groups agree on it
+	first := cmakeTarget.CompileGroups[0]
+	for _, define := range first.CompileDefinitions {
+		inAll := true
+		for _, other := range cmakeTarget.CompileGroups[1:] {
+			if !containsString(other.CompileDefinitions, define) {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			cmakeTarget.CompileDefinitions = append(cmakeTarget.CompileDefinitions, define)
+		}
+	}
+
+	cmakeTarget.CompileOptions = append([]string{}, first.CompileOptions...)
+	cmakeTarget.LanguageStandard = first.LanguageStandard
+	for _, other := range cmakeTarget.CompileGroups[1:] {
+		n := 0
+		for n < len(cmakeTarget.CompileOptions) && n < len(other.CompileOptions) && cmakeTarget.CompileOptions[n] == other.CompileOptions[n] {
+			n++
+		}
+		cmakeTarget.CompileOptions = cmakeTarget.CompileOptions[:n]
+		if other.LanguageStandard != cmakeTarget.LanguageStandard {
+			cmakeTarget.LanguageStandard = ""
+		}
+	}
+}
+
+// cmakeDirectory converts the source directory of a codemodel directory or
+// target into a path relative to the top-level source directory, "" for that
+// directory itself
+func cmakeDirectory(source, sourceDir string) string {
+	dir := filepath.ToSlash(relativeSourcePath(source, sourceDir))
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// relativeSourcePath makes a source path reported by CMake relative to the source directory
+func relativeSourcePath(sourcePath, sourceDir string) string {
+	if filepath.IsAbs(sourcePath) {
+		if relPath, err := filepath.Rel(sourceDir, sourcePath); err == nil {
+			return relPath
+		}
+	}
+	return sourcePath
+}
+
+// splitCommandFragment splits a command line fragment into individual arguments,
+// honoring single quotes, double quotes and backslash escapes.
+func splitCommandFragment(fragment string) []string {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+
+	for i := 0; i < len(fragment); i++ {
+		ch := rune(fragment[i])
+		switch {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else if ch == '\\' && quote == '"' && i+1 < len(fragment) {
+				i++
+				current.WriteByte(fragment[i])
+			} else {
+				current.WriteRune(ch)
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+			inArg = true
+		case ch == '\\' && i+1 < len(fragment):
+			i++
+			current.WriteByte(fragment[i])
+			inArg = true
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(ch)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// isToolchainControlledFlag reports whether a compile flag is one Bazel already
+// controls through compilation_mode or the toolchain (optimization, debug info,
+// position independent code, MSVC runtime selection). These come from
+// CMAKE_<LANG>_FLAGS_<CONFIG> rather than from the project itself.
+func isToolchainControlledFlag(flag string) bool {
+	switch flag {
+	case "-g", "-ggdb", "-DNDEBUG", "-fPIC", "-fpic", "-fPIE", "-fpie",
+		"/DNDEBUG", "/Zi", "/Z7", "/RTC1", "/MD", "/MDd", "/MT", "/MTd":
+		return true
+	}
+	return strings.HasPrefix(flag, "-O") ||
+		(strings.HasPrefix(flag, "-g") && len(flag) == 3 && flag[2] >= '0' && flag[2] <= '3') ||
+		strings.HasPrefix(flag, "/O")
+}
+
 // Note: Helper functions moved to gazelle package util.go
 // These functions are now accessed via gazelle.functionName()
\ No newline at end of file
@@ -2,7 +2,15 @@ package language
 
 import (
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/goniz/gazelle-foreign-cc/common"
 )
 
 func TestTargetJSONParsing(t *testing.T) {
@@ -257,4 +265,663 @@ func TestTargetJSONParsingWithMissingFields(t *testing.T) {
 			t.Errorf("Expected malformed JSON to fail parsing, but it succeeded")
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestExtractCompileSettings(t *testing.T) {
+	target := &Target{
+		Name: "libzmq",
+		ID:   "libzmq::@abc123",
+		Type: "STATIC_LIBRARY",
+		CompileGroups: json.RawMessage(`[{
+			"language": "CXX",
+			"sourceIndexes": [0],
+			"compileCommandFragments": [
+				{"fragment": "-O3 -DNDEBUG -fPIC"},
+				{"fragment": "-Wall -DMSG=\"hello world\""},
+				{"fragment": "-std=gnu++11"}
+			],
+			"defines": [
+				{"define": "ZMQ_STATIC", "backtrace": 3},
+				{"define": "ZMQ_CUSTOM_PLATFORM_HPP"}
+			],
+			"languageStandard": {"standard": "11"},
+			"sysroot": {"path": "/opt/sysroot"}
+		}]`),
+	}
+
+	cmakeTarget := &common.CMakeTarget{Name: target.Name}
+	extractCompileSettings(target, cmakeTarget, "/test")
+
+	expectedDefines := []string{"ZMQ_STATIC", "ZMQ_CUSTOM_PLATFORM_HPP"}
+	if !reflect.DeepEqual(cmakeTarget.CompileDefinitions, expectedDefines) {
+		t.Errorf("Expected defines %v, got %v", expectedDefines, cmakeTarget.CompileDefinitions)
+	}
+
+	// Optimization, NDEBUG and PIC flags are left to Bazel
+	expectedOptions := []string{"-Wall", "-DMSG=hello world", "-std=gnu++11"}
+	if !reflect.DeepEqual(cmakeTarget.CompileOptions, expectedOptions) {
+		t.Errorf("Expected compile options %v, got %v", expectedOptions, cmakeTarget.CompileOptions)
+	}
+
+	if cmakeTarget.LanguageStandard != "c++11" {
+		t.Errorf("Expected language standard 'c++11', got '%s'", cmakeTarget.LanguageStandard)
+	}
+	if cmakeTarget.Sysroot != "/opt/sysroot" {
+		t.Errorf("Expected sysroot '/opt/sysroot', got '%s'", cmakeTarget.Sysroot)
+	}
+}
+
+func TestExtractCompileSettingsMultipleGroups(t *testing.T) {
+	targetJSON := `{
+		"id": "mixed::@abc123",
+		"name": "mixed",
+		"type": "STATIC_LIBRARY",
+		"sources": [
+			{"path": "src/a.cpp", "compileGroupIndex": 0},
+			{"path": "src/b.cpp", "compileGroupIndex": 0},
+			{"path": "src/sha1.c", "compileGroupIndex": 1},
+			{"path": "src/special.cpp", "compileGroupIndex": 2}
+		],
+		"compileGroups": [
+			{"language": "CXX", "sourceIndexes": [0, 1],
+			 "compileCommandFragments": [{"fragment": "-Wall"}, {"fragment": "-std=gnu++17"}],
+			 "includes": [{"path": "/test/include"}],
+			 "defines": [{"define": "ZMQ_STATIC"}]},
+			{"language": "C", "sourceIndexes": [2],
+			 "compileCommandFragments": [{"fragment": "-Wall"}, {"fragment": "-std=gnu11"}],
+			 "includes": [{"path": "/test/include"}, {"path": "/test/external/sha1"}],
+			 "defines": [{"define": "ZMQ_STATIC"}]},
+			{"language": "CXX", "sourceIndexes": [3],
+			 "compileCommandFragments": [{"fragment": "-Wall"}, {"fragment": "-std=gnu++17"}],
+			 "includes": [{"path": "/test/include"}],
+			 "defines": [{"define": "ZMQ_STATIC"}, {"define": "SPECIAL=1"}]}
+		]
+	}`
+
+	var target Target
+	if err := json.Unmarshal([]byte(targetJSON), &target); err != nil {
+		t.Fatalf("Failed to parse target JSON: %v", err)
+	}
+
+	includes := extractIncludeDirectories(&target, "/test")
+	if expected := []string{"include", "external/sha1"}; !reflect.DeepEqual(includes, expected) {
+		t.Errorf("Expected includes merged across groups %v, got %v", expected, includes)
+	}
+
+	cmakeTarget := &common.CMakeTarget{Name: target.Name}
+	extractCompileSettings(&target, cmakeTarget, "/test")
+
+	if len(cmakeTarget.CompileGroups) != 3 {
+		t.Fatalf("Expected 3 compile groups, got %d", len(cmakeTarget.CompileGroups))
+	}
+	if expected := []string{"ZMQ_STATIC"}; !reflect.DeepEqual(cmakeTarget.CompileDefinitions, expected) {
+		t.Errorf("Expected shared defines %v, got %v", expected, cmakeTarget.CompileDefinitions)
+	}
+	if expected := []string{"-Wall"}; !reflect.DeepEqual(cmakeTarget.CompileOptions, expected) {
+		t.Errorf("Expected shared compile options %v, got %v", expected, cmakeTarget.CompileOptions)
+	}
+	if expected := []string{"src/sha1.c"}; !reflect.DeepEqual(cmakeTarget.CompileGroups[1].Sources, expected) {
+		t.Errorf("Expected C group sources %v, got %v", expected, cmakeTarget.CompileGroups[1].Sources)
+	}
+
+	languageOpts, helpers := splitCompileGroups(cmakeTarget)
+	if expected := []string{"-std=gnu++17"}; !reflect.DeepEqual(languageOpts["CXX"], expected) {
+		t.Errorf("Expected cxxopts %v, got %v", expected, languageOpts["CXX"])
+	}
+	if expected := []string{"-std=gnu11"}; !reflect.DeepEqual(languageOpts["C"], expected) {
+		t.Errorf("Expected conlyopts %v, got %v", expected, languageOpts["C"])
+	}
+	if len(helpers) != 1 || !reflect.DeepEqual(helpers[0].Sources, []string{"src/special.cpp"}) {
+		t.Errorf("Expected one helper group for src/special.cpp, got %+v", helpers)
+	}
+}
+
+func TestTestsFromCTestInfo(t *testing.T) {
+	ctestJSON := `{
+		"kind": "ctestInfo",
+		"version": {"major": 1, "minor": 0},
+		"tests": [
+			{
+				"name": "unit",
+				"command": ["/build/test_runner", "--verbose", "/src/data/input.txt"],
+				"properties": [
+					{"name": "ENVIRONMENT", "value": ["MODE=fast", "LEVEL=2"]},
+					{"name": "LABELS", "value": ["unit", "quick"]},
+					{"name": "TIMEOUT", "value": 120},
+					{"name": "WILL_FAIL", "value": true}
+				]
+			},
+			{
+				"name": "disabled",
+				"command": ["/build/test_runner"],
+				"properties": [{"name": "DISABLED", "value": true}]
+			},
+			{"name": "unavailable", "properties": []}
+		]
+	}`
+
+	var info CTestInfo
+	if err := json.Unmarshal([]byte(ctestJSON), &info); err != nil {
+		t.Fatalf("Failed to parse ctest JSON: %v", err)
+	}
+
+	tests := testsFromCTestInfo(&info, "/src")["/build/test_runner"]
+	if len(tests) != 2 {
+		t.Fatalf("Expected 2 tests for /build/test_runner, got %d", len(tests))
+	}
+
+	unit := tests[0]
+	if expected := []string{"--verbose", "data/input.txt"}; !reflect.DeepEqual(unit.Args, expected) {
+		t.Errorf("Expected args %v, got %v", expected, unit.Args)
+	}
+	if expected := map[string]string{"MODE": "fast", "LEVEL": "2"}; !reflect.DeepEqual(unit.Env, expected) {
+		t.Errorf("Expected env %v, got %v", expected, unit.Env)
+	}
+	if expected := []string{"unit", "quick"}; !reflect.DeepEqual(unit.Labels, expected) {
+		t.Errorf("Expected labels %v, got %v", expected, unit.Labels)
+	}
+	if unit.Timeout != 120 || !unit.WillFail {
+		t.Errorf("Expected timeout 120 and WILL_FAIL, got %v and %v", unit.Timeout, unit.WillFail)
+	}
+	if !tests[1].Disabled {
+		t.Error("Expected second test to be disabled")
+	}
+
+	// Two tests on one executable produce a shared library and two cc_tests
+	r := rule.NewRule("cc_binary", "test_runner")
+	r.SetAttr("srcs", []string{"main.cpp"})
+	rules := common.TestRules(r, tests)
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %d", len(rules))
+	}
+	if rules[0].Kind() != "cc_library" || rules[0].Name() != "test_runner_lib" {
+		t.Errorf("Expected cc_library test_runner_lib, got %s %s", rules[0].Kind(), rules[0].Name())
+	}
+	if rules[1].Kind() != "cc_test" || rules[1].AttrString("timeout") != "moderate" {
+		t.Errorf("Expected cc_test with moderate timeout, got %s with %q", rules[1].Kind(), rules[1].AttrString("timeout"))
+	}
+	if tags := rules[2].AttrStrings("tags"); !reflect.DeepEqual(tags, []string{"manual"}) {
+		t.Errorf("Expected disabled test to be tagged manual, got %v", tags)
+	}
+}
+
+func TestGlobsFromCMakeFiles(t *testing.T) {
+	cmakeFilesJSON := `{
+		"kind": "cmakeFiles",
+		"version": {"major": 1, "minor": 1},
+		"paths": {"source": "/src", "build": "/build"},
+		"inputs": [{"path": "CMakeLists.txt"}],
+		"globsDependent": [
+			{
+				"expression": "/src/lib/*.cpp",
+				"paths": ["/src/lib/a.cpp", "/src/lib/b.cpp"]
+			},
+			{
+				"expression": "/src/include/*.h",
+				"recurse": true,
+				"listDirectories": false,
+				"relative": "/src/include",
+				"paths": ["core.h", "sub/util.h"]
+			},
+			{
+				"expression": "/src/gen/file?.c",
+				"paths": ["/src/gen/file1.c"]
+			}
+		]
+	}`
+
+	var files CMakeFiles
+	if err := json.Unmarshal([]byte(cmakeFilesJSON), &files); err != nil {
+		t.Fatalf("Failed to parse cmakeFiles JSON: %v", err)
+	}
+
+	expected := []common.CMakeGlob{
+		{Pattern: "lib/*.cpp", Files: []string{"lib/a.cpp", "lib/b.cpp"}},
+		{Pattern: "include/**/*.h", Files: []string{"include/core.h", "include/sub/util.h"}},
+		// Bazel has no equivalent of ?, so the files are listed instead
+		{Pattern: "", Files: []string{"gen/file1.c"}},
+	}
+	if globs := globsFromCMakeFiles(&files, "/src"); !reflect.DeepEqual(globs, expected) {
+		t.Errorf("Expected globs %+v, got %+v", expected, globs)
+	}
+}
+
+func TestMergeFallbackInterfaceTargets(t *testing.T) {
+	sourceDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sourceDir, "mathutil"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	topLevel := "add_subdirectory(mathutil)\nadd_executable(calc main.cpp)\ntarget_link_libraries(calc PRIVATE mathutil)\n"
+	subdir := "add_library(mathutil INTERFACE)\n" +
+		"target_include_directories(mathutil INTERFACE $<BUILD_INTERFACE:${CMAKE_CURRENT_SOURCE_DIR}/include> $<INSTALL_INTERFACE:include>)\n" +
+		"target_compile_definitions(mathutil INTERFACE MATHUTIL_HEADER_ONLY)\n"
+	if err := os.WriteFile(filepath.Join(sourceDir, "CMakeLists.txt"), []byte(topLevel), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "mathutil", "CMakeLists.txt"), []byte(subdir), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The File API of older CMake versions only reports the executable
+	api := NewCMakeFileAPI(sourceDir, filepath.Join(sourceDir, "build"), "cmake", nil)
+	calc := &common.CMakeTarget{Name: "calc", Type: "executable", Sources: []string{"main.cpp"}}
+	cmakeTargets := mergeFallbackInterfaceTargets(api.parseFallbackTargets(), []*common.CMakeTarget{calc})
+
+	if len(cmakeTargets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(cmakeTargets))
+	}
+	mathutil := cmakeTargets[1]
+	if mathutil.Name != "mathutil" || mathutil.Type != "interface" {
+		t.Errorf("Expected interface target mathutil, got %s target %s", mathutil.Type, mathutil.Name)
+	}
+	if expected := []string{"mathutil/include"}; !reflect.DeepEqual(mathutil.IncludeDirectories, expected) {
+		t.Errorf("Expected include directories %v, got %v", expected, mathutil.IncludeDirectories)
+	}
+	if expected := []string{"MATHUTIL_HEADER_ONLY"}; !reflect.DeepEqual(mathutil.CompileDefinitions, expected) {
+		t.Errorf("Expected compile definitions %v, got %v", expected, mathutil.CompileDefinitions)
+	}
+	if expected := []string{"mathutil"}; !reflect.DeepEqual(calc.LinkedLibraries, expected) {
+		t.Errorf("Expected calc to link %v, got %v", expected, calc.LinkedLibraries)
+	}
+}
+
+func TestApplyFallbackScopes(t *testing.T) {
+	cmTarget := &common.CMakeTarget{
+		Name:               "core",
+		IncludeDirectories: []string{"include", "src"},
+		CompileDefinitions: []string{"CORE_API", "CORE_BUILD"},
+		LinkedLibraries:    []string{"util"},
+	}
+	parsed := &common.CMakeTarget{
+		Name:                      "core",
+		PrivateIncludeDirectories: []string{"src", "generated"},
+		PrivateCompileDefinitions: []string{"CORE_BUILD"},
+		PrivateLinkedLibraries:    []string{"util"},
+	}
+
+	applyFallbackScopes(cmTarget, parsed)
+
+	// Values CMake does not build the target with are ignored
+	if expected := []string{"src"}; !reflect.DeepEqual(cmTarget.PrivateIncludeDirectories, expected) {
+		t.Errorf("Expected private include directories %v, got %v", expected, cmTarget.PrivateIncludeDirectories)
+	}
+	if expected := []string{"CORE_BUILD"}; !reflect.DeepEqual(cmTarget.PrivateCompileDefinitions, expected) {
+		t.Errorf("Expected private compile definitions %v, got %v", expected, cmTarget.PrivateCompileDefinitions)
+	}
+	if expected := []string{"util"}; !reflect.DeepEqual(cmTarget.PrivateLinkedLibraries, expected) {
+		t.Errorf("Expected private linked libraries %v, got %v", expected, cmTarget.PrivateLinkedLibraries)
+	}
+}
+
+func TestParseLibraryFileName(t *testing.T) {
+	testCases := []struct {
+		nameOnDisk, outputName, version string
+	}{
+		{"libcore.so", "core", ""},
+		{"libcore.so.1.2.3", "core", "1.2.3"},
+		{"libutils.a", "utils", ""},
+		{"core.dll", "core", ""},
+		{"libcore.dylib", "core", ""},
+		{"libcore.1.2.3.dylib", "core", "1.2.3"},
+		{"libcore.1.dylib", "core", "1"},
+		{"libcore.plugin.1.dylib", "core.plugin", "1"},
+		{"", "", ""},
+	}
+	for _, tc := range testCases {
+		outputName, version := parseLibraryFileName(tc.nameOnDisk)
+		if outputName != tc.outputName || version != tc.version {
+			t.Errorf("parseLibraryFileName(%q) = %q, %q; expected %q, %q", tc.nameOnDisk, outputName, version, tc.outputName, tc.version)
+		}
+	}
+}
+
+func TestExtractLinkSettings(t *testing.T) {
+	targetJSON := `{
+		"name": "client",
+		"id": "client::@6890427a1f51a3e7e1df",
+		"type": "EXECUTABLE",
+		"link": {
+			"language": "CXX",
+			"commandFragments": [
+				{"fragment": "-O3 -DNDEBUG -rdynamic", "role": "flags"},
+				{"fragment": "-L/opt/zmq/lib", "role": "libraryPath"},
+				{"fragment": "-Wl,-rpath,/src/build", "role": "libraries"},
+				{"fragment": "libzmq.a", "role": "libraries"},
+				{"fragment": "-lpthread", "role": "libraries"},
+				{"fragment": "/usr/lib/x86_64-linux-gnu/libz.so", "role": "libraries"},
+				{"fragment": "-Wl,--as-needed", "role": "libraries"},
+				{"fragment": "$<$<PLATFORM_ID:Linux>:-ldl>", "role": "libraries"}
+			]
+		}
+	}`
+
+	var target Target
+	if err := json.Unmarshal([]byte(targetJSON), &target); err != nil {
+		t.Fatalf("Failed to parse target JSON: %v", err)
+	}
+
+	cmakeTarget := &common.CMakeTarget{Name: "client", Type: "executable"}
+	extractLinkSettings(&target, cmakeTarget, map[string]string{"zmq": "libzmq-static"}, "/src/build", "")
+
+	if expected := []string{"libzmq-static"}; !reflect.DeepEqual(cmakeTarget.LinkedLibraries, expected) {
+		t.Errorf("Expected linked libraries %v, got %v", expected, cmakeTarget.LinkedLibraries)
+	}
+	if expected := []string{"pthread", "z", "dl"}; !reflect.DeepEqual(cmakeTarget.SystemLibraries, expected) {
+		t.Errorf("Expected system libraries %v, got %v", expected, cmakeTarget.SystemLibraries)
+	}
+	if expected := []string{"-rdynamic", "-L/opt/zmq/lib", "-Wl,--as-needed"}; !reflect.DeepEqual(cmakeTarget.LinkOptions, expected) {
+		t.Errorf("Expected link options %v, got %v", expected, cmakeTarget.LinkOptions)
+	}
+
+	// Directives override how system libraries are linked
+	cfg := common.NewCMakeConfig()
+	cfg.LinkoptsMappings["pthread"] = []string{"-pthread"}
+	cfg.ResolveMappings["z"] = "@zlib//:zlib"
+	linkopts, deps := common.LinkAttrs(cmakeTarget, cfg, "client")
+	if expected := []string{"-pthread", "-ldl", "-rdynamic", "-L/opt/zmq/lib", "-Wl,--as-needed"}; !reflect.DeepEqual(linkopts, expected) {
+		t.Errorf("Expected linkopts %v, got %v", expected, linkopts)
+	}
+	if expected := []string{"@zlib//:zlib"}; !reflect.DeepEqual(deps, expected) {
+		t.Errorf("Expected deps %v, got %v", expected, deps)
+	}
+
+	// What a generator expression links in some configurations only goes to
+	// the values of their compilation modes
+	var configTarget Target
+	if err := json.Unmarshal([]byte(`{"name": "app", "link": {"commandFragments": [
+		{"fragment": "$<$<CONFIG:Debug>:-lasan>", "role": "libraries"},
+		{"fragment": "$<$<NOT:$<CONFIG:Debug>>:-Wl,-O1>", "role": "flags"},
+		{"fragment": "$<$<CONFIG:Debug,Release,RelWithDebInfo>:-lm>", "role": "libraries"}
+	]}}`), &configTarget); err != nil {
+		t.Fatal(err)
+	}
+	configCMakeTarget := &common.CMakeTarget{Name: "app", Type: "executable"}
+	extractLinkSettings(&configTarget, configCMakeTarget, nil, "/src/build", "RelWithDebInfo")
+	if expected := []string{"m"}; !reflect.DeepEqual(configCMakeTarget.SystemLibraries, expected) {
+		t.Errorf("Expected system libraries %v, got %v", expected, configCMakeTarget.SystemLibraries)
+	}
+	if len(configCMakeTarget.LinkOptions) != 0 {
+		t.Errorf("Expected no link options in every mode, got %v", configCMakeTarget.LinkOptions)
+	}
+	if values := configCMakeTarget.ConfigValues["dbg"]; values == nil || !reflect.DeepEqual(values.SystemLibraries, []string{"asan"}) || len(values.LinkOptions) != 0 {
+		t.Errorf("Expected dbg system libraries [asan], got %+v", values)
+	}
+	for _, mode := range []string{"fastbuild", "opt"} {
+		if values := configCMakeTarget.ConfigValues[mode]; values == nil || !reflect.DeepEqual(values.LinkOptions, []string{"-Wl,-O1"}) || len(values.SystemLibraries) != 0 {
+			t.Errorf("Expected %s link options [-Wl,-O1], got %+v", mode, values)
+		}
+	}
+
+	// On macOS, the version of a library comes before its extension
+	var macTarget Target
+	if err := json.Unmarshal([]byte(`{"name": "app", "link": {"commandFragments": [
+		{"fragment": "/src/build/libcore.1.2.dylib", "role": "libraries"},
+		{"fragment": "/usr/lib/libz.1.dylib", "role": "libraries"}
+	]}}`), &macTarget); err != nil {
+		t.Fatal(err)
+	}
+	macCMakeTarget := &common.CMakeTarget{Name: "app", Type: "executable"}
+	extractLinkSettings(&macTarget, macCMakeTarget, map[string]string{"core": "core"}, "/src/build", "")
+	if expected := []string{"core"}; !reflect.DeepEqual(macCMakeTarget.LinkedLibraries, expected) {
+		t.Errorf("Expected linked libraries %v, got %v", expected, macCMakeTarget.LinkedLibraries)
+	}
+	if expected := []string{"z"}; !reflect.DeepEqual(macCMakeTarget.SystemLibraries, expected) {
+		t.Errorf("Expected system libraries %v, got %v", expected, macCMakeTarget.SystemLibraries)
+	}
+
+	// A framework is linked with -framework and its name, which stay together
+	var frameworkTarget Target
+	if err := json.Unmarshal([]byte(`{"name": "app", "link": {"commandFragments": [
+		{"fragment": "-framework CoreFoundation -framework Security", "role": "libraries"}
+	]}}`), &frameworkTarget); err != nil {
+		t.Fatal(err)
+	}
+	frameworkCMakeTarget := &common.CMakeTarget{Name: "app", Type: "executable"}
+	extractLinkSettings(&frameworkTarget, frameworkCMakeTarget, nil, "/src/build", "")
+	if expected := []string{"-framework CoreFoundation", "-framework Security"}; !reflect.DeepEqual(frameworkCMakeTarget.LinkOptions, expected) {
+		t.Errorf("Expected link options %v, got %v", expected, frameworkCMakeTarget.LinkOptions)
+	}
+	if len(frameworkCMakeTarget.SystemLibraries) != 0 {
+		t.Errorf("Expected no system libraries, got %v", frameworkCMakeTarget.SystemLibraries)
+	}
+}
+
+func TestParseCMakeListsForConfigureFile(t *testing.T) {
+	sourceDir := t.TempDir()
+	src := "project(Demo)\n" +
+		"# configure_file(ignored.h.in ignored.h)\n" +
+		"configure_file(\n" +
+		"    \"${CMAKE_CURRENT_SOURCE_DIR}/config.h.in\" # template\n" +
+		"    ${CMAKE_CURRENT_BINARY_DIR}/config.h\n" +
+		"    @ONLY)\n"
+	if err := os.WriteFile(filepath.Join(sourceDir, "CMakeLists.txt"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewCMakeFileAPI(sourceDir, filepath.Join(sourceDir, "build"), "cmake", map[string]string{"VERSION": "1.0"})
+	configureFiles, err := api.parseCMakeListsForConfigureFile()
+	if err != nil {
+		t.Fatalf("parseCMakeListsForConfigureFile failed: %v", err)
+	}
+	if len(configureFiles) != 1 {
+		t.Fatalf("Expected 1 configure_file, got %d", len(configureFiles))
+	}
+	configFile := configureFiles[0]
+	if configFile.InputFile != "config.h.in" || configFile.OutputFile != ".cmake-build/config.h" {
+		t.Errorf("Expected config.h.in -> .cmake-build/config.h, got %s -> %s", configFile.InputFile, configFile.OutputFile)
+	}
+	if configFile.Name != "config_h" {
+		t.Errorf("Expected rule name config_h, got %s", configFile.Name)
+	}
+	if configFile.Variables["VERSION"] != "1.0" {
+		t.Errorf("Expected VERSION from cmake_define, got %v", configFile.Variables)
+	}
+}
+
+func TestConfigureTemplateRule(t *testing.T) {
+	sourceDir := t.TempDir()
+	files := map[string]string{
+		"CMakeLists.txt": "project(Demo VERSION 3.1)\n" +
+			"check_symbol_exists(fork unistd.h HAVE_FORK)\n" +
+			"set(NAME demo)\n" +
+			"configure_file(version.h.in version.h @ONLY)\n" +
+			"configure_file(fork.h.in fork.h)\n" +
+			"set(DATA_DIR ${CMAKE_BINARY_DIR}/data)\n" +
+			"configure_file(paths.h.in paths.h)\n" +
+			"configure_file(data.txt ${CMAKE_CURRENT_BINARY_DIR}/data.txt COPYONLY)\n" +
+			"file(CONFIGURE OUTPUT name.h CONTENT \"#define NAME \\\"${NAME}\\\"\")\n",
+		"version.h.in": "#define VERSION \"@Demo_VERSION@\"\n#define CACHED \"@CACHED@\"\n",
+		"fork.h.in":    "#cmakedefine HAVE_FORK\n",
+		"paths.h.in":   "#define DATA_DIR \"@DATA_DIR@\"\n",
+		"data.txt":     "@NAME@\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api := NewCMakeFileAPI(sourceDir, filepath.Join(sourceDir, "build"), "cmake", nil)
+	api.cache["CACHED"] = "yes"
+	configureFiles, err := api.parseCMakeListsForConfigureFile()
+	if err != nil {
+		t.Fatalf("parseCMakeListsForConfigureFile failed: %v", err)
+	}
+	api.parseFallbackTargets()
+	byName := make(map[string]*common.CMakeConfigureFile)
+	for _, configFile := range configureFiles {
+		byName[configFile.Name] = configFile
+	}
+
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"version_h", []string{`"Demo_VERSION": "3.1"`, `"CACHED": "yes"`, `at_only = True`}},
+		{"data_txt", []string{`copy_only = True`}},
+		{"name_h", []string{`content = "#define NAME \"demo\""`}},
+	}
+	for _, tt := range tests {
+		configFile := byName[tt.name]
+		if configFile == nil {
+			t.Errorf("Expected a configure file %s, got %v", tt.name, configureFiles)
+			continue
+		}
+		r := api.configureTemplateRule(configFile)
+		if r == nil {
+			t.Errorf("Expected a cmake_configure_template rule for %s", tt.name)
+			continue
+		}
+		f := rule.EmptyFile("BUILD.bazel", "")
+		r.Insert(f)
+		formatted := string(f.Format())
+		for _, expected := range tt.expected {
+			if !strings.Contains(formatted, expected) {
+				t.Errorf("Expected %s in:\n%s", expected, formatted)
+			}
+		}
+	}
+
+	// Only cmake knows the result of check_symbol_exists()
+	if r := api.configureTemplateRule(byName["fork_h"]); r != nil {
+		t.Errorf("Expected fork.h to be configured with cmake, got %s", r.Kind())
+	}
+	// Paths of this machine must not end up in the BUILD file
+	if r := api.configureTemplateRule(byName["paths_h"]); r != nil {
+		t.Errorf("Expected paths.h to be configured with cmake, got %s", r.Kind())
+	}
+}
+
+func TestTranslateBuildPaths(t *testing.T) {
+	api := NewCMakeFileAPI("/src/proj", "/scratch/0123", "cmake", nil)
+	data := `{"paths": {"source": "/src/proj", "build": "/scratch/0123"}, ` +
+		`"sources": [{"path": "/scratch/0123/gen/version.c"}, {"path": "/scratch/01234/other.c"}]}`
+	expected := `{"paths": {"source": "/src/proj", "build": "/src/proj/.cmake-build"}, ` +
+		`"sources": [{"path": "/src/proj/.cmake-build/gen/version.c"}, {"path": "/scratch/01234/other.c"}]}`
+	if translated := string(api.translateBuildPaths([]byte(data))); translated != expected {
+		t.Errorf("Expected %s, got %s", expected, translated)
+	}
+}
+
+func TestGenerateFromAPIMultiConfig(t *testing.T) {
+	sourceDir := t.TempDir()
+	buildDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, "CMakeLists.txt"), []byte("project(MultiConfig C)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reply := filepath.Join(buildDir, ".cmake", "api", "v1", "reply")
+	if err := os.MkdirAll(reply, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Ninja Multi-Config reports a configuration per build type
+	target := func(config string, sources []string, defines []string, fragment string) string {
+		var paths, indexes, defineObjects []string
+		for i, source := range sources {
+			paths = append(paths, fmt.Sprintf(`{"path": %q, "compileGroupIndex": 0}`, filepath.Join(sourceDir, source)))
+			indexes = append(indexes, fmt.Sprint(i))
+		}
+		for _, define := range defines {
+			defineObjects = append(defineObjects, fmt.Sprintf(`{"define": %q}`, define))
+		}
+		return fmt.Sprintf(`{"name": "core", "id": "core::@1", "type": "STATIC_LIBRARY", "nameOnDisk": "libcore.a",
+			"paths": {"source": %q, "build": %q},
+			"sources": [%s],
+			"compileGroups": [{"language": "C", "sourceIndexes": [%s], "defines": [%s], "compileCommandFragments": [{"fragment": %q}]}]}`,
+			sourceDir, filepath.Join(buildDir, config), strings.Join(paths, ", "), strings.Join(indexes, ", "), strings.Join(defineObjects, ", "), fragment)
+	}
+	files := map[string]string{
+		"index-1.json": `{"objects": [{"kind": "codemodel", "version": {"major": 2, "minor": 6}, "jsonFile": "codemodel-v2-1.json"}]}`,
+		"codemodel-v2-1.json": fmt.Sprintf(`{"configurations": [
+			{"name": "Debug", "directories": [{"source": %[1]q}], "targets": [{"name": "core", "id": "core::@1", "jsonFile": "target-core-Debug.json"}]},
+			{"name": "Release", "directories": [{"source": %[1]q}], "targets": [{"name": "core", "id": "core::@1", "jsonFile": "target-core-Release.json"}]},
+			{"name": "RelWithDebInfo", "directories": [{"source": %[1]q}], "targets": [{"name": "core", "id": "core::@1", "jsonFile": "target-core-RelWithDebInfo.json"}]}
+		]}`, sourceDir),
+		"target-core-Debug.json":          target("Debug", []string{"core.c", "debug.c"}, []string{"CORE", "TRACE"}, "-O0 -g -Wall"),
+		"target-core-Release.json":        target("Release", []string{"core.c"}, []string{"CORE"}, "-O3 -DNDEBUG -Wall -ffast-math"),
+		"target-core-RelWithDebInfo.json": target("RelWithDebInfo", []string{"core.c"}, []string{"CORE"}, "-O2 -g -DNDEBUG -Wall"),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(reply, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	generate := func(buildType string) *common.CMakeTarget {
+		t.Helper()
+		api := NewCMakeFileAPI(sourceDir, buildDir, filepath.Join(t.TempDir(), "cmake"), nil)
+		api.SetBuildConfiguration("Ninja Multi-Config", buildType)
+		api.configured = true
+		targets, err := api.GenerateFromAPI("")
+		if err != nil {
+			t.Fatalf("GenerateFromAPI failed: %v", err)
+		}
+		if len(targets) != 1 {
+			t.Fatalf("Expected one target, got %d", len(targets))
+		}
+		return targets[0]
+	}
+
+	// fastbuild builds the default configuration, the first one
+	core := generate("")
+	if expected := []string{"core.c"}; !reflect.DeepEqual(core.Sources, expected) {
+		t.Errorf("Expected sources %v, got %v", expected, core.Sources)
+	}
+	if expected := []string{"CORE"}; !reflect.DeepEqual(core.CompileDefinitions, expected) {
+		t.Errorf("Expected defines %v, got %v", expected, core.CompileDefinitions)
+	}
+	if expected := []string{"-Wall"}; !reflect.DeepEqual(core.CompileOptions, expected) {
+		t.Errorf("Expected compile options %v, got %v", expected, core.CompileOptions)
+	}
+	for _, mode := range []string{"dbg", "fastbuild"} {
+		values := core.ConfigValues[mode]
+		if values == nil || !reflect.DeepEqual(values.Sources, []string{"debug.c"}) || !reflect.DeepEqual(values.CompileDefinitions, []string{"TRACE"}) {
+			t.Errorf("Expected %s to build debug.c with TRACE, got %+v", mode, values)
+		}
+	}
+	if values := core.ConfigValues["opt"]; values == nil || !reflect.DeepEqual(values.CompileOptions, []string{"-ffast-math"}) || len(values.Sources) != 0 {
+		t.Errorf("Expected opt to compile with -ffast-math only, got %+v", values)
+	}
+	if expected := []string{"core.c"}; !reflect.DeepEqual(core.CompileGroups[0].Sources, expected) {
+		t.Errorf("Expected the compile group to keep %v, got %v", expected, core.CompileGroups[0].Sources)
+	}
+
+	// The build type selects the configuration of fastbuild
+	core = generate("RelWithDebInfo")
+	if values := core.ConfigValues["fastbuild"]; values != nil {
+		t.Errorf("Expected fastbuild to build RelWithDebInfo like the target, got %+v", values)
+	}
+	if values := core.ConfigValues["dbg"]; values == nil || !reflect.DeepEqual(values.Sources, []string{"debug.c"}) {
+		t.Errorf("Expected dbg to build debug.c, got %+v", values)
+	}
+}
+
+func TestConfigurationSelection(t *testing.T) {
+	var codemodel Codemodel
+	if err := json.Unmarshal([]byte(`{"configurations": [{"name": "Debug"}, {"name": "Release"}, {"name": "MinSizeRel"}]}`), &codemodel); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewCMakeFileAPI("/src", "/build", "cmake", nil)
+	if i := api.configuration(&codemodel); i != 0 {
+		t.Errorf("Expected the first configuration by default, got %d", i)
+	}
+	api.SetBuildConfiguration("", "minsizerel")
+	if i := api.configuration(&codemodel); i != 2 {
+		t.Errorf("Expected the configuration of the build type, got %d", i)
+	}
+	if expected := map[string]int{"dbg": 0, "fastbuild": 2, "opt": 1}; !reflect.DeepEqual(api.modeConfigurations(&codemodel), expected) {
+		t.Errorf("Expected mode configurations %v, got %v", expected, api.modeConfigurations(&codemodel))
+	}
+
+	// A cmake_define of CMAKE_BUILD_TYPE takes precedence
+	api = NewCMakeFileAPI("/src", "/build", "cmake", map[string]string{"CMAKE_BUILD_TYPE": "Release"})
+	api.SetBuildConfiguration("", "Debug")
+	if i := api.configuration(&codemodel); i != 1 {
+		t.Errorf("Expected the configuration of the defined build type, got %d", i)
+	}
+
+	codemodel.Configurations = codemodel.Configurations[:1]
+	if byMode := api.modeConfigurations(&codemodel); byMode != nil {
+		t.Errorf("Expected no mode configurations for a single configuration, got %v", byMode)
+	}
+}
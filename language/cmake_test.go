@@ -1,13 +1,17 @@
 package language
 
 import (
+	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/goniz/gazelle-foreign-cc/common"
 	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
 
@@ -397,4 +401,630 @@ func TestCMakeIncludeDirectoriesExternalRepoCore(t *testing.T) {
 	if !reflect.DeepEqual(includes, expectedIncludes) {
 		t.Errorf("Expected includes %v, got %v", expectedIncludes, includes)
 	}
-}
\ No newline at end of file
+}
+
+func TestImportsPublishesHeadersRelativeToIncludeDirectories(t *testing.T) {
+	lang := &cmakeLang{}
+	c := &config.Config{Exts: make(map[string]interface{})}
+
+	r := rule.NewRule("cc_library", "foo")
+	r.SetAttr("hdrs", []string{"include/foo/foo.h", "src/internal.h"})
+	r.SetPrivateAttr("cmake_include_directories", []string{"include"})
+
+	specs := lang.Imports(c, r, &rule.File{Pkg: "libs/foo"})
+
+	var got []string
+	for _, spec := range specs {
+		if spec.Lang != "cc" {
+			t.Errorf("Expected import language 'cc', got '%s'", spec.Lang)
+		}
+		got = append(got, spec.Imp)
+	}
+	expected := []string{"libs/foo/include/foo/foo.h", "foo/foo.h", "libs/foo/src/internal.h"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected imports %v, got %v", expected, got)
+	}
+
+	// Binaries are not importable
+	if specs := lang.Imports(c, rule.NewRule("cc_binary", "app"), &rule.File{Pkg: "app"}); specs != nil {
+		t.Errorf("Expected no imports for cc_binary, got %v", specs)
+	}
+}
+
+func TestResolveAddsDepsFromIncludes(t *testing.T) {
+	lang := &cmakeLang{}
+	c := &config.Config{Exts: make(map[string]interface{})}
+
+	libFile := &rule.File{Pkg: "libs/foo"}
+	lib := rule.NewRule("cc_library", "foo")
+	lib.SetAttr("hdrs", []string{"include/foo/foo.h"})
+	lib.SetPrivateAttr("cmake_include_directories", []string{"include"})
+
+	appFile := &rule.File{Pkg: "app"}
+	app := rule.NewRule("cc_binary", "app")
+	app.SetAttr("srcs", []string{"main.cc"})
+	app.SetAttr("deps", []string{":app_includes"})
+	app.SetPrivateAttr("cmake_includes", []common.IncludeDirective{
+		{Path: "foo/foo.h", Quoted: false, FromDir: "."},
+		{Path: "vector", Quoted: false, FromDir: "."},
+	})
+
+	ix := resolve.NewRuleIndex(func(r *rule.Rule, pkgRel string) resolve.Resolver { return lang })
+	ix.AddRule(c, lib, libFile)
+	ix.AddRule(c, app, appFile)
+	ix.Finish()
+
+	lang.Resolve(c, ix, nil, app, app.PrivateAttr("cmake_includes"), label.New("", "app", "app"))
+
+	expected := []string{":app_includes", "//libs/foo"}
+	if deps := app.AttrStrings("deps"); !reflect.DeepEqual(deps, expected) {
+		t.Errorf("Expected deps %v, got %v", expected, deps)
+	}
+}
+
+func TestClassifyCompileDefinitions(t *testing.T) {
+	cmakeTargets := []*common.CMakeTarget{
+		{
+			Name:               "zmq",
+			Type:               "library",
+			CompileDefinitions: []string{"ZMQ_STATIC", "ZMQ_BUILD_DRAFT_API"},
+		},
+		{
+			Name:               "client",
+			Type:               "executable",
+			CompileDefinitions: []string{"ZMQ_STATIC", "CLIENT_MAIN"},
+			LinkedLibraries:    []string{"zmq"},
+		},
+	}
+
+	publicDefines, localDefines := classifyCompileDefinitions(cmakeTargets)
+
+	if expected := []string{"ZMQ_STATIC"}; !reflect.DeepEqual(publicDefines["zmq"], expected) {
+		t.Errorf("Expected defines %v for zmq, got %v", expected, publicDefines["zmq"])
+	}
+	if expected := []string{"ZMQ_BUILD_DRAFT_API"}; !reflect.DeepEqual(localDefines["zmq"], expected) {
+		t.Errorf("Expected local_defines %v for zmq, got %v", expected, localDefines["zmq"])
+	}
+
+	// A PRIVATE definition is local even when every consumer shares it
+	cmakeTargets[0].PrivateCompileDefinitions = []string{"ZMQ_STATIC"}
+	if publicDefines, _ := classifyCompileDefinitions(cmakeTargets); len(publicDefines["zmq"]) != 0 {
+		t.Errorf("Expected no defines for zmq with PRIVATE ZMQ_STATIC, got %v", publicDefines["zmq"])
+	}
+
+	// ZMQ_STATIC reaches the client through deps, so only its own define remains
+	if len(publicDefines["client"]) != 0 {
+		t.Errorf("Expected no defines for client, got %v", publicDefines["client"])
+	}
+	if expected := []string{"CLIENT_MAIN"}; !reflect.DeepEqual(localDefines["client"], expected) {
+		t.Errorf("Expected local_defines %v for client, got %v", expected, localDefines["client"])
+	}
+
+	// Without targets linking it, nothing speaks against propagating the
+	// definitions of a library that are not PRIVATE
+	standalone := []*common.CMakeTarget{
+		{
+			Name:                      "codec",
+			Type:                      "library",
+			CompileDefinitions:        []string{"CODEC_API=1", "CODEC_BUILDING"},
+			PrivateCompileDefinitions: []string{"CODEC_BUILDING"},
+		},
+	}
+	publicDefines, localDefines = classifyCompileDefinitions(standalone)
+	if expected := []string{"CODEC_API=1"}; !reflect.DeepEqual(publicDefines["codec"], expected) {
+		t.Errorf("Expected defines %v for codec, got %v", expected, publicDefines["codec"])
+	}
+	if expected := []string{"CODEC_BUILDING"}; !reflect.DeepEqual(localDefines["codec"], expected) {
+		t.Errorf("Expected local_defines %v for codec, got %v", expected, localDefines["codec"])
+	}
+}
+
+func TestInterfaceLibraryGeneratesHeaderOnlyLibrary(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "include", "mathutil"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "include", "mathutil", "vec.h"), []byte("#pragma once\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := config.New()
+	c.Exts["cmake"] = common.NewCMakeConfig()
+	args := language.GenerateArgs{Config: c, Dir: dir, Rel: "project"}
+
+	cmakeTargets := []*common.CMakeTarget{
+		{
+			Name:               "mathutil",
+			Type:               "interface",
+			Headers:            []string{"include/mathutil/vec.h"},
+			IncludeDirectories: []string{"include"},
+			CompileDefinitions: []string{"MATHUTIL_HEADER_ONLY"},
+		},
+		{
+			Name:               "shapes",
+			Type:               "interface",
+			CompileDefinitions: []string{"SHAPES_NO_HEADERS"},
+			LinkedLibraries:    []string{"mathutil"},
+		},
+	}
+
+	lang := &cmakeLang{}
+	result := lang.generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "", nil, map[string]string{})
+
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+
+	mathutil, ok := rules["mathutil"]
+	if !ok || mathutil.Kind() != "cc_library" {
+		t.Fatalf("Expected cc_library mathutil, got %v", mathutil)
+	}
+	if srcs := mathutil.AttrStrings("srcs"); len(srcs) != 0 {
+		t.Errorf("Expected no srcs, got %v", srcs)
+	}
+	if hdrs := mathutil.AttrStrings("hdrs"); !reflect.DeepEqual(hdrs, []string{"include/mathutil/vec.h"}) {
+		t.Errorf("Expected hdrs [include/mathutil/vec.h], got %v", hdrs)
+	}
+	if defines := mathutil.AttrStrings("defines"); !reflect.DeepEqual(defines, []string{"MATHUTIL_HEADER_ONLY"}) {
+		t.Errorf("Expected defines [MATHUTIL_HEADER_ONLY], got %v", defines)
+	}
+	if deps := mathutil.AttrStrings("deps"); !reflect.DeepEqual(deps, []string{":project_includes"}) {
+		t.Errorf("Expected deps [:project_includes], got %v", deps)
+	}
+
+	// An interface library without headers is still generated for its consumers
+	shapes, ok := rules["shapes"]
+	if !ok {
+		t.Fatal("Expected to find 'shapes' rule")
+	}
+	if defines := shapes.AttrStrings("defines"); !reflect.DeepEqual(defines, []string{"SHAPES_NO_HEADERS"}) {
+		t.Errorf("Expected defines [SHAPES_NO_HEADERS], got %v", defines)
+	}
+	if deps := shapes.AttrStrings("deps"); !reflect.DeepEqual(deps, []string{":mathutil"}) {
+		t.Errorf("Expected deps [:mathutil], got %v", deps)
+	}
+}
+
+func TestLibraryTypesGenerateMatchingRules(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"core.cpp", "plugin.cpp", "objects.cpp", "main.cpp"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("int x;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := config.New()
+	c.Exts["cmake"] = common.NewCMakeConfig()
+	args := language.GenerateArgs{Config: c, Dir: dir, Rel: "project"}
+
+	cmakeTargets := []*common.CMakeTarget{
+		{Name: "core", Type: "library", LibraryType: "SHARED", OutputName: "mycore", SOVersion: "2", Sources: []string{"core.cpp"}},
+		{Name: "plugin", Type: "library", LibraryType: "MODULE", Sources: []string{"plugin.cpp"}, LinkedLibraries: []string{"core"}},
+		{Name: "objects", Type: "library", LibraryType: "OBJECT", Sources: []string{"objects.cpp"}},
+		{Name: "app", Type: "executable", Sources: []string{"main.cpp"}, LinkedLibraries: []string{"core", "objects"}},
+	}
+
+	lang := &cmakeLang{}
+	result := lang.generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "", nil, map[string]string{})
+
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+
+	if r := rules["core"]; r == nil || r.Kind() != "cc_library" {
+		t.Errorf("Expected cc_library core, got %v", r)
+	}
+	shared := rules["core_shared"]
+	if shared == nil || shared.Kind() != "cc_shared_library" {
+		t.Fatalf("Expected cc_shared_library core_shared, got %v", shared)
+	}
+	if name := shared.AttrString("shared_lib_name"); name != "libmycore.so.2" {
+		t.Errorf("Expected shared_lib_name 'libmycore.so.2', got '%s'", name)
+	}
+
+	plugin := rules["libplugin.so"]
+	if plugin == nil || plugin.Kind() != "cc_binary" {
+		t.Fatalf("Expected cc_binary libplugin.so, got %v", plugin)
+	}
+	if !attrIsTrue(plugin, "linkshared") {
+		t.Error("Expected linkshared = True for the module")
+	}
+	if dynamicDeps := plugin.AttrStrings("dynamic_deps"); !reflect.DeepEqual(dynamicDeps, []string{":core_shared"}) {
+		t.Errorf("Expected module dynamic_deps [:core_shared], got %v", dynamicDeps)
+	}
+
+	if !attrIsTrue(rules["objects"], "alwayslink") {
+		t.Error("Expected alwayslink = True for the object library")
+	}
+	if dynamicDeps := rules["app"].AttrStrings("dynamic_deps"); !reflect.DeepEqual(dynamicDeps, []string{":core_shared"}) {
+		t.Errorf("Expected app dynamic_deps [:core_shared], got %v", dynamicDeps)
+	}
+}
+
+func TestScopesGeneratePrivateDeps(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"core.cpp", "fast.cpp", "util.cpp"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("int x;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := config.New()
+	c.Exts["cmake"] = common.NewCMakeConfig()
+	args := language.GenerateArgs{Config: c, Dir: dir, Rel: "project"}
+
+	cmakeTargets := []*common.CMakeTarget{
+		{Name: "util", Type: "library", Sources: []string{"util.cpp"}},
+		{
+			Name:                      "core",
+			Type:                      "library",
+			Sources:                   []string{"core.cpp", "fast.cpp"},
+			IncludeDirectories:        []string{"include", "src"},
+			PrivateIncludeDirectories: []string{"src"},
+			LinkedLibraries:           []string{"util"},
+			PrivateLinkedLibraries:    []string{"util"},
+			CompileGroups: []common.CMakeCompileGroup{
+				{Language: "CXX", Sources: []string{"core.cpp"}},
+				{Language: "CXX", Sources: []string{"fast.cpp"}, CompileOptions: []string{"-O3"}},
+			},
+		},
+	}
+
+	lang := &cmakeLang{}
+	result := lang.generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "", nil, map[string]string{})
+
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+	core := rules["core"]
+	if core == nil {
+		t.Fatal("Expected a rule for core")
+	}
+
+	includeTargets := make(map[string][]string)
+	for _, r := range result.Gen {
+		if r.Kind() == "cmake_include_directories" {
+			includeTargets[":"+r.Name()] = r.AttrStrings("includes")
+		}
+	}
+	deps := core.AttrStrings("deps")
+	if len(deps) != 1 || !reflect.DeepEqual(includeTargets[deps[0]], []string{"include"}) {
+		t.Errorf("Expected deps on the include target of [include], got %v", deps)
+	}
+	implementationDeps := core.AttrStrings("implementation_deps")
+	if len(implementationDeps) != 3 || implementationDeps[0] != ":util" || !reflect.DeepEqual(includeTargets[implementationDeps[1]], []string{"src"}) || implementationDeps[2] != ":core_cxx_1" {
+		t.Errorf("Expected implementation_deps on :util, the include target of [src] and :core_cxx_1, got %v", implementationDeps)
+	}
+
+	// The helper compiling fast.cpp with its own flags keeps the PRIVATE deps
+	// of core private as well
+	helper := rules["core_cxx_1"]
+	if helper == nil {
+		t.Fatal("Expected a helper rule for fast.cpp")
+	}
+	if expected := deps; !reflect.DeepEqual(helper.AttrStrings("deps"), expected) {
+		t.Errorf("Expected helper deps %v, got %v", expected, helper.AttrStrings("deps"))
+	}
+	if expected := implementationDeps[:2]; !reflect.DeepEqual(helper.AttrStrings("implementation_deps"), expected) {
+		t.Errorf("Expected helper implementation_deps %v, got %v", expected, helper.AttrStrings("implementation_deps"))
+	}
+	if dirs, _ := core.PrivateAttr("cmake_include_directories").([]string); !reflect.DeepEqual(dirs, []string{"include"}) {
+		t.Errorf("Expected headers to be published relative to [include], got %v", dirs)
+	}
+}
+
+func TestMirrorLayoutGeneratesPackagePerDirectory(t *testing.T) {
+	repoRoot := t.TempDir()
+	files := map[string]string{
+		"proj/CMakeLists.txt":     "add_subdirectory(lib)\nadd_executable(app main.cpp)\ntarget_link_libraries(app foo)\n",
+		"proj/main.cpp":           "#include \"foo.h\"\n",
+		"proj/lib/CMakeLists.txt": "add_library(foo foo.cpp foo.h)\ntarget_include_directories(foo PUBLIC .)\n",
+		"proj/lib/foo.cpp":        "int foo;\n",
+		"proj/lib/foo.h":          "int foo();\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(repoRoot, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repoRoot, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := config.New()
+	c.RepoRoot = repoRoot
+	cfg := common.NewCMakeConfig()
+	cfg.Layout = common.LayoutMirror
+	c.Exts["cmake"] = cfg
+
+	cmakeTargets := []*common.CMakeTarget{
+		{Name: "foo", Type: "library", Directory: "lib", Sources: []string{"lib/foo.cpp"}, Headers: []string{"lib/foo.h"}, IncludeDirectories: []string{"lib"}},
+		{Name: "app", Type: "executable", Sources: []string{"main.cpp"}, LinkedLibraries: []string{"foo"}},
+	}
+	generate := func(rel string) map[string]*rule.Rule {
+		args := language.GenerateArgs{Config: c, Dir: filepath.Join(repoRoot, "proj"), Rel: rel}
+		result := (&cmakeLang{}).generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "", nil, map[string]string{})
+		rules := make(map[string]*rule.Rule)
+		for _, r := range result.Gen {
+			rules[r.Name()] = r
+		}
+		return rules
+	}
+
+	lib := generate("proj/lib")
+	if lib["app"] != nil {
+		t.Error("Expected app to be generated in the package of its directory only")
+	}
+	foo := lib["foo"]
+	if foo == nil {
+		t.Fatal("Expected foo in proj/lib")
+	}
+	if expected := []string{"foo.cpp"}; !reflect.DeepEqual(foo.AttrStrings("srcs"), expected) {
+		t.Errorf("Expected srcs %v relative to the package, got %v", expected, foo.AttrStrings("srcs"))
+	}
+	if expected := []string{"foo.h"}; !reflect.DeepEqual(foo.AttrStrings("hdrs"), expected) {
+		t.Errorf("Expected hdrs %v relative to the package, got %v", expected, foo.AttrStrings("hdrs"))
+	}
+	if expected := []string{"//proj:__pkg__"}; !reflect.DeepEqual(foo.AttrStrings("visibility"), expected) {
+		t.Errorf("Expected visibility %v, got %v", expected, foo.AttrStrings("visibility"))
+	}
+	if dirs, _ := foo.PrivateAttr("cmake_include_directories").([]string); !reflect.DeepEqual(dirs, []string{"."}) {
+		t.Errorf("Expected include directories relative to the package, got %v", dirs)
+	}
+	includes := lib["lib_includes"]
+	if includes == nil || !containsString(foo.AttrStrings("deps"), ":lib_includes") {
+		t.Fatalf("Expected foo to depend on :lib_includes, got %v", foo.AttrStrings("deps"))
+	}
+	if expected := []string{"."}; !reflect.DeepEqual(includes.AttrStrings("includes"), expected) {
+		t.Errorf("Expected includes %v relative to the package, got %v", expected, includes.AttrStrings("includes"))
+	}
+
+	top := generate("proj")
+	if top["foo"] != nil {
+		t.Error("Expected foo to be generated in proj/lib only")
+	}
+	app := top["app"]
+	if app == nil {
+		t.Fatal("Expected app in proj")
+	}
+	if deps := app.AttrStrings("deps"); !containsString(deps, "//proj/lib:foo") {
+		t.Errorf("Expected app to depend on //proj/lib:foo, got %v", deps)
+	}
+}
+
+func TestMirrorLayoutPackages(t *testing.T) {
+	repoRoot := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repoRoot, "thirdparty", "somelib", "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Directories of an external project without a directory in the
+	// repository belong to the package of their innermost parent that has one
+	cmakeTargets := []*common.CMakeTarget{
+		{Name: "core", Directory: "src/core"},
+		{Name: "docs", Directory: "docs"},
+		{Name: "tool", Directory: "src", LinkedLibraries: []string{"core", "docs"}},
+	}
+	mirror := newMirrorLayout(repoRoot, "thirdparty/somelib", false, []string{"", "src", "src/core", "docs"}, cmakeTargets)
+
+	for dir, expected := range map[string]string{
+		"":         "thirdparty/somelib",
+		"src":      "thirdparty/somelib/src",
+		"src/core": "thirdparty/somelib/src",
+		"docs":     "thirdparty/somelib",
+	} {
+		if pkg := mirror.packages[dir]; pkg != expected {
+			t.Errorf("Expected directory %q in package %s, got %s", dir, expected, pkg)
+		}
+	}
+	if label := mirror.label("core", "thirdparty/somelib/src"); label != ":core" {
+		t.Errorf("Expected :core, got %s", label)
+	}
+	if label := mirror.label("docs", "thirdparty/somelib/src"); label != "//thirdparty/somelib:docs" {
+		t.Errorf("Expected //thirdparty/somelib:docs, got %s", label)
+	}
+	if expected := []string{"//thirdparty/somelib/src:__pkg__"}; !reflect.DeepEqual(mirror.visibility("docs"), expected) {
+		t.Errorf("Expected visibility %v for docs, got %v", expected, mirror.visibility("docs"))
+	}
+	if visibility := mirror.visibility("core"); len(visibility) != 0 {
+		t.Errorf("Expected no visibility for core, got %v", visibility)
+	}
+}
+
+func TestCMakeResolveDirectiveInheritance(t *testing.T) {
+	lang := &cmakeLang{}
+	root := config.New()
+	lang.Configure(root, "", &rule.File{Directives: []rule.Directive{
+		{Key: "cmake_resolve", Value: "ZLIB::ZLIB @zlib//:zlib"},
+	}})
+
+	// Gazelle clones the configuration for every subdirectory
+	child := root.Clone()
+	lang.Configure(child, "app", &rule.File{Directives: []rule.Directive{
+		{Key: "cmake_resolve", Value: "OpenSSL::SSL @openssl//:ssl"},
+	}})
+	sibling := root.Clone()
+	lang.Configure(sibling, "other", &rule.File{})
+
+	if _, ok := common.GetCMakeConfig(child).ResolveLabel("ZLIB::ZLIB", "app"); !ok {
+		t.Error("Expected the app package to inherit the ZLIB::ZLIB mapping")
+	}
+	if _, ok := common.GetCMakeConfig(root).ResolveLabel("OpenSSL::SSL", ""); ok {
+		t.Error("Expected the OpenSSL::SSL mapping not to leak into the parent package")
+	}
+	if _, ok := common.GetCMakeConfig(sibling).ResolveLabel("OpenSSL::SSL", "other"); ok {
+		t.Error("Expected the OpenSSL::SSL mapping not to leak into a sibling package")
+	}
+
+	// Mapped targets are added to deps, unmapped external targets are not
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.cpp"), []byte("int main() { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := language.GenerateArgs{Config: child, Dir: dir, Rel: "app"}
+	cmakeTargets := []*common.CMakeTarget{
+		{Name: "app", Type: "executable", Sources: []string{"main.cpp"}, LinkedLibraries: []string{"ZLIB::ZLIB", "OpenSSL::SSL", "Threads::Threads"}},
+	}
+	result := lang.generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "", nil, map[string]string{})
+	if len(result.Gen) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(result.Gen))
+	}
+	if deps := result.Gen[0].AttrStrings("deps"); !reflect.DeepEqual(deps, []string{"@zlib//:zlib", "@openssl//:ssl"}) {
+		t.Errorf("Expected deps [@zlib//:zlib @openssl//:ssl], got %v", deps)
+	}
+}
+
+// attrIsTrue reports whether a rule sets a boolean attribute to True
+func attrIsTrue(r *rule.Rule, key string) bool {
+	f := rule.EmptyFile("BUILD.bazel", "")
+	r.Insert(f)
+	return strings.Contains(string(f.Format()), key+" = True")
+}
+
+func TestCompileOptionsForTarget(t *testing.T) {
+	withStd := &common.CMakeTarget{CompileOptions: []string{"-Wall", "-std=gnu++17"}, LanguageStandard: "c++17"}
+	if copts, expected := compileOptionsForTarget(withStd), []string{"-Wall", "-std=gnu++17"}; !reflect.DeepEqual(copts, expected) {
+		t.Errorf("Expected copts %v, got %v", expected, copts)
+	}
+
+	withoutStd := &common.CMakeTarget{LanguageStandard: "c11", Sysroot: "/opt/sysroot"}
+	if copts, expected := compileOptionsForTarget(withoutStd), []string{"-std=c11", "--sysroot=/opt/sysroot"}; !reflect.DeepEqual(copts, expected) {
+		t.Errorf("Expected copts %v, got %v", expected, copts)
+	}
+}
+
+func TestCustomCommandsGenerateGenrules(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"lib.c", "gen.cpp", "spec.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(""), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := config.New()
+	c.Exts["cmake"] = common.NewCMakeConfig()
+	args := language.GenerateArgs{Config: c, Dir: dir, Rel: "thirdparty/somelib"}
+
+	cmakeTargets := []*common.CMakeTarget{
+		{Name: "gen", Type: "executable", Sources: []string{"gen.cpp"}},
+		{Name: "lib", Type: "library", Sources: []string{"lib.c", "gen.c", "other.c"}, Headers: []string{"gen.h"}},
+	}
+	api := NewCMakeFileAPI(dir, filepath.Join(dir, ".cmake-build"), "cmake-not-installed", nil)
+	api.customCommands = []*common.CMakeCustomCommand{
+		{
+			Outputs:        []string{"gen.c", "gen.h"},
+			Commands:       [][]string{{"gen", "spec.txt", "gen.c", "gen.h"}},
+			Depends:        []string{"spec.txt"},
+			DependsTargets: []string{"gen"},
+		},
+		{
+			Outputs:  []string{"other.c"},
+			Commands: [][]string{{"cmake", "-P", "generate.cmake"}},
+		},
+		{Target: "docs", Commands: [][]string{{"doxygen"}}},
+	}
+
+	lang := &cmakeLang{}
+	result := lang.generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "somelib", api, map[string]string{})
+
+	rules := make(map[string]*rule.Rule)
+	for _, r := range result.Gen {
+		rules[r.Name()] = r
+	}
+	genrule := rules["gen_c"]
+	if genrule == nil || genrule.Kind() != "genrule" {
+		t.Fatalf("Expected a genrule gen_c, got %v", genrule)
+	}
+	if expected := []string{"@somelib//:spec.txt"}; !reflect.DeepEqual(genrule.AttrStrings("srcs"), expected) {
+		t.Errorf("Expected srcs %v, got %v", expected, genrule.AttrStrings("srcs"))
+	}
+	if expected := []string{"gen.c", "gen.h"}; !reflect.DeepEqual(genrule.AttrStrings("outs"), expected) {
+		t.Errorf("Expected outs %v, got %v", expected, genrule.AttrStrings("outs"))
+	}
+	if expected := []string{":gen"}; !reflect.DeepEqual(genrule.AttrStrings("tools"), expected) {
+		t.Errorf("Expected tools %v, got %v", expected, genrule.AttrStrings("tools"))
+	}
+	if expected := "$(execpath :gen) $(location @somelib//:spec.txt) $(location gen.c) $(location gen.h)"; genrule.AttrString("cmd") != expected {
+		t.Errorf("Expected cmd %q, got %q", expected, genrule.AttrString("cmd"))
+	}
+	if rules["other_c"] != nil || rules["docs"] != nil {
+		t.Error("Expected no genrules for commands that cannot be translated")
+	}
+
+	// Generated files are files of the package, and the outputs of commands
+	// without genrule are left out
+	lib := rules["lib"]
+	if lib == nil {
+		t.Fatal("Expected a rule for lib")
+	}
+	if expected := []string{"@somelib//:lib.c", "gen.c"}; !reflect.DeepEqual(lib.AttrStrings("srcs"), expected) {
+		t.Errorf("Expected srcs %v, got %v", expected, lib.AttrStrings("srcs"))
+	}
+	if expected := []string{"gen.h"}; !reflect.DeepEqual(lib.AttrStrings("hdrs"), expected) {
+		t.Errorf("Expected hdrs %v, got %v", expected, lib.AttrStrings("hdrs"))
+	}
+}
+
+func TestConfigValuesGenerateSelects(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"core.c", "debug.c"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("int x;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := config.New()
+	c.Exts["cmake"] = common.NewCMakeConfig()
+	args := language.GenerateArgs{Config: c, Dir: dir, Rel: "project"}
+
+	cmakeTargets := []*common.CMakeTarget{
+		{
+			Name:                      "core",
+			Type:                      "library",
+			Sources:                   []string{"core.c"},
+			CompileDefinitions:        []string{"CORE"},
+			PrivateCompileDefinitions: []string{"CORE", "TRACE"},
+			CompileOptions:            []string{"-Wall"},
+			ConfigValues: map[string]*common.CMakeConfigValues{
+				"dbg": {Sources: []string{"debug.c"}, CompileDefinitions: []string{"TRACE"}},
+				"opt": {CompileOptions: []string{"-ffast-math"}},
+			},
+		},
+	}
+
+	lang := &cmakeLang{}
+	result := lang.generateRulesFromTargetsWithRepoAndAPI(args, cmakeTargets, "", nil, map[string]string{})
+
+	var core *rule.Rule
+	for _, r := range result.Gen {
+		if r.Name() == "core" {
+			core = r
+		}
+	}
+	if core == nil {
+		t.Fatal("Expected a rule for core")
+	}
+	f := rule.EmptyFile("BUILD.bazel", "")
+	core.Insert(f)
+	content := string(f.Format())
+	compact := strings.Join(strings.Fields(content), "")
+	for _, expected := range []string{
+		`srcs=["core.c"]+select({`,
+		`"@gazelle-foreign-cc//conditions:dbg":["debug.c",],`,
+		`local_defines=["CORE"]+select({"@gazelle-foreign-cc//conditions:dbg":["TRACE",],`,
+		`copts=["-Wall"]+select({`,
+		`"@gazelle-foreign-cc//conditions:opt":["-ffast-math",],`,
+	} {
+		if !strings.Contains(compact, expected) {
+			t.Errorf("Expected generated rule to contain %s, got:\n%s", expected, content)
+		}
+	}
+
+	// The files of every mode are known to the resolver
+	if expected := []string{"core.c", "debug.c"}; !reflect.DeepEqual(common.RuleFiles(core, "srcs"), expected) {
+		t.Errorf("Expected core files %v, got %v", expected, common.RuleFiles(core, "srcs"))
+	}
+}
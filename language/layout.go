@@ -0,0 +1,205 @@
+package language
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/goniz/gazelle-foreign-cc/common"
+)
+
+// cmakeProjectRel returns the package of the top-level directory of the CMake
+// project a package belongs to: the outermost directory between the package
+// and the repository root that has a CMakeLists.txt
+func cmakeProjectRel(args language.GenerateArgs) string {
+	projectRel := args.Rel
+	for rel := args.Rel; rel != ""; {
+		if rel = path.Dir(rel); rel == "." {
+			rel = ""
+		}
+		if _, err := os.Stat(filepath.Join(args.Config.RepoRoot, rel, "CMakeLists.txt")); err == nil {
+			projectRel = rel
+		}
+	}
+	return projectRel
+}
+
+// mirrorLayout places each target of a CMake project in the package matching
+// the CMake source directory that declares it (cmake_layout mirror). A
+// directory that is not a directory of the repository, which happens for
+// external projects, is placed in the package of its innermost parent that is.
+type mirrorLayout struct {
+	// projectRel is the package of the top-level CMake directory
+	projectRel string
+	// local tells whether the sources of the project are in the repository, in
+	// which case rules list them relative to the package holding them
+	local bool
+	// directories are the CMake directories of the project, innermost first
+	directories []string
+	// packages maps the CMake directories to their packages
+	packages map[string]string
+	// rulePackages maps the rules generated for the targets to their packages
+	rulePackages map[string]string
+	// consumers lists the other packages with targets linking each target
+	consumers map[string][]string
+}
+
+// newMirrorLayout places the targets of a project, given the CMake directories
+// the codemodel reports
+func newMirrorLayout(repoRoot, projectRel string, local bool, directories []string, cmakeTargets []*common.CMakeTarget) *mirrorLayout {
+	m := &mirrorLayout{
+		projectRel:   projectRel,
+		local:        local,
+		packages:     make(map[string]string),
+		rulePackages: make(map[string]string),
+		consumers:    make(map[string][]string),
+	}
+
+	for _, dir := range directories {
+		m.directories = appendIfMissing(m.directories, dir)
+	}
+	for _, cmTarget := range cmakeTargets {
+		m.directories = appendIfMissing(m.directories, cmTarget.Directory)
+	}
+	sort.Slice(m.directories, func(i, j int) bool {
+		return len(m.directories[i]) > len(m.directories[j])
+	})
+
+	for _, dir := range m.directories {
+		pkg := dir
+		for pkg != "" && !isDirectory(filepath.Join(repoRoot, projectRel, pkg)) {
+			if pkg = path.Dir(pkg); pkg == "." {
+				pkg = ""
+			}
+		}
+		m.packages[dir] = path.Join(projectRel, pkg)
+	}
+
+	for _, cmTarget := range cmakeTargets {
+		pkg := m.packages[cmTarget.Directory]
+		m.rulePackages[cmTarget.Name] = pkg
+		m.rulePackages[common.SharedLibraryRuleName(cmTarget.Name)] = pkg
+	}
+	for _, cmTarget := range cmakeTargets {
+		from := m.packages[cmTarget.Directory]
+		for _, lib := range cmTarget.LinkedLibraries {
+			if pkg, ok := m.rulePackages[lib]; ok && pkg != from {
+				m.consumers[lib] = appendIfMissing(m.consumers[lib], from)
+			}
+		}
+	}
+	return m
+}
+
+func isDirectory(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+// targets returns the targets to generate in a package
+func (m *mirrorLayout) targets(cmakeTargets []*common.CMakeTarget, pkg string) []*common.CMakeTarget {
+	var result []*common.CMakeTarget
+	for _, cmTarget := range cmakeTargets {
+		if m.packages[cmTarget.Directory] == pkg {
+			result = append(result, cmTarget)
+		}
+	}
+	return result
+}
+
+// label returns the label of a rule generated for a target of the project,
+// relative to the package from
+func (m *mirrorLayout) label(name, from string) string {
+	if pkg, ok := m.rulePackages[name]; ok && pkg != from {
+		return "//" + pkg + ":" + name
+	}
+	return ":" + name
+}
+
+// visibility returns the visibility of the rules of a target that targets in
+// other packages link, or nil if there are none
+func (m *mirrorLayout) visibility(name string) []string {
+	var visibility []string
+	for _, pkg := range m.consumers[name] {
+		visibility = append(visibility, "//"+pkg+":__pkg__")
+	}
+	sort.Strings(visibility)
+	return visibility
+}
+
+// packageDir returns the directory of a package relative to the top-level
+// CMake directory
+func (m *mirrorLayout) packageDir(pkg string) string {
+	if pkg == m.projectRel {
+		return ""
+	}
+	if m.projectRel == "" {
+		return pkg
+	}
+	return strings.TrimPrefix(pkg, m.projectRel+"/")
+}
+
+// fileLabel converts the path of a file of a local project, relative to the
+// top-level CMake directory, into the label the rules of package from use for
+// it. Files belong to the package of the innermost CMake directory holding
+// them.
+func (m *mirrorLayout) fileLabel(file, from string) string {
+	owner := m.projectRel
+	for _, dir := range m.directories {
+		if dir == "" || strings.HasPrefix(file, dir+"/") {
+			owner = m.packages[dir]
+			break
+		}
+	}
+	rel := file
+	if dir := m.packageDir(owner); dir != "" {
+		rel = strings.TrimPrefix(file, dir+"/")
+	}
+	if owner == from {
+		return rel
+	}
+	return "//" + owner + ":" + rel
+}
+
+// relativeDirs converts directories relative to the top-level CMake directory
+// into ones relative to a package, dropping those outside of it
+func (m *mirrorLayout) relativeDirs(dirs []string, pkg string) []string {
+	pkgDir := m.packageDir(pkg)
+	var result []string
+	for _, dir := range dirs {
+		switch {
+		case pkgDir == "":
+			result = append(result, dir)
+		case dir == pkgDir:
+			result = append(result, ".")
+		case strings.HasPrefix(dir, pkgDir+"/"):
+			result = append(result, strings.TrimPrefix(dir, pkgDir+"/"))
+		}
+	}
+	return result
+}
+
+// relativeGlobs converts the globs of a target into ones relative to a
+// package, dropping those that match files of other packages
+func (m *mirrorLayout) relativeGlobs(globs []common.CMakeGlob, pkg string) []common.CMakeGlob {
+	var result []common.CMakeGlob
+	for _, glob := range globs {
+		relative := common.CMakeGlob{Pattern: glob.Pattern}
+		if glob.Pattern != "" {
+			relative.Pattern = m.fileLabel(glob.Pattern, pkg)
+		}
+		outside := strings.HasPrefix(relative.Pattern, "//")
+		for _, f := range glob.Files {
+			f = m.fileLabel(f, pkg)
+			outside = outside || strings.HasPrefix(f, "//")
+			relative.Files = append(relative.Files, f)
+		}
+		if !outside {
+			result = append(result, relative)
+		}
+	}
+	return result
+}
@@ -0,0 +1,288 @@
+package language
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/goniz/gazelle-foreign-cc/common"
+)
+
+// cmakeProject is the result of configuring a CMake project, which the
+// packages configuring it share. done is closed once it is available.
+type cmakeProject struct {
+	api     *CMakeFileAPI
+	targets []*common.CMakeTarget
+	err     error
+	done    chan struct{}
+}
+
+// projectKey identifies the configuration of a CMake project
+func projectKey(sourceDir string, cfg *common.CMakeConfig, cmakeDefines map[string]string) string {
+	var defines []string
+	for key, value := range common.WithBuildType(cmakeDefines, cfg.BuildType) {
+		defines = append(defines, "-D"+key+"="+value)
+	}
+	sort.Strings(defines)
+	return strings.Join(append([]string{sourceDir, cfg.CMakeExecutable, "-G" + cfg.Generator}, defines...), "\x00")
+}
+
+// projectBuildDir returns the directory the CMake project of a key is
+// configured in, below the -cmake_build_dir directory. It is the same across
+// runs, so that cmake reuses its CMakeCache.txt, and differs between defines.
+func projectBuildDir(cfg *common.CMakeConfig, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cfg.BuildDir, hex.EncodeToString(sum[:8]))
+}
+
+// loadProject configures the CMake project in sourceDir for the package rel,
+// unless a package visited before, or the discovery of the projects to
+// configure, already started to
+func (l *cmakeLang) loadProject(c *config.Config, sourceDir string, cfg *common.CMakeConfig, cmakeDefines map[string]string, rel string) *cmakeProject {
+	project := l.startProject(c, sourceDir, cfg, cmakeDefines, rel)
+	<-project.done
+	return project
+}
+
+// startProject starts configuring the CMake project in sourceDir in the
+// background, once one of the -cmake_jobs slots is free. Its snapshot is in
+// the package rel configuring it.
+func (l *cmakeLang) startProject(c *config.Config, sourceDir string, cfg *common.CMakeConfig, cmakeDefines map[string]string, rel string) *cmakeProject {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := projectKey(sourceDir, cfg, cmakeDefines)
+	if project, ok := l.projects[key]; ok {
+		return project
+	}
+	if l.projects == nil {
+		l.projects = make(map[string]*cmakeProject)
+		jobs := cfg.Jobs
+		if jobs < 1 {
+			jobs = 1
+		}
+		l.jobs = make(chan struct{}, jobs)
+	}
+
+	if info, err := os.Stat(filepath.Join(sourceDir, ".cmake-build")); err == nil && info.IsDir() {
+		log.Printf("Warning: %s was configured in the source tree by an earlier version and can be removed", filepath.Join(sourceDir, ".cmake-build"))
+	}
+	api := NewCMakeFileAPI(sourceDir, projectBuildDir(cfg, key), cfg.CMakeExecutable, cmakeDefines)
+	api.SetCacheDir(cfg.CacheDir)
+	api.SetBuildConfiguration(cfg.Generator, cfg.BuildType)
+	if c.RepoRoot != "" {
+		api.SetSnapshot(filepath.Join(c.RepoRoot, filepath.FromSlash(rel), snapshotFileName), cfg.SnapshotMode)
+	}
+	project := &cmakeProject{api: api, done: make(chan struct{})}
+	l.projects[key] = project
+
+	go func() {
+		defer close(project.done)
+		l.jobs <- struct{}{}
+		defer func() { <-l.jobs }()
+		project.targets, project.err = api.GenerateFromAPI(rel)
+	}()
+	return project
+}
+
+// discoverProjects starts configuring the CMake projects of the packages in
+// the directories Gazelle updates, so that they configure in parallel while
+// Gazelle visits packages one at a time. It reads the directives of the BUILD
+// files on the way like Configure does and picks the projects like
+// GenerateRules does, which then waits for their results. A project it misses
+// is configured when GenerateRules gets to it.
+func (l *cmakeLang) discoverProjects(c *config.Config, f *rule.File) {
+	if c.RepoRoot == "" {
+		return
+	}
+	d := &projectDiscovery{
+		updateRels: l.updateRels,
+		ignored:    loadBazelIgnore(c.RepoRoot),
+	}
+	if len(d.updateRels) == 0 {
+		d.updateRels = []string{""}
+	}
+	l.discoverDirectory(c, d, common.GetCMakeConfig(c), "", f, l.excludes, false)
+}
+
+// projectDiscovery holds what the discovery of the projects to configure
+// skips, like the walk of Gazelle
+type projectDiscovery struct {
+	updateRels []string
+	// ignored are the directories listed in .bazelignore
+	ignored map[string]bool
+}
+
+// discoverDirectory starts the project of the package rel and discovers the
+// ones of its subdirectories. excludes are the patterns of the exclude
+// directives of the parent directories, relative to the repository root, and
+// inProject tells whether a parent directory has a CMakeLists.txt, whose
+// project the ones below belong to.
+func (l *cmakeLang) discoverDirectory(c *config.Config, d *projectDiscovery, cfg *common.CMakeConfig, rel string, f *rule.File, excludes []string, inProject bool) {
+	dir := filepath.Join(c.RepoRoot, rel)
+	if rel != "" {
+		f = loadBuildFile(c, rel, dir)
+		if f != nil {
+			cfg = cfg.Clone()
+			cfg.Configure(c, rel, f)
+		}
+	}
+
+	update := false
+	descend := false
+	for _, updateRel := range d.updateRels {
+		switch {
+		case isWithin(rel, updateRel):
+			update = true
+			descend = descend || !l.updateNonRecursive
+		case isWithin(updateRel, rel):
+			descend = true
+		}
+	}
+	_, err := os.Stat(filepath.Join(dir, "CMakeLists.txt"))
+	hasCMakeLists := err == nil
+	if update && !(inProject && hasCMakeLists) {
+		if sourceDir, defines, projectRel, ok := l.packageProject(c, cfg, rel, dir, f); ok {
+			log.Printf("Configuring the CMake project in %s for package %s in the background", sourceDir, rel)
+			l.startProject(c, sourceDir, cfg, defines, projectRel)
+		}
+	}
+	if !descend {
+		return
+	}
+
+	if f != nil {
+		// The patterns of the parent directories are kept as they are
+		excludes = excludes[:len(excludes):len(excludes)]
+		for _, directive := range f.Directives {
+			if directive.Key == "exclude" {
+				excludes = append(excludes, path.Join(rel, directive.Value))
+			}
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "bazel-") {
+			continue
+		}
+		childRel := path.Join(rel, name)
+		if d.ignored[childRel] || isExcluded(excludes, childRel) {
+			continue
+		}
+		l.discoverDirectory(c, d, cfg, childRel, nil, excludes, inProject || hasCMakeLists)
+	}
+}
+
+// isExcluded checks if a path of the repository matches one of the patterns
+// of the exclude directives, which Gazelle matches with doublestar
+func isExcluded(excludes []string, rel string) bool {
+	for _, exclude := range excludes {
+		if doublestar.MatchUnvalidated(exclude, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadBazelIgnore returns the directories of the repository .bazelignore
+// lists, which Bazel and Gazelle skip
+func loadBazelIgnore(repoRoot string) map[string]bool {
+	data, err := os.ReadFile(filepath.Join(repoRoot, ".bazelignore"))
+	if err != nil {
+		return nil
+	}
+	ignored := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ignored[path.Clean(line)] = true
+	}
+	return ignored
+}
+
+// packageProject returns the source directory and defines of the CMake
+// project GenerateRules configures for a package, if any, and the package
+// configuring it
+func (l *cmakeLang) packageProject(c *config.Config, cfg *common.CMakeConfig, rel, dir string, f *rule.File) (string, map[string]string, string, bool) {
+	var cmakeSource string
+	packageDefines := make(map[string]string)
+	if f != nil {
+		for _, directive := range f.Directives {
+			switch directive.Key {
+			case common.CMakeSourceDirective:
+				cmakeSource = directive.Value
+			case common.CMakeDefineDirective:
+				if parts := strings.Fields(directive.Value); len(parts) == 2 {
+					packageDefines[parts[0]] = parts[1]
+				}
+			}
+		}
+	}
+
+	externalSource := func(source string, defines map[string]string, projectRel string) (string, map[string]string, string, bool) {
+		repoName := strings.TrimPrefix(source, "@")
+		if !strings.HasPrefix(source, "@") || repoName == "" || strings.Contains(repoName, "/") {
+			return "", nil, "", false
+		}
+		repoPath := l.findExternalRepo(repoName, language.GenerateArgs{Config: c, Dir: dir, Rel: rel})
+		if repoPath == "" {
+			return "", nil, "", false
+		}
+		return repoPath, defines, projectRel, true
+	}
+	if cmakeSource != "" {
+		return externalSource(cmakeSource, packageDefines, rel)
+	}
+	if cfg.Layout == common.LayoutMirror && cfg.Source != "" {
+		return externalSource(cfg.Source, cfg.SourceDefines, cfg.SourcePackage)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "CMakeLists.txt")); err != nil {
+		return "", nil, "", false
+	}
+	if cfg.Layout == common.LayoutMirror {
+		projectRel := cmakeProjectRel(language.GenerateArgs{Config: c, Dir: dir, Rel: rel})
+		return filepath.Join(c.RepoRoot, projectRel), cfg.SourceDefines, projectRel, true
+	}
+	return dir, packageDefines, rel, true
+}
+
+// loadBuildFile reads the BUILD file of a directory, or returns nil if it
+// has none or it cannot be parsed
+func loadBuildFile(c *config.Config, rel, dir string) *rule.File {
+	names := c.ValidBuildFileNames
+	if len(names) == 0 {
+		names = config.DefaultValidBuildFileNames
+	}
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		if info, err := os.Stat(p); err != nil || info.IsDir() {
+			continue
+		}
+		f, err := rule.LoadFile(p, rel)
+		if err != nil {
+			return nil
+		}
+		return f
+	}
+	return nil
+}
+
+// isWithin reports whether the package rel is dir or one of its subpackages
+func isWithin(rel, dir string) bool {
+	return dir == "" || rel == dir || strings.HasPrefix(rel, dir+"/")
+}
@@ -0,0 +1,103 @@
+package language
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	gzflag "github.com/bazelbuild/bazel-gazelle/flag"
+	"github.com/goniz/gazelle-foreign-cc/common"
+)
+
+func TestDiscoverProjectsConfiguresInParallel(t *testing.T) {
+	cmake, runs := writeFakeCMake(t, t.TempDir())
+	repoRoot := t.TempDir()
+	files := map[string]string{
+		"a/CMakeLists.txt":       "project(A)\n",
+		"b/CMakeLists.txt":       "project(B)\n",
+		"b/BUILD.bazel":          "# gazelle:cmake_define OPTION ON\n",
+		"c/CMakeLists.txt":       "project(C)\n",
+		"skipped/CMakeLists.txt": "project(Skipped)\n",
+		"BUILD.bazel":            "# gazelle:cmake_executable " + cmake + "\n# gazelle:exclude vendor/excluded\n",
+		// Directories Gazelle does not visit are not configured either
+		"vendor/excluded/CMakeLists.txt": "project(Excluded)\n",
+		"vendor/ignored/CMakeLists.txt":  "project(Ignored)\n",
+		"vendor/flagged/CMakeLists.txt":  "project(Flagged)\n",
+		".bazelignore":                   "vendor/ignored\n",
+		// nor are the directories of a project in a parent directory
+		"a/sub/CMakeLists.txt": "add_library(sub sub.c)\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(repoRoot, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repoRoot, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := config.New()
+	c.RepoRoot = repoRoot
+	c.WorkDir = repoRoot
+	cfg := common.NewCMakeConfig()
+	cfg.CacheDir = ""
+	cfg.BuildDir = t.TempDir()
+	c.Exts["cmake"] = cfg
+
+	lang := &cmakeLang{}
+	fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)
+	lang.RegisterFlags(fs, "update", c)
+	var excludes []string
+	fs.Var(&gzflag.MultiFlag{Values: &excludes}, "exclude", "registered by Gazelle")
+	if err := fs.Parse([]string{"-cmake_jobs=2", "-exclude=vendor/flag*", "a", "b", filepath.Join(repoRoot, "c"), "vendor"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lang.CheckFlags(fs, c); err != nil {
+		t.Fatal(err)
+	}
+	lang.Configure(c, "", loadBuildFile(c, "", repoRoot))
+
+	// GenerateRules waits for the projects discovery started
+	for _, rel := range []string{"a", "b", "c"} {
+		defines := map[string]string{}
+		if rel == "b" {
+			defines["OPTION"] = "ON"
+		}
+		if project := lang.loadProject(c, filepath.Join(repoRoot, rel), common.GetCMakeConfig(c), defines, rel); project.err != nil {
+			t.Errorf("Expected %s to configure, got %v", rel, project.err)
+		}
+	}
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected the 3 projects to update to configure once each, got %v", lines)
+	}
+	maxRunning := 0
+	for _, line := range lines {
+		running, _ := strconv.Atoi(strings.TrimPrefix(line, "configure "))
+		if running > maxRunning {
+			maxRunning = running
+		}
+	}
+	if maxRunning != 2 {
+		t.Errorf("Expected 2 configures at once with -cmake_jobs=2, got %d", maxRunning)
+	}
+
+	// Projects are configured out of the source tree
+	for _, rel := range []string{"a", "b", "c"} {
+		if _, err := os.Stat(filepath.Join(repoRoot, rel, ".cmake-build")); err == nil {
+			t.Errorf("Expected no build directory in %s", rel)
+		}
+	}
+	if entries, _ := os.ReadDir(cfg.BuildDir); len(entries) != 3 {
+		t.Errorf("Expected a build directory per project in -cmake_build_dir, got %d", len(entries))
+	}
+}
@@ -0,0 +1,201 @@
+package language
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/goniz/gazelle-foreign-cc/common"
+)
+
+// snapshotVersion changes whenever what snapshots hold changes, so that
+// snapshots recorded by other versions of the plugin are not replayed
+const snapshotVersion = 2
+
+// snapshotFileName is the name of the snapshot recorded next to the BUILD file
+// of the package configuring a CMake project
+const snapshotFileName = "cmake_snapshot.json"
+
+// snapshotSourceDir stands for the source directory of the project in the
+// paths of a snapshot, so that it replays wherever the sources are
+const snapshotSourceDir = "@CMAKE_SOURCE_DIR@"
+
+// snapshotIndexFile is the name the index of the reply is recorded under,
+// instead of its timestamped one
+const snapshotIndexFile = "index-snapshot.json"
+
+// fileAPISnapshot is the File API reply of a configure with the inputs it
+// was computed from, which can be checked in and replayed without cmake
+type fileAPISnapshot struct {
+	Version int `json:"version"`
+	// Defines and Generator are the -D defines, including the build type, and
+	// the generator of the configure, which another configuration cannot reuse
+	Defines   []string `json:"defines,omitempty"`
+	Generator string   `json:"generator,omitempty"`
+	// Inputs and Globs are the CMake files of the project the configure read
+	// and its file(GLOB CONFIGURE_DEPENDS) expressions, like in the cache
+	Inputs map[string]string `json:"inputs"`
+	Globs  map[string]string `json:"globs,omitempty"`
+	// Reply holds the files of the reply the plugin reads, by name
+	Reply map[string]json.RawMessage `json:"reply"`
+	// CTest is the output of ctest --show-only=json-v1
+	CTest json.RawMessage `json:"ctest,omitempty"`
+}
+
+// loadSnapshot replays the snapshot of the project, if the snapshot mode
+// allows it and there is one, and reports whether it did. The reply is
+// written below the build directory and read like a cached one.
+func (api *CMakeFileAPI) loadSnapshot() bool {
+	if api.snapshotPath == "" || (api.snapshotMode != common.SnapshotAuto && api.snapshotMode != common.SnapshotReplay) {
+		return false
+	}
+	data, err := os.ReadFile(api.snapshotPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: cannot read the CMake snapshot %s: %v", api.snapshotPath, err)
+		}
+		return false
+	}
+	var snapshot fileAPISnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		log.Printf("Warning: cannot parse the CMake snapshot %s: %v", api.snapshotPath, err)
+		return false
+	}
+	if snapshot.Version != snapshotVersion {
+		log.Printf("Warning: the CMake snapshot %s has version %d instead of %d, record it again", api.snapshotPath, snapshot.Version, snapshotVersion)
+		return false
+	}
+
+	if defines := api.sortedDefines(); !reflect.DeepEqual(snapshot.Defines, defines) || snapshot.Generator != api.generator {
+		log.Printf("Warning: the CMake snapshot %s was recorded with the defines %v and generator %q instead of %v and %q, run gazelle with -cmake_snapshot=record to update it", api.snapshotPath, snapshot.Defines, snapshot.Generator, defines, api.generator)
+		return false
+	}
+
+	entry := filepath.Join(api.buildDir, "snapshot")
+	if err := api.writeSnapshotEntry(&snapshot, entry); err != nil {
+		log.Printf("Warning: cannot replay the CMake snapshot %s: %v", api.snapshotPath, err)
+		return false
+	}
+	if changed := api.changedInput(&configureManifest{Inputs: snapshot.Inputs, Globs: snapshot.Globs}); changed != "" {
+		log.Printf("Warning: the CMake snapshot %s is stale: %s changed since it was recorded, run gazelle with -cmake_snapshot=record to update it", api.snapshotPath, changed)
+	}
+
+	log.Printf("Replaying the CMake snapshot %s instead of configuring %s", api.snapshotPath, api.sourceDir)
+	api.cacheEntryDir = entry
+	api.cachedReplyDir = filepath.Join(entry, "reply")
+	return true
+}
+
+// writeSnapshotEntry writes the reply and ctest output of a snapshot into
+// entry, laid out like a cache entry, with the paths of the source directory
+func (api *CMakeFileAPI) writeSnapshotEntry(snapshot *fileAPISnapshot, entry string) error {
+	if err := os.RemoveAll(entry); err != nil {
+		return err
+	}
+	reply := filepath.Join(entry, "reply")
+	if err := os.MkdirAll(reply, 0755); err != nil {
+		return err
+	}
+	sourceDir := []byte(filepath.ToSlash(api.sourceDir))
+	for name, content := range snapshot.Reply {
+		if name != filepath.Base(name) {
+			return fmt.Errorf("invalid reply file name %q", name)
+		}
+		data := bytes.ReplaceAll(content, []byte(snapshotSourceDir), sourceDir)
+		if err := os.WriteFile(filepath.Join(reply, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	if len(snapshot.CTest) > 0 {
+		data := bytes.ReplaceAll(snapshot.CTest, []byte(snapshotSourceDir), sourceDir)
+		if err := os.WriteFile(filepath.Join(entry, "ctest.json"), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordSnapshot records the File API reply of the project and the hashes of
+// its inputs in its snapshot. Failures are logged, since the rules were
+// generated anyway.
+func (api *CMakeFileAPI) recordSnapshot() {
+	if api.snapshotPath == "" {
+		return
+	}
+	if err := api.writeSnapshot(); err != nil {
+		log.Printf("Warning: failed to record the CMake snapshot %s: %v", api.snapshotPath, err)
+		return
+	}
+	log.Printf("Recorded the CMake snapshot of %s in %s", api.sourceDir, api.snapshotPath)
+}
+
+func (api *CMakeFileAPI) writeSnapshot() error {
+	index, codemodel, _, err := api.ReadAPIResponse()
+	if err != nil {
+		return err
+	}
+	manifest, err := api.inputManifest(index)
+	if err != nil {
+		return err
+	}
+
+	snapshot := fileAPISnapshot{
+		Version:   snapshotVersion,
+		Defines:   api.sortedDefines(),
+		Generator: api.generator,
+		Inputs:    make(map[string]string),
+		Globs:     manifest.Globs,
+		Reply:     make(map[string]json.RawMessage),
+	}
+	// Files outside the sources are where they are on this machine only
+	for input, hash := range manifest.Inputs {
+		if !filepath.IsAbs(input) {
+			snapshot.Inputs[input] = hash
+		}
+	}
+
+	indexFiles, err := filepath.Glob(filepath.Join(api.replyDir(), "index-*.json"))
+	if err != nil || len(indexFiles) == 0 {
+		return fmt.Errorf("no index files found in %s", api.replyDir())
+	}
+	files := map[string]string{snapshotIndexFile: indexFiles[len(indexFiles)-1]}
+	for _, obj := range index.Objects {
+		files[obj.JSONFile] = filepath.Join(api.replyDir(), obj.JSONFile)
+	}
+	for _, config := range codemodel.Configurations {
+		for _, target := range config.Targets {
+			files[target.JSONFile] = filepath.Join(api.replyDir(), target.JSONFile)
+		}
+	}
+	for name, path := range files {
+		data, err := api.readReplyFile(path)
+		if err != nil {
+			return err
+		}
+		snapshot.Reply[name] = api.snapshotPaths(data)
+	}
+	if len(api.ctestOutput) > 0 && json.Valid(api.ctestOutput) {
+		snapshot.CTest = api.snapshotPaths(api.ctestOutput)
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(api.snapshotPath, append(data, '\n'), 0644)
+}
+
+// snapshotPaths replaces the source directory in JSON data, which the build
+// paths are translated into already, with snapshotSourceDir
+func (api *CMakeFileAPI) snapshotPaths(data []byte) []byte {
+	sourceDir := filepath.ToSlash(api.sourceDir)
+	data = replacePathPrefix(data, sourceDir, snapshotSourceDir)
+	if resolved, err := filepath.EvalSymlinks(api.sourceDir); err == nil && filepath.ToSlash(resolved) != sourceDir {
+		data = replacePathPrefix(data, filepath.ToSlash(resolved), snapshotSourceDir)
+	}
+	return data
+}
@@ -0,0 +1,122 @@
+package language
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goniz/gazelle-foreign-cc/common"
+)
+
+func TestSnapshotRecordAndReplay(t *testing.T) {
+	// Files outside the sources, such as toolchain files, are only where
+	// they are on this machine
+	toolchain := filepath.Join(t.TempDir(), "toolchain.cmake")
+	if err := os.WriteFile(toolchain, []byte("set(CMAKE_C_COMPILER cc)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmake, runs := writeFakeCMake(t, t.TempDir(), toolchain)
+	sourceDir := t.TempDir()
+	snapshotPath := filepath.Join(t.TempDir(), snapshotFileName)
+	if err := os.WriteFile(filepath.Join(sourceDir, "CMakeLists.txt"), []byte("project(Snapshot)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewCMakeFileAPI(sourceDir, t.TempDir(), cmake, nil)
+	api.SetSnapshot(snapshotPath, common.SnapshotRecord)
+	if _, err := api.GenerateFromAPI(""); err != nil {
+		t.Fatalf("GenerateFromAPI failed: %v", err)
+	}
+	data, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		t.Fatalf("Expected a snapshot to be recorded: %v", err)
+	}
+	for _, want := range []string{`"CMakeLists.txt"`, `"` + snapshotIndexFile + `"`, `"codemodel-v2-1.json"`, `"cmakeFiles-v1-1.json"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected the snapshot to contain %s, got:\n%s", want, data)
+		}
+	}
+	var recorded fileAPISnapshot
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recorded.Inputs[toolchain]; ok || len(recorded.Inputs) != 1 {
+		t.Errorf("Expected only CMakeLists.txt among the inputs, got %v", recorded.Inputs)
+	}
+
+	// Replaying never runs cmake
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	replay := func() {
+		t.Helper()
+		logs.Reset()
+		api := NewCMakeFileAPI(sourceDir, t.TempDir(), filepath.Join(t.TempDir(), "cmake"), nil)
+		api.SetSnapshot(snapshotPath, common.SnapshotReplay)
+		if _, err := api.GenerateFromAPI(""); err != nil {
+			t.Fatalf("GenerateFromAPI failed to replay the snapshot: %v", err)
+		}
+	}
+	replay()
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "configure") != 1 {
+		t.Errorf("Expected cmake to configure once, got:\n%s", data)
+	}
+	if strings.Contains(logs.String(), "is stale") {
+		t.Errorf("Expected the snapshot to be up to date, got:\n%s", logs.String())
+	}
+
+	// A changed input is reported
+	if err := os.WriteFile(filepath.Join(sourceDir, "CMakeLists.txt"), []byte("project(Changed)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replay()
+	if !strings.Contains(logs.String(), "is stale: CMakeLists.txt changed") {
+		t.Errorf("Expected the changed CMakeLists.txt to be reported, got:\n%s", logs.String())
+	}
+
+	// A snapshot is not replayed for other defines
+	logs.Reset()
+	api = NewCMakeFileAPI(sourceDir, t.TempDir(), cmake, map[string]string{"OPTION": "ON"})
+	api.SetSnapshot(snapshotPath, common.SnapshotReplay)
+	if _, err := api.GenerateFromAPI(""); err == nil {
+		t.Errorf("Expected a snapshot recorded without OPTION not to be replayed")
+	}
+	if !strings.Contains(logs.String(), "was recorded with the defines") {
+		t.Errorf("Expected the other defines to be reported, got:\n%s", logs.String())
+	}
+
+	// Without a snapshot, replaying fails instead of running cmake
+	api = NewCMakeFileAPI(sourceDir, t.TempDir(), cmake, nil)
+	api.SetSnapshot(filepath.Join(t.TempDir(), snapshotFileName), common.SnapshotReplay)
+	if _, err := api.GenerateFromAPI(""); err == nil {
+		t.Errorf("Expected replaying a missing snapshot to fail")
+	}
+}
+
+func TestSnapshotPaths(t *testing.T) {
+	recorded := NewCMakeFileAPI("/work/project", "/tmp/build", "cmake", nil)
+	data := recorded.snapshotPaths([]byte(`{"source": "/work/project", "build": "/work/project/.cmake-build", "other": "/work/projectile/a.c"}`))
+	want := `{"source": "@CMAKE_SOURCE_DIR@", "build": "@CMAKE_SOURCE_DIR@/.cmake-build", "other": "/work/projectile/a.c"}`
+	if string(data) != want {
+		t.Fatalf("Expected %s, got %s", want, data)
+	}
+
+	entry := t.TempDir()
+	replayed := NewCMakeFileAPI("/home/user/project", "/tmp/build", "cmake", nil)
+	snapshot := &fileAPISnapshot{Reply: map[string]json.RawMessage{"codemodel-v2-1.json": data}}
+	if err := replayed.writeSnapshotEntry(snapshot, entry); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(entry, "reply", "codemodel-v2-1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"source": "/home/user/project", "build": "/home/user/project/.cmake-build", "other": "/work/projectile/a.c"}`
+	if string(got) != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
@@ -35,4 +35,13 @@ func fileExists(file string, fileList []string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+// containsString checks if a string is present in a slice
+func containsString(slice []string, str string) bool {
+	for _, s := range slice {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
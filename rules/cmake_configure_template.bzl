@@ -0,0 +1,173 @@
+"""Rule generating a file from a configure_file() template without running cmake."""
+
+# Substitutes the variables of a template like configure_file() does. The
+# first input file holds the values of the variables, one "NAME<TAB>VALUE"
+# per line, and the second one is the template.
+_CONFIGURE_AWK = r"""
+function off(name,    v, u) {
+    if (!(name in vars)) {
+        return 1
+    }
+    v = vars[name]
+    u = toupper(v)
+    return v == "" || u == "0" || u == "OFF" || u == "NO" || u == "FALSE" || u == "N" || u == "IGNORE" || u == "NOTFOUND" || u ~ /-NOTFOUND$/
+}
+
+function value(name,    v) {
+    v = (name in vars) ? vars[name] : ""
+    if (escape_quotes) {
+        gsub(/"/, "\\\\\"", v)
+    }
+    return v
+}
+
+function expand(line,    out, at, atlen, ref, reflen) {
+    out = ""
+    while (1) {
+        at = match(line, /@[A-Za-z0-9_.+-]+@/)
+        atlen = RLENGTH
+        ref = 0
+        if (!at_only) {
+            ref = match(line, /\$\{[A-Za-z0-9_.+-]+\}/)
+            reflen = RLENGTH
+        }
+        if (!at && !ref) {
+            return out line
+        }
+        if (at && (!ref || at < ref)) {
+            out = out substr(line, 1, at - 1) value(substr(line, at + 1, atlen - 2))
+            line = substr(line, at + atlen)
+        } else {
+            out = out substr(line, 1, ref - 1) value(substr(line, ref + 2, reflen - 3))
+            line = substr(line, ref + reflen)
+        }
+    }
+}
+
+FILENAME == ARGV[1] {
+    i = index($0, "\t")
+    vars[substr($0, 1, i - 1)] = substr($0, i + 1)
+    next
+}
+
+{
+    line = $0
+    if (match(line, /#[ \t]*cmakedefine[ \t]+[A-Za-z0-9_]*/)) {
+        name = substr(line, RSTART, RLENGTH)
+        sub(/^#[ \t]*cmakedefine[ \t]+/, "", name)
+        if (off(name)) {
+            line = "/* #undef " name " */"
+        } else {
+            sub(/cmakedefine/, "define", line)
+        }
+    } else if (match(line, /#[ \t]*cmakedefine01[ \t]+[A-Za-z0-9_]*/)) {
+        name = substr(line, RSTART, RLENGTH)
+        sub(/^#[ \t]*cmakedefine01[ \t]+/, "", name)
+        sub(/cmakedefine01/, "define", line)
+        line = line (off(name) ? " 0" : " 1")
+    }
+    print expand(line)
+}
+"""
+
+_LINE_ENDINGS = {
+    "": "\\n",
+    "UNIX": "\\n",
+    "DOS": "\\r\\n",
+}
+
+def _cmake_configure_template_impl(ctx):
+    """Implementation of cmake_configure_template rule."""
+    out = ctx.outputs.out
+
+    # file(CONFIGURE) passes the template itself
+    if ctx.file.src:
+        template = ctx.file.src
+    else:
+        template = ctx.actions.declare_file(ctx.label.name + ".in")
+        ctx.actions.write(template, ctx.attr.content)
+
+    if ctx.attr.newline_style not in _LINE_ENDINGS:
+        fail("newline_style must be UNIX or DOS, got %s" % ctx.attr.newline_style)
+
+    if ctx.attr.copy_only:
+        ctx.actions.run_shell(
+            inputs = [template],
+            outputs = [out],
+            command = 'cp "$1" "$2"',
+            arguments = [template.path, out.path],
+            mnemonic = "CMakeCopyFile",
+            progress_message = "Copying %s" % out.short_path,
+        )
+    else:
+        defines = ctx.actions.declare_file(ctx.label.name + ".defines")
+        ctx.actions.write(defines, "".join(["%s\t%s\n" % (key, value) for key, value in ctx.attr.defines.items()]))
+        script = ctx.actions.declare_file(ctx.label.name + ".awk")
+        ctx.actions.write(script, _CONFIGURE_AWK)
+
+        ctx.actions.run_shell(
+            inputs = [script, defines, template],
+            outputs = [out],
+            command = 'awk -v at_only="$1" -v escape_quotes="$2" -v ORS="$3" -f "$4" "$5" "$6" > "$7"',
+            arguments = [
+                "1" if ctx.attr.at_only else "0",
+                "1" if ctx.attr.escape_quotes else "0",
+                _LINE_ENDINGS[ctx.attr.newline_style],
+                script.path,
+                defines.path,
+                template.path,
+                out.path,
+            ],
+            mnemonic = "CMakeConfigureTemplate",
+            progress_message = "Configuring %s" % out.short_path,
+        )
+
+    # Consumers include the generated file from the directory it is written to
+    compilation_context = cc_common.create_compilation_context(
+        headers = depset([out]),
+        includes = depset([out.dirname]),
+        quote_includes = depset([out.dirname]),
+    )
+
+    return [
+        DefaultInfo(files = depset([out])),
+        CcInfo(compilation_context = compilation_context),
+    ]
+
+cmake_configure_template = rule(
+    implementation = _cmake_configure_template_impl,
+    attrs = {
+        "src": attr.label(
+            allow_single_file = True,
+            doc = "The template to configure. Either src or content is required.",
+        ),
+        "content": attr.string(
+            doc = "The content of the template, for file(CONFIGURE)",
+        ),
+        "out": attr.output(
+            mandatory = True,
+            doc = "The output file to generate",
+        ),
+        "defines": attr.string_dict(
+            default = {},
+            doc = "Values of the variables the template uses. Variables missing from it are undefined.",
+        ),
+        "at_only": attr.bool(
+            default = False,
+            doc = "Only substitute @VAR@ references, like @ONLY",
+        ),
+        "escape_quotes": attr.bool(
+            default = False,
+            doc = "Escape the quotes of substituted values with backslashes, like ESCAPE_QUOTES",
+        ),
+        "copy_only": attr.bool(
+            default = False,
+            doc = "Copy the template without substituting anything, like COPYONLY",
+        ),
+        "newline_style": attr.string(
+            default = "",
+            doc = "Line endings of the output, UNIX or DOS. Defaults to the ones of the template.",
+        ),
+    },
+    doc = "Generates a file from a configure_file() or file(CONFIGURE) template, substituting @VAR@, ${VAR}, #cmakedefine and #cmakedefine01 with the values of defines, without running cmake.",
+)
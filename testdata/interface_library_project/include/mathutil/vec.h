@@ -0,0 +1,17 @@
+#ifndef MATHUTIL_VEC_H
+#define MATHUTIL_VEC_H
+
+namespace mathutil {
+
+struct Vec2 {
+    double x;
+    double y;
+};
+
+inline Vec2 add(Vec2 a, Vec2 b) {
+    return Vec2{a.x + b.x, a.y + b.y};
+}
+
+}  // namespace mathutil
+
+#endif  // MATHUTIL_VEC_H
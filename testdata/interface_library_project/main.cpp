@@ -0,0 +1,12 @@
+#include <iostream>
+
+#include "mathutil/vec.h"
+
+int main() {
+#ifndef MATHUTIL_HEADER_ONLY
+#error "MATHUTIL_HEADER_ONLY must be defined by the mathutil interface library"
+#endif
+    mathutil::Vec2 v = mathutil::add({1, 2}, {3, 4});
+    std::cout << v.x << ", " << v.y << std::endl;
+    return 0;
+}
@@ -0,0 +1,2 @@
+# Sources of the app, relative to this file
+set(APP_SOURCES ${CMAKE_CURRENT_LIST_DIR}/../main.cpp)
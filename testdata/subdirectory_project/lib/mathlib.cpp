@@ -0,0 +1,3 @@
+#include "mathlib.h"
+
+int add(int a, int b) { return a + b; }
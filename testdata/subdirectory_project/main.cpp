@@ -0,0 +1,3 @@
+#include "mathlib.h"
+
+int main() { return add(1, -1); }
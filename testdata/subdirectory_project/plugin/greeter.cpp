@@ -0,0 +1 @@
+// Empty implementation for testing